@@ -95,7 +95,6 @@ const struct InitOp ops[] = {
 
     // mount /sys (which should already exist)
     { OpMount, .mount = { "sysfs", "/sys", "sysfs", MS_NODEV | MS_NOSUID | MS_NOEXEC } },
-    { OpMount, .mount = { "cgroup_root", "/sys/fs/cgroup", "tmpfs", MS_NODEV | MS_NOSUID | MS_NOEXEC, "mode=0755" } },
 };
 
 void warn(const char *msg) {
@@ -198,7 +197,39 @@ void init_fs(const struct InitOp *ops, size_t count) {
     }
 }
 
-void init_cgroups() {
+// filesystem_supported returns true if the kernel supports the filesystem type
+// `fstype` according to /proc/filesystems.
+int filesystem_supported(const char *fstype) {
+    const char *fpath = "/proc/filesystems";
+    FILE *f = fopen(fpath, "r");
+    if (f == NULL) {
+        die2("fopen", fpath);
+    }
+    int supported = 0;
+    char line[256];
+    while (fgets(line, sizeof(line), f) != NULL) {
+        // Each line is an optional "nodev" flag, a tab and the type.
+        char *name = strchr(line, '\t');
+        name = name ? name + 1 : line;
+        name[strcspn(name, "\n")] = '\0';
+        if (strcmp(name, fstype) == 0) {
+            supported = 1;
+            break;
+        }
+    }
+    fclose(f);
+    return supported;
+}
+
+// init_cgroups_v1 mounts a tmpfs at `base` and every enabled v1 controller
+// under it. It returns the number of controllers mounted, or -1 with errno set
+// if a controller cannot be mounted, such as when v1 controllers are disabled
+// with cgroup_no_v1.
+int init_cgroups_v1(const char *base) {
+    if (mount("cgroup_root", base, "tmpfs", MS_NODEV | MS_NOSUID | MS_NOEXEC, "mode=0755") < 0) {
+        die2("mount", base);
+    }
+
     const char *fpath = "/proc/cgroups";
     FILE *f = fopen(fpath, "r");
     if (f == NULL) {
@@ -211,6 +242,7 @@ void init_cgroups() {
             break;
         }
     }
+    int mounted = 0;
     for (;;) {
         static const char base_path[] = "/sys/fs/cgroup/";
         char path[sizeof(base_path) - 1 + 64];
@@ -230,11 +262,42 @@ void init_cgroups() {
                 die2("mkdir", path);
             }
             if (mount(name, path, "cgroup", MS_NODEV | MS_NOSUID | MS_NOEXEC, name) < 0) {
-                die2("mount", path);
+                warn2("mount", path);
+                int error = errno;
+                fclose(f);
+                errno = error;
+                return -1;
             }
+            mounted++;
         }
     }
     fclose(f);
+    return mounted;
+}
+
+// init_cgroups mounts the v1 cgroup controllers, or the unified cgroup v2
+// hierarchy if none of them can be mounted and the kernel supports it.
+void init_cgroups() {
+    const char *base = "/sys/fs/cgroup";
+    int mounted = init_cgroups_v1(base);
+    if (mounted > 0) {
+        return;
+    }
+    int error = errno;
+    if (!filesystem_supported("cgroup2")) {
+        if (mounted < 0) {
+            errno = error;
+            dien();
+        }
+        return;
+    }
+    // Detach the tmpfs along with any controller mounted under it.
+    if (umount2(base, MNT_DETACH) < 0) {
+        die2("umount", base);
+    }
+    if (mount("cgroup2", base, "cgroup2", MS_NODEV | MS_NOSUID | MS_NOEXEC, NULL) < 0) {
+        die2("mount", base);
+    }
 }
 
 void init_network(const char *iface, int domain) {
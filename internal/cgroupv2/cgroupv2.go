@@ -0,0 +1,501 @@
+// +build linux
+
+// Package cgroupv2 manages cgroups on the unified cgroup v2 hierarchy, which
+// the vendored cgroups library does not support.
+package cgroupv2
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Test dependencies
+var (
+	mountpoint = "/sys/fs/cgroup"
+)
+
+// ErrDeleted is returned by `MemoryEventWatcher.Wait` once the cgroup it
+// watches has been deleted.
+var ErrDeleted = errors.New("cgroup deleted")
+
+// IsUnified returns true if the unified hierarchy is mounted at
+// /sys/fs/cgroup rather than a v1 controller per directory.
+func IsUnified() bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &st); err != nil {
+		return false
+	}
+	return st.Type == unix.CGROUP2_SUPER_MAGIC
+}
+
+// Cgroup is a cgroup on the unified hierarchy.
+type Cgroup struct {
+	// path is relative to the root of the hierarchy, such as "/containers".
+	path string
+}
+
+// New creates the cgroup at `path` and applies `resources` to it. Every
+// controller available at the root is enabled down to the new cgroup so that
+// its interface files exist.
+func New(path string, resources *oci.LinuxResources) (*Cgroup, error) {
+	dir := mountpoint
+	for _, elem := range strings.Split(strings.Trim(path, "/"), "/") {
+		if err := enableControllers(dir); err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(dir, elem)
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return nil, errors.Wrapf(err, "failed to create cgroup %s", dir)
+		}
+	}
+	cg := &Cgroup{path: path}
+	if err := cg.Update(resources); err != nil {
+		return nil, err
+	}
+	return cg, nil
+}
+
+// Load returns the existing cgroup at `path`.
+func Load(path string) (*Cgroup, error) {
+	cg := &Cgroup{path: path}
+	if _, err := os.Stat(cg.dir()); err != nil {
+		return nil, errors.Wrapf(err, "failed to load cgroup %s", path)
+	}
+	return cg, nil
+}
+
+// enableControllers enables every controller available in the cgroup at
+// `dir` for its children.
+func enableControllers(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read controllers of cgroup %s", dir)
+	}
+	controllers := strings.Fields(string(data))
+	if len(controllers) == 0 {
+		return nil
+	}
+	for i, c := range controllers {
+		controllers[i] = "+" + c
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0); err != nil {
+		return errors.Wrapf(err, "failed to enable controllers in cgroup %s", dir)
+	}
+	return nil
+}
+
+// Path returns the path of the cgroup relative to the root of the hierarchy.
+func (cg *Cgroup) Path() string {
+	return cg.path
+}
+
+func (cg *Cgroup) dir() string {
+	return filepath.Join(mountpoint, cg.path)
+}
+
+func (cg *Cgroup) write(file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(cg.dir(), file), []byte(value), 0); err != nil {
+		return errors.Wrapf(err, "failed to write %q to %s of cgroup %s", value, file, cg.path)
+	}
+	return nil
+}
+
+// Update applies the memory, CPU and pids limits of `resources` to the
+// cgroup. The v1 values of the OCI spec are converted to their v2 equivalent.
+func (cg *Cgroup) Update(resources *oci.LinuxResources) error {
+	if resources == nil {
+		return nil
+	}
+	if mem := resources.Memory; mem != nil {
+		if mem.Limit != nil {
+			if err := cg.write("memory.max", formatLimit(*mem.Limit)); err != nil {
+				return err
+			}
+			// The v1 swap limit includes memory, the v2 limit does not.
+			if mem.Swap != nil && (*mem.Swap == -1 || (*mem.Swap > 0 && *mem.Limit > 0)) {
+				swap := "max"
+				if *mem.Swap > 0 {
+					swap = strconv.FormatInt(*mem.Swap-*mem.Limit, 10)
+				}
+				if err := cg.write("memory.swap.max", swap); err != nil {
+					return err
+				}
+			}
+		}
+		if mem.Reservation != nil {
+			if err := cg.write("memory.low", formatLimit(*mem.Reservation)); err != nil {
+				return err
+			}
+		}
+	}
+	if cpu := resources.CPU; cpu != nil {
+		if cpu.Shares != nil && *cpu.Shares != 0 {
+			// Maps the v1 range [2, 262144] onto the v2 range [1, 10000].
+			weight := 1 + ((*cpu.Shares-2)*9999)/262142
+			if err := cg.write("cpu.weight", strconv.FormatUint(weight, 10)); err != nil {
+				return err
+			}
+		}
+		if cpu.Quota != nil || cpu.Period != nil {
+			quota := "max"
+			if cpu.Quota != nil && *cpu.Quota > 0 {
+				quota = strconv.FormatInt(*cpu.Quota, 10)
+			}
+			period := uint64(100000)
+			if cpu.Period != nil && *cpu.Period != 0 {
+				period = *cpu.Period
+			}
+			if err := cg.write("cpu.max", quota+" "+strconv.FormatUint(period, 10)); err != nil {
+				return err
+			}
+		}
+	}
+	if pids := resources.Pids; pids != nil {
+		if err := cg.write("pids.max", formatLimit(pids.Limit)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatLimit returns `limit` as written to a v2 limit file, where any value
+// <= 0 means there is no limit.
+func formatLimit(limit int64) string {
+	if limit <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// AddProc moves the process `pid` into the cgroup.
+func (cg *Cgroup) AddProc(pid int) error {
+	return cg.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// Delete removes the cgroup. It must not contain any process or child
+// cgroup.
+func (cg *Cgroup) Delete() error {
+	if err := os.Remove(cg.dir()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to delete cgroup %s", cg.path)
+	}
+	return nil
+}
+
+// readUint returns the single value in `file` of the cgroup. "max" is
+// returned as 0.
+func (cg *Cgroup) readUint(file string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(cg.dir(), file))
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s of cgroup %s", file, cg.path)
+	}
+	return v, nil
+}
+
+// readKeyValues returns the values of the flat keyed `file` of the cgroup,
+// such as memory.stat.
+func (cg *Cgroup) readKeyValues(file string) (map[string]uint64, error) {
+	f, err := os.Open(filepath.Join(cg.dir(), file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s value %q of cgroup %s", fields[0], fields[1], cg.path)
+		}
+		values[fields[0]] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s of cgroup %s", file, cg.path)
+	}
+	return values, nil
+}
+
+// MemoryEvents returns the counters in memory.events of the cgroup.
+func (cg *Cgroup) MemoryEvents() (*MemoryEvents, error) {
+	kv, err := cg.readKeyValues("memory.events")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read memory events of cgroup %s", cg.path)
+	}
+	return &MemoryEvents{
+		Low:     kv["low"],
+		High:    kv["high"],
+		Max:     kv["max"],
+		Oom:     kv["oom"],
+		OomKill: kv["oom_kill"],
+	}, nil
+}
+
+// Stat returns the metrics of the cgroup. The metrics of a controller that is
+// not enabled for the cgroup are omitted.
+func (cg *Cgroup) Stat() (*Metrics, error) {
+	m := &Metrics{}
+
+	if current, err := cg.readUint("pids.current"); err == nil {
+		limit, err := cg.readUint("pids.max")
+		if err != nil {
+			return nil, err
+		}
+		m.Pids = &PidsStat{Current: current, Limit: limit}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if kv, err := cg.readKeyValues("cpu.stat"); err == nil {
+		m.CPU = &CPUStat{
+			UsageUsec:     kv["usage_usec"],
+			UserUsec:      kv["user_usec"],
+			SystemUsec:    kv["system_usec"],
+			NrPeriods:     kv["nr_periods"],
+			NrThrottled:   kv["nr_throttled"],
+			ThrottledUsec: kv["throttled_usec"],
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if kv, err := cg.readKeyValues("memory.stat"); err == nil {
+		mem := &MemoryStat{
+			Anon:          kv["anon"],
+			File:          kv["file"],
+			KernelStack:   kv["kernel_stack"],
+			Slab:          kv["slab"],
+			Sock:          kv["sock"],
+			Shmem:         kv["shmem"],
+			FileMapped:    kv["file_mapped"],
+			FileDirty:     kv["file_dirty"],
+			FileWriteback: kv["file_writeback"],
+			Pgfault:       kv["pgfault"],
+			Pgmajfault:    kv["pgmajfault"],
+		}
+		for file, v := range map[string]*uint64{
+			"memory.current":      &mem.Usage,
+			"memory.max":          &mem.UsageLimit,
+			"memory.swap.current": &mem.SwapUsage,
+			"memory.swap.max":     &mem.SwapLimit,
+		} {
+			// Swap accounting may be disabled.
+			if *v, err = cg.readUint(file); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		m.Memory = mem
+		if m.MemoryEvents, err = cg.MemoryEvents(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if io, err := cg.readIOStat(); err == nil {
+		m.IO = io
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readIOStat parses io.stat, whose lines are of the form
+// "8:0 rbytes=90112 wbytes=0 rios=3 wios=0 dbytes=0 dios=0".
+func (cg *Cgroup) readIOStat() (*IOStat, error) {
+	f, err := os.Open(filepath.Join(cg.dir(), "io.stat"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat := &IOStat{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var e IOEntry
+		dev := strings.SplitN(fields[0], ":", 2)
+		if len(dev) != 2 {
+			return nil, errors.Errorf("invalid device %q in io.stat of cgroup %s", fields[0], cg.path)
+		}
+		if e.Major, err = strconv.ParseUint(dev[0], 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid device %q in io.stat of cgroup %s", fields[0], cg.path)
+		}
+		if e.Minor, err = strconv.ParseUint(dev[1], 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid device %q in io.stat of cgroup %s", fields[0], cg.path)
+		}
+		for _, kv := range fields[1:] {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			v, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse %q in io.stat of cgroup %s", kv, cg.path)
+			}
+			switch parts[0] {
+			case "rbytes":
+				e.Rbytes = v
+			case "wbytes":
+				e.Wbytes = v
+			case "rios":
+				e.Rios = v
+			case "wios":
+				e.Wios = v
+			}
+		}
+		stat.Usage = append(stat.Usage, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read io.stat of cgroup %s", cg.path)
+	}
+	return stat, nil
+}
+
+// MemoryEventWatcher waits for the counters in memory.events of a cgroup to
+// change.
+type MemoryEventWatcher struct {
+	cg *Cgroup
+	f  *os.File
+}
+
+// WatchMemoryEvents returns a watcher for the memory events of the cgroup.
+// It replaces the eventfds registered through cgroup.event_control on v1.
+func (cg *Cgroup) WatchMemoryEvents() (*MemoryEventWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create inotify instance")
+	}
+	p := filepath.Join(cg.dir(), "memory.events")
+	if _, err := unix.InotifyAddWatch(fd, p, unix.IN_MODIFY|unix.IN_DELETE_SELF); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "failed to watch %s", p)
+	}
+	return &MemoryEventWatcher{
+		cg: cg,
+		f:  os.NewFile(uintptr(fd), "inotify:"+p),
+	}, nil
+}
+
+// Wait blocks until memory.events changes and returns its new counters. It
+// returns `ErrDeleted` once the cgroup is deleted.
+func (w *MemoryEventWatcher) Wait() (*MemoryEvents, error) {
+	buf := make([]byte, 4096)
+	n, err := w.f.Read(buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read memory events of cgroup %s", w.cg.path)
+	}
+	for off := 0; off+unix.SizeofInotifyEvent <= n; {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		if ev.Mask&(unix.IN_DELETE_SELF|unix.IN_IGNORED) != 0 {
+			return nil, ErrDeleted
+		}
+		off += unix.SizeofInotifyEvent + int(ev.Len)
+	}
+	events, err := w.cg.MemoryEvents()
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, ErrDeleted
+		}
+		return nil, err
+	}
+	return events, nil
+}
+
+// Close stops the watcher, unblocking any call to `Wait`.
+func (w *MemoryEventWatcher) Close() error {
+	return w.f.Close()
+}
+
+// MemoryUsage returns the memory usage of the cgroup read from memory.current.
+func (cg *Cgroup) MemoryUsage() (uint64, error) {
+	return cg.readUint("memory.current")
+}
+
+// MemoryThresholdWatcher waits for the memory usage of a cgroup to rise above
+// a threshold. The unified hierarchy has no usage threshold events, and
+// memory.high throttles the cgroup rather than notifying, so memory.current is
+// polled instead.
+type MemoryThresholdWatcher struct {
+	cg        *Cgroup
+	threshold uint64
+	ticker    *time.Ticker
+	// above is whether the usage was above the threshold when last polled.
+	above bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// WatchMemoryThreshold returns a watcher that polls the memory usage of the
+// cgroup against `threshold` every `interval`. It replaces the memory
+// threshold eventfds registered through cgroup.event_control on v1.
+func (cg *Cgroup) WatchMemoryThreshold(threshold uint64, interval time.Duration) *MemoryThresholdWatcher {
+	return &MemoryThresholdWatcher{
+		cg:        cg,
+		threshold: threshold,
+		ticker:    time.NewTicker(interval),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Wait blocks until the memory usage of the cgroup rises above the threshold
+// and returns the usage. Like a v1 threshold event it fires once per crossing:
+// the usage must drop to the threshold before `Wait` returns again. It returns
+// `ErrDeleted` once the cgroup is deleted.
+func (w *MemoryThresholdWatcher) Wait() (uint64, error) {
+	for {
+		select {
+		case <-w.ticker.C:
+		case <-w.closed:
+			return 0, errors.Errorf("memory threshold watcher of cgroup %s closed", w.cg.path)
+		}
+		usage, err := w.cg.MemoryUsage()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return 0, ErrDeleted
+			}
+			return 0, errors.Wrapf(err, "failed to read memory usage of cgroup %s", w.cg.path)
+		}
+		above := usage > w.threshold
+		crossed := above && !w.above
+		w.above = above
+		if crossed {
+			return usage, nil
+		}
+	}
+}
+
+// Close stops the watcher, unblocking any call to `Wait`.
+func (w *MemoryThresholdWatcher) Close() error {
+	w.closeOnce.Do(func() {
+		w.ticker.Stop()
+		close(w.closed)
+	})
+	return nil
+}
@@ -0,0 +1,251 @@
+// +build linux
+
+package cgroupv2
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// newTestHierarchy points the package at a temp directory whose root offers
+// the memory and pids controllers. The returned func restores the package and
+// removes the directory.
+func newTestHierarchy(t *testing.T) (string, func()) {
+	root, err := ioutil.TempDir("", "cgroupv2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := mountpoint
+	mountpoint = root
+	cleanup := func() {
+		mountpoint = old
+		os.RemoveAll(root)
+	}
+	writeFile(t, filepath.Join(root, "cgroup.controllers"), "memory pids\n")
+	return root, cleanup
+}
+
+func writeFile(t *testing.T, path, data string) {
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func Test_New(t *testing.T) {
+	root, cleanup := newTestHierarchy(t)
+	defer cleanup()
+	// A real hierarchy populates the controllers of every new cgroup.
+	if err := os.Mkdir(filepath.Join(root, "parent"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "parent", "cgroup.controllers"), "memory\n")
+
+	limit := int64(1024)
+	pids := int64(0)
+	cg, err := New("/parent/child", &oci.LinuxResources{
+		Memory: &oci.LinuxMemory{Limit: &limit},
+		Pids:   &oci.LinuxPids{Limit: pids},
+	})
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if cg.Path() != "/parent/child" {
+		t.Fatalf("expected path /parent/child got: %s", cg.Path())
+	}
+	for file, expected := range map[string]string{
+		"cgroup.subtree_control":        "+memory +pids",
+		"parent/cgroup.subtree_control": "+memory",
+		"parent/child/memory.max":       "1024",
+		"parent/child/pids.max":         "max",
+	} {
+		if got := readFile(t, filepath.Join(root, file)); got != expected {
+			t.Errorf("expected %s to be %q got: %q", file, expected, got)
+		}
+	}
+}
+
+func Test_Stat(t *testing.T) {
+	root, cleanup := newTestHierarchy(t)
+	defer cleanup()
+	dir := filepath.Join(root, "c1")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, data := range map[string]string{
+		"pids.current":   "3\n",
+		"pids.max":       "max\n",
+		"memory.current": "4096\n",
+		"memory.max":     "8192\n",
+		"memory.stat":    "anon 1024\nfile 2048\npgfault 7\n",
+		"memory.events":  "low 0\nhigh 1\nmax 2\noom 3\noom_kill 4\n",
+		"io.stat":        "8:0 rbytes=512 wbytes=1024 rios=1 wios=2 dbytes=0 dios=0\n",
+	} {
+		writeFile(t, filepath.Join(dir, file), data)
+	}
+
+	cg, err := Load("/c1")
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	m, err := cg.Stat()
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	expected := &Metrics{
+		Pids:         &PidsStat{Current: 3},
+		Memory:       &MemoryStat{Usage: 4096, UsageLimit: 8192, Anon: 1024, File: 2048, Pgfault: 7},
+		MemoryEvents: &MemoryEvents{High: 1, Max: 2, Oom: 3, OomKill: 4},
+		IO:           &IOStat{Usage: []IOEntry{{Major: 8, Rbytes: 512, Wbytes: 1024, Rios: 1, Wios: 2}}},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("expected %+v got: %+v", expected, m)
+	}
+}
+
+func Test_Load_NotExist(t *testing.T) {
+	_, cleanup := newTestHierarchy(t)
+	defer cleanup()
+	if _, err := Load("/missing"); err == nil {
+		t.Fatal("expected an error loading a missing cgroup")
+	}
+}
+
+func Test_MemoryEventWatcher(t *testing.T) {
+	root, cleanup := newTestHierarchy(t)
+	defer cleanup()
+	dir := filepath.Join(root, "c1")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	events := filepath.Join(dir, "memory.events")
+	writeFile(t, events, "oom 0\noom_kill 0\n")
+
+	cg, err := Load("/c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := cg.WatchMemoryEvents()
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	defer w.Close()
+
+	type result struct {
+		e   *MemoryEvents
+		err error
+	}
+	wait := func() result {
+		ch := make(chan result, 1)
+		go func() {
+			e, err := w.Wait()
+			ch <- result{e, err}
+		}()
+		select {
+		case r := <-ch:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for memory events")
+		}
+		return result{}
+	}
+
+	writeFile(t, events, "oom 1\noom_kill 1\n")
+	r := wait()
+	if r.err != nil {
+		t.Fatalf("expected nil error got: %v", r.err)
+	}
+	if r.e.OomKill != 1 {
+		t.Fatalf("expected oom_kill 1 got: %+v", r.e)
+	}
+
+	if err := os.Remove(events); err != nil {
+		t.Fatal(err)
+	}
+	if r := wait(); r.err != ErrDeleted {
+		t.Fatalf("expected ErrDeleted got: %v", r.err)
+	}
+}
+
+func Test_MemoryThresholdWatcher(t *testing.T) {
+	root, cleanup := newTestHierarchy(t)
+	defer cleanup()
+	dir := filepath.Join(root, "gcs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	current := filepath.Join(dir, "memory.current")
+	writeFile(t, current, "100\n")
+
+	cg, err := Load("/gcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := cg.WatchMemoryThreshold(200, time.Millisecond)
+	defer w.Close()
+
+	type result struct {
+		usage uint64
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		for {
+			usage, err := w.Wait()
+			results <- result{usage, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	next := func() result {
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the memory threshold")
+		}
+		return result{}
+	}
+	expectNone := func() {
+		select {
+		case r := <-results:
+			t.Fatalf("expected no threshold crossing got: %+v", r)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	expectNone()
+	writeFile(t, current, "300\n")
+	if r := next(); r.err != nil || r.usage != 300 {
+		t.Fatalf("expected usage 300 got: %+v", r)
+	}
+	// Staying above the threshold is a single crossing.
+	expectNone()
+	writeFile(t, current, "150\n")
+	expectNone()
+	writeFile(t, current, "250\n")
+	if r := next(); r.err != nil || r.usage != 250 {
+		t.Fatalf("expected usage 250 got: %+v", r)
+	}
+
+	if err := os.Remove(current); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(); r.err != ErrDeleted {
+		t.Fatalf("expected ErrDeleted got: %+v", r)
+	}
+}
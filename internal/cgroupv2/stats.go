@@ -0,0 +1,73 @@
+package cgroupv2
+
+// Metrics are the statistics of a cgroup on the unified hierarchy. A
+// controller that is not enabled for the cgroup leaves its field nil.
+type Metrics struct {
+	Pids         *PidsStat     `json:",omitempty"`
+	CPU          *CPUStat      `json:",omitempty"`
+	Memory       *MemoryStat   `json:",omitempty"`
+	MemoryEvents *MemoryEvents `json:",omitempty"`
+	IO           *IOStat       `json:",omitempty"`
+}
+
+// PidsStat is read from pids.current and pids.max. A `Limit` of 0 means there
+// is no limit.
+type PidsStat struct {
+	Current uint64
+	Limit   uint64
+}
+
+// CPUStat is read from cpu.stat.
+type CPUStat struct {
+	UsageUsec     uint64
+	UserUsec      uint64
+	SystemUsec    uint64
+	NrPeriods     uint64
+	NrThrottled   uint64
+	ThrottledUsec uint64
+}
+
+// MemoryStat is read from memory.current, memory.max, memory.swap.current,
+// memory.swap.max and memory.stat. A limit of 0 means there is no limit.
+type MemoryStat struct {
+	Usage      uint64
+	UsageLimit uint64
+	SwapUsage  uint64
+	SwapLimit  uint64
+
+	Anon          uint64
+	File          uint64
+	KernelStack   uint64
+	Slab          uint64
+	Sock          uint64
+	Shmem         uint64
+	FileMapped    uint64
+	FileDirty     uint64
+	FileWriteback uint64
+	Pgfault       uint64
+	Pgmajfault    uint64
+}
+
+// MemoryEvents are the counters read from memory.events.
+type MemoryEvents struct {
+	Low     uint64
+	High    uint64
+	Max     uint64
+	Oom     uint64
+	OomKill uint64
+}
+
+// IOStat is read from io.stat.
+type IOStat struct {
+	Usage []IOEntry `json:",omitempty"`
+}
+
+// IOEntry is the I/O of a cgroup to the block device `Major`:`Minor`.
+type IOEntry struct {
+	Major  uint64
+	Minor  uint64
+	Rbytes uint64
+	Wbytes uint64
+	Rios   uint64
+	Wios   uint64
+}
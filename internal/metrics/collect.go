@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	v1 "github.com/containerd/cgroups/stats/v1"
+	"github.com/pkg/errors"
+)
+
+// Test dependencies
+var (
+	procMeminfo = "/proc/meminfo"
+)
+
+// collectContainer adds the memory, CPU, pids and blkio metrics of container
+// `id` to `s`.
+func collectContainer(s *metricSet, id string, m *v1.Metrics) {
+	cid := []string{"container_id", id}
+
+	if mem := m.Memory; mem != nil {
+		if mem.Usage != nil {
+			s.gauge("opengcs_container_memory_usage_bytes", "Current memory usage of the container.", float64(mem.Usage.Usage), cid...)
+			s.gauge("opengcs_container_memory_max_usage_bytes", "Maximum recorded memory usage of the container.", float64(mem.Usage.Max), cid...)
+			s.gauge("opengcs_container_memory_limit_bytes", "Memory limit of the container.", float64(mem.Usage.Limit), cid...)
+			s.counter("opengcs_container_memory_failcnt_total", "Number of times the container memory limit was hit.", float64(mem.Usage.Failcnt), cid...)
+		}
+		if mem.Swap != nil {
+			s.gauge("opengcs_container_memory_swap_usage_bytes", "Current memory and swap usage of the container.", float64(mem.Swap.Usage), cid...)
+		}
+		s.gauge("opengcs_container_memory_rss_bytes", "Anonymous and swap cache memory of the container.", float64(mem.TotalRSS), cid...)
+		s.gauge("opengcs_container_memory_cache_bytes", "Page cache memory of the container.", float64(mem.TotalCache), cid...)
+	}
+
+	if cpu := m.CPU; cpu != nil {
+		if cpu.Usage != nil {
+			s.counter("opengcs_container_cpu_usage_seconds_total", "Total CPU time consumed by the container.", nsToSeconds(cpu.Usage.Total), cid...)
+			s.counter("opengcs_container_cpu_user_seconds_total", "User CPU time consumed by the container.", nsToSeconds(cpu.Usage.User), cid...)
+			s.counter("opengcs_container_cpu_kernel_seconds_total", "Kernel CPU time consumed by the container.", nsToSeconds(cpu.Usage.Kernel), cid...)
+		}
+		if cpu.Throttling != nil {
+			s.counter("opengcs_container_cpu_throttled_periods_total", "Number of periods the container was throttled.", float64(cpu.Throttling.ThrottledPeriods), cid...)
+			s.counter("opengcs_container_cpu_throttled_seconds_total", "Total time the container was throttled.", nsToSeconds(cpu.Throttling.ThrottledTime), cid...)
+		}
+	}
+
+	if pids := m.Pids; pids != nil {
+		s.gauge("opengcs_container_pids_current", "Number of processes in the container.", float64(pids.Current), cid...)
+		s.gauge("opengcs_container_pids_limit", "Maximum number of processes in the container, 0 if unlimited.", float64(pids.Limit), cid...)
+	}
+
+	if blkio := m.Blkio; blkio != nil {
+		for _, e := range blkio.IoServiceBytesRecursive {
+			s.counter("opengcs_container_blkio_service_bytes_total", "Bytes transferred to and from block devices by the container.", float64(e.Value), blkioLabels(id, e)...)
+		}
+		for _, e := range blkio.IoServicedRecursive {
+			s.counter("opengcs_container_blkio_serviced_total", "I/O operations issued to block devices by the container.", float64(e.Value), blkioLabels(id, e)...)
+		}
+	}
+}
+
+func blkioLabels(id string, e *v1.BlkIOEntry) []string {
+	device := e.Device
+	if device == "" {
+		device = strconv.FormatUint(e.Major, 10) + ":" + strconv.FormatUint(e.Minor, 10)
+	}
+	return []string{"container_id", id, "device", device, "op", strings.ToLower(e.Op)}
+}
+
+func nsToSeconds(ns uint64) float64 {
+	return float64(ns) / 1e9
+}
+
+// meminfoMetrics maps the /proc/meminfo fields exported for the UVM to their
+// metric name.
+var meminfoMetrics = map[string]string{
+	"MemTotal":     "opengcs_uvm_memory_total_bytes",
+	"MemFree":      "opengcs_uvm_memory_free_bytes",
+	"MemAvailable": "opengcs_uvm_memory_available_bytes",
+	"Buffers":      "opengcs_uvm_memory_buffers_bytes",
+	"Cached":       "opengcs_uvm_memory_cached_bytes",
+	"SwapTotal":    "opengcs_uvm_memory_swap_total_bytes",
+	"SwapFree":     "opengcs_uvm_memory_swap_free_bytes",
+}
+
+// collectUVM adds the UVM-wide memory metrics read from /proc/meminfo to `s`.
+func collectUVM(s *metricSet) error {
+	f, err := os.Open(procMeminfo)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", procMeminfo)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines are of the form "MemTotal:        8155984 kB".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		name, ok := meminfoMetrics[strings.TrimSuffix(fields[0], ":")]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s value %q", fields[0], fields[1])
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			v *= 1024
+		}
+		s.gauge(name, "UVM "+strings.TrimSuffix(fields[0], ":")+" from /proc/meminfo.", float64(v))
+	}
+	return scanner.Err()
+}
+
+// collectGCS adds the goroutine and heap metrics of the GCS process to `s`.
+func collectGCS(s *metricSet) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	s.gauge("opengcs_gcs_goroutines", "Number of goroutines in the GCS.", float64(runtime.NumGoroutine()))
+	s.gauge("opengcs_gcs_heap_alloc_bytes", "Bytes of allocated heap objects in the GCS.", float64(ms.HeapAlloc))
+	s.gauge("opengcs_gcs_heap_inuse_bytes", "Bytes in in-use heap spans in the GCS.", float64(ms.HeapInuse))
+	s.gauge("opengcs_gcs_heap_sys_bytes", "Bytes of heap memory obtained from the OS by the GCS.", float64(ms.HeapSys))
+	s.gauge("opengcs_gcs_sys_bytes", "Total bytes of memory obtained from the OS by the GCS.", float64(ms.Sys))
+	s.counter("opengcs_gcs_gc_total", "Number of completed GC cycles in the GCS.", float64(ms.NumGC))
+}
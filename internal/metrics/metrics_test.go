@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/containerd/cgroups/stats/v1"
+)
+
+type fakeSource map[string]*v1.Metrics
+
+func (f fakeSource) GetAllContainerStats(context.Context) map[string]*v1.Metrics {
+	return f
+}
+
+func Test_MetricSet_WriteTo(t *testing.T) {
+	s := newMetricSet()
+	s.gauge("b_metric", "Second metric.", 2, "id", "x")
+	s.counter("a_metric", "First\nmetric.", 1.5, "id", `quoted "value"`, "op", "read")
+	s.gauge("b_metric", "Second metric.", 3, "id", "y")
+
+	var buf bytes.Buffer
+	if err := s.writeTo(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `# HELP a_metric First\nmetric.
+# TYPE a_metric counter
+a_metric{id="quoted \"value\"",op="read"} 1.5
+# HELP b_metric Second metric.
+# TYPE b_metric gauge
+b_metric{id="x"} 2
+b_metric{id="y"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func Test_Handler_ServesAllMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meminfo := filepath.Join(dir, "meminfo")
+	if err := ioutil.WriteFile(meminfo, []byte("MemTotal:        1024 kB\nMemFree:          512 kB\nHugePages_Total:     0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(p string) { procMeminfo = p }(procMeminfo)
+	procMeminfo = meminfo
+
+	source := fakeSource{
+		"c1": &v1.Metrics{
+			Memory: &v1.MemoryStat{
+				Usage:    &v1.MemoryEntry{Usage: 100, Limit: 200},
+				TotalRSS: 50,
+			},
+			CPU: &v1.CPUStat{
+				Usage: &v1.CPUUsage{Total: 2500000000},
+			},
+			Pids: &v1.PidsStat{Current: 3, Limit: 10},
+			Blkio: &v1.BlkIOStat{
+				IoServiceBytesRecursive: []*v1.BlkIOEntry{
+					{Op: "Read", Major: 8, Minor: 0, Value: 4096},
+				},
+			},
+		},
+		// A container without any stats must not cause a failure.
+		"c2": &v1.Metrics{},
+	}
+
+	rec := httptest.NewRecorder()
+	Handler(source).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != contentType {
+		t.Errorf("expected content type %q got: %q", contentType, ct)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		`opengcs_container_memory_usage_bytes{container_id="c1"} 100`,
+		`opengcs_container_memory_limit_bytes{container_id="c1"} 200`,
+		`opengcs_container_memory_rss_bytes{container_id="c1"} 50`,
+		`opengcs_container_cpu_usage_seconds_total{container_id="c1"} 2.5`,
+		`opengcs_container_pids_current{container_id="c1"} 3`,
+		`opengcs_container_blkio_service_bytes_total{container_id="c1",device="8:0",op="read"} 4096`,
+		`opengcs_uvm_memory_total_bytes 1.048576e+06`,
+		`opengcs_uvm_memory_free_bytes 524288`,
+		`# TYPE opengcs_gcs_goroutines gauge`,
+		`# TYPE opengcs_gcs_heap_alloc_bytes gauge`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected response to contain %q got:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `container_id="c2"`) {
+		t.Errorf("expected no metrics for a container without stats got:\n%s", body)
+	}
+}
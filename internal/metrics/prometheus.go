@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The Prometheus metric types used by the GCS.
+const (
+	typeGauge   = "gauge"
+	typeCounter = "counter"
+)
+
+// sample is a single value of a metric family with its label pairs.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// family is a Prometheus metric family: every sample of a metric name.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+// metricSet collects samples by metric family so they can be written in the
+// Prometheus text exposition format, which requires all samples of a family
+// to be written together.
+type metricSet struct {
+	families map[string]*family
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{families: make(map[string]*family)}
+}
+
+// add adds a sample of `value` to the family `name`. `labels` are alternating
+// label names and values.
+func (s *metricSet) add(name, help, typ string, value float64, labels ...string) {
+	f, ok := s.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		s.families[name] = f
+	}
+	f.samples = append(f.samples, sample{labels: labels, value: value})
+}
+
+// gauge adds a sample to the gauge family `name`.
+func (s *metricSet) gauge(name, help string, value float64, labels ...string) {
+	s.add(name, help, typeGauge, value, labels...)
+}
+
+// counter adds a sample to the counter family `name`.
+func (s *metricSet) counter(name, help string, value float64, labels ...string) {
+	s.add(name, help, typeCounter, value, labels...)
+}
+
+// writeTo writes every family in `s` to `w` in the Prometheus text exposition
+// format, sorted by name.
+func (s *metricSet) writeTo(w io.Writer) error {
+	names := make([]string, 0, len(s.families))
+	for name := range s.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := s.families[name]
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		for _, smp := range f.samples {
+			bw.WriteString(f.name)
+			if len(smp.labels) > 0 {
+				bw.WriteByte('{')
+				for i := 0; i+1 < len(smp.labels); i += 2 {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					fmt.Fprintf(bw, "%s=\"%s\"", smp.labels[i], escapeLabelValue(smp.labels[i+1]))
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteByte(' ')
+			bw.WriteString(formatValue(smp.value))
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
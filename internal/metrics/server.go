@@ -0,0 +1,60 @@
+// Package metrics serves the metrics of the UVM, its containers and the GCS
+// itself in the Prometheus text exposition format so that host-side agents
+// can scrape them without a `GetProperties` round trip through the HCS.
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	v1 "github.com/containerd/cgroups/stats/v1"
+)
+
+// contentType is the content type of the Prometheus text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// ContainerStatsSource provides the cgroup metrics of the running containers.
+type ContainerStatsSource interface {
+	// GetAllContainerStats returns the cgroup metrics of every container by
+	// container ID.
+	GetAllContainerStats(ctx context.Context) map[string]*v1.Metrics
+}
+
+// Handler returns an `http.Handler` that serves the metrics of the containers
+// in `source`, the UVM and the GCS on every request.
+func Handler(source ContainerStatsSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		s := newMetricSet()
+
+		stats := source.GetAllContainerStats(ctx)
+		ids := make([]string, 0, len(stats))
+		for id := range stats {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			collectContainer(s, id, stats[id])
+		}
+		if err := collectUVM(s); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to collect UVM metrics")
+		}
+		collectGCS(s)
+
+		w.Header().Set("Content-Type", contentType)
+		if err := s.writeTo(w); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to write metrics response")
+		}
+	})
+}
+
+// Serve serves the metrics of `source` at "/metrics" on `l` until `l` is
+// closed.
+func Serve(l net.Listener, source ContainerStatsSource) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(source))
+	return http.Serve(l, mux)
+}
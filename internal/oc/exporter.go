@@ -2,13 +2,15 @@ package oc
 
 import (
 	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
 )
 
 var _ = (trace.Exporter)(&LogrusExporter{})
+var _ = (view.Exporter)(&LogrusExporter{})
 
-// LogrusExporter is an OpenCensus `trace.Exporter` that exports
-// `trace.SpanData` to logrus output.
+// LogrusExporter is an OpenCensus `trace.Exporter` and `view.Exporter` that
+// exports `trace.SpanData` and `view.Data` to logrus output.
 type LogrusExporter struct {
 }
 
@@ -41,3 +43,62 @@ func (le *LogrusExporter) ExportSpan(s *trace.SpanData) {
 	}
 	baseEntry.Log(level, "Span")
 }
+
+// ExportView exports each row of `vd` as a separate entry at
+// `logrus.InfoLevel`. The entry contains the row's tags and, depending on the
+// aggregation of the view, its `count`, `sum`, `value` or the `count`, `mean`,
+// `min`, `max` and estimated `p50`, `p90` and `p99` of a distribution.
+func (le *LogrusExporter) ExportView(vd *view.Data) {
+	for _, row := range vd.Rows {
+		entry := logrus.WithFields(logrus.Fields{
+			"name":      vd.View.Name,
+			"startTime": vd.Start,
+			"endTime":   vd.End,
+		})
+		for _, t := range row.Tags {
+			entry.Data[t.Key.Name()] = t.Value
+		}
+		switch data := row.Data.(type) {
+		case *view.CountData:
+			entry.Data["count"] = data.Value
+		case *view.SumData:
+			entry.Data["sum"] = data.Value
+		case *view.LastValueData:
+			entry.Data["value"] = data.Value
+		case *view.DistributionData:
+			bounds := vd.View.Aggregation.Buckets
+			entry.Data["count"] = data.Count
+			entry.Data["mean"] = data.Mean
+			entry.Data["min"] = data.Min
+			entry.Data["max"] = data.Max
+			entry.Data["p50"] = estimatePercentile(data, bounds, 0.50)
+			entry.Data["p90"] = estimatePercentile(data, bounds, 0.90)
+			entry.Data["p99"] = estimatePercentile(data, bounds, 0.99)
+		}
+		entry.Info("View")
+	}
+}
+
+// estimatePercentile returns the upper bound of the bucket of `data`
+// containing the percentile `p`. Values beyond the last bound are reported as
+// `data.Max`.
+func estimatePercentile(data *view.DistributionData, bounds []float64, p float64) float64 {
+	if data.Count == 0 {
+		return 0
+	}
+	rank := int64(p * float64(data.Count))
+	if rank >= data.Count {
+		rank = data.Count - 1
+	}
+	var seen int64
+	for i, c := range data.CountPerBucket {
+		seen += c
+		if seen > rank {
+			if i < len(bounds) && bounds[i] < data.Max {
+				return bounds[i]
+			}
+			return data.Max
+		}
+	}
+	return data.Max
+}
@@ -0,0 +1,30 @@
+package oc
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// LatencyDistribution is the `view.Aggregation` used for all latency views.
+// The bucket bounds are in milliseconds.
+var LatencyDistribution = view.Distribution(
+	1, 2, 5, 10, 25, 50, 100, 250, 500,
+	1000, 2500, 5000, 10000, 30000, 60000, 300000)
+
+// SinceInMilliseconds returns the time elapsed since `start` in fractional
+// milliseconds.
+func SinceInMilliseconds(start time.Time) float64 {
+	return float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond)
+}
+
+// RecordLatency records the time elapsed since `start` against `m` with the
+// tags in `mutators`.
+func RecordLatency(ctx context.Context, m *stats.Float64Measure, start time.Time, mutators ...tag.Mutator) {
+	// The only error returned is for invalid tag values which are constants
+	// or identifiers here, so it is safe to ignore.
+	_ = stats.RecordWithTags(ctx, mutators, m.M(SinceInMilliseconds(start)))
+}
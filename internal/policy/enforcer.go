@@ -0,0 +1,482 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Enforcer decides whether the requests of the host are allowed by a `Policy`.
+// It tracks the layer devices and containers of the UVM to match them with
+// the policy. It is safe for concurrent use.
+type Enforcer struct {
+	policy *Policy
+
+	mu sync.Mutex
+	// devices are the layer identities of the devices by mount path.
+	devices map[string]string
+	// roots are the layer identities of the combined root filesystems by
+	// container root path.
+	roots map[string][]string
+	// containers are the policy containers each container matched by ID.
+	containers map[string][]*Container
+}
+
+// NewEnforcer returns an `Enforcer` of `p`.
+func NewEnforcer(p *Policy) *Enforcer {
+	return &Enforcer{
+		policy:     p,
+		devices:    make(map[string]string),
+		roots:      make(map[string][]string),
+		containers: make(map[string][]*Container),
+	}
+}
+
+// AllowAll returns an `Enforcer` that allows every request.
+func AllowAll() *Enforcer {
+	return NewEnforcer(&Policy{AllowAll: true})
+}
+
+// verityIdentityPrefix prefixes the identity of a device with verity
+// information.
+const verityIdentityPrefix = "verity:"
+
+// DefaultCapabilities are the capabilities of a container that is not
+// privileged. They match the defaults of Docker and containerd.
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// isolatedNamespaces are the namespaces a container that is not privileged
+// does not share with the UVM.
+var isolatedNamespaces = []oci.LinuxNamespaceType{
+	oci.MountNamespace,
+	oci.PIDNamespace,
+	oci.IPCNamespace,
+	oci.UTSNamespace,
+}
+
+// DeviceIdentity returns the identity of the content of the layer device
+// mapped by a `MappedVirtualDiskV2` or `MappedVPMemDeviceV2` request, or `""`
+// if the request has no verity information. The identity is derived from the
+// verity information rather than from where the host attached the device,
+// since the host cannot forge a device whose blocks match it:
+//
+//	verity:<version>:<algorithm>:<block size>:<ext4 size>:<superblock>:<salt>:<root digest>
+//
+// where superblock is 1 if a superblock precedes the hash tree and 0
+// otherwise, and the salt and root digest are lower case hex. Every parameter
+// is included because the same root digest verifies different content with
+// different parameters.
+func DeviceIdentity(settings interface{}) string {
+	var info *prot.DeviceVerityInfo
+	switch s := settings.(type) {
+	case *prot.MappedVirtualDiskV2:
+		info = s.VerityInfo
+	case *prot.MappedVPMemDeviceV2:
+		info = s.VerityInfo
+	}
+	if info == nil {
+		return ""
+	}
+	superBlock := 0
+	if info.SuperBlock {
+		superBlock = 1
+	}
+	return fmt.Sprintf("%s%d:%s:%d:%d:%d:%s:%s",
+		verityIdentityPrefix,
+		info.Version,
+		strings.ToLower(info.HashAlgorithm()),
+		info.BlockSize,
+		info.Ext4SizeInBytes,
+		superBlock,
+		strings.ToLower(info.Salt),
+		strings.ToLower(info.RootDigest))
+}
+
+// deviceMountPath returns the mount path of a `MappedVirtualDiskV2` or
+// `MappedVPMemDeviceV2` request.
+func deviceMountPath(settings interface{}) string {
+	switch s := settings.(type) {
+	case *prot.MappedVirtualDiskV2:
+		return s.MountPath
+	case *prot.MappedVPMemDeviceV2:
+		return s.MountPath
+	}
+	return ""
+}
+
+// deny audit logs the denial of `operation` and returns an
+// `HrErrAccessDisabledByPolicy` error with the reason.
+func deny(ctx context.Context, operation string, fields logrus.Fields, format string, args ...interface{}) error {
+	err := errors.Errorf(format, args...)
+	log.G(ctx).WithFields(fields).WithFields(logrus.Fields{
+		"audit":     "security-policy",
+		"operation": operation,
+	}).WithError(err).Warning("security policy denied request")
+	return gcserr.WrapHresult(errors.Wrap(err, "denied by security policy"), gcserr.HrErrAccessDisabledByPolicy)
+}
+
+// EnforceModifySettings enforces the policy on the UVM modify request `req`.
+// It allows combining layers only in an order some container of the policy
+// runs on. The devices and root filesystems are tracked once the request
+// succeeds by `RecordModifySettings`.
+func (e *Enforcer) EnforceModifySettings(ctx context.Context, req *prot.ModifySettingRequest) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, ok := req.Settings.(*prot.CombinedLayersV2)
+	if !ok || req.RequestType == prot.MreqtRemove || e.policy.AllowAll {
+		return nil
+	}
+	layers := make([]string, len(s.Layers))
+	for i, l := range s.Layers {
+		id, ok := e.devices[l.Path]
+		if !ok {
+			return deny(ctx, "CombinedLayers", logrus.Fields{"layer": l.Path},
+				"layer %s is not a mapped device", l.Path)
+		}
+		if id == "" {
+			return deny(ctx, "CombinedLayers", logrus.Fields{"layer": l.Path},
+				"layer %s has no verity information", l.Path)
+		}
+		layers[i] = id
+	}
+	if !e.anyLayersLocked(layers) {
+		return deny(ctx, "CombinedLayers", logrus.Fields{"layers": layers},
+			"no container runs on layers %v", layers)
+	}
+	return nil
+}
+
+// RecordModifySettings tracks the layer devices and root filesystems added or
+// removed by the UVM modify request `req` once it succeeded.
+func (e *Enforcer) RecordModifySettings(req *prot.ModifySettingRequest) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch s := req.Settings.(type) {
+	case *prot.MappedVirtualDiskV2, *prot.MappedVPMemDeviceV2:
+		mountPath := deviceMountPath(s)
+		if mountPath == "" {
+			return
+		}
+		if req.RequestType == prot.MreqtRemove {
+			delete(e.devices, mountPath)
+		} else {
+			e.devices[mountPath] = DeviceIdentity(s)
+		}
+	case *prot.CombinedLayersV2:
+		if req.RequestType == prot.MreqtRemove {
+			delete(e.roots, s.ContainerRootPath)
+			return
+		}
+		layers := make([]string, len(s.Layers))
+		for i, l := range s.Layers {
+			layers[i] = e.devices[l.Path]
+		}
+		e.roots[s.ContainerRootPath] = layers
+	}
+}
+
+// anyLayersLocked returns `true` if any container of the policy runs on
+// `layers`. `e.mu` must be held.
+func (e *Enforcer) anyLayersLocked(layers []string) bool {
+	for _, c := range e.policy.Containers {
+		if equal(c.Layers, layers) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnforceCreateContainer enforces the policy on the creation of container
+// `id` from `spec`, with the security defaults of the GCS applied. Whether the
+// container is privileged is derived from the capabilities, namespaces,
+// devices and seccomp profile of `spec`.
+func (e *Enforcer) EnforceCreateContainer(ctx context.Context, id string, spec *oci.Spec) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.policy.AllowAll {
+		return nil
+	}
+	var args, env []string
+	if spec.Process != nil {
+		args, env = spec.Process.Args, spec.Process.Env
+	}
+	var layers []string
+	if spec.Root != nil {
+		layers = e.roots[spec.Root.Path]
+	}
+	fields := logrus.Fields{"cid": id, "args": args, "layers": layers}
+
+	// Hooks run in the UVM and namespace paths join namespaces of the UVM, so
+	// no policy container allows them.
+	if spec.Hooks != nil && (len(spec.Hooks.Prestart) != 0 || len(spec.Hooks.Poststart) != 0 || len(spec.Hooks.Poststop) != 0) {
+		return deny(ctx, "CreateContainer", fields, "hooks are not allowed")
+	}
+	if spec.Linux != nil {
+		for _, ns := range spec.Linux.Namespaces {
+			if ns.Path != "" {
+				return deny(ctx, "CreateContainer", fields, "joining the %s namespace at %q is not allowed", ns.Type, ns.Path)
+			}
+		}
+	}
+	privileged := privilegedReason(spec)
+
+	// Report why the closest container did not match.
+	reason := errors.Errorf("no container runs on layers %v", layers)
+	var matched []*Container
+	for _, c := range e.policy.Containers {
+		if !equal(c.Layers, layers) {
+			continue
+		}
+		if err := c.match(args, env, spec.Mounts, privileged); err != nil {
+			reason = err
+			continue
+		}
+		matched = append(matched, c)
+	}
+	if len(matched) == 0 {
+		return deny(ctx, "CreateContainer", fields, "%v", reason)
+	}
+	e.containers[id] = matched
+	return nil
+}
+
+// privilegedReason returns why `spec` runs with more privileges than the
+// defaults, or nil if it does not.
+func privilegedReason(spec *oci.Spec) error {
+	if spec.Process == nil || spec.Process.Capabilities == nil {
+		return errors.New("container keeps every capability")
+	}
+	has := make(map[string]bool, len(DefaultCapabilities))
+	for _, c := range DefaultCapabilities {
+		has[c] = true
+	}
+	caps := spec.Process.Capabilities
+	for _, set := range [][]string{caps.Bounding, caps.Effective, caps.Inheritable, caps.Permitted, caps.Ambient} {
+		for _, c := range set {
+			if !has[c] {
+				return errors.Errorf("capability %s is not a default capability", c)
+			}
+		}
+	}
+	if spec.Linux == nil {
+		return errors.New("container shares every namespace of the UVM")
+	}
+	for _, t := range isolatedNamespaces {
+		found := false
+		for _, ns := range spec.Linux.Namespaces {
+			if ns.Type == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("container shares the %s namespace of the UVM", t)
+		}
+	}
+	if len(spec.Linux.Devices) != 0 {
+		return errors.Errorf("container has device %s of the UVM", spec.Linux.Devices[0].Path)
+	}
+	if spec.Linux.Seccomp == nil || spec.Linux.Seccomp.DefaultAction == oci.ActAllow {
+		return errors.New("container has no seccomp profile that denies syscalls by default")
+	}
+	return nil
+}
+
+// match returns an error if a container with the init process `args` and
+// `env` and the mounts `mounts` does not match `c`. `privileged` is why the
+// container is privileged, or nil if it is not.
+func (c *Container) match(args, env []string, mounts []oci.Mount, privileged error) error {
+	if !equal(c.Command, args) {
+		return errors.Errorf("command %v is not allowed", args)
+	}
+	if v, ok := c.envRules.matchAll(env); !ok {
+		return errors.Errorf("environment variable %q is not allowed", v)
+	}
+	for _, m := range mounts {
+		if !isBindMount(m) {
+			continue
+		}
+		if !c.allowsMount(m) {
+			return errors.Errorf("mount of %q at %q is not allowed", m.Source, m.Destination)
+		}
+	}
+	if privileged != nil && !c.AllowPrivileged {
+		return errors.Wrap(privileged, "privileged container is not allowed")
+	}
+	return nil
+}
+
+func (c *Container) allowsMount(m oci.Mount) bool {
+	for _, pm := range c.Mounts {
+		if pm.source.MatchString(m.Source) && pm.destination.MatchString(m.Destination) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBindMount returns `true` if `m` exposes a path of the UVM to the
+// container.
+func isBindMount(m oci.Mount) bool {
+	if m.Type == "bind" {
+		return true
+	}
+	for _, o := range m.Options {
+		if o == "bind" || o == "rbind" {
+			return true
+		}
+	}
+	return false
+}
+
+// EnforceExecProcess enforces the policy on the execution of `process` in
+// container `id`.
+func (e *Enforcer) EnforceExecProcess(ctx context.Context, id string, process *oci.Process) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.policy.AllowAll {
+		return nil
+	}
+	fields := logrus.Fields{"cid": id, "args": process.Args}
+	for _, c := range e.containers[id] {
+		if matchProcess(c.ExecProcesses, process.Args, process.Env) {
+			return nil
+		}
+	}
+	return deny(ctx, "ExecProcess", fields, "process %v is not allowed in container %s", process.Args, id)
+}
+
+// EnforceExternalProcess enforces the policy on running the process `args`
+// with the environment `env` in the UVM.
+func (e *Enforcer) EnforceExternalProcess(ctx context.Context, args, env []string) error {
+	if e.policy.AllowAll {
+		return nil
+	}
+	if matchProcess(e.policy.ExternalProcesses, args, env) {
+		return nil
+	}
+	return deny(ctx, "RunExternalProcess", logrus.Fields{"args": args},
+		"external process %v is not allowed", args)
+}
+
+// matchProcess returns `true` if the process `args` with the environment `env`
+// matches any of `processes`.
+func matchProcess(processes []*Process, args, env []string) bool {
+	for _, p := range processes {
+		if !equal(p.Command, args) {
+			continue
+		}
+		if _, ok := p.envRules.matchAll(env); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveContainer forgets container `id` once it is deleted.
+func (e *Enforcer) RemoveContainer(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.containers, id)
+}
+
+// enforcerState is the persisted state of an `Enforcer`. The policy containers
+// each container matched are stored by index in the policy they were matched
+// with.
+type enforcerState struct {
+	PolicyDigest string
+	Devices      map[string]string
+	Roots        map[string][]string
+	Containers   map[string][]int
+}
+
+// MarshalState returns the state of `e`, which `UnmarshalState` restores in an
+// `Enforcer` of the same policy after the GCS restarts.
+func (e *Enforcer) MarshalState() ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	state := enforcerState{
+		PolicyDigest: e.policy.digest,
+		Devices:      e.devices,
+		Roots:        e.roots,
+		Containers:   make(map[string][]int, len(e.containers)),
+	}
+	for id, matched := range e.containers {
+		for _, c := range matched {
+			for i, pc := range e.policy.Containers {
+				if pc == c {
+					state.Containers[id] = append(state.Containers[id], i)
+				}
+			}
+		}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal security policy state")
+	}
+	return data, nil
+}
+
+// UnmarshalState restores the state returned by `MarshalState`. It fails if
+// the state was produced with another policy, since the devices and
+// containers it allowed may not be allowed by the policy of `e`.
+func (e *Enforcer) UnmarshalState(data []byte) error {
+	var state enforcerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.Wrap(err, "failed to unmarshal security policy state")
+	}
+	if state.PolicyDigest != e.policy.digest {
+		return errors.New("security policy state was persisted with another policy")
+	}
+	containers := make(map[string][]*Container, len(state.Containers))
+	for id, indexes := range state.Containers {
+		for _, i := range indexes {
+			if i < 0 || i >= len(e.policy.Containers) {
+				return errors.Errorf("security policy state of container %s has invalid policy container %d", id, i)
+			}
+			containers[id] = append(containers[id], e.policy.Containers[i])
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if state.Devices != nil {
+		e.devices = state.Devices
+	}
+	if state.Roots != nil {
+		e.roots = state.Roots
+	}
+	e.containers = containers
+	return nil
+}
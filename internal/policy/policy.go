@@ -0,0 +1,192 @@
+// Package policy enforces a security policy document on the requests of a host
+// that is not fully trusted. The policy lists the containers that may run in
+// the UVM, the layers they run on, the processes that may be executed in them
+// and the processes that may run in the UVM itself.
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Policy is the security policy document.
+type Policy struct {
+	// AllowAll disables the policy, every request is allowed.
+	AllowAll bool `json:",omitempty"`
+	// Containers are the containers that may be created. A container is
+	// allowed if it matches any of them.
+	Containers []*Container `json:",omitempty"`
+	// ExternalProcesses are the processes that may run in the UVM outside of
+	// any container.
+	ExternalProcesses []*Process `json:",omitempty"`
+
+	// digest is the SHA-256 digest of the policy document, which the persisted
+	// state of an `Enforcer` must have been produced with.
+	digest string
+}
+
+// Container is a container allowed by the policy.
+type Container struct {
+	// Layers are the identities of the layer devices of the container root
+	// filesystem in the order of `CombinedLayersV2.Layers`, as returned by
+	// `DeviceIdentity`. A container with no layers only matches a root
+	// filesystem that was not combined from layer devices.
+	Layers []string `json:",omitempty"`
+	// Command is the exact command line of the init process.
+	Command []string
+	// EnvRules are the regular expressions every "NAME=value" environment
+	// variable of the init process must match one of.
+	EnvRules []string `json:",omitempty"`
+	// Mounts are the bind mounts the container may have. Mounts of other types
+	// do not expose files of the UVM and are always allowed.
+	Mounts []*Mount `json:",omitempty"`
+	// AllowPrivileged allows the container to run with more privileges than
+	// the defaults of the GCS: with capabilities outside of
+	// `DefaultCapabilities`, in a namespace of the UVM, with devices of the
+	// UVM or without a seccomp profile that denies syscalls by default.
+	AllowPrivileged bool `json:",omitempty"`
+	// ExecProcesses are the processes that may be executed in the container.
+	ExecProcesses []*Process `json:",omitempty"`
+
+	envRules rules
+}
+
+// Mount is a bind mount allowed by the policy.
+type Mount struct {
+	// Source is the regular expression the source of the mount must match.
+	Source string
+	// Destination is the regular expression the destination of the mount
+	// must match.
+	Destination string
+
+	source      *regexp.Regexp
+	destination *regexp.Regexp
+}
+
+// Process is a process allowed by the policy.
+type Process struct {
+	// Command is the exact command line of the process.
+	Command []string
+	// EnvRules are the regular expressions every "NAME=value" environment
+	// variable of the process must match one of.
+	EnvRules []string `json:",omitempty"`
+
+	envRules rules
+}
+
+// Parse parses the JSON policy document `data`.
+func Parse(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errors.Wrap(err, "failed to parse security policy")
+	}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	p.digest = hex.EncodeToString(digest[:])
+	return p, nil
+}
+
+// Load parses the JSON policy document in the file at `path`.
+func Load(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read security policy")
+	}
+	return Parse(data)
+}
+
+// compile compiles the regular expressions of `p`.
+func (p *Policy) compile() (err error) {
+	for _, c := range p.Containers {
+		for _, l := range c.Layers {
+			if !strings.HasPrefix(l, verityIdentityPrefix) {
+				return errors.Errorf("invalid security policy layer %q: layers must be identified by their verity information", l)
+			}
+		}
+		if c.envRules, err = compileRules(c.EnvRules); err != nil {
+			return err
+		}
+		for _, m := range c.Mounts {
+			if m.source, err = compileRule(m.Source); err != nil {
+				return err
+			}
+			if m.destination, err = compileRule(m.Destination); err != nil {
+				return err
+			}
+		}
+		for _, ep := range c.ExecProcesses {
+			if ep.envRules, err = compileRules(ep.EnvRules); err != nil {
+				return err
+			}
+		}
+	}
+	for _, ep := range p.ExternalProcesses {
+		if ep.envRules, err = compileRules(ep.EnvRules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rules are regular expressions of which a value must match at least one.
+type rules []*regexp.Regexp
+
+// compileRule compiles `rule` so that it must match a whole value.
+func compileRule(rule string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + rule + ")$")
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid security policy rule %q", rule)
+	}
+	return re, nil
+}
+
+func compileRules(rs []string) (rules, error) {
+	compiled := make(rules, len(rs))
+	for i, r := range rs {
+		re, err := compileRule(r)
+		if err != nil {
+			return nil, err
+		}
+		compiled[i] = re
+	}
+	return compiled, nil
+}
+
+// matchAll returns the first of `values` that matches none of `r`, or `""` and
+// `true` if all of them match.
+func (r rules) matchAll(values []string) (string, bool) {
+	for _, v := range values {
+		matched := false
+		for _, re := range r {
+			if re.MatchString(v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return v, false
+		}
+	}
+	return "", true
+}
+
+// equal returns `true` if `a` and `b` have the same strings in the same order.
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
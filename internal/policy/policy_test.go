@@ -0,0 +1,387 @@
+package policy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const testPolicy = `{
+	"Containers": [
+		{
+			"Layers": ["verity:1:sha256:4096:65536:0:ab:0000", "verity:1:sha256:4096:65536:0:ab:0001"],
+			"Command": ["/bin/app", "-v"],
+			"EnvRules": ["PATH=.*", "MODE=(fast|slow)"],
+			"Mounts": [{"Source": "sandbox://data/.*", "Destination": "/data"}],
+			"ExecProcesses": [{"Command": ["/bin/sh"], "EnvRules": ["TERM=xterm"]}]
+		}
+	],
+	"ExternalProcesses": [{"Command": ["ls", "-l"]}]
+}`
+
+// testVerityInfo returns the verity information of a test layer with the root
+// digest `digest`.
+func testVerityInfo(digest string) *prot.DeviceVerityInfo {
+	return &prot.DeviceVerityInfo{
+		Ext4SizeInBytes: 65536,
+		Version:         1,
+		Algorithm:       "sha256",
+		RootDigest:      digest,
+		Salt:            "ab",
+		BlockSize:       4096,
+	}
+}
+
+func newTestEnforcer(t *testing.T) *Enforcer {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	return NewEnforcer(p)
+}
+
+func assertDenied(t *testing.T, err error) {
+	t.Helper()
+	if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrErrAccessDisabledByPolicy {
+		t.Fatalf("expected %v got: %v", gcserr.HrErrAccessDisabledByPolicy, err)
+	}
+}
+
+func modify(rt prot.ModifyRequestType, settings interface{}) *prot.ModifySettingRequest {
+	return &prot.ModifySettingRequest{RequestType: rt, Settings: settings}
+}
+
+// enforceAndRecord enforces `e` on `req` and records it as if it succeeded.
+func enforceAndRecord(e *Enforcer, req *prot.ModifySettingRequest) error {
+	if err := e.EnforceModifySettings(context.Background(), req); err != nil {
+		return err
+	}
+	e.RecordModifySettings(req)
+	return nil
+}
+
+// mapLayers maps the test policy layers at /l0 and /l1.
+func mapLayers(t *testing.T, e *Enforcer) {
+	l0 := &prot.MappedVPMemDeviceV2{DeviceNumber: 0, MountPath: "/l0", VerityInfo: testVerityInfo("0000")}
+	if err := enforceAndRecord(e, modify(prot.MreqtAdd, l0)); err != nil {
+		t.Fatalf("expected vpmem mount to be allowed got: %v", err)
+	}
+	l1 := &prot.MappedVirtualDiskV2{Controller: 0, Lun: 1, MountPath: "/l1", VerityInfo: testVerityInfo("0001")}
+	if err := enforceAndRecord(e, modify(prot.MreqtAdd, l1)); err != nil {
+		t.Fatalf("expected scsi mount to be allowed got: %v", err)
+	}
+}
+
+// combineLayers maps the test policy layers and combines them at `root`.
+func combineLayers(t *testing.T, e *Enforcer, root string) {
+	mapLayers(t, e)
+	cl := &prot.CombinedLayersV2{
+		Layers:            []prot.Layer{{Path: "/l0"}, {Path: "/l1"}},
+		ContainerRootPath: root,
+	}
+	if err := enforceAndRecord(e, modify(prot.MreqtAdd, cl)); err != nil {
+		t.Fatalf("expected combined layers to be allowed got: %v", err)
+	}
+}
+
+func testSpec(root string) *oci.Spec {
+	return &oci.Spec{
+		Root: &oci.Root{Path: root},
+		Process: &oci.Process{
+			Args: []string{"/bin/app", "-v"},
+			Env:  []string{"PATH=/bin", "MODE=fast"},
+			Capabilities: &oci.LinuxCapabilities{
+				Bounding:  DefaultCapabilities,
+				Effective: DefaultCapabilities,
+			},
+		},
+		Mounts: []oci.Mount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/data", Type: "bind", Source: "sandbox://data/x"},
+		},
+		Linux: &oci.Linux{
+			Namespaces: []oci.LinuxNamespace{
+				{Type: oci.PIDNamespace},
+				{Type: oci.NetworkNamespace},
+				{Type: oci.IPCNamespace},
+				{Type: oci.UTSNamespace},
+				{Type: oci.MountNamespace},
+			},
+			Seccomp: &oci.LinuxSeccomp{DefaultAction: oci.ActErrno},
+		},
+	}
+}
+
+func Test_Parse_InvalidRule(t *testing.T) {
+	if _, err := Parse([]byte(`{"Containers": [{"EnvRules": ["("]}]}`)); err == nil {
+		t.Fatal("expected invalid rule to fail")
+	}
+}
+
+func Test_Parse_LayerWithoutVerity(t *testing.T) {
+	if _, err := Parse([]byte(`{"Containers": [{"Layers": ["scsi:0:1"]}]}`)); err == nil {
+		t.Fatal("expected a layer not identified by its verity information to fail")
+	}
+}
+
+func Test_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(path, []byte(testPolicy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(path)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if len(p.Containers) != 1 || len(p.ExternalProcesses) != 1 {
+		t.Fatalf("unexpected policy: %+v", p)
+	}
+}
+
+func Test_AllowAll(t *testing.T) {
+	e := AllowAll()
+	ctx := context.Background()
+	if err := e.EnforceModifySettings(ctx, modify(prot.MreqtAdd, &prot.CombinedLayersV2{Layers: []prot.Layer{{Path: "/x"}}})); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if err := e.EnforceCreateContainer(ctx, "c1", &oci.Spec{}); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if err := e.EnforceExecProcess(ctx, "c1", &oci.Process{Args: []string{"x"}}); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if err := e.EnforceExternalProcess(ctx, []string{"x"}, nil); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+}
+
+func Test_EnforceModifySettings_Layers(t *testing.T) {
+	e := newTestEnforcer(t)
+	combineLayers(t, e, "/c1")
+
+	// The layers in another order are not allowed.
+	cl := &prot.CombinedLayersV2{
+		Layers:            []prot.Layer{{Path: "/l1"}, {Path: "/l0"}},
+		ContainerRootPath: "/c2",
+	}
+	assertDenied(t, enforceAndRecord(e, modify(prot.MreqtAdd, cl)))
+
+	// A layer that is not a mapped device is not allowed.
+	cl = &prot.CombinedLayersV2{
+		Layers:            []prot.Layer{{Path: "/l0"}, {Path: "/other"}},
+		ContainerRootPath: "/c2",
+	}
+	assertDenied(t, enforceAndRecord(e, modify(prot.MreqtAdd, cl)))
+
+	// A removed device is forgotten.
+	if err := enforceAndRecord(e, modify(prot.MreqtRemove, &prot.MappedVirtualDiskV2{Controller: 0, Lun: 1, MountPath: "/l1"})); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	cl = &prot.CombinedLayersV2{
+		Layers:            []prot.Layer{{Path: "/l0"}, {Path: "/l1"}},
+		ContainerRootPath: "/c2",
+	}
+	assertDenied(t, enforceAndRecord(e, modify(prot.MreqtAdd, cl)))
+}
+
+func Test_EnforceModifySettings_LayerWithoutVerity(t *testing.T) {
+	e := newTestEnforcer(t)
+	mapLayers(t, e)
+	// The device at /l1 is replaced by one without verity information.
+	if err := enforceAndRecord(e, modify(prot.MreqtAdd, &prot.MappedVirtualDiskV2{Controller: 0, Lun: 1, MountPath: "/l1"})); err != nil {
+		t.Fatalf("expected scsi mount to be allowed got: %v", err)
+	}
+	cl := &prot.CombinedLayersV2{
+		Layers:            []prot.Layer{{Path: "/l0"}, {Path: "/l1"}},
+		ContainerRootPath: "/c1",
+	}
+	assertDenied(t, enforceAndRecord(e, modify(prot.MreqtAdd, cl)))
+}
+
+func Test_EnforceModifySettings_RecordsOnlyOnSuccess(t *testing.T) {
+	e := newTestEnforcer(t)
+	ctx := context.Background()
+	l0 := &prot.MappedVPMemDeviceV2{DeviceNumber: 0, MountPath: "/l0", VerityInfo: testVerityInfo("0000")}
+	if err := enforceAndRecord(e, modify(prot.MreqtAdd, l0)); err != nil {
+		t.Fatalf("expected vpmem mount to be allowed got: %v", err)
+	}
+	// The mount of /l1 failed so it was never recorded.
+	l1 := &prot.MappedVirtualDiskV2{Controller: 0, Lun: 1, MountPath: "/l1", VerityInfo: testVerityInfo("0001")}
+	if err := e.EnforceModifySettings(ctx, modify(prot.MreqtAdd, l1)); err != nil {
+		t.Fatalf("expected scsi mount to be allowed got: %v", err)
+	}
+	cl := &prot.CombinedLayersV2{
+		Layers:            []prot.Layer{{Path: "/l0"}, {Path: "/l1"}},
+		ContainerRootPath: "/c1",
+	}
+	assertDenied(t, e.EnforceModifySettings(ctx, modify(prot.MreqtAdd, cl)))
+}
+
+func Test_EnforceCreateContainer(t *testing.T) {
+	e := newTestEnforcer(t)
+	combineLayers(t, e, "/c1")
+	if err := e.EnforceCreateContainer(context.Background(), "c1", testSpec("/c1")); err != nil {
+		t.Fatalf("expected container to be allowed got: %v", err)
+	}
+}
+
+func Test_EnforceCreateContainer_Denied(t *testing.T) {
+	e := newTestEnforcer(t)
+	combineLayers(t, e, "/c1")
+	ctx := context.Background()
+
+	tests := map[string]func(*oci.Spec){
+		"root":    func(s *oci.Spec) { s.Root.Path = "/other" },
+		"command": func(s *oci.Spec) { s.Process.Args = []string{"/bin/sh"} },
+		"env":     func(s *oci.Spec) { s.Process.Env = append(s.Process.Env, "MODE=debug") },
+		"mount": func(s *oci.Spec) {
+			s.Mounts = append(s.Mounts, oci.Mount{Destination: "/data", Source: "/etc", Options: []string{"rbind"}})
+		},
+		"hook": func(s *oci.Spec) {
+			s.Hooks = &oci.Hooks{Prestart: []oci.Hook{{Path: "/bin/sh"}}}
+		},
+		"namespace path": func(s *oci.Spec) {
+			s.Linux.Namespaces[0].Path = "/proc/1/ns/pid"
+		},
+		"every capability": func(s *oci.Spec) { s.Process.Capabilities = nil },
+		"capability": func(s *oci.Spec) {
+			s.Process.Capabilities.Effective = append(s.Process.Capabilities.Effective, "CAP_SYS_ADMIN")
+		},
+		"shared namespace": func(s *oci.Spec) { s.Linux.Namespaces = s.Linux.Namespaces[1:] },
+		"device": func(s *oci.Spec) {
+			s.Linux.Devices = []oci.LinuxDevice{{Path: "/dev/sda", Type: "b"}}
+		},
+		"no seccomp":    func(s *oci.Spec) { s.Linux.Seccomp = nil },
+		"allow seccomp": func(s *oci.Spec) { s.Linux.Seccomp.DefaultAction = oci.ActAllow },
+	}
+	for name, mutate := range tests {
+		spec := testSpec("/c1")
+		mutate(spec)
+		t.Run(name, func(t *testing.T) {
+			assertDenied(t, e.EnforceCreateContainer(ctx, "c1", spec))
+		})
+	}
+}
+
+func Test_EnforceCreateContainer_AllowPrivileged(t *testing.T) {
+	p, err := Parse([]byte(`{"Containers": [{"Command": ["/bin/app"], "AllowPrivileged": true}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEnforcer(p)
+	spec := &oci.Spec{Process: &oci.Process{Args: []string{"/bin/app"}}}
+	if err := e.EnforceCreateContainer(context.Background(), "c1", spec); err != nil {
+		t.Fatalf("expected privileged container to be allowed got: %v", err)
+	}
+	spec.Hooks = &oci.Hooks{Poststart: []oci.Hook{{Path: "/bin/sh"}}}
+	assertDenied(t, e.EnforceCreateContainer(context.Background(), "c1", spec))
+}
+
+func Test_EnforceExecProcess(t *testing.T) {
+	e := newTestEnforcer(t)
+	combineLayers(t, e, "/c1")
+	ctx := context.Background()
+	if err := e.EnforceCreateContainer(ctx, "c1", testSpec("/c1")); err != nil {
+		t.Fatalf("expected container to be allowed got: %v", err)
+	}
+
+	if err := e.EnforceExecProcess(ctx, "c1", &oci.Process{Args: []string{"/bin/sh"}, Env: []string{"TERM=xterm"}}); err != nil {
+		t.Fatalf("expected exec to be allowed got: %v", err)
+	}
+	assertDenied(t, e.EnforceExecProcess(ctx, "c1", &oci.Process{Args: []string{"/bin/bash"}}))
+	assertDenied(t, e.EnforceExecProcess(ctx, "c1", &oci.Process{Args: []string{"/bin/sh"}, Env: []string{"LD_PRELOAD=x"}}))
+
+	// A container the policy does not know of runs no process.
+	e.RemoveContainer("c1")
+	assertDenied(t, e.EnforceExecProcess(ctx, "c1", &oci.Process{Args: []string{"/bin/sh"}}))
+}
+
+func Test_EnforceExternalProcess(t *testing.T) {
+	e := newTestEnforcer(t)
+	ctx := context.Background()
+	if err := e.EnforceExternalProcess(ctx, []string{"ls", "-l"}, nil); err != nil {
+		t.Fatalf("expected external process to be allowed got: %v", err)
+	}
+	assertDenied(t, e.EnforceExternalProcess(ctx, []string{"ls"}, nil))
+	assertDenied(t, e.EnforceExternalProcess(ctx, []string{"ls", "-l"}, []string{"PATH=/bin"}))
+}
+
+func Test_DeviceIdentity(t *testing.T) {
+	const expected = "verity:1:sha256:4096:65536:0:ab:abcd"
+	if id := DeviceIdentity(&prot.MappedVirtualDiskV2{Controller: 1, Lun: 2}); id != "" {
+		t.Fatalf("expected no identity without verity info got: %q", id)
+	}
+	if id := DeviceIdentity(&prot.MappedVPMemDeviceV2{DeviceNumber: 3, VerityInfo: testVerityInfo("abcd")}); id != expected {
+		t.Fatalf("expected identity %q got: %q", expected, id)
+	}
+
+	// The default algorithm and the case of the hex values do not change the
+	// identity.
+	info := testVerityInfo("ABCD")
+	info.Algorithm = ""
+	info.Salt = "AB"
+	if id := DeviceIdentity(&prot.MappedVirtualDiskV2{VerityInfo: info}); id != expected {
+		t.Fatalf("expected identity %q got: %q", expected, id)
+	}
+
+	// Every other parameter does.
+	tests := map[string]func(*prot.DeviceVerityInfo){
+		"version":    func(i *prot.DeviceVerityInfo) { i.Version = 0 },
+		"algorithm":  func(i *prot.DeviceVerityInfo) { i.Algorithm = "sha512" },
+		"block size": func(i *prot.DeviceVerityInfo) { i.BlockSize = 512 },
+		"ext4 size":  func(i *prot.DeviceVerityInfo) { i.Ext4SizeInBytes = 8192 },
+		"superblock": func(i *prot.DeviceVerityInfo) { i.SuperBlock = true },
+		"salt":       func(i *prot.DeviceVerityInfo) { i.Salt = "" },
+	}
+	for name, mutate := range tests {
+		info := testVerityInfo("abcd")
+		mutate(info)
+		if id := DeviceIdentity(&prot.MappedVirtualDiskV2{VerityInfo: info}); id == expected {
+			t.Fatalf("expected the %s to change the identity", name)
+		}
+	}
+}
+
+func Test_Enforcer_State(t *testing.T) {
+	e := newTestEnforcer(t)
+	combineLayers(t, e, "/c1")
+	ctx := context.Background()
+	if err := e.EnforceCreateContainer(ctx, "c1", testSpec("/c1")); err != nil {
+		t.Fatalf("expected container to be allowed got: %v", err)
+	}
+	data, err := e.MarshalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestEnforcer(t)
+	if err := restored.UnmarshalState(data); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if err := restored.EnforceExecProcess(ctx, "c1", &oci.Process{Args: []string{"/bin/sh"}}); err != nil {
+		t.Fatalf("expected exec in the restored container to be allowed got: %v", err)
+	}
+	if err := restored.EnforceCreateContainer(ctx, "c2", testSpec("/c1")); err != nil {
+		t.Fatalf("expected container on the restored root to be allowed got: %v", err)
+	}
+
+	// The state of another policy is not restored.
+	other, err := Parse([]byte(`{"Containers": [{"Command": ["/bin/sh"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewEnforcer(other).UnmarshalState(data); err == nil {
+		t.Fatal("expected state of another policy to fail")
+	}
+}
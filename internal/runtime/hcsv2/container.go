@@ -6,7 +6,9 @@ import (
 	"context"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/Microsoft/opengcs/internal/cgroupv2"
 	"github.com/Microsoft/opengcs/internal/log"
 	"github.com/Microsoft/opengcs/internal/storage"
 	"github.com/Microsoft/opengcs/service/gcs/gcserr"
@@ -27,23 +29,38 @@ type Container struct {
 
 	spec      *oci.Spec
 	isSandbox bool
+	// restored is true if the init process is already running, because the
+	// container was restored from a checkpoint or recovered after a GCS
+	// restart.
+	restored bool
 
 	container   runtime.Container
 	initProcess *containerProcess
 
-	etL      sync.Mutex
-	exitType prot.NotificationType
+	etL       sync.Mutex
+	exitType  prot.NotificationType
+	oomKilled bool
+
+	oomEvents chan *v1.MemoryStat
 
 	processesMutex sync.Mutex
 	processes      map[uint32]*containerProcess
 }
 
+// ID returns the id of the container.
+func (c *Container) ID() string {
+	return c.id
+}
+
 func (c *Container) Start(ctx context.Context, conSettings stdio.ConnectionSettings) (int, error) {
 	stdioSet, err := stdio.Connect(c.vsock, conSettings)
 	if err != nil {
 		return -1, err
 	}
-	if c.initProcess.spec.Terminal {
+	if c.container.Tty() == nil && c.container.PipeRelay() == nil {
+		// The stdio of a container recovered after a GCS restart is lost.
+		stdioSet.Close()
+	} else if c.initProcess.spec.Terminal {
 		ttyr := c.container.Tty()
 		ttyr.ReplaceConnectionSet(stdioSet)
 		ttyr.Start()
@@ -53,14 +70,19 @@ func (c *Container) Start(ctx context.Context, conSettings stdio.ConnectionSetti
 		pr.CloseUnusedPipes()
 		pr.Start()
 	}
-	err = c.container.Start()
-	if err != nil {
-		stdioSet.Close()
+	if !c.restored {
+		err = c.container.Start()
+		if err != nil {
+			stdioSet.Close()
+		}
 	}
 	return int(c.initProcess.pid), err
 }
 
 func (c *Container) ExecProcess(ctx context.Context, process *oci.Process, conSettings stdio.ConnectionSettings) (int, error) {
+	if err := setExecCapabilities(c.spec, process); err != nil {
+		return -1, err
+	}
 	stdioSet, err := stdio.Connect(c.vsock, conSettings)
 	if err != nil {
 		return -1, err
@@ -125,24 +147,96 @@ func (c *Container) Delete(ctx context.Context) error {
 		if err := storage.UnmountAllInPath(ctx, getSandboxMountsDir(c.id), true); err != nil {
 			log.G(ctx).WithError(err).Error("failed to unmount sandbox mounts")
 		}
+		if err := storage.UnmountPath(ctx, getSandboxShmPath(c.id), true); err != nil {
+			log.G(ctx).WithError(err).Error("failed to unmount sandbox shm")
+		}
+	}
+	if err := c.container.Delete(); err != nil {
+		return err
+	}
+	if c.isSandbox {
+		if err := c.deletePodCgroup(); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to delete pod cgroup")
+		}
+	}
+	return nil
+}
+
+// Pause suspends all processes running in the container.
+func (c *Container) Pause(ctx context.Context) error {
+	return c.container.Pause()
+}
+
+// Resume resumes all processes in the container suspended by `Pause`.
+func (c *Container) Resume(ctx context.Context) error {
+	return c.container.Resume()
+}
+
+// Checkpoint writes the state of the container to the image directory
+// `imagePath` so that it can be restored with `Host.RestoreContainer`, possibly
+// in another UVM.
+func (c *Container) Checkpoint(ctx context.Context, imagePath string, opts runtime.CheckpointOptions) error {
+	if c.initProcess.spec.Terminal {
+		return gcserr.WrapHresult(errors.Errorf("cannot checkpoint container %s with a terminal", c.id), gcserr.HrNotImpl)
 	}
-	return c.container.Delete()
+	if err := c.container.Checkpoint(imagePath, opts); err != nil {
+		return err
+	}
+	if !opts.LeaveRunning {
+		// The checkpoint stopped the container so don't report it as
+		// unexpected.
+		c.etL.Lock()
+		c.exitType = prot.NtGracefulExit
+		c.etL.Unlock()
+	}
+	return nil
 }
 
 func (c *Container) Update(ctx context.Context, resources interface{}) error {
 	return c.container.Update(resources)
 }
 
+// ExitStatus describes how the init process of a container exited.
+type ExitStatus struct {
+	// Type is the exit notification type: graceful or forced if the GCS was
+	// asked to signal the container, unexpected otherwise.
+	Type prot.NotificationType
+	// ExitCode is the exit code of the init process. It is 128+N if the
+	// process was terminated by signal N.
+	ExitCode int
+	// Signal is the signal that terminated the init process, or 0 if it
+	// exited on its own.
+	Signal syscall.Signal
+	// OOMKilled is true if any process in the container was killed by the
+	// kernel OOM killer.
+	OOMKilled bool
+	// ExitTime is the time the init process exited.
+	ExitTime time.Time
+}
+
 // Wait waits for the container's init process to exit.
-func (c *Container) Wait() prot.NotificationType {
+func (c *Container) Wait() ExitStatus {
 	_, span := trace.StartSpan(context.Background(), "opengcs::Container::Wait")
 	defer span.End()
 	span.AddAttributes(trace.StringAttribute("cid", c.id))
 
 	c.initProcess.writersWg.Wait()
 	c.etL.Lock()
-	defer c.etL.Unlock()
-	return c.exitType
+	nt := c.exitType
+	c.etL.Unlock()
+
+	status := ExitStatus{
+		Type:      nt,
+		ExitCode:  c.initProcess.exitCode,
+		Signal:    c.initProcess.exitSignal,
+		OOMKilled: c.OOMKilled(),
+		ExitTime:  c.initProcess.exitTime,
+	}
+	span.AddAttributes(
+		trace.StringAttribute("type", string(status.Type)),
+		trace.Int64Attribute("exitCode", int64(status.ExitCode)),
+		trace.BoolAttribute("oomKilled", status.OOMKilled))
+	return status
 }
 
 // setExitType sets `c.exitType` to the appropriate value based on `signal` if
@@ -158,12 +252,21 @@ func (c *Container) setExitType(signal syscall.Signal) {
 	}
 }
 
-// GetStats returns the cgroup metrics for the container.
+// IsSandbox returns true if the container is the sandbox of a pod.
+func (c *Container) IsSandbox() bool {
+	return c.isSandbox
+}
+
+// GetStats returns the cgroup metrics for the container. It fails on a
+// unified hierarchy, where `GetStatsV2` must be used instead.
 func (c *Container) GetStats(ctx context.Context) (*v1.Metrics, error) {
 	_, span := trace.StartSpan(ctx, "opengcs::Container::GetStats")
 	defer span.End()
 	span.AddAttributes(trace.StringAttribute("cid", c.id))
 
+	if isCgroupV2() {
+		return nil, gcserr.WrapHresult(errors.Errorf("failed to get container stats for %v: v1 metrics are not available on a cgroup v2 hierarchy", c.id), gcserr.HrNotImpl)
+	}
 	cgroupPath := c.spec.Linux.CgroupsPath
 	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(cgroupPath))
 	if err != nil {
@@ -173,6 +276,27 @@ func (c *Container) GetStats(ctx context.Context) (*v1.Metrics, error) {
 	return cg.Stat(cgroups.IgnoreNotExist)
 }
 
+// GetStatsV2 returns the cgroup v2 metrics for the container.
+func (c *Container) GetStatsV2(ctx context.Context) (*prot.MetricsV2, error) {
+	_, span := trace.StartSpan(ctx, "opengcs::Container::GetStatsV2")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("cid", c.id))
+
+	m, err := c.statsV2()
+	if err != nil {
+		return nil, err
+	}
+	return protMetricsV2(m), nil
+}
+
+func (c *Container) statsV2() (*cgroupv2.Metrics, error) {
+	cg, err := cgroupv2.Load(c.spec.Linux.CgroupsPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get container stats for %v", c.id)
+	}
+	return cg.Stat()
+}
+
 func (c *Container) modifyContainerConstraints(ctx context.Context, rt prot.ModifyRequestType, cc *prot.ContainerConstraintsV2) (err error) {
 	return c.Update(ctx, cc.Linux)
 }
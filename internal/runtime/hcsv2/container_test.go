@@ -0,0 +1,29 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+)
+
+func Test_Container_Wait_ExitCode137_NotSignaled(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	c := h.createContainer("c1", "/bin/sh")
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	// An exit code in the signal range does not mean a signal terminated the
+	// process.
+	h.rt.Container("c1").Exit(137)
+	if exitCode := waitProcess(t, c.initProcess); exitCode != 137 {
+		t.Fatalf("expected exit code 137 got: %d", exitCode)
+	}
+	if status := c.Wait(); status.ExitCode != 137 || status.Signal != 0 {
+		t.Fatalf("expected exit code 137 without a signal got: %+v", status)
+	}
+}
@@ -0,0 +1,100 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"github.com/Microsoft/opengcs/internal/cgroupv2"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	v1 "github.com/containerd/cgroups/stats/v1"
+)
+
+// v1Metrics returns the closest v1 equivalent of the cgroup v2 metrics `m`,
+// for the consumers that only understand v1 metrics such as the metrics
+// server and OOM notifications.
+func v1Metrics(m *cgroupv2.Metrics) *v1.Metrics {
+	metrics := &v1.Metrics{}
+	if p := m.Pids; p != nil {
+		metrics.Pids = &v1.PidsStat{Current: p.Current, Limit: p.Limit}
+	}
+	if c := m.CPU; c != nil {
+		metrics.CPU = &v1.CPUStat{
+			Usage: &v1.CPUUsage{
+				Total:  c.UsageUsec * 1000,
+				User:   c.UserUsec * 1000,
+				Kernel: c.SystemUsec * 1000,
+			},
+			Throttling: &v1.Throttle{
+				Periods:          c.NrPeriods,
+				ThrottledPeriods: c.NrThrottled,
+				ThrottledTime:    c.ThrottledUsec * 1000,
+			},
+		}
+	}
+	if mem := m.Memory; mem != nil {
+		usage := &v1.MemoryEntry{Usage: mem.Usage, Limit: mem.UsageLimit}
+		if e := m.MemoryEvents; e != nil {
+			usage.Failcnt = e.Max
+		}
+		metrics.Memory = &v1.MemoryStat{
+			RSS:             mem.Anon,
+			TotalRSS:        mem.Anon,
+			Cache:           mem.File,
+			TotalCache:      mem.File,
+			MappedFile:      mem.FileMapped,
+			TotalMappedFile: mem.FileMapped,
+			Dirty:           mem.FileDirty,
+			TotalDirty:      mem.FileDirty,
+			Writeback:       mem.FileWriteback,
+			TotalWriteback:  mem.FileWriteback,
+			PgFault:         mem.Pgfault,
+			TotalPgFault:    mem.Pgfault,
+			PgMajFault:      mem.Pgmajfault,
+			TotalPgMajFault: mem.Pgmajfault,
+			Usage:           usage,
+			// The v1 swap usage includes memory, the v2 usage does not.
+			Swap: &v1.MemoryEntry{Usage: mem.Usage + mem.SwapUsage},
+		}
+	}
+	if io := m.IO; io != nil {
+		blkio := &v1.BlkIOStat{}
+		for _, e := range io.Usage {
+			blkio.IoServiceBytesRecursive = append(blkio.IoServiceBytesRecursive,
+				&v1.BlkIOEntry{Op: "Read", Major: e.Major, Minor: e.Minor, Value: e.Rbytes},
+				&v1.BlkIOEntry{Op: "Write", Major: e.Major, Minor: e.Minor, Value: e.Wbytes})
+			blkio.IoServicedRecursive = append(blkio.IoServicedRecursive,
+				&v1.BlkIOEntry{Op: "Read", Major: e.Major, Minor: e.Minor, Value: e.Rios},
+				&v1.BlkIOEntry{Op: "Write", Major: e.Major, Minor: e.Minor, Value: e.Wios})
+		}
+		metrics.Blkio = blkio
+	}
+	return metrics
+}
+
+// protMetricsV2 returns the cgroup v2 metrics `m` as they are sent over the
+// bridge.
+func protMetricsV2(m *cgroupv2.Metrics) *prot.MetricsV2 {
+	metrics := &prot.MetricsV2{}
+	if p := m.Pids; p != nil {
+		pids := prot.PidsStatV2(*p)
+		metrics.Pids = &pids
+	}
+	if c := m.CPU; c != nil {
+		cpu := prot.CPUStatV2(*c)
+		metrics.CPU = &cpu
+	}
+	if mem := m.Memory; mem != nil {
+		memory := prot.MemoryStatV2(*mem)
+		metrics.Memory = &memory
+	}
+	if e := m.MemoryEvents; e != nil {
+		events := prot.MemoryEventsV2(*e)
+		metrics.MemoryEvents = &events
+	}
+	if io := m.IO; io != nil {
+		metrics.IO = &prot.IOStatV2{}
+		for _, e := range io.Usage {
+			metrics.IO.Usage = append(metrics.IO.Usage, prot.IOEntryV2(e))
+		}
+	}
+	return metrics
+}
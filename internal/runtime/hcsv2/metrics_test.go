@@ -0,0 +1,60 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"testing"
+
+	"github.com/Microsoft/opengcs/internal/cgroupv2"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+)
+
+func Test_v1Metrics(t *testing.T) {
+	m := v1Metrics(&cgroupv2.Metrics{
+		CPU:          &cgroupv2.CPUStat{UsageUsec: 2, UserUsec: 1, SystemUsec: 1},
+		Memory:       &cgroupv2.MemoryStat{Usage: 100, UsageLimit: 200, SwapUsage: 10, Anon: 60, File: 40},
+		MemoryEvents: &cgroupv2.MemoryEvents{Max: 3},
+		IO:           &cgroupv2.IOStat{Usage: []cgroupv2.IOEntry{{Major: 8, Rbytes: 512, Wbytes: 1024}}},
+	})
+	if m.Pids != nil {
+		t.Errorf("expected no pids stats got: %+v", m.Pids)
+	}
+	if m.CPU.Usage.Total != 2000 || m.CPU.Usage.User != 1000 || m.CPU.Usage.Kernel != 1000 {
+		t.Errorf("expected cpu usage in nanoseconds got: %+v", m.CPU.Usage)
+	}
+	if u := m.Memory.Usage; u.Usage != 100 || u.Limit != 200 || u.Failcnt != 3 {
+		t.Errorf("unexpected memory usage: %+v", u)
+	}
+	if m.Memory.Swap.Usage != 110 {
+		t.Errorf("expected swap usage to include memory got: %d", m.Memory.Swap.Usage)
+	}
+	if m.Memory.TotalRSS != 60 || m.Memory.TotalCache != 40 {
+		t.Errorf("unexpected memory breakdown: rss %d cache %d", m.Memory.TotalRSS, m.Memory.TotalCache)
+	}
+	if n := len(m.Blkio.IoServiceBytesRecursive); n != 2 {
+		t.Fatalf("expected read and write blkio entries got: %d", n)
+	}
+	if e := m.Blkio.IoServiceBytesRecursive[1]; e.Op != "Write" || e.Value != 1024 {
+		t.Errorf("unexpected blkio write entry: %+v", e)
+	}
+}
+
+func Test_protMetricsV2(t *testing.T) {
+	m := protMetricsV2(&cgroupv2.Metrics{
+		Pids:   &cgroupv2.PidsStat{Current: 3, Limit: 10},
+		Memory: &cgroupv2.MemoryStat{Usage: 100, UsageLimit: 200, Pgmajfault: 7},
+		IO:     &cgroupv2.IOStat{Usage: []cgroupv2.IOEntry{{Major: 8, Minor: 16, Wios: 4}}},
+	})
+	if m.CPU != nil || m.MemoryEvents != nil {
+		t.Errorf("expected no cpu or memory events stats got: %+v %+v", m.CPU, m.MemoryEvents)
+	}
+	if *m.Pids != (prot.PidsStatV2{Current: 3, Limit: 10}) {
+		t.Errorf("unexpected pids stats: %+v", m.Pids)
+	}
+	if u := m.Memory; u.Usage != 100 || u.UsageLimit != 200 || u.Pgmajfault != 7 {
+		t.Errorf("unexpected memory stats: %+v", u)
+	}
+	if len(m.IO.Usage) != 1 || m.IO.Usage[0] != (prot.IOEntryV2{Major: 8, Minor: 16, Wios: 4}) {
+		t.Errorf("unexpected io stats: %+v", m.IO.Usage)
+	}
+}
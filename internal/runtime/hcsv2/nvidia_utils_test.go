@@ -0,0 +1,37 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"testing"
+
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_isSeccompConfined(t *testing.T) {
+	specs := map[*oci.Spec]bool{
+		{}:                    false,
+		{Linux: &oci.Linux{}}: false,
+		{Linux: &oci.Linux{Seccomp: &oci.LinuxSeccomp{DefaultAction: oci.ActAllow}}}: false,
+		{Linux: &oci.Linux{Seccomp: defaultSeccompProfile(nil)}}:                     true,
+	}
+	for spec, expected := range specs {
+		if confined := isSeccompConfined(spec); confined != expected {
+			t.Fatalf("expected confined %v for %+v got: %v", expected, spec.Linux, confined)
+		}
+	}
+}
+
+func Test_updateEnvWithNvidiaVariables(t *testing.T) {
+	for _, insecure := range []bool{true, false} {
+		found := false
+		for _, v := range updateEnvWithNvidiaVariables(insecure) {
+			if v == "NVC_INSECURE_MODE=1" {
+				found = true
+			}
+		}
+		if found != insecure {
+			t.Fatalf("expected NVC_INSECURE_MODE set %v got: %v", insecure, found)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Microsoft/opengcs/internal/cgroupv2"
+	"github.com/containerd/cgroups"
+	v1 "github.com/containerd/cgroups/stats/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// oomEventQueueSize is the number of OOM events of a container that can wait to
+// be read from `Container.OOMEvents`. Later events are dropped, the container is
+// still reported as OOM killed.
+const oomEventQueueSize = 16
+
+// Test dependencies
+var (
+	cgroupMemoryRoot = "/sys/fs/cgroup/memory"
+	isCgroupV2       = cgroupv2.IsUnified
+)
+
+// OOMEvents returns a channel that receives the memory stats of the container
+// every time the kernel OOM killer kills one of its processes. The stats are
+// nil if they could not be read. The channel is closed once the container's
+// cgroup is torn down or if OOM events could not be registered for it.
+func (c *Container) OOMEvents() <-chan *v1.MemoryStat {
+	return c.oomEvents
+}
+
+// OOMKilled returns true if any process in the container has been killed by
+// the kernel OOM killer.
+func (c *Container) OOMKilled() bool {
+	c.etL.Lock()
+	oomKilled := c.oomKilled
+	c.etL.Unlock()
+	if oomKilled {
+		return true
+	}
+	// The OOM event may not have been read yet if the OOM kill took down the
+	// init process, so fall back to the kernel's count.
+	n, err := c.oomKillCount()
+	if err != nil {
+		logrus.WithField("cid", c.id).WithError(err).Debug("failed to read container oom kill count")
+		return false
+	}
+	return n > 0
+}
+
+// watchOOMEvents registers an OOM eventfd on the memory cgroup of the
+// container, or watches its memory.events on a unified hierarchy, and forwards
+// its events to `c.oomEvents`. `c.oomEvents` is closed if registration fails.
+func (c *Container) watchOOMEvents() (err error) {
+	defer func() {
+		if err != nil {
+			close(c.oomEvents)
+		}
+	}()
+
+	if isCgroupV2() {
+		cg, err := cgroupv2.Load(c.spec.Linux.CgroupsPath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load cgroup for container %s", c.id)
+		}
+		w, err := cg.WatchMemoryEvents()
+		if err != nil {
+			return errors.Wrapf(err, "failed to watch memory events for container %s", c.id)
+		}
+		// A recovered container may have been OOM killed before.
+		events, err := cg.MemoryEvents()
+		if err != nil {
+			w.Close()
+			return errors.Wrapf(err, "failed to read memory events for container %s", c.id)
+		}
+		go c.readOOMEventsV2(w, events.OomKill, func() (*v1.Metrics, error) {
+			m, err := cg.Stat()
+			if err != nil {
+				return nil, err
+			}
+			return v1Metrics(m), nil
+		})
+		return nil
+	}
+
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(c.spec.Linux.CgroupsPath))
+	if err != nil {
+		return errors.Wrapf(err, "failed to load cgroup for container %s", c.id)
+	}
+	efd, err := cg.OOMEventFD()
+	if err != nil {
+		return errors.Wrapf(err, "failed to register oom eventfd for container %s", c.id)
+	}
+	go c.readOOMEvents(os.NewFile(efd, "oom-"+c.id), func() (*v1.Metrics, error) {
+		return cg.Stat(cgroups.IgnoreNotExist)
+	})
+	return nil
+}
+
+// readOOMEvents reads OOM events from `efdFile` until the container's cgroup
+// is torn down, marking the container as OOM killed and sending the result of
+// `stat` to `c.oomEvents` for each of them.
+func (c *Container) readOOMEvents(efdFile io.ReadCloser, stat func() (*v1.Metrics, error)) {
+	defer close(c.oomEvents)
+	defer efdFile.Close()
+
+	entry := logrus.WithField("cid", c.id)
+	// Buffer must be >= 8 bytes for eventfd reads
+	// http://man7.org/linux/man-pages/man2/eventfd.2.html
+	buf := make([]byte, 8)
+	for {
+		if _, err := efdFile.Read(buf); err != nil {
+			entry.WithError(err).Error("failed to read from container oom eventfd")
+			return
+		}
+
+		// An event is also sent during cgroup teardown. In that case the
+		// cgroup.event_control file won't exist anymore.
+		if _, err := os.Lstat(filepath.Join(cgroupMemoryRoot, c.spec.Linux.CgroupsPath, "cgroup.event_control")); os.IsNotExist(err) {
+			return
+		}
+
+		c.oomKill(stat)
+	}
+}
+
+// readOOMEventsV2 is `readOOMEvents` for a unified hierarchy, where an OOM
+// kill is seen as an increase of the oom_kill counter of memory.events from
+// `oomKills`.
+func (c *Container) readOOMEventsV2(w *cgroupv2.MemoryEventWatcher, oomKills uint64, stat func() (*v1.Metrics, error)) {
+	defer close(c.oomEvents)
+	defer w.Close()
+
+	for {
+		events, err := w.Wait()
+		if err != nil {
+			if err != cgroupv2.ErrDeleted {
+				logrus.WithField("cid", c.id).WithError(err).Error("failed to read container memory events")
+			}
+			return
+		}
+		for ; oomKills < events.OomKill; oomKills++ {
+			c.oomKill(stat)
+		}
+	}
+}
+
+// oomKill marks the container as OOM killed and sends the memory stats
+// returned by `stat` to `c.oomEvents` unless it is full.
+func (c *Container) oomKill(stat func() (*v1.Metrics, error)) {
+	entry := logrus.WithField("cid", c.id)
+
+	c.etL.Lock()
+	c.oomKilled = true
+	c.etL.Unlock()
+
+	var mem *v1.MemoryStat
+	metrics, err := stat()
+	if err != nil {
+		entry.WithError(err).Warn("failed to get container stats after oom kill")
+	} else {
+		mem = metrics.Memory
+	}
+	entry.Warn("container process killed by the oom killer")
+	// Never block the watcher, which would miss the teardown of the cgroup.
+	select {
+	case c.oomEvents <- mem:
+	default:
+		entry.Warn("dropped container oom event, too many events are waiting to be read")
+	}
+}
+
+// oomKillCount returns the number of processes in the container that were
+// killed by the kernel OOM killer as reported by memory.oom_control, or
+// memory.events on a unified hierarchy. Kernels that do not report it return
+// 0.
+func (c *Container) oomKillCount() (uint64, error) {
+	if isCgroupV2() {
+		cg, err := cgroupv2.Load(c.spec.Linux.CgroupsPath)
+		if err != nil {
+			return 0, err
+		}
+		events, err := cg.MemoryEvents()
+		if err != nil {
+			return 0, err
+		}
+		return events.OomKill, nil
+	}
+
+	p := filepath.Join(cgroupMemoryRoot, c.spec.Linux.CgroupsPath, "memory.oom_control")
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to open %s", p)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to parse oom_kill value %q", fields[1])
+			}
+			return n, nil
+		}
+	}
+	return 0, scanner.Err()
+}
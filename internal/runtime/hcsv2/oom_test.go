@@ -0,0 +1,119 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/containerd/cgroups/stats/v1"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// newOOMTestContainer returns a container whose memory cgroup is a temp
+// directory containing cgroup.event_control.
+func newOOMTestContainer(t *testing.T) (*Container, string) {
+	root, err := ioutil.TempDir("", "oom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cgroupMemoryRoot = root
+	isCgroupV2 = func() bool { return false }
+
+	c := &Container{
+		id:        t.Name(),
+		spec:      &oci.Spec{Linux: &oci.Linux{CgroupsPath: "/containers/" + t.Name()}},
+		oomEvents: make(chan *v1.MemoryStat, oomEventQueueSize),
+	}
+	dir := filepath.Join(root, c.spec.Linux.CgroupsPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.event_control"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c, dir
+}
+
+func Test_readOOMEvents(t *testing.T) {
+	defer func(r string) { cgroupMemoryRoot = r }(cgroupMemoryRoot)
+	defer func(f func() bool) { isCgroupV2 = f }(isCgroupV2)
+	c, dir := newOOMTestContainer(t)
+	defer os.RemoveAll(cgroupMemoryRoot)
+
+	r, w := io.Pipe()
+	stat := func() (*v1.Metrics, error) {
+		return &v1.Metrics{Memory: &v1.MemoryStat{Usage: &v1.MemoryEntry{Usage: 10, Limit: 10}}}, nil
+	}
+	go c.readOOMEvents(r, stat)
+
+	if c.OOMKilled() {
+		t.Fatal("expected container to not be oom killed before an event")
+	}
+	go w.Write(make([]byte, 8))
+	mem, ok := <-c.OOMEvents()
+	if !ok {
+		t.Fatal("expected an oom event got closed channel")
+	}
+	if mem == nil || mem.Usage.Limit != 10 {
+		t.Fatalf("expected memory stats in oom event got: %+v", mem)
+	}
+	if !c.OOMKilled() {
+		t.Fatal("expected container to be oom killed")
+	}
+
+	// The teardown event must close the channel without another oom event.
+	if err := os.Remove(filepath.Join(dir, "cgroup.event_control")); err != nil {
+		t.Fatal(err)
+	}
+	go w.Write(make([]byte, 8))
+	if mem, ok := <-c.OOMEvents(); ok {
+		t.Fatalf("expected closed channel after teardown got: %+v", mem)
+	}
+}
+
+func Test_oomKill_QueueFull(t *testing.T) {
+	defer func(r string) { cgroupMemoryRoot = r }(cgroupMemoryRoot)
+	defer func(f func() bool) { isCgroupV2 = f }(isCgroupV2)
+	c, _ := newOOMTestContainer(t)
+	defer os.RemoveAll(cgroupMemoryRoot)
+
+	stat := func() (*v1.Metrics, error) {
+		return &v1.Metrics{Memory: &v1.MemoryStat{}}, nil
+	}
+	// Nothing reads the events, the kills past the queue size are dropped
+	// rather than blocking.
+	for i := 0; i < oomEventQueueSize+1; i++ {
+		c.oomKill(stat)
+	}
+	if len(c.oomEvents) != oomEventQueueSize {
+		t.Fatalf("expected %d queued oom events got: %d", oomEventQueueSize, len(c.oomEvents))
+	}
+	if !c.OOMKilled() {
+		t.Fatal("expected container to be oom killed")
+	}
+}
+
+func Test_OOMKilled_OOMControl(t *testing.T) {
+	defer func(r string) { cgroupMemoryRoot = r }(cgroupMemoryRoot)
+	defer func(f func() bool) { isCgroupV2 = f }(isCgroupV2)
+	c, dir := newOOMTestContainer(t)
+	defer os.RemoveAll(cgroupMemoryRoot)
+
+	oomControl := filepath.Join(dir, "memory.oom_control")
+	if err := ioutil.WriteFile(oomControl, []byte("oom_kill_disable 0\nunder_oom 0\noom_kill 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c.OOMKilled() {
+		t.Fatal("expected container to not be oom killed with oom_kill 0")
+	}
+	if err := ioutil.WriteFile(oomControl, []byte("oom_kill_disable 0\nunder_oom 0\noom_kill 2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !c.OOMKilled() {
+		t.Fatal("expected container to be oom killed with oom_kill 2")
+	}
+}
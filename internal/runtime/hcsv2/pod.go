@@ -0,0 +1,160 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"path"
+
+	"github.com/Microsoft/opengcs/internal/cgroupv2"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/containerd/cgroups"
+	v1 "github.com/containerd/cgroups/stats/v1"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// getPodCgroupPath returns the cgroup of the pod of sandbox `sbid`. The
+// sandbox and each of its workload containers have their own cgroup nested in
+// it, so that the pod can be limited as a whole.
+func getPodCgroupPath(sbid string) string {
+	return path.Join("/containers", sbid)
+}
+
+// getPodContainerCgroupPath returns the cgroup of container `id` in the pod of
+// sandbox `sbid`. The sandbox container is not placed in the pod cgroup itself
+// because a cgroup v2 cgroup cannot hold both processes and child cgroups.
+func getPodContainerCgroupPath(sbid, id string) string {
+	return path.Join(getPodCgroupPath(sbid), id)
+}
+
+// podResources returns the resources of a pod limited to `limits` with
+// `overhead` added to account for the cost of running the pod itself.
+// Unlimited resources stay unlimited.
+func podResources(limits, overhead *oci.LinuxResources) *oci.LinuxResources {
+	r := *limits
+	if limits.Memory != nil {
+		mem := *limits.Memory
+		if overhead.Memory != nil {
+			mem.Limit = addLimit(mem.Limit, overhead.Memory.Limit)
+			mem.Reservation = addLimit(mem.Reservation, overhead.Memory.Reservation)
+		}
+		r.Memory = &mem
+	}
+	if limits.CPU != nil {
+		cpu := *limits.CPU
+		if overhead.CPU != nil {
+			if cpu.Shares != nil && overhead.CPU.Shares != nil {
+				shares := *cpu.Shares + *overhead.CPU.Shares
+				cpu.Shares = &shares
+			}
+			cpu.Quota = addLimit(cpu.Quota, overhead.CPU.Quota)
+		}
+		r.CPU = &cpu
+	}
+	return &r
+}
+
+// addLimit returns the sum of `limit` and `overhead`. A nil or non positive
+// `limit` means there is no limit and is returned as is.
+func addLimit(limit, overhead *int64) *int64 {
+	if limit == nil || *limit <= 0 || overhead == nil || *overhead <= 0 {
+		return limit
+	}
+	sum := *limit + *overhead
+	return &sum
+}
+
+// modifyPodConstraints sets the resource limits of the pod of sandbox
+// container `c`.
+func (c *Container) modifyPodConstraints(ctx context.Context, rt prot.ModifyRequestType, pc *prot.PodConstraintsV2) (err error) {
+	_, span := trace.StartSpan(ctx, "opengcs::Container::modifyPodConstraints")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("cid", c.id))
+
+	if !c.isSandbox {
+		return gcserr.WrapHresult(errors.Errorf("container %s is not a sandbox", c.id), gcserr.HrInvalidArg)
+	}
+	if rt != prot.MreqtUpdate && rt != prot.MreqtAdd {
+		return errors.Errorf("the RequestType \"%s\" is not supported for pod constraints", rt)
+	}
+	resources := podResources(&pc.Linux, &pc.Overhead)
+	p := getPodCgroupPath(c.id)
+	if isCgroupV2() {
+		cg, err := cgroupv2.Load(p)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load pod cgroup of sandbox %s", c.id)
+		}
+		return cg.Update(resources)
+	}
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(p))
+	if err != nil {
+		return errors.Wrapf(err, "failed to load pod cgroup of sandbox %s", c.id)
+	}
+	if err := cg.Update(resources); err != nil {
+		return errors.Wrapf(err, "failed to update pod cgroup of sandbox %s", c.id)
+	}
+	return nil
+}
+
+// deletePodCgroup removes the pod cgroup of sandbox container `c`. It fails
+// if any container of the pod still exists.
+func (c *Container) deletePodCgroup() error {
+	// A pod cgroup that cannot be loaded was never created or is already
+	// deleted.
+	p := getPodCgroupPath(c.id)
+	if isCgroupV2() {
+		cg, err := cgroupv2.Load(p)
+		if err != nil {
+			return nil
+		}
+		return cg.Delete()
+	}
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(p))
+	if err != nil {
+		return nil
+	}
+	if err := cg.Delete(); err != nil {
+		return errors.Wrapf(err, "failed to delete pod cgroup of sandbox %s", c.id)
+	}
+	return nil
+}
+
+// GetPodStats returns the cgroup metrics of the pod of sandbox container `c`,
+// which include every container in the pod.
+func (c *Container) GetPodStats(ctx context.Context) (*v1.Metrics, error) {
+	_, span := trace.StartSpan(ctx, "opengcs::Container::GetPodStats")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("cid", c.id))
+
+	if !c.isSandbox {
+		return nil, gcserr.WrapHresult(errors.Errorf("container %s is not a sandbox", c.id), gcserr.HrInvalidArg)
+	}
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(getPodCgroupPath(c.id)))
+	if err != nil {
+		return nil, errors.Errorf("failed to get pod stats for %v: %v", c.id, err)
+	}
+	return cg.Stat(cgroups.IgnoreNotExist)
+}
+
+// GetPodStatsV2 is `GetPodStats` on a unified hierarchy.
+func (c *Container) GetPodStatsV2(ctx context.Context) (*prot.MetricsV2, error) {
+	_, span := trace.StartSpan(ctx, "opengcs::Container::GetPodStatsV2")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("cid", c.id))
+
+	if !c.isSandbox {
+		return nil, gcserr.WrapHresult(errors.Errorf("container %s is not a sandbox", c.id), gcserr.HrInvalidArg)
+	}
+	cg, err := cgroupv2.Load(getPodCgroupPath(c.id))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pod stats for %v", c.id)
+	}
+	m, err := cg.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return protMetricsV2(m), nil
+}
@@ -0,0 +1,79 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func uint64Ptr(i uint64) *uint64 {
+	return &i
+}
+
+func Test_getPodContainerCgroupPath(t *testing.T) {
+	if p := getPodContainerCgroupPath("sb", "c1"); p != "/containers/sb/c1" {
+		t.Fatalf("expected /containers/sb/c1 got: %s", p)
+	}
+	if p := getPodContainerCgroupPath("sb", "sb"); p != "/containers/sb/sb" {
+		t.Fatalf("expected /containers/sb/sb got: %s", p)
+	}
+}
+
+func Test_podResources(t *testing.T) {
+	limits := &oci.LinuxResources{
+		Memory: &oci.LinuxMemory{Limit: int64Ptr(100)},
+		CPU:    &oci.LinuxCPU{Shares: uint64Ptr(512), Quota: int64Ptr(50000), Period: uint64Ptr(100000)},
+	}
+	overhead := &oci.LinuxResources{
+		Memory: &oci.LinuxMemory{Limit: int64Ptr(10), Reservation: int64Ptr(5)},
+		CPU:    &oci.LinuxCPU{Shares: uint64Ptr(2), Quota: int64Ptr(10000)},
+	}
+	r := podResources(limits, overhead)
+	if *r.Memory.Limit != 110 {
+		t.Errorf("expected memory limit 110 got: %d", *r.Memory.Limit)
+	}
+	if r.Memory.Reservation != nil {
+		t.Errorf("expected no memory reservation got: %d", *r.Memory.Reservation)
+	}
+	if *r.CPU.Shares != 514 || *r.CPU.Quota != 60000 || *r.CPU.Period != 100000 {
+		t.Errorf("unexpected cpu resources: shares %d quota %d period %d", *r.CPU.Shares, *r.CPU.Quota, *r.CPU.Period)
+	}
+	// The limits must not be modified.
+	if *limits.Memory.Limit != 100 || *limits.CPU.Quota != 50000 {
+		t.Errorf("expected limits to be unchanged got: memory %d quota %d", *limits.Memory.Limit, *limits.CPU.Quota)
+	}
+}
+
+func Test_podResources_Unlimited(t *testing.T) {
+	limits := &oci.LinuxResources{
+		Memory: &oci.LinuxMemory{Limit: int64Ptr(-1)},
+	}
+	overhead := &oci.LinuxResources{
+		Memory: &oci.LinuxMemory{Limit: int64Ptr(10)},
+		CPU:    &oci.LinuxCPU{Quota: int64Ptr(10000)},
+	}
+	r := podResources(limits, overhead)
+	if *r.Memory.Limit != -1 {
+		t.Errorf("expected unlimited memory to stay unlimited got: %d", *r.Memory.Limit)
+	}
+	if r.CPU != nil {
+		t.Errorf("expected no cpu limits got: %+v", r.CPU)
+	}
+}
+
+func Test_modifyPodConstraints_NotSandbox(t *testing.T) {
+	c := &Container{id: t.Name()}
+	err := c.modifyPodConstraints(context.Background(), prot.MreqtUpdate, &prot.PodConstraintsV2{})
+	if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrInvalidArg {
+		t.Fatalf("expected HrInvalidArg got: %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os/exec"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Microsoft/opengcs/internal/log"
 	"github.com/Microsoft/opengcs/service/gcs/gcserr"
@@ -50,6 +51,12 @@ type containerProcess struct {
 
 	// This is only valid post the exitWg
 	exitCode int
+	// exitSignal is the signal that terminated the process, or 0 if it exited
+	// on its own. This is only valid post the exitWg
+	exitSignal syscall.Signal
+	// exitTime is the time the process was observed to exit. This is only
+	// valid post the exitWg
+	exitTime time.Time
 	// exitWg is marked as done as soon as the underlying
 	// (runtime.Process).Wait() call returns, and exitCode has been updated.
 	exitWg sync.WaitGroup
@@ -94,6 +101,8 @@ func newProcess(c *Container, spec *oci.Process, process runtime.Process, pid ui
 			log.G(ctx).WithError(err).Error("failed to wait for runc process")
 		}
 		p.exitCode = exitCode
+		p.exitSignal = p.process.ExitSignal()
+		p.exitTime = time.Now()
 		log.G(ctx).WithField("exitCode", p.exitCode).Debug("process exited")
 
 		// Free any process waiters
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/Microsoft/opengcs/internal/network"
@@ -12,10 +13,20 @@ import (
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// annotationShmSizeKB is the size in KB of the `/dev/shm` shared by the
+	// containers of a sandbox.
+	annotationShmSizeKB = "io.microsoft.container.storage.shm.size-kb"
+	// defaultShmSizeKB is the size of `/dev/shm` when the sandbox does not set
+	// `annotationShmSizeKB`, which matches the default of Docker and CRI.
+	defaultShmSizeKB = 64 * 1024
 )
 
 func getSandboxRootDir(id string) string {
-	return filepath.Join("/run/gcs/c", id)
+	return filepath.Join(containersRootDir, id)
 }
 
 func getSandboxMountsDir(id string) string {
@@ -34,6 +45,53 @@ func getSandboxResolvPath(id string) string {
 	return filepath.Join(getSandboxRootDir(id), "resolv.conf")
 }
 
+func getSandboxShmPath(id string) string {
+	return filepath.Join(getSandboxRootDir(id), "shm")
+}
+
+// setupSandboxShm mounts the tmpfs that is bind mounted as `/dev/shm` in every
+// container of sandbox `id`.
+func setupSandboxShm(id string, spec *oci.Spec) error {
+	sizeKB := uint64(defaultShmSizeKB)
+	if v, ok := spec.Annotations[annotationShmSizeKB]; ok {
+		var err error
+		sizeKB, err = strconv.ParseUint(v, 10, 64)
+		if err != nil || sizeKB == 0 {
+			return errors.Errorf("invalid '%s': '%s'", annotationShmSizeKB, v)
+		}
+	}
+	shmPath := getSandboxShmPath(id)
+	if err := os.MkdirAll(shmPath, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create sandbox shm directory %q", shmPath)
+	}
+	flags := uintptr(unix.MS_NOEXEC | unix.MS_NOSUID | unix.MS_NODEV)
+	data := "mode=1777,size=" + strconv.FormatUint(sizeKB, 10) + "k"
+	if err := unix.Mount("shm", shmPath, "tmpfs", flags, data); err != nil {
+		return errors.Wrapf(err, "failed to mount sandbox shm at %q", shmPath)
+	}
+	return nil
+}
+
+// getSandboxPid returns the pid of the init process of sandbox `sb`, whose
+// namespaces the containers of its pod join. It fails once the sandbox has
+// exited because its namespaces are gone and its pid may have been reused.
+func getSandboxPid(sb *Container) (int, error) {
+	state, err := sb.container.GetState()
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to get state of sandbox %s", sb.id)
+	}
+	switch state.Status {
+	case "created", "running", "paused":
+	default:
+		return -1, errors.Errorf("sandbox %s is %s", sb.id, state.Status)
+	}
+	pid := sb.container.Pid()
+	if state.Pid != pid {
+		return -1, errors.Errorf("sandbox %s init process %d has exited", sb.id, pid)
+	}
+	return pid, nil
+}
+
 func setupSandboxContainerSpec(ctx context.Context, id string, spec *oci.Spec) (err error) {
 	ctx, span := trace.StartSpan(ctx, "hcsv2::setupSandboxContainerSpec")
 	defer span.End()
@@ -97,12 +155,14 @@ func setupSandboxContainerSpec(ctx context.Context, id string, spec *oci.Spec) (
 		}
 	}
 
-	// TODO: JTERRY75 /dev/shm is not properly setup for LCOW I believe. CRI
-	// also has a concept of a sandbox/shm file when the IPC NamespaceMode !=
-	// NODE.
+	// Set up the /dev/shm shared with the workload containers
+	if err := setupSandboxShm(id, spec); err != nil {
+		return err
+	}
+	setShmMount(spec, getSandboxShmPath(id))
 
-	// Force the parent cgroup into our /containers root
-	spec.Linux.CgroupsPath = "/containers/" + id
+	// Force the parent cgroup into the pod cgroup under our /containers root
+	spec.Linux.CgroupsPath = getPodContainerCgroupPath(id, id)
 
 	// Clear the windows section as we dont want to forward to runc
 	spec.Windows = nil
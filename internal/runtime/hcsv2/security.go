@@ -0,0 +1,556 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"sort"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/policy"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// annotationPrivileged is set to "true" to run a container with every
+	// host device and without the security defaults.
+	annotationPrivileged = "io.microsoft.virtualmachine.lcow.privileged"
+	// annotationUnconfined is set to "true" to run a container without the
+	// security defaults.
+	annotationUnconfined = "io.microsoft.virtualmachine.lcow.unconfined"
+)
+
+// allowedSyscalls are the syscalls the default seccomp profile allows to every
+// container. They match the default profile of Docker.
+var allowedSyscalls = []string{
+	"accept",
+	"accept4",
+	"access",
+	"adjtimex",
+	"alarm",
+	"arch_prctl",
+	"bind",
+	"brk",
+	"capget",
+	"capset",
+	"chdir",
+	"chmod",
+	"chown",
+	"chown32",
+	"clock_adjtime",
+	"clock_adjtime64",
+	"clock_getres",
+	"clock_getres_time64",
+	"clock_gettime",
+	"clock_gettime64",
+	"clock_nanosleep",
+	"clock_nanosleep_time64",
+	"close",
+	"close_range",
+	"connect",
+	"copy_file_range",
+	"creat",
+	"dup",
+	"dup2",
+	"dup3",
+	"epoll_create",
+	"epoll_create1",
+	"epoll_ctl",
+	"epoll_ctl_old",
+	"epoll_pwait",
+	"epoll_pwait2",
+	"epoll_wait",
+	"epoll_wait_old",
+	"eventfd",
+	"eventfd2",
+	"execve",
+	"execveat",
+	"exit",
+	"exit_group",
+	"faccessat",
+	"faccessat2",
+	"fadvise64",
+	"fadvise64_64",
+	"fallocate",
+	"fanotify_mark",
+	"fchdir",
+	"fchmod",
+	"fchmodat",
+	"fchown",
+	"fchown32",
+	"fchownat",
+	"fcntl",
+	"fcntl64",
+	"fdatasync",
+	"fgetxattr",
+	"flistxattr",
+	"flock",
+	"fork",
+	"fremovexattr",
+	"fsetxattr",
+	"fstat",
+	"fstat64",
+	"fstatat64",
+	"fstatfs",
+	"fstatfs64",
+	"fsync",
+	"ftruncate",
+	"ftruncate64",
+	"futex",
+	"futex_time64",
+	"futimesat",
+	"get_robust_list",
+	"get_thread_area",
+	"getcpu",
+	"getcwd",
+	"getdents",
+	"getdents64",
+	"getegid",
+	"getegid32",
+	"geteuid",
+	"geteuid32",
+	"getgid",
+	"getgid32",
+	"getgroups",
+	"getgroups32",
+	"getitimer",
+	"getpeername",
+	"getpgid",
+	"getpgrp",
+	"getpid",
+	"getppid",
+	"getpriority",
+	"getrandom",
+	"getresgid",
+	"getresgid32",
+	"getresuid",
+	"getresuid32",
+	"getrlimit",
+	"getrusage",
+	"getsid",
+	"getsockname",
+	"getsockopt",
+	"gettid",
+	"gettimeofday",
+	"getuid",
+	"getuid32",
+	"getxattr",
+	"inotify_add_watch",
+	"inotify_init",
+	"inotify_init1",
+	"inotify_rm_watch",
+	"io_cancel",
+	"io_destroy",
+	"io_getevents",
+	"io_pgetevents",
+	"io_pgetevents_time64",
+	"io_setup",
+	"io_submit",
+	"io_uring_enter",
+	"io_uring_register",
+	"io_uring_setup",
+	"ioctl",
+	"ioprio_get",
+	"ioprio_set",
+	"ipc",
+	"kill",
+	"lchown",
+	"lchown32",
+	"lgetxattr",
+	"link",
+	"linkat",
+	"listen",
+	"listxattr",
+	"llistxattr",
+	"_llseek",
+	"lremovexattr",
+	"lseek",
+	"lsetxattr",
+	"lstat",
+	"lstat64",
+	"madvise",
+	"membarrier",
+	"memfd_create",
+	"mincore",
+	"mkdir",
+	"mkdirat",
+	"mknod",
+	"mknodat",
+	"mlock",
+	"mlock2",
+	"mlockall",
+	"mmap",
+	"mmap2",
+	"modify_ldt",
+	"mprotect",
+	"mq_getsetattr",
+	"mq_notify",
+	"mq_open",
+	"mq_timedreceive",
+	"mq_timedreceive_time64",
+	"mq_timedsend",
+	"mq_timedsend_time64",
+	"mq_unlink",
+	"mremap",
+	"msgctl",
+	"msgget",
+	"msgrcv",
+	"msgsnd",
+	"msync",
+	"munlock",
+	"munlockall",
+	"munmap",
+	"nanosleep",
+	"newfstatat",
+	"_newselect",
+	"open",
+	"openat",
+	"openat2",
+	"pause",
+	"pidfd_open",
+	"pidfd_send_signal",
+	"pipe",
+	"pipe2",
+	"poll",
+	"ppoll",
+	"ppoll_time64",
+	"prctl",
+	"pread64",
+	"preadv",
+	"preadv2",
+	"prlimit64",
+	"pselect6",
+	"pselect6_time64",
+	"pwrite64",
+	"pwritev",
+	"pwritev2",
+	"read",
+	"readahead",
+	"readlink",
+	"readlinkat",
+	"readv",
+	"recv",
+	"recvfrom",
+	"recvmmsg",
+	"recvmmsg_time64",
+	"recvmsg",
+	"remap_file_pages",
+	"removexattr",
+	"rename",
+	"renameat",
+	"renameat2",
+	"restart_syscall",
+	"rmdir",
+	"rseq",
+	"rt_sigaction",
+	"rt_sigpending",
+	"rt_sigprocmask",
+	"rt_sigqueueinfo",
+	"rt_sigreturn",
+	"rt_sigsuspend",
+	"rt_sigtimedwait",
+	"rt_sigtimedwait_time64",
+	"rt_tgsigqueueinfo",
+	"sched_get_priority_max",
+	"sched_get_priority_min",
+	"sched_getaffinity",
+	"sched_getattr",
+	"sched_getparam",
+	"sched_getscheduler",
+	"sched_rr_get_interval",
+	"sched_rr_get_interval_time64",
+	"sched_setaffinity",
+	"sched_setattr",
+	"sched_setparam",
+	"sched_setscheduler",
+	"sched_yield",
+	"seccomp",
+	"select",
+	"semctl",
+	"semget",
+	"semop",
+	"semtimedop",
+	"semtimedop_time64",
+	"send",
+	"sendfile",
+	"sendfile64",
+	"sendmmsg",
+	"sendmsg",
+	"sendto",
+	"set_robust_list",
+	"set_thread_area",
+	"set_tid_address",
+	"setfsgid",
+	"setfsgid32",
+	"setfsuid",
+	"setfsuid32",
+	"setgid",
+	"setgid32",
+	"setgroups",
+	"setgroups32",
+	"setitimer",
+	"setpgid",
+	"setpriority",
+	"setregid",
+	"setregid32",
+	"setresgid",
+	"setresgid32",
+	"setresuid",
+	"setresuid32",
+	"setreuid",
+	"setreuid32",
+	"setrlimit",
+	"setsid",
+	"setsockopt",
+	"setuid",
+	"setuid32",
+	"setxattr",
+	"shmat",
+	"shmctl",
+	"shmdt",
+	"shmget",
+	"shutdown",
+	"sigaltstack",
+	"signalfd",
+	"signalfd4",
+	"sigprocmask",
+	"sigreturn",
+	"socket",
+	"socketcall",
+	"socketpair",
+	"splice",
+	"stat",
+	"stat64",
+	"statfs",
+	"statfs64",
+	"statx",
+	"symlink",
+	"symlinkat",
+	"sync",
+	"sync_file_range",
+	"syncfs",
+	"sysinfo",
+	"tee",
+	"tgkill",
+	"time",
+	"timer_create",
+	"timer_delete",
+	"timer_getoverrun",
+	"timer_gettime",
+	"timer_gettime64",
+	"timer_settime",
+	"timer_settime64",
+	"timerfd_create",
+	"timerfd_gettime",
+	"timerfd_gettime64",
+	"timerfd_settime",
+	"timerfd_settime64",
+	"times",
+	"tkill",
+	"truncate",
+	"truncate64",
+	"ugetrlimit",
+	"umask",
+	"uname",
+	"unlink",
+	"unlinkat",
+	"utime",
+	"utimensat",
+	"utimensat_time64",
+	"utimes",
+	"vfork",
+	"vmsplice",
+	"wait4",
+	"waitid",
+	"waitpid",
+	"write",
+	"writev",
+}
+
+// capabilitySyscalls are the syscalls the default seccomp profile allows to a
+// container only if its bounding set has the capability that guards them.
+var capabilitySyscalls = map[string][]string{
+	"CAP_DAC_READ_SEARCH": {"open_by_handle_at"},
+	"CAP_SYS_ADMIN": {
+		"bpf",
+		"clone",
+		"clone3",
+		"fanotify_init",
+		"fsconfig",
+		"fsmount",
+		"fsopen",
+		"fspick",
+		"lookup_dcookie",
+		"mount",
+		"move_mount",
+		"name_to_handle_at",
+		"open_tree",
+		"perf_event_open",
+		"quotactl",
+		"setdomainname",
+		"sethostname",
+		"setns",
+		"syslog",
+		"umount",
+		"umount2",
+		"unshare",
+	},
+	"CAP_SYS_BOOT":       {"reboot"},
+	"CAP_SYS_CHROOT":     {"chroot"},
+	"CAP_SYS_MODULE":     {"delete_module", "finit_module", "init_module"},
+	"CAP_SYS_NICE":       {"get_mempolicy", "mbind", "set_mempolicy"},
+	"CAP_SYS_PACCT":      {"acct"},
+	"CAP_SYS_PTRACE":     {"kcmp", "pidfd_getfd", "process_madvise", "process_vm_readv", "process_vm_writev", "ptrace"},
+	"CAP_SYS_RAWIO":      {"ioperm", "iopl"},
+	"CAP_SYS_TIME":       {"clock_settime", "clock_settime64", "settimeofday", "stime"},
+	"CAP_SYS_TTY_CONFIG": {"vhangup"},
+	"CAP_SYSLOG":         {"syslog"},
+}
+
+// allowedPersonalities are the personality(2) domains the default seccomp
+// profile allows: Linux, Linux32, UNAME26 with either, and the query of the
+// current domain.
+var allowedPersonalities = []uint64{0x0, 0x8, 0x20000, 0x20008, 0xffffffff}
+
+// cloneNamespaceFlags are the clone(2) flags that create namespaces, which the
+// default seccomp profile denies without CAP_SYS_ADMIN.
+const cloneNamespaceFlags = unix.CLONE_NEWNS | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC |
+	unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET | unix.CLONE_NEWCGROUP
+
+// isPrivileged returns `true` if `spec` is annotated to run without the
+// security defaults.
+func isPrivileged(spec *oci.Spec) bool {
+	return spec.Annotations[annotationPrivileged] == "true" ||
+		spec.Annotations[annotationUnconfined] == "true"
+}
+
+// checkPrivileged fails with `HrAccessDenied` if `allowPrivileged` is not set
+// and `spec` has the privileged or unconfined annotation. The capabilities and
+// seccomp profile a spec sets itself are left to the security policy, which
+// can deny them.
+func checkPrivileged(spec *oci.Spec, allowPrivileged bool) error {
+	if allowPrivileged || !isPrivileged(spec) {
+		return nil
+	}
+	return gcserr.WrapHresult(errors.New("privileged containers are not allowed"), gcserr.HrAccessDenied)
+}
+
+// checkCapabilities fails with `HrAccessDenied` if any set of `caps` has a
+// capability that is not in `allowed`.
+func checkCapabilities(caps *oci.LinuxCapabilities, allowed []string) error {
+	if caps == nil {
+		return nil
+	}
+	has := make(map[string]bool, len(allowed))
+	for _, c := range allowed {
+		has[c] = true
+	}
+	for _, set := range [][]string{caps.Bounding, caps.Effective, caps.Inheritable, caps.Permitted, caps.Ambient} {
+		for _, c := range set {
+			if !has[c] {
+				return gcserr.WrapHresult(errors.Errorf("capability %s is not allowed", c), gcserr.HrAccessDenied)
+			}
+		}
+	}
+	return nil
+}
+
+// setExecCapabilities sets the capabilities of `process` exec'd in the
+// container of `spec` to those of its init process if it does not set any.
+// It fails with `HrAccessDenied` if `process` asks for a capability outside
+// of the bounding set of the init process, since runc does not bound the
+// capabilities of an exec'd process by those of the container.
+func setExecCapabilities(spec *oci.Spec, process *oci.Process) error {
+	if spec.Process == nil || spec.Process.Capabilities == nil {
+		return nil
+	}
+	caps := spec.Process.Capabilities
+	if process.Capabilities == nil {
+		process.Capabilities = &oci.LinuxCapabilities{
+			Bounding:    append([]string(nil), caps.Bounding...),
+			Effective:   append([]string(nil), caps.Effective...),
+			Inheritable: append([]string(nil), caps.Inheritable...),
+			Permitted:   append([]string(nil), caps.Permitted...),
+			Ambient:     append([]string(nil), caps.Ambient...),
+		}
+		return nil
+	}
+	return checkCapabilities(process.Capabilities, caps.Bounding)
+}
+
+// defaultSeccompProfile returns the seccomp profile of a container with the
+// bounding set `bounding`. Like the default profile of Docker it denies every
+// syscall with EPERM except `allowedSyscalls` and those guarded by a
+// capability in `bounding`. Without CAP_SYS_ADMIN clone is allowed only
+// without namespace flags, and clone3, whose flags cannot be filtered, is
+// denied.
+func defaultSeccompProfile(bounding []string) *oci.LinuxSeccomp {
+	has := make(map[string]bool, len(bounding))
+	for _, c := range bounding {
+		has[c] = true
+	}
+	names := append([]string(nil), allowedSyscalls...)
+	for c, syscalls := range capabilitySyscalls {
+		if has[c] {
+			names = append(names, syscalls...)
+		}
+	}
+	sort.Strings(names)
+	// syslog is guarded by both CAP_SYS_ADMIN and CAP_SYSLOG.
+	unique := make([]string, 0, len(names))
+	for i, n := range names {
+		if i == 0 || n != names[i-1] {
+			unique = append(unique, n)
+		}
+	}
+	syscalls := []oci.LinuxSyscall{
+		{
+			Names:  unique,
+			Action: oci.ActAllow,
+		},
+	}
+	for _, p := range allowedPersonalities {
+		syscalls = append(syscalls, oci.LinuxSyscall{
+			Names:  []string{"personality"},
+			Action: oci.ActAllow,
+			Args:   []oci.LinuxSeccompArg{{Index: 0, Value: p, Op: oci.OpEqualTo}},
+		})
+	}
+	if !has["CAP_SYS_ADMIN"] {
+		syscalls = append(syscalls, oci.LinuxSyscall{
+			Names:  []string{"clone"},
+			Action: oci.ActAllow,
+			Args:   []oci.LinuxSeccompArg{{Index: 0, Value: cloneNamespaceFlags, ValueTwo: 0, Op: oci.OpMaskedEqual}},
+		})
+	}
+	return &oci.LinuxSeccomp{
+		DefaultAction: oci.ActErrno,
+		Architectures: []oci.Arch{oci.ArchX86_64, oci.ArchX86, oci.ArchX32},
+		Syscalls:      syscalls,
+	}
+}
+
+// applySecurityDefaults sets the capabilities and seccomp profile of `spec` to
+// the defaults when the spec does not set them and the container is not
+// privileged.
+func applySecurityDefaults(ctx context.Context, spec *oci.Spec) {
+	if isPrivileged(spec) {
+		log.G(ctx).Debug("skipping security defaults for privileged container")
+		return
+	}
+	setProcess(spec)
+	if spec.Process.Capabilities == nil {
+		spec.Process.Capabilities = &oci.LinuxCapabilities{
+			Bounding:    append([]string(nil), policy.DefaultCapabilities...),
+			Effective:   append([]string(nil), policy.DefaultCapabilities...),
+			Inheritable: append([]string(nil), policy.DefaultCapabilities...),
+			Permitted:   append([]string(nil), policy.DefaultCapabilities...),
+		}
+	}
+	if spec.Linux != nil && spec.Linux.Seccomp == nil {
+		spec.Linux.Seccomp = defaultSeccompProfile(spec.Process.Capabilities.Bounding)
+	}
+}
@@ -0,0 +1,311 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Microsoft/opengcs/internal/policy"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func hasString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_applySecurityDefaults(t *testing.T) {
+	spec := &oci.Spec{Process: &oci.Process{}, Linux: &oci.Linux{}}
+	applySecurityDefaults(context.Background(), spec)
+	caps := spec.Process.Capabilities
+	if caps == nil || len(caps.Bounding) != len(policy.DefaultCapabilities) {
+		t.Fatalf("expected default capabilities got: %+v", caps)
+	}
+	if hasString(caps.Bounding, "CAP_SYS_ADMIN") {
+		t.Fatal("expected CAP_SYS_ADMIN to not be in the default capabilities")
+	}
+	seccomp := spec.Linux.Seccomp
+	if seccomp == nil || seccomp.DefaultAction != oci.ActErrno {
+		t.Fatalf("expected default seccomp profile got: %+v", seccomp)
+	}
+	allowed := seccomp.Syscalls[0].Names
+	for _, name := range []string{"read", "execve", "chroot"} {
+		if !hasString(allowed, name) {
+			t.Fatalf("expected %s to be allowed", name)
+		}
+	}
+	for _, name := range []string{"kexec_load", "keyctl", "mount", "ptrace", "clone3"} {
+		if hasString(allowed, name) {
+			t.Fatalf("expected %s to be denied", name)
+		}
+	}
+}
+
+func Test_applySecurityDefaults_KeepsSpec(t *testing.T) {
+	caps := &oci.LinuxCapabilities{Bounding: []string{"CAP_SYS_ADMIN"}}
+	seccomp := &oci.LinuxSeccomp{DefaultAction: oci.ActErrno}
+	spec := &oci.Spec{
+		Process: &oci.Process{Capabilities: caps},
+		Linux:   &oci.Linux{Seccomp: seccomp},
+	}
+	applySecurityDefaults(context.Background(), spec)
+	if spec.Process.Capabilities != caps || spec.Linux.Seccomp != seccomp {
+		t.Fatal("expected the spec capabilities and seccomp profile to be kept")
+	}
+}
+
+func Test_applySecurityDefaults_Privileged(t *testing.T) {
+	for _, a := range []string{annotationPrivileged, annotationUnconfined} {
+		spec := &oci.Spec{
+			Annotations: map[string]string{a: "true"},
+			Process:     &oci.Process{},
+			Linux:       &oci.Linux{},
+		}
+		applySecurityDefaults(context.Background(), spec)
+		if spec.Process.Capabilities != nil || spec.Linux.Seccomp != nil {
+			t.Fatalf("expected no security defaults with %s", a)
+		}
+	}
+}
+
+func Test_defaultSeccompProfile_Capabilities(t *testing.T) {
+	names := defaultSeccompProfile([]string{"CAP_SYS_ADMIN", "CAP_SYSLOG"}).Syscalls[0].Names
+	if !hasString(names, "mount") || !hasString(names, "unshare") || !hasString(names, "clone3") {
+		t.Fatal("expected CAP_SYS_ADMIN syscalls to be allowed with CAP_SYS_ADMIN")
+	}
+	if hasString(names, "ptrace") || hasString(names, "reboot") {
+		t.Fatal("expected syscalls of other capabilities to still be denied")
+	}
+	count := 0
+	for _, n := range names {
+		if n == "syslog" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("expected syslog to be allowed once got: %d", count)
+	}
+}
+
+func Test_defaultSeccompProfile_Clone(t *testing.T) {
+	findClone := func(profile *oci.LinuxSeccomp) *oci.LinuxSyscall {
+		for i, s := range profile.Syscalls {
+			if hasString(s.Names, "clone") {
+				return &profile.Syscalls[i]
+			}
+		}
+		return nil
+	}
+	clone := findClone(defaultSeccompProfile(policy.DefaultCapabilities))
+	if clone == nil || len(clone.Args) != 1 {
+		t.Fatalf("expected clone to be allowed with an argument filter got: %+v", clone)
+	}
+	arg := clone.Args[0]
+	if arg.Op != oci.OpMaskedEqual || arg.Value != cloneNamespaceFlags || arg.ValueTwo != 0 {
+		t.Fatalf("expected clone to be allowed without namespace flags got: %+v", arg)
+	}
+	clone = findClone(defaultSeccompProfile([]string{"CAP_SYS_ADMIN"}))
+	if clone == nil || len(clone.Args) != 0 {
+		t.Fatalf("expected clone to be allowed unfiltered with CAP_SYS_ADMIN got: %+v", clone)
+	}
+}
+
+func Test_checkPrivileged(t *testing.T) {
+	specs := map[string]*oci.Spec{
+		"privileged": {Annotations: map[string]string{annotationPrivileged: "true"}},
+		"unconfined": {Annotations: map[string]string{annotationUnconfined: "true"}},
+	}
+	for name, spec := range specs {
+		if err := checkPrivileged(spec, false); err == nil {
+			t.Fatalf("expected %s spec to be denied", name)
+		} else if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrAccessDenied {
+			t.Fatalf("expected %s spec to fail with %v got: %v", name, gcserr.HrAccessDenied, err)
+		}
+		if err := checkPrivileged(spec, true); err != nil {
+			t.Fatalf("expected %s spec to be allowed with allowPrivileged got: %v", name, err)
+		}
+	}
+	// The capabilities and seccomp profile set by the spec are not gated by
+	// allowPrivileged.
+	specs = map[string]*oci.Spec{
+		"restricted": {
+			Process: &oci.Process{Capabilities: &oci.LinuxCapabilities{Bounding: []string{"CAP_CHOWN"}}},
+			Linux:   &oci.Linux{Seccomp: &oci.LinuxSeccomp{DefaultAction: oci.ActErrno}},
+		},
+		"capability": {Process: &oci.Process{Capabilities: &oci.LinuxCapabilities{Effective: []string{"CAP_NET_ADMIN", "CAP_SYS_PTRACE"}}}},
+		"seccomp":    {Linux: &oci.Linux{Seccomp: &oci.LinuxSeccomp{DefaultAction: oci.ActAllow}}},
+	}
+	for name, spec := range specs {
+		if err := checkPrivileged(spec, false); err != nil {
+			t.Fatalf("expected %s spec to be allowed got: %v", name, err)
+		}
+	}
+}
+
+func Test_setExecCapabilities(t *testing.T) {
+	spec := &oci.Spec{Process: &oci.Process{Capabilities: &oci.LinuxCapabilities{
+		Bounding:  []string{"CAP_CHOWN", "CAP_KILL"},
+		Effective: []string{"CAP_CHOWN"},
+	}}}
+	process := &oci.Process{}
+	if err := setExecCapabilities(spec, process); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if process.Capabilities == nil || len(process.Capabilities.Bounding) != 2 || len(process.Capabilities.Effective) != 1 {
+		t.Fatalf("expected the init process capabilities got: %+v", process.Capabilities)
+	}
+	process = &oci.Process{Capabilities: &oci.LinuxCapabilities{Effective: []string{"CAP_KILL"}}}
+	if err := setExecCapabilities(spec, process); err != nil {
+		t.Fatalf("expected capabilities in the bounding set to be allowed got: %v", err)
+	}
+	process = &oci.Process{Capabilities: &oci.LinuxCapabilities{Effective: []string{"CAP_SYS_ADMIN"}}}
+	err := setExecCapabilities(spec, process)
+	if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrAccessDenied {
+		t.Fatalf("expected %v got: %v", gcserr.HrAccessDenied, err)
+	}
+}
+
+func Test_Host_CreateContainer_PrivilegedNotAllowed(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	settings := h.settings("c1", "/bin/sh")
+	settings.OCISpecification.Annotations = map[string]string{annotationPrivileged: "true"}
+	_, err := h.CreateContainer(context.Background(), "c1", settings)
+	if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrAccessDenied {
+		t.Fatalf("expected %v got: %v", gcserr.HrAccessDenied, err)
+	}
+	if _, err := h.GetContainer("c1"); err == nil {
+		t.Fatal("expected denied container to not be tracked")
+	}
+
+	c := h.createContainer("c2", "/bin/sh")
+	if c.spec.Process.Capabilities == nil || c.spec.Linux.Seccomp == nil {
+		t.Fatal("expected security defaults to be applied")
+	}
+}
+
+func Test_Host_CreateContainer_SpecSecurityAllowed(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	// Without a policy the capabilities and seccomp profile of the spec are
+	// kept even though privileged containers are not allowed.
+	settings := h.settings("c1", "/bin/sh")
+	settings.OCISpecification.Process.Capabilities = &oci.LinuxCapabilities{
+		Bounding:  []string{"CAP_NET_ADMIN", "CAP_SYS_PTRACE"},
+		Effective: []string{"CAP_NET_ADMIN", "CAP_SYS_PTRACE"},
+	}
+	settings.OCISpecification.Linux.Seccomp = &oci.LinuxSeccomp{DefaultAction: oci.ActAllow}
+	c, err := h.CreateContainer(context.Background(), "c1", settings)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if c.spec.Linux.Seccomp.DefaultAction != oci.ActAllow || len(c.spec.Process.Capabilities.Bounding) != 2 {
+		t.Fatalf("expected the spec security settings to be kept got: %+v %+v", c.spec.Process.Capabilities, c.spec.Linux.Seccomp)
+	}
+}
+
+func Test_Host_RunExternalProcess_DeniedByPolicy(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.SetSecurityPolicy(policy.NewEnforcer(&policy.Policy{}))
+
+	params := prot.ProcessParameters{CommandArgs: []string{"/bin/true"}, CreateStdOutPipe: true}
+	// The policy is enforced before the stdio is connected.
+	_, err := h.RunExternalProcess(context.Background(), params, stdio.ConnectionSettings{StdOut: uint32Ptr(1)})
+	if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrErrAccessDisabledByPolicy {
+		t.Fatalf("expected %v got: %v", gcserr.HrErrAccessDisabledByPolicy, err)
+	}
+}
+
+func Test_Container_ExecProcess_CapabilitiesDenied(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	c := h.createContainer("c1", "/bin/sh")
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatal(err)
+	}
+
+	process := &oci.Process{
+		Args:         []string{"/bin/sh"},
+		Cwd:          "/",
+		Capabilities: &oci.LinuxCapabilities{Effective: []string{"CAP_SYS_ADMIN"}},
+	}
+	_, err := c.ExecProcess(context.Background(), process, stdio.ConnectionSettings{})
+	if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrAccessDenied {
+		t.Fatalf("expected %v got: %v", gcserr.HrAccessDenied, err)
+	}
+	if n := len(h.rt.Container("c1").ExecProcesses()); n != 0 {
+		t.Fatalf("expected no exec process got: %d", n)
+	}
+}
+
+func Test_Host_CreateContainer_DeniedByPolicy(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.SetSecurityPolicy(policy.NewEnforcer(&policy.Policy{}))
+
+	_, err := h.CreateContainer(context.Background(), "c1", h.settings("c1", "/bin/sh"))
+	if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrErrAccessDisabledByPolicy {
+		t.Fatalf("expected %v got: %v", gcserr.HrErrAccessDisabledByPolicy, err)
+	}
+	if h.rt.Container("c1") != nil {
+		t.Fatal("expected the container not to be created")
+	}
+}
+
+// testPolicy allows containers running /bin/sh, which run privileged as
+// the test containers share the namespaces of the UVM, and /bin/ls in them.
+const testPolicy = `{"Containers": [{"Command": ["/bin/sh"], "AllowPrivileged": true, "ExecProcesses": [{"Command": ["/bin/ls"]}]}]}`
+
+func newTestEnforcer(t *testing.T, document string) *policy.Enforcer {
+	p, err := policy.Parse([]byte(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy.NewEnforcer(p)
+}
+
+func Test_Host_Recover_PolicyState(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.SetSecurityPolicy(newTestEnforcer(t, testPolicy))
+	h.createContainer("c1", "/bin/sh")
+
+	restarted := NewHost(h.rt, h.tport)
+	restarted.SetSecurityPolicy(newTestEnforcer(t, testPolicy))
+	if err := restarted.Recover(context.Background()); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if _, err := restarted.GetContainer("c1"); err != nil {
+		t.Fatalf("expected container to be recovered got: %v", err)
+	}
+	if err := restarted.SecurityPolicy().EnforceExecProcess(context.Background(), "c1", &oci.Process{Args: []string{"/bin/ls"}}); err != nil {
+		t.Fatalf("expected exec in the recovered container to be allowed got: %v", err)
+	}
+}
+
+func Test_Host_Recover_PolicyChanged(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.SetSecurityPolicy(newTestEnforcer(t, testPolicy))
+	h.createContainer("c1", "/bin/sh")
+
+	restarted := NewHost(h.rt, h.tport)
+	restarted.SetSecurityPolicy(newTestEnforcer(t, `{"Containers": [{"Command": ["/bin/sh"], "AllowPrivileged": true}]}`))
+	if err := restarted.Recover(context.Background()); err == nil {
+		t.Fatal("expected recovery with another policy to fail")
+	}
+	if _, err := restarted.GetContainer("c1"); err == nil {
+		t.Fatal("expected no container to be recovered")
+	}
+}
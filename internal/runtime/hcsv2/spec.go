@@ -40,6 +40,40 @@ func isInMounts(target string, mounts []oci.Mount) bool {
 	return false
 }
 
+// setShmMount replaces the `/dev/shm` mount of `spec` with a bind mount of
+// `source`. A `/dev/shm` bind mount already in the spec overrides it.
+func setShmMount(spec *oci.Spec, source string) {
+	for _, m := range spec.Mounts {
+		if m.Destination == "/dev/shm" && m.Type == "bind" {
+			return
+		}
+	}
+	mounts := spec.Mounts[:0]
+	for _, m := range spec.Mounts {
+		if m.Destination != "/dev/shm" {
+			mounts = append(mounts, m)
+		}
+	}
+	spec.Mounts = append(mounts, oci.Mount{
+		Destination: "/dev/shm",
+		Type:        "bind",
+		Source:      source,
+		Options:     []string{"bind"},
+	})
+}
+
+// setNamespacePath makes `spec` join the namespace of type `nsType` at `path`
+// instead of creating a new one.
+func setNamespacePath(spec *oci.Spec, nsType oci.LinuxNamespaceType, path string) {
+	for i, ns := range spec.Linux.Namespaces {
+		if ns.Type == nsType {
+			spec.Linux.Namespaces[i].Path = path
+			return
+		}
+	}
+	spec.Linux.Namespaces = append(spec.Linux.Namespaces, oci.LinuxNamespace{Type: nsType, Path: path})
+}
+
 func setProcess(spec *oci.Spec) {
 	if spec.Process == nil {
 		spec.Process = &oci.Process{}
@@ -15,7 +15,7 @@ import (
 )
 
 func getStandaloneRootDir(id string) string {
-	return filepath.Join("/run/gcs/c", id)
+	return filepath.Join(containersRootDir, id)
 }
 
 func getStandaloneHostnamePath(id string) string {
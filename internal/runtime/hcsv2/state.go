@@ -0,0 +1,425 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/storage/pmem"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+	v1 "github.com/containerd/cgroups/stats/v1"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// containerRecord is the state of a container persisted so that the Host can
+// be rebuilt after the GCS restarts. The spec of the container is read back
+// from its bundle.
+type containerRecord struct {
+	ID         string
+	BundlePath string
+	IsSandbox  bool
+}
+
+// namespaceRecord is the persisted state of a network namespace.
+type namespaceRecord struct {
+	ID       string
+	Pid      int
+	Adapters []nicRecord
+}
+
+// nicRecord is the persisted state of an adapter in a network namespace.
+type nicRecord struct {
+	Adapter     *prot.NetworkAdapterV2
+	Ifname      string
+	AssignedPid int
+}
+
+// mountRecord is the persisted state of a device mounted in the UVM. Only one
+// of the settings is set, those of the request that mounted it.
+type mountRecord struct {
+	MountPath         string
+	MappedVirtualDisk *prot.MappedVirtualDiskV2 `json:",omitempty"`
+	MappedDirectory   *prot.MappedDirectoryV2   `json:",omitempty"`
+	VPMemDevice       *prot.MappedVPMemDeviceV2 `json:",omitempty"`
+}
+
+func getContainerRecordPath(id string) string {
+	return filepath.Join(stateDir, "containers", id+".json")
+}
+
+func getExternalProcessRecordPath(pid int) string {
+	return filepath.Join(stateDir, "processes", strconv.Itoa(pid))
+}
+
+func getNamespacesRecordPath() string {
+	return filepath.Join(stateDir, "namespaces.json")
+}
+
+func getMountsRecordPath() string {
+	return filepath.Join(stateDir, "mounts.json")
+}
+
+func getPolicyStateRecordPath() string {
+	return filepath.Join(stateDir, "policy.json")
+}
+
+// writeStateFile atomically replaces the state file at `path` with `data`, so
+// that a GCS exiting while writing it never leaves a partial record.
+func writeStateFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create state directory for %s", path)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write state file %s", tmp)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "failed to rename state file %s", tmp)
+	}
+	return nil
+}
+
+// saveContainerRecord persists the record of `c` created from the bundle at
+// `bundlePath`.
+func saveContainerRecord(c *Container, bundlePath string) error {
+	data, err := json.Marshal(containerRecord{
+		ID:         c.id,
+		BundlePath: bundlePath,
+		IsSandbox:  c.isSandbox,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal record of container %s", c.id)
+	}
+	return writeStateFile(getContainerRecordPath(c.id), data)
+}
+
+// saveNetworkNamespaces persists every in-memory network namespace. The
+// namespaces are written while `namespaceSync` is held so that concurrent
+// saves are not reordered.
+func saveNetworkNamespaces() error {
+	namespaceSync.Lock()
+	defer namespaceSync.Unlock()
+
+	records := make([]namespaceRecord, 0, len(namespaces))
+	for _, ns := range namespaces {
+		ns.m.Lock()
+		r := namespaceRecord{ID: ns.id, Pid: ns.pid}
+		for _, nin := range ns.nics {
+			r.Adapters = append(r.Adapters, nicRecord{
+				Adapter:     nin.adapter,
+				Ifname:      nin.ifname,
+				AssignedPid: nin.assignedPid,
+			})
+		}
+		ns.m.Unlock()
+		records = append(records, r)
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal network namespace records")
+	}
+	return writeStateFile(getNamespacesRecordPath(), data)
+}
+
+// loadNetworkNamespaces adds the network namespaces persisted by
+// `saveNetworkNamespaces` to the in-memory namespaces.
+func loadNetworkNamespaces() error {
+	data, err := ioutil.ReadFile(getNamespacesRecordPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to read network namespace records")
+	}
+	var records []namespaceRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return errors.Wrap(err, "failed to unmarshal network namespace records")
+	}
+
+	namespaceSync.Lock()
+	defer namespaceSync.Unlock()
+
+	for _, r := range records {
+		ns := &namespace{id: r.ID, pid: r.Pid}
+		for _, nr := range r.Adapters {
+			ns.nics = append(ns.nics, &nicInNamespace{
+				adapter:     nr.Adapter,
+				ifname:      nr.Ifname,
+				assignedPid: nr.AssignedPid,
+			})
+		}
+		namespaces[r.ID] = ns
+	}
+	return nil
+}
+
+// logSaveNetworkNamespaces persists the network namespaces, logging rather than
+// failing the operation that changed them if it cannot.
+func logSaveNetworkNamespaces(ctx context.Context) {
+	if err := saveNetworkNamespaces(); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to persist network namespaces")
+	}
+}
+
+// updateMountRecord adds `record` to the mounts of the Host after a successful
+// add request, or removes the mount at its path after a successful remove
+// request, and persists the mounts. Failing to persist them is logged rather
+// than failing the request.
+func (h *Host) updateMountRecord(ctx context.Context, rt prot.ModifyRequestType, record *mountRecord) {
+	h.mountsMutex.Lock()
+	defer h.mountsMutex.Unlock()
+
+	switch rt {
+	case prot.MreqtAdd:
+		h.mounts[record.MountPath] = record
+	case prot.MreqtRemove:
+		delete(h.mounts, record.MountPath)
+	default:
+		return
+	}
+	records := make([]*mountRecord, 0, len(h.mounts))
+	for _, r := range h.mounts {
+		records = append(records, r)
+	}
+	data, err := json.Marshal(records)
+	if err == nil {
+		err = writeStateFile(getMountsRecordPath(), data)
+	}
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to persist mounts")
+	}
+}
+
+// loadMountRecords adds the mounts persisted by `updateMountRecord` to the Host
+// and takes the references on the pmem devices they hold.
+func (h *Host) loadMountRecords(ctx context.Context) error {
+	data, err := ioutil.ReadFile(getMountsRecordPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to read mount records")
+	}
+	var records []*mountRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return errors.Wrap(err, "failed to unmarshal mount records")
+	}
+
+	h.mountsMutex.Lock()
+	defer h.mountsMutex.Unlock()
+
+	for _, r := range records {
+		if vpd := r.VPMemDevice; vpd != nil {
+			if err := pmem.Adopt(vpd.DeviceNumber, vpd.Mappings); err != nil {
+				log.G(ctx).WithField("path", r.MountPath).WithError(err).Error("failed to recover pmem mount")
+				continue
+			}
+		}
+		h.mounts[r.MountPath] = r
+	}
+	return nil
+}
+
+// savePolicyState persists the state of the security policy of the Host,
+// logging rather than failing the operation that changed it if it cannot.
+func (h *Host) savePolicyState(ctx context.Context) {
+	h.policyStateMutex.Lock()
+	defer h.policyStateMutex.Unlock()
+
+	data, err := h.policy.MarshalState()
+	if err == nil {
+		err = writeStateFile(getPolicyStateRecordPath(), data)
+	}
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to persist security policy state")
+	}
+}
+
+// loadPolicyState restores the state of the security policy persisted by
+// `savePolicyState`.
+func (h *Host) loadPolicyState() error {
+	data, err := ioutil.ReadFile(getPolicyStateRecordPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to read security policy state")
+	}
+	return h.policy.UnmarshalState(data)
+}
+
+// Recover rebuilds the Host from the state persisted by a previous instance of
+// the GCS, such as before it crashed and was restarted. The containers and
+// external processes that still exist are adopted so that they can be waited
+// on and signaled again, but their stdio is lost and the exit code of their
+// processes is reported as `runtime.UnknownExitCode`. The devices mounted in
+// the UVM are tracked again so that they can still be unmounted, and the
+// security policy is restored to allow what it allowed before. Nothing is
+// recovered if the state of the policy cannot be restored, such as when the
+// GCS restarted with another policy. It must be called after
+// `SetSecurityPolicy` and before the bridge serves any request.
+func (h *Host) Recover(ctx context.Context) error {
+	if err := h.loadPolicyState(); err != nil {
+		return err
+	}
+	if err := loadNetworkNamespaces(); err != nil {
+		return err
+	}
+	if err := h.loadMountRecords(ctx); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(stateDir, "containers"))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read container records")
+	}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		id := strings.TrimSuffix(f.Name(), ".json")
+		entry := log.G(ctx).WithField("cid", id)
+		c, err := h.recoverContainer(ctx, id)
+		if err != nil {
+			if hr, _ := gcserr.GetHresult(err); hr == gcserr.HrVmcomputeSystemNotFound {
+				entry.Info("dropping record of container that no longer exists")
+				os.Remove(getContainerRecordPath(id))
+				continue
+			}
+			entry.WithError(err).Error("failed to recover container")
+			continue
+		}
+		entry.Info("recovered container")
+		h.containersMutex.Lock()
+		h.containers[id] = c
+		h.recovered = append(h.recovered, c)
+		h.containersMutex.Unlock()
+	}
+
+	files, err = ioutil.ReadDir(filepath.Join(stateDir, "processes"))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read external process records")
+	}
+	for _, f := range files {
+		pid, err := strconv.Atoi(f.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			os.Remove(getExternalProcessRecordPath(pid))
+			continue
+		}
+		p := adoptExternalProcess(ctx, pid, h.removeExternalProcess)
+		h.externalProcessesMutex.Lock()
+		h.externalProcesses[pid] = p
+		h.externalProcessesMutex.Unlock()
+		log.G(ctx).WithField("pid", pid).Info("recovered external process")
+	}
+	return nil
+}
+
+// recoverContainer returns the container `id` rebuilt from its record and the
+// runtime.
+func (h *Host) recoverContainer(ctx context.Context, id string) (*Container, error) {
+	data, err := ioutil.ReadFile(getContainerRecordPath(id))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read record of container %s", id)
+	}
+	var record containerRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal record of container %s", id)
+	}
+
+	con, err := h.rtime.LoadContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	configFile := filepath.Join(record.BundlePath, "config.json")
+	data, err = ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read config.json at: '%s'", configFile)
+	}
+	var spec oci.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal config.json at: '%s'", configFile)
+	}
+	state, err := con.GetState()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Container{
+		id:        id,
+		vsock:     h.vsock,
+		spec:      &spec,
+		isSandbox: record.IsSandbox,
+		restored:  state.Status != "created",
+		container: con,
+		exitType:  prot.NtUnexpectedExit,
+		processes: make(map[uint32]*containerProcess),
+		oomEvents: make(chan *v1.MemoryStat, oomEventQueueSize),
+	}
+	c.initProcess = newProcess(c, spec.Process, con.(runtime.Process), uint32(con.Pid()), true)
+	processes, err := con.LoadProcesses()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range processes {
+		pid := uint32(p.Pid())
+		c.processes[pid] = newProcess(c, nil, p, pid, false)
+	}
+
+	if err := c.watchOOMEvents(); err != nil {
+		log.G(ctx).WithField("cid", id).WithError(err).Warn("failed to watch container for oom kills")
+	}
+	return c, nil
+}
+
+// TakeRecoveredContainers returns the containers added by `Recover` that were
+// not returned by a previous call. Their creation was handled by the previous
+// instance of the GCS, so the caller is responsible for publishing their
+// events.
+func (h *Host) TakeRecoveredContainers() []*Container {
+	h.containersMutex.Lock()
+	defer h.containersMutex.Unlock()
+
+	recovered := h.recovered
+	h.recovered = nil
+	return recovered
+}
+
+// adoptExternalProcess returns the external process `pid` started by a
+// previous instance of the GCS. The process is not a child of the GCS so its
+// exit code is reported as `runtime.UnknownExitCode`.
+func adoptExternalProcess(ctx context.Context, pid int, onRemove func(pid int)) *externalProcess {
+	// FindProcess always succeeds on unix.
+	p, _ := os.FindProcess(pid)
+	ep := &externalProcess{
+		cmd:       &exec.Cmd{Process: p},
+		waitBlock: make(chan struct{}),
+		remove:    onRemove,
+	}
+	go func() {
+		runtime.WaitAdoptedProcess(pid)
+		ep.exitCode = runtime.UnknownExitCode
+		log.G(ctx).WithFields(logrus.Fields{
+			"pid":      pid,
+			"exitCode": ep.exitCode,
+		}).Debug("adopted external process exited")
+		close(ep.waitBlock)
+	}()
+	return ep
+}
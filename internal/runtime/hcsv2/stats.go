@@ -0,0 +1,57 @@
+package hcsv2
+
+import (
+	"context"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/oc"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// The phases of `Host.CreateContainer` recorded to `CreateContainerLatency`.
+const (
+	// createPhaseSpec is the time taken to prepare the OCI spec and the
+	// container's directories.
+	createPhaseSpec = "spec"
+	// createPhaseBundle is the time taken to write the OCI bundle.
+	createPhaseBundle = "bundle"
+	// createPhaseRuntime is the time taken by the runtime to create the
+	// container.
+	createPhaseRuntime = "runtime"
+	// createPhaseNetwork is the time taken to move the network adapters into
+	// the container's namespace.
+	createPhaseNetwork = "network"
+	// createPhaseTotal is the time taken by the whole create.
+	createPhaseTotal = "total"
+)
+
+var (
+	// CreateContainerLatency is the time in milliseconds taken by each phase
+	// of a successful container create.
+	CreateContainerLatency = stats.Float64("opengcs/hcsv2/create_container_latency", "The time taken by each phase of a container create", stats.UnitMilliseconds)
+
+	// KeyPhase is the phase of the container create.
+	KeyPhase, _ = tag.NewKey("phase")
+
+	// Views are the views of the hcsv2 measures to register with
+	// `view.Register`.
+	Views = []*view.View{
+		{
+			Name:        "opengcs/hcsv2/create_container_latency",
+			Measure:     CreateContainerLatency,
+			Description: "The distribution of the time taken by each phase of a container create",
+			TagKeys:     []tag.Key{KeyPhase},
+			Aggregation: oc.LatencyDistribution,
+		},
+	}
+)
+
+// recordCreatePhase records the time elapsed since `start` to
+// `CreateContainerLatency` for `phase` and returns the current time for use as
+// the start of the next phase.
+func recordCreatePhase(ctx context.Context, phase string, start time.Time) time.Time {
+	oc.RecordLatency(ctx, CreateContainerLatency, start, tag.Upsert(KeyPhase, phase))
+	return time.Now()
+}
@@ -15,6 +15,9 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Microsoft/opengcs/internal/cgroupv2"
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/policy"
 	"github.com/Microsoft/opengcs/internal/storage"
 	"github.com/Microsoft/opengcs/internal/storage/overlay"
 	"github.com/Microsoft/opengcs/internal/storage/pci"
@@ -26,6 +29,7 @@ import (
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
 	"github.com/Microsoft/opengcs/service/gcs/transport"
+	v1 "github.com/containerd/cgroups/stats/v1"
 	shellwords "github.com/mattn/go-shellwords"
 	"github.com/pkg/errors"
 )
@@ -34,34 +38,93 @@ import (
 // for V2 where the specific message is targeted at the UVM itself.
 const UVMContainerID = "00000000-0000-0000-0000-000000000000"
 
+// Test dependencies
+var (
+	// containersRootDir is the directory containing the files the GCS creates
+	// for each container, such as its hostname and hosts files.
+	containersRootDir = "/run/gcs/c"
+	// stateDir is the directory the Host persists its state in, so that it can
+	// be recovered after the GCS restarts.
+	stateDir = "/run/gcs/state"
+)
+
+// SetRunDir sets the directory the Host keeps its files in, such as the files
+// it creates for each container and its persisted state. It is /run/gcs by
+// default and must be set before a Host is created.
+func SetRunDir(dir string) {
+	containersRootDir = filepath.Join(dir, "c")
+	stateDir = filepath.Join(dir, "state")
+}
+
 // Host is the structure tracking all UVM host state including all containers
 // and processes.
 type Host struct {
 	containersMutex sync.Mutex
 	containers      map[string]*Container
 
+	// recovered are the containers added by `Recover` that have not been
+	// returned by `TakeRecoveredContainers`. Protected by containersMutex.
+	recovered []*Container
+
 	externalProcessesMutex sync.Mutex
 	externalProcesses      map[int]*externalProcess
 
+	// mounts are the devices mounted in the UVM by their mount path.
+	mountsMutex sync.Mutex
+	mounts      map[string]*mountRecord
+
 	// Rtime is the Runtime interface used by the GCS core.
 	rtime runtime.Runtime
 	vsock transport.Transport
+
+	// allowPrivileged is whether containers may be annotated to run without
+	// the security defaults.
+	allowPrivileged bool
+	// policy is the security policy enforced on the requests of the host.
+	policy *policy.Enforcer
+	// policyStateMutex serializes the writes of the persisted state of
+	// `policy`.
+	policyStateMutex sync.Mutex
 }
 
 func NewHost(rtime runtime.Runtime, vsock transport.Transport) *Host {
 	return &Host{
 		containers:        make(map[string]*Container),
 		externalProcesses: make(map[int]*externalProcess),
+		mounts:            make(map[string]*mountRecord),
 		rtime:             rtime,
 		vsock:             vsock,
+		policy:            policy.AllowAll(),
 	}
 }
 
+// SetAllowPrivileged sets whether containers may be created with the
+// privileged or unconfined annotation, which skip the security defaults. It is
+// denied by default.
+func (h *Host) SetAllowPrivileged(allow bool) {
+	h.allowPrivileged = allow
+}
+
+// SetSecurityPolicy sets the security policy enforced on the requests of the
+// host. Every request is allowed by default.
+func (h *Host) SetSecurityPolicy(p *policy.Enforcer) {
+	h.policy = p
+}
+
+// SecurityPolicy returns the security policy enforced on the requests of the
+// host.
+func (h *Host) SecurityPolicy() *policy.Enforcer {
+	return h.policy
+}
+
 func (h *Host) RemoveContainer(id string) {
 	h.containersMutex.Lock()
 	defer h.containersMutex.Unlock()
 
 	delete(h.containers, id)
+	h.policy.RemoveContainer(id)
+	h.savePolicyState(context.Background())
+	os.Remove(getContainerRecordPath(id))
 }
 
 func (h *Host) getContainerLocked(id string) (*Container, error) {
@@ -79,6 +142,39 @@ func (h *Host) GetContainer(id string) (*Container, error) {
 	return h.getContainerLocked(id)
 }
 
+// GetAllContainerStats returns the cgroup metrics of every container by
+// container ID. On a unified hierarchy the v2 metrics are converted to their
+// v1 equivalent. Containers whose metrics cannot be read are logged and
+// omitted.
+func (h *Host) GetAllContainerStats(ctx context.Context) map[string]*v1.Metrics {
+	h.containersMutex.Lock()
+	containers := make([]*Container, 0, len(h.containers))
+	for _, c := range h.containers {
+		containers = append(containers, c)
+	}
+	h.containersMutex.Unlock()
+
+	stats := make(map[string]*v1.Metrics, len(containers))
+	for _, c := range containers {
+		var m *v1.Metrics
+		var err error
+		if isCgroupV2() {
+			var m2 *cgroupv2.Metrics
+			if m2, err = c.statsV2(); err == nil {
+				m = v1Metrics(m2)
+			}
+		} else {
+			m, err = c.GetStats(ctx)
+		}
+		if err != nil {
+			log.G(ctx).WithField("cid", c.id).WithError(err).Warn("failed to get container stats")
+			continue
+		}
+		stats[c.id] = m
+	}
+	return stats
+}
+
 func setupSandboxMountsPath(id string) error {
 	mountPath := getSandboxMountsDir(id)
 	if err := os.MkdirAll(mountPath, 0755); err != nil {
@@ -88,7 +184,26 @@ func setupSandboxMountsPath(id string) error {
 	return storage.MountRShared(mountPath)
 }
 
-func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VMHostedContainerSettingsV2) (_ *Container, err error) {
+// CreateContainer creates container `id` from `settings`. The container's init
+// process does not run until `Container.Start`.
+func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VMHostedContainerSettingsV2) (*Container, error) {
+	return h.createContainer(ctx, id, settings, "")
+}
+
+// RestoreContainer restores container `id` from `settings` and the checkpoint
+// image directory `imagePath` written by `Container.Checkpoint`. The restored
+// init process is already running, `Container.Start` only connects its stdio.
+func (h *Host) RestoreContainer(ctx context.Context, id string, settings *prot.VMHostedContainerSettingsV2, imagePath string) (*Container, error) {
+	if settings.OCISpecification.Process != nil && settings.OCISpecification.Process.Terminal {
+		return nil, gcserr.WrapHresult(errors.Errorf("cannot restore container %s with a terminal", id), gcserr.HrNotImpl)
+	}
+	return h.createContainer(ctx, id, settings, imagePath)
+}
+
+// createContainer creates container `id`, restoring it from `imagePath` if it
+// is not empty. The security policy is enforced on the spec of the container
+// with the security defaults applied.
+func (h *Host) createContainer(ctx context.Context, id string, settings *prot.VMHostedContainerSettingsV2, imagePath string) (_ *Container, err error) {
 	h.containersMutex.Lock()
 	defer h.containersMutex.Unlock()
 
@@ -96,6 +211,22 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 		return nil, gcserr.NewHresultError(gcserr.HrVmcomputeSystemAlreadyExists)
 	}
 
+	createStart := time.Now()
+	phaseStart := createStart
+
+	if err := checkPrivileged(settings.OCISpecification, h.allowPrivileged); err != nil {
+		return nil, err
+	}
+	applySecurityDefaults(ctx, settings.OCISpecification)
+	if err := h.policy.EnforceCreateContainer(ctx, id, settings.OCISpecification); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			h.policy.RemoveContainer(id)
+		}
+	}()
+
 	var namespaceID string
 	criType, isCRI := settings.OCISpecification.Annotations["io.kubernetes.cri.container-type"]
 	if isCRI {
@@ -106,16 +237,29 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 			err = setupSandboxContainerSpec(ctx, id, settings.OCISpecification)
 			defer func() {
 				if err != nil {
+					storage.UnmountPath(ctx, getSandboxShmPath(id), false)
 					defer os.RemoveAll(getSandboxRootDir(id))
 				}
 			}()
-			err = setupSandboxMountsPath(id)
+			if err == nil {
+				err = setupSandboxMountsPath(id)
+			}
 		case "container":
 			sid, ok := settings.OCISpecification.Annotations["io.kubernetes.cri.sandbox-id"]
 			if !ok || sid == "" {
 				return nil, errors.Errorf("unsupported 'io.kubernetes.cri.sandbox-id': '%s'", sid)
 			}
-			err = setupWorkloadContainerSpec(ctx, sid, id, settings.OCISpecification)
+			var sb *Container
+			sb, err = h.getContainerLocked(sid)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to find sandbox %s of container %s", sid, id)
+			}
+			var sbPid int
+			sbPid, err = getSandboxPid(sb)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to join sandbox %s of container %s", sid, id)
+			}
+			err = setupWorkloadContainerSpec(ctx, sid, id, sbPid, settings.OCISpecification)
 			defer func() {
 				if err != nil {
 					defer os.RemoveAll(getWorkloadRootDir(id))
@@ -137,6 +281,7 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 	if err != nil {
 		return nil, err
 	}
+	phaseStart = recordCreatePhase(ctx, createPhaseSpec, phaseStart)
 
 	// Create the BundlePath
 	if err := os.MkdirAll(settings.OCIBundlePath, 0700); err != nil {
@@ -155,20 +300,32 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 	if err := writer.Flush(); err != nil {
 		return nil, errors.Wrapf(err, "failed to flush writer for config.json at: '%s'", configFile)
 	}
+	phaseStart = recordCreatePhase(ctx, createPhaseBundle, phaseStart)
 
-	con, err := h.rtime.CreateContainer(id, settings.OCIBundlePath, nil)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create container")
+	var con runtime.Container
+	if imagePath == "" {
+		con, err = h.rtime.CreateContainer(id, settings.OCIBundlePath, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create container")
+		}
+	} else {
+		con, err = h.rtime.RestoreContainer(id, settings.OCIBundlePath, imagePath, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to restore container")
+		}
 	}
+	phaseStart = recordCreatePhase(ctx, createPhaseRuntime, phaseStart)
 
 	c := &Container{
 		id:        id,
 		vsock:     h.vsock,
 		spec:      settings.OCISpecification,
 		isSandbox: criType == "sandbox",
+		restored:  imagePath != "",
 		container: con,
 		exitType:  prot.NtUnexpectedExit,
 		processes: make(map[uint32]*containerProcess),
+		oomEvents: make(chan *v1.MemoryStat, oomEventQueueSize),
 	}
 	c.initProcess = newProcess(c, settings.OCISpecification.Process, con.(runtime.Process), uint32(c.container.Pid()), true)
 
@@ -186,21 +343,53 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 			if err := ns.Sync(ctx); err != nil {
 				return nil, err
 			}
+			logSaveNetworkNamespaces(ctx)
 		}
+		recordCreatePhase(ctx, createPhaseNetwork, phaseStart)
+	}
+
+	// Failing to watch for OOM kills does not prevent the container from
+	// running.
+	if err := c.watchOOMEvents(); err != nil {
+		log.G(ctx).WithField("cid", id).WithError(err).Warn("failed to watch container for oom kills")
+	}
+
+	// The container runs even if it cannot be recovered after a GCS restart.
+	if err := saveContainerRecord(c, settings.OCIBundlePath); err != nil {
+		log.G(ctx).WithField("cid", id).WithError(err).Warn("failed to persist container record")
 	}
+	h.savePolicyState(ctx)
 
 	h.containers[id] = c
+	recordCreatePhase(ctx, createPhaseTotal, createStart)
 	return c, nil
 }
 
 func (h *Host) modifyHostSettings(ctx context.Context, containerID string, settings *prot.ModifySettingRequest) error {
 	switch settings.ResourceType {
 	case prot.MrtMappedVirtualDisk:
-		return modifyMappedVirtualDisk(ctx, settings.RequestType, settings.Settings.(*prot.MappedVirtualDiskV2))
+		mvd := settings.Settings.(*prot.MappedVirtualDiskV2)
+		if err := modifyMappedVirtualDisk(ctx, settings.RequestType, mvd); err != nil {
+			return err
+		}
+		if mvd.MountPath != "" {
+			h.updateMountRecord(ctx, settings.RequestType, &mountRecord{MountPath: mvd.MountPath, MappedVirtualDisk: mvd})
+		}
+		return nil
 	case prot.MrtMappedDirectory:
-		return modifyMappedDirectory(ctx, h.vsock, settings.RequestType, settings.Settings.(*prot.MappedDirectoryV2))
+		md := settings.Settings.(*prot.MappedDirectoryV2)
+		if err := modifyMappedDirectory(ctx, h.vsock, settings.RequestType, md); err != nil {
+			return err
+		}
+		h.updateMountRecord(ctx, settings.RequestType, &mountRecord{MountPath: md.MountPath, MappedDirectory: md})
+		return nil
 	case prot.MrtVPMemDevice:
-		return modifyMappedVPMemDevice(ctx, settings.RequestType, settings.Settings.(*prot.MappedVPMemDeviceV2))
+		vpd := settings.Settings.(*prot.MappedVPMemDeviceV2)
+		if err := modifyMappedVPMemDevice(ctx, settings.RequestType, vpd); err != nil {
+			return err
+		}
+		h.updateMountRecord(ctx, settings.RequestType, &mountRecord{MountPath: vpd.MountPath, VPMemDevice: vpd})
+		return nil
 	case prot.MrtCombinedLayers:
 		return modifyCombinedLayers(ctx, settings.RequestType, settings.Settings.(*prot.CombinedLayersV2))
 	case prot.MrtNetwork:
@@ -227,16 +416,26 @@ func (h *Host) modifyContainerSettings(ctx context.Context, containerID string,
 	switch settings.ResourceType {
 	case prot.MrtContainerConstraints:
 		return c.modifyContainerConstraints(ctx, settings.RequestType, settings.Settings.(*prot.ContainerConstraintsV2))
+	case prot.MrtPodConstraints:
+		return c.modifyPodConstraints(ctx, settings.RequestType, settings.Settings.(*prot.PodConstraintsV2))
 	default:
 		return errors.Errorf("the ResourceType \"%s\" is not supported for containers", settings.ResourceType)
 	}
 }
 
 func (h *Host) ModifySettings(ctx context.Context, containerID string, settings *prot.ModifySettingRequest) error {
-	if containerID == UVMContainerID {
-		return h.modifyHostSettings(ctx, containerID, settings)
+	if containerID != UVMContainerID {
+		return h.modifyContainerSettings(ctx, containerID, settings)
 	}
-	return h.modifyContainerSettings(ctx, containerID, settings)
+	if err := h.policy.EnforceModifySettings(ctx, settings); err != nil {
+		return err
+	}
+	if err := h.modifyHostSettings(ctx, containerID, settings); err != nil {
+		return err
+	}
+	h.policy.RecordModifySettings(settings)
+	h.savePolicyState(ctx)
+	return nil
 }
 
 // Shutdown terminates this UVM. This is a destructive call and will destroy all
@@ -247,6 +446,18 @@ func (h *Host) Shutdown() {
 
 // RunExternalProcess runs a process in the utility VM.
 func (h *Host) RunExternalProcess(ctx context.Context, params prot.ProcessParameters, conSettings stdio.ConnectionSettings) (_ int, err error) {
+	args := params.CommandArgs
+	if len(args) == 0 {
+		args, err = processParamCommandLineToOCIArgs(params.CommandLine)
+		if err != nil {
+			return -1, err
+		}
+	}
+	env := processParamEnvToOCIEnv(params.Environment)
+	if err := h.policy.EnforceExternalProcess(ctx, args, env); err != nil {
+		return -1, err
+	}
+
 	var stdioSet *stdio.ConnectionSet
 	stdioSet, err = stdio.Connect(h.vsock, conSettings)
 	if err != nil {
@@ -258,17 +469,9 @@ func (h *Host) RunExternalProcess(ctx context.Context, params prot.ProcessParame
 		}
 	}()
 
-	args := params.CommandArgs
-	if len(args) == 0 {
-		args, err = processParamCommandLineToOCIArgs(params.CommandLine)
-		if err != nil {
-			return -1, err
-		}
-	}
-
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Dir = params.WorkingDirectory
-	cmd.Env = processParamEnvToOCIEnv(params.Environment)
+	cmd.Env = env
 
 	var relay *stdio.TtyRelay
 	if params.EmulateConsole {
@@ -318,15 +521,13 @@ func (h *Host) RunExternalProcess(ctx context.Context, params prot.ProcessParame
 		cmd.Stderr = fileSet.Err
 	}
 
-	onRemove := func(pid int) {
-		h.externalProcessesMutex.Lock()
-		delete(h.externalProcesses, pid)
-		h.externalProcessesMutex.Unlock()
-	}
-	p, err := newExternalProcess(ctx, cmd, relay, onRemove)
+	p, err := newExternalProcess(ctx, cmd, relay, h.removeExternalProcess)
 	if err != nil {
 		return -1, err
 	}
+	if err := writeStateFile(getExternalProcessRecordPath(p.Pid()), nil); err != nil {
+		log.G(ctx).WithField("pid", p.Pid()).WithError(err).Warn("failed to persist external process record")
+	}
 
 	h.externalProcessesMutex.Lock()
 	h.externalProcesses[p.Pid()] = p
@@ -334,6 +535,15 @@ func (h *Host) RunExternalProcess(ctx context.Context, params prot.ProcessParame
 	return p.Pid(), nil
 }
 
+// removeExternalProcess removes the external process `pid` once at least one
+// waiter got its exit code.
+func (h *Host) removeExternalProcess(pid int) {
+	h.externalProcessesMutex.Lock()
+	delete(h.externalProcesses, pid)
+	h.externalProcessesMutex.Unlock()
+	os.Remove(getExternalProcessRecordPath(pid))
+}
+
 func (h *Host) GetExternalProcess(pid int) (Process, error) {
 	h.externalProcessesMutex.Lock()
 	defer h.externalProcessesMutex.Unlock()
@@ -355,12 +565,12 @@ func modifyMappedVirtualDisk(ctx context.Context, rt prot.ModifyRequestType, mvd
 		mountCtx, cancel := context.WithTimeout(ctx, time.Second*4)
 		defer cancel()
 		if mvd.MountPath != "" {
-			return scsi.Mount(mountCtx, mvd.Controller, mvd.Lun, mvd.MountPath, mvd.ReadOnly)
+			return scsi.Mount(mountCtx, mvd.Controller, mvd.Lun, mvd.MountPath, mvd.ReadOnly, mvd.VerityInfo, mvd.Encrypted)
 		}
 		return nil
 	case prot.MreqtRemove:
 		if mvd.MountPath != "" {
-			if err := storage.UnmountPath(ctx, mvd.MountPath, true); err != nil {
+			if err := scsi.Unmount(ctx, mvd.Controller, mvd.Lun, mvd.MountPath, mvd.VerityInfo, mvd.Encrypted); err != nil {
 				return err
 			}
 		}
@@ -384,9 +594,9 @@ func modifyMappedDirectory(ctx context.Context, vsock transport.Transport, rt pr
 func modifyMappedVPMemDevice(ctx context.Context, rt prot.ModifyRequestType, vpd *prot.MappedVPMemDeviceV2) (err error) {
 	switch rt {
 	case prot.MreqtAdd:
-		return pmem.Mount(ctx, vpd.DeviceNumber, vpd.MountPath)
+		return pmem.Mount(ctx, vpd.DeviceNumber, vpd.MountPath, vpd.Mappings, vpd.VerityInfo)
 	case prot.MreqtRemove:
-		return storage.UnmountPath(ctx, vpd.MountPath, true)
+		return pmem.Unmount(ctx, vpd.DeviceNumber, vpd.MountPath, vpd.Mappings, vpd.VerityInfo)
 	default:
 		return newInvalidRequestTypeError(rt)
 	}
@@ -437,12 +647,15 @@ func modifyNetwork(ctx context.Context, rt prot.ModifyRequestType, na *prot.Netw
 		}
 		// This code doesnt know if the namespace was already added to the
 		// container or not so it must always call `Sync`.
-		return ns.Sync(ctx)
+		err := ns.Sync(ctx)
+		logSaveNetworkNamespaces(ctx)
+		return err
 	case prot.MreqtRemove:
 		ns := getOrAddNetworkNamespace(na.ID)
 		if err := ns.RemoveAdapter(ctx, na.ID); err != nil {
 			return err
 		}
+		logSaveNetworkNamespaces(ctx)
 		return nil
 	default:
 		return newInvalidRequestTypeError(rt)
@@ -0,0 +1,706 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	"github.com/Microsoft/opengcs/service/gcs/transport"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+type testHost struct {
+	*Host
+	t     *testing.T
+	dir   string
+	rt    *mockruntime.Runtime
+	tport *transport.MockTransport
+	// scripts are the scripts of the mock processes by their first argument.
+	scripts map[string]mockruntime.ProcessScript
+}
+
+// newTestHost returns a Host backed by a mock runtime and transport whose
+// container files are created in a temp directory.
+func newTestHost(t *testing.T) *testHost {
+	dir, err := ioutil.TempDir("", "hcsv2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &testHost{
+		t:       t,
+		dir:     dir,
+		rt:      mockruntime.NewRuntime(),
+		tport:   &transport.MockTransport{},
+		scripts: make(map[string]mockruntime.ProcessScript),
+	}
+	h.rt.Script = func(id string, spec *oci.Process) mockruntime.ProcessScript {
+		if s, ok := h.scripts[spec.Args[0]]; ok {
+			return s
+		}
+		return mockruntime.RunUntilKilled
+	}
+	h.Host = NewHost(h.rt, h.tport)
+	containersRootDir = filepath.Join(dir, "c")
+	stateDir = filepath.Join(dir, "state")
+	return h
+}
+
+func (h *testHost) close() {
+	// Release the network namespaces of the containers, including those
+	// recovered by a restarted host.
+	namespaceSync.Lock()
+	namespaces = make(map[string]*namespace)
+	namespaceSync.Unlock()
+	containersRootDir = "/run/gcs/c"
+	stateDir = "/run/gcs/state"
+	os.RemoveAll(h.dir)
+}
+
+// restart returns a Host recovered from the state persisted by `h`, as if the
+// GCS restarted. The in-memory network namespaces are lost as well.
+func (h *testHost) restart() *testHost {
+	namespaceSync.Lock()
+	namespaces = make(map[string]*namespace)
+	namespaceSync.Unlock()
+
+	restarted := *h
+	restarted.Host = NewHost(h.rt, h.tport)
+	if err := restarted.Recover(context.Background()); err != nil {
+		h.t.Fatalf("failed to recover host: %v", err)
+	}
+	return &restarted
+}
+
+// settings returns the settings of a standalone container `id` running
+// `args`. Every container gets its own network namespace as a standalone
+// container is assigned to it.
+func (h *testHost) settings(id string, args ...string) *prot.VMHostedContainerSettingsV2 {
+	return &prot.VMHostedContainerSettingsV2{
+		OCIBundlePath: filepath.Join(h.dir, "bundles", id),
+		OCISpecification: &oci.Spec{
+			Version:  oci.Version,
+			Hostname: "test",
+			Process:  &oci.Process{Args: args, Cwd: "/"},
+			Linux:    &oci.Linux{},
+			Windows: &oci.Windows{
+				Network: &oci.WindowsNetwork{NetworkNamespace: h.t.Name() + "-" + id},
+			},
+		},
+	}
+}
+
+func (h *testHost) createContainer(id string, args ...string) *Container {
+	settings := h.settings(id, args...)
+	c, err := h.CreateContainer(context.Background(), id, settings)
+	if err != nil {
+		h.t.Fatalf("failed to create container %s: %v", id, err)
+	}
+	return c
+}
+
+// waitProcess waits for `p` to exit and acknowledges the exit code as the
+// bridge does once the exit notification is written.
+func waitProcess(t *testing.T, p Process) int {
+	exitCodeChan, doneChan := p.Wait()
+	select {
+	case exitCode := <-exitCodeChan:
+		doneChan <- true
+		return exitCode
+	case <-time.After(10 * time.Second):
+		doneChan <- true
+		t.Fatalf("timed out waiting for process %d to exit", p.Pid())
+		return -1
+	}
+}
+
+func uint32Ptr(i uint32) *uint32 {
+	return &i
+}
+
+func Test_Host_CreateContainer(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	c := h.createContainer("c1", "/bin/sh")
+	if _, err := os.Stat(filepath.Join(h.dir, "bundles", "c1", "config.json")); err != nil {
+		t.Fatalf("expected bundle config to be written: %v", err)
+	}
+	hostname, err := ioutil.ReadFile(getStandaloneHostnamePath("c1"))
+	if err != nil {
+		t.Fatalf("expected hostname file to be written: %v", err)
+	}
+	if string(hostname) != "test\n" {
+		t.Fatalf("expected hostname \"test\\n\" got: %q", hostname)
+	}
+	if got, err := h.GetContainer("c1"); err != nil || got != c {
+		t.Fatalf("expected container c1 to be tracked got: %v, %v", got, err)
+	}
+	if status := h.rt.Container("c1").Status(); status != "created" {
+		t.Fatalf("expected runtime container to be created got: %s", status)
+	}
+
+	_, err = h.CreateContainer(context.Background(), "c1", h.settings("c1", "/bin/sh"))
+	if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrVmcomputeSystemAlreadyExists {
+		t.Fatalf("expected %v creating container twice got: %v", gcserr.HrVmcomputeSystemAlreadyExists, err)
+	}
+}
+
+func Test_Host_CreateContainer_RuntimeFailure(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.rt.Fail(mockruntime.OpCreate, errors.New("injected"))
+
+	settings := h.settings("c1", "/bin/sh")
+	defer removeNetworkNamespace(context.Background(), getNetworkNamespaceID(settings.OCISpecification))
+	if _, err := h.CreateContainer(context.Background(), "c1", settings); err == nil || !strings.Contains(err.Error(), "injected") {
+		t.Fatalf("expected injected create error got: %v", err)
+	}
+	if _, err := h.GetContainer("c1"); err == nil {
+		t.Fatal("expected failed container to not be tracked")
+	}
+	if _, err := os.Stat(getStandaloneRootDir("c1")); !os.IsNotExist(err) {
+		t.Fatalf("expected container root dir to be removed got: %v", err)
+	}
+}
+
+func Test_Container_Start_RelaysStdio(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.scripts["/bin/echo"] = mockruntime.ProcessScript{Stdout: []byte("hello"), Stderr: []byte("oops"), ExitCode: 3}
+
+	c := h.createContainer("c1", "/bin/echo")
+	done := make(chan map[uint32]string)
+	go func() {
+		output := make(map[uint32]string)
+		for _, port := range []uint32{1, 2} {
+			conn := h.tport.Accept(port)
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			output[port] = string(b)
+		}
+		done <- output
+	}()
+	pid, err := c.Start(context.Background(), stdio.ConnectionSettings{StdOut: uint32Ptr(1), StdErr: uint32Ptr(2)})
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if pid != c.container.Pid() {
+		t.Fatalf("expected init pid %d got: %d", c.container.Pid(), pid)
+	}
+
+	if exitCode := waitProcess(t, c.initProcess); exitCode != 3 {
+		t.Fatalf("expected exit code 3 got: %d", exitCode)
+	}
+	output := <-done
+	if output[1] != "hello" || output[2] != "oops" {
+		t.Fatalf("expected stdout \"hello\" and stderr \"oops\" got: %q, %q", output[1], output[2])
+	}
+	status := c.Wait()
+	if status.Type != prot.NtUnexpectedExit || status.ExitCode != 3 || status.Signal != 0 {
+		t.Fatalf("expected unexpected exit with code 3 got: %+v", status)
+	}
+}
+
+func Test_Container_Start_Terminal(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.scripts["/bin/sh"] = mockruntime.ProcessScript{Stdout: []byte("$ "), ExitCode: 0}
+
+	settings := h.settings("c1", "/bin/sh")
+	settings.OCISpecification.Process.Terminal = true
+	defer removeNetworkNamespace(context.Background(), getNetworkNamespaceID(settings.OCISpecification))
+	c, err := h.CreateContainer(context.Background(), "c1", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.container.Tty() == nil {
+		t.Fatal("expected a tty relay for a container with a terminal")
+	}
+
+	done := make(chan string)
+	go func() {
+		conn := h.tport.Accept(1)
+		b := make([]byte, 2)
+		n, _ := conn.Read(b)
+		conn.Close()
+		done <- string(b[:n])
+	}()
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{StdOut: uint32Ptr(1)}); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if out := <-done; out != "$ " {
+		t.Fatalf("expected terminal output \"$ \" got: %q", out)
+	}
+	if exitCode := waitProcess(t, c.initProcess); exitCode != 0 {
+		t.Fatalf("expected exit code 0 got: %d", exitCode)
+	}
+}
+
+func Test_Container_Start_RuntimeFailure(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	c := h.createContainer("c1", "/bin/sh")
+	h.rt.Fail(mockruntime.OpStart, errors.New("injected"))
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{}); err == nil {
+		t.Fatal("expected injected start error")
+	}
+	if status := h.rt.Container("c1").Status(); status != "created" {
+		t.Fatalf("expected container to remain created got: %s", status)
+	}
+}
+
+func Test_Container_Start_DialFailure(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	c := h.createContainer("c1", "/bin/sh")
+	h.tport.FailDial(1, errors.New("injected"))
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{StdOut: uint32Ptr(1)}); err == nil {
+		t.Fatal("expected dial error")
+	}
+	if status := h.rt.Container("c1").Status(); status != "created" {
+		t.Fatalf("expected container to not be started got: %s", status)
+	}
+}
+
+func Test_Container_Kill(t *testing.T) {
+	tests := []struct {
+		name     string
+		signals  []syscall.Signal
+		ignored  []syscall.Signal
+		expected prot.NotificationType
+		exitCode int
+	}{
+		{"SIGKILL", []syscall.Signal{syscall.SIGKILL}, nil, prot.NtForcedExit, 137},
+		{"SIGTERM", []syscall.Signal{syscall.SIGTERM}, nil, prot.NtGracefulExit, 143},
+		{"SIGTERM_Ignored", []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL}, []syscall.Signal{syscall.SIGTERM}, prot.NtForcedExit, 137},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHost(t)
+			defer h.close()
+			h.scripts["/bin/sh"] = mockruntime.ProcessScript{Delay: -1, IgnoredSignals: test.ignored}
+
+			c := h.createContainer("c1", "/bin/sh")
+			// The runtime container is deleted once its exit is acknowledged.
+			mc := h.rt.Container("c1")
+			if _, err := c.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+				t.Fatal(err)
+			}
+			for _, signal := range test.signals {
+				if err := c.Kill(context.Background(), signal); err != nil {
+					t.Fatalf("expected nil error sending %v got: %v", signal, err)
+				}
+			}
+			if exitCode := waitProcess(t, c.initProcess); exitCode != test.exitCode {
+				t.Fatalf("expected exit code %d got: %d", test.exitCode, exitCode)
+			}
+			status := c.Wait()
+			if status.Type != test.expected || status.ExitCode != test.exitCode || status.Signal != test.signals[len(test.signals)-1] {
+				t.Fatalf("expected %s exit with code %d got: %+v", test.expected, test.exitCode, status)
+			}
+			if signals := mc.Signals(); len(signals) != len(test.signals) {
+				t.Fatalf("expected signals %v got: %v", test.signals, signals)
+			}
+
+			// The init process has exited so the container is not found.
+			err := c.Kill(context.Background(), syscall.SIGKILL)
+			if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrVmcomputeSystemNotFound {
+				t.Fatalf("expected %v killing stopped container got: %v", gcserr.HrVmcomputeSystemNotFound, err)
+			}
+		})
+	}
+}
+
+func Test_Container_ExecProcess(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.scripts["/bin/ls"] = mockruntime.ProcessScript{Stdout: []byte("file"), ExitCode: 2}
+
+	c := h.createContainer("c1", "/bin/sh")
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan string)
+	go func() {
+		conn := h.tport.Accept(1)
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		done <- string(b)
+	}()
+	pid, err := c.ExecProcess(context.Background(), &oci.Process{Args: []string{"/bin/ls"}, Cwd: "/"}, stdio.ConnectionSettings{StdOut: uint32Ptr(1)})
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	p, err := c.GetProcess(uint32(pid))
+	if err != nil {
+		t.Fatalf("expected exec process %d got: %v", pid, err)
+	}
+	if exitCode := waitProcess(t, p); exitCode != 2 {
+		t.Fatalf("expected exit code 2 got: %d", exitCode)
+	}
+	if out := <-done; out != "file" {
+		t.Fatalf("expected stdout \"file\" got: %q", out)
+	}
+
+	// The process is removed once its exit code was acknowledged.
+	for i := 0; ; i++ {
+		if _, err := c.GetProcess(uint32(pid)); err != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected exec process to be removed after wait")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(h.rt.Container("c1").ExecProcesses()) != 0 {
+		t.Fatal("expected runtime exec process to be deleted after wait")
+	}
+
+	h.rt.Fail(mockruntime.OpExec, errors.New("injected"))
+	if _, err := c.ExecProcess(context.Background(), &oci.Process{Args: []string{"/bin/ls"}, Cwd: "/"}, stdio.ConnectionSettings{}); err == nil {
+		t.Fatal("expected injected exec error")
+	}
+}
+
+func Test_Container_InitExit_KillsExecProcesses(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.scripts["/bin/init"] = mockruntime.ProcessScript{Delay: 50 * time.Millisecond}
+
+	c := h.createContainer("c1", "/bin/init")
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	pid, err := c.ExecProcess(context.Background(), &oci.Process{Args: []string{"/bin/sleep"}, Cwd: "/"}, stdio.ConnectionSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.GetProcess(uint32(pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCode := waitProcess(t, p); exitCode != 137 {
+		t.Fatalf("expected exec process to be killed with exit code 137 got: %d", exitCode)
+	}
+	if exitCode := waitProcess(t, c.initProcess); exitCode != 0 {
+		t.Fatalf("expected init exit code 0 got: %d", exitCode)
+	}
+}
+
+func Test_containerProcess_Wait_CanceledBeforeExit(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	c := h.createContainer("c1", "/bin/sh")
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A waiter that gives up before the exit must not count as having
+	// written the exit response.
+	exitCodeChan, doneChan := c.initProcess.Wait()
+	doneChan <- true
+	select {
+	case exitCode := <-exitCodeChan:
+		t.Fatalf("expected no exit code for a canceled wait got: %d", exitCode)
+	default:
+	}
+
+	waited := make(chan ExitStatus)
+	go func() {
+		waited <- c.Wait()
+	}()
+	h.rt.Container("c1").Exit(7)
+	select {
+	case status := <-waited:
+		t.Fatalf("expected container wait to block until the exit is acknowledged got: %+v", status)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if exitCode := waitProcess(t, c.initProcess); exitCode != 7 {
+		t.Fatalf("expected exit code 7 got: %d", exitCode)
+	}
+	if status := <-waited; status.ExitCode != 7 {
+		t.Fatalf("expected container exit code 7 got: %+v", status)
+	}
+}
+
+func Test_Container_CheckpointRestore(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	c := h.createContainer("c1", "/bin/sh")
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	imagePath := filepath.Join(h.dir, "image")
+	if err := c.Checkpoint(context.Background(), imagePath, runtime.CheckpointOptions{}); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	waitProcess(t, c.initProcess)
+	if status := c.Wait(); status.Type != prot.NtGracefulExit {
+		t.Fatalf("expected graceful exit after checkpoint got: %+v", status)
+	}
+
+	settings := h.settings("c2", "/bin/sh")
+	defer removeNetworkNamespace(context.Background(), getNetworkNamespaceID(settings.OCISpecification))
+	restored, err := h.RestoreContainer(context.Background(), "c2", settings, imagePath)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	// The mock runtime fails to start a running container, so this also
+	// checks that Start does not start a restored container again.
+	if _, err := restored.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatalf("expected nil error starting restored container got: %v", err)
+	}
+	if status := h.rt.Container("c2").Status(); status != "running" {
+		t.Fatalf("expected restored container to be running got: %s", status)
+	}
+}
+
+func Test_Container_PauseResume(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	c := h.createContainer("c1", "/bin/sh")
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Pause(context.Background()); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if status := h.rt.Container("c1").Status(); status != "paused" {
+		t.Fatalf("expected paused container got: %s", status)
+	}
+	if err := c.Resume(context.Background()); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if status := h.rt.Container("c1").Status(); status != "running" {
+		t.Fatalf("expected running container got: %s", status)
+	}
+
+	h.rt.Fail(mockruntime.OpPause, errors.New("injected"))
+	if err := c.Pause(context.Background()); err == nil {
+		t.Fatal("expected injected pause error")
+	}
+}
+
+func Test_Container_Delete(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	c := h.createContainer("c1", "/bin/sh")
+	if err := c.Delete(context.Background()); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if h.rt.Container("c1") != nil {
+		t.Fatal("expected runtime container to be deleted")
+	}
+	// Deleting a container that was never started kills its init process.
+	if exitCode := waitProcess(t, c.initProcess); exitCode != 137 {
+		t.Fatalf("expected exit code 137 got: %d", exitCode)
+	}
+}
+
+func Test_Host_Recover(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	c := h.createContainer("c1", "/bin/sh")
+	if _, err := c.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	pid, err := c.ExecProcess(context.Background(), &oci.Process{Args: []string{"/bin/sleep"}, Cwd: "/"}, stdio.ConnectionSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h2 := h.restart()
+	recovered, err := h2.GetContainer("c1")
+	if err != nil {
+		t.Fatalf("expected container c1 to be recovered got: %v", err)
+	}
+	if recovered == c || !recovered.restored {
+		t.Fatal("expected a new running container to be recovered")
+	}
+	if recovered.spec.Hostname != "test" {
+		t.Fatalf("expected spec to be read from the bundle got hostname: %q", recovered.spec.Hostname)
+	}
+	if _, err := recovered.GetProcess(uint32(pid)); err != nil {
+		t.Fatalf("expected exec process %d to be recovered got: %v", pid, err)
+	}
+	ns, err := getNetworkNamespace(h.t.Name() + "-c1")
+	if err != nil {
+		t.Fatalf("expected network namespace to be recovered got: %v", err)
+	}
+	if ns.pid != c.container.Pid() {
+		t.Fatalf("expected recovered network namespace pid %d got: %d", c.container.Pid(), ns.pid)
+	}
+	if containers := h2.TakeRecoveredContainers(); len(containers) != 1 || containers[0] != recovered {
+		t.Fatalf("expected recovered container c1 got: %v", containers)
+	}
+	if containers := h2.TakeRecoveredContainers(); len(containers) != 0 {
+		t.Fatalf("expected recovered containers to be taken once got: %v", containers)
+	}
+
+	if err := recovered.Kill(context.Background(), syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	if exitCode := waitProcess(t, recovered.initProcess); exitCode != 137 {
+		t.Fatalf("expected exit code 137 got: %d", exitCode)
+	}
+	if status := recovered.Wait(); status.Type != prot.NtForcedExit {
+		t.Fatalf("expected forced exit got: %+v", status)
+	}
+	h2.RemoveContainer("c1")
+	if _, err := os.Stat(getContainerRecordPath("c1")); !os.IsNotExist(err) {
+		t.Fatalf("expected container record to be removed got: %v", err)
+	}
+}
+
+func Test_Host_Recover_CreatedContainer(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.scripts["/bin/echo"] = mockruntime.ProcessScript{ExitCode: 4}
+
+	h.createContainer("c1", "/bin/echo")
+	h2 := h.restart()
+	recovered, err := h2.GetContainer("c1")
+	if err != nil {
+		t.Fatalf("expected container c1 to be recovered got: %v", err)
+	}
+	if recovered.restored {
+		t.Fatal("expected recovered container to not be running")
+	}
+	if _, err := recovered.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatalf("expected nil error starting recovered container got: %v", err)
+	}
+	if exitCode := waitProcess(t, recovered.initProcess); exitCode != 4 {
+		t.Fatalf("expected exit code 4 got: %d", exitCode)
+	}
+}
+
+func Test_Host_Recover_DropsDeletedContainer(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	h.createContainer("c1", "/bin/sh")
+	if err := h.rt.Container("c1").Delete(); err != nil {
+		t.Fatal(err)
+	}
+	h2 := h.restart()
+	if _, err := h2.GetContainer("c1"); err == nil {
+		t.Fatal("expected deleted container to not be recovered")
+	}
+	if _, err := os.Stat(getContainerRecordPath("c1")); !os.IsNotExist(err) {
+		t.Fatalf("expected record of deleted container to be removed got: %v", err)
+	}
+}
+
+func Test_Host_Recover_KeepsRecordOnFailure(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	h.createContainer("c1", "/bin/sh")
+	h.rt.Fail(mockruntime.OpLoad, errors.New("injected"))
+	h2 := h.restart()
+	if _, err := h2.GetContainer("c1"); err == nil {
+		t.Fatal("expected container to not be recovered")
+	}
+	if _, err := os.Stat(getContainerRecordPath("c1")); err != nil {
+		t.Fatalf("expected container record to be kept got: %v", err)
+	}
+}
+
+func Test_Host_Recover_Mounts(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+
+	ctx := context.Background()
+	vpd := &prot.MappedVPMemDeviceV2{
+		DeviceNumber: 7,
+		MountPath:    "/run/layers/p0",
+		Mappings:     []prot.VPMemMapping{{DeviceOffsetInBytes: 0, DeviceSizeInBytes: 4096}},
+	}
+	h.updateMountRecord(ctx, prot.MreqtAdd, &mountRecord{MountPath: vpd.MountPath, VPMemDevice: vpd})
+	md := &prot.MappedDirectoryV2{MountPath: "/run/mounts/m0", ShareName: "share"}
+	h.updateMountRecord(ctx, prot.MreqtAdd, &mountRecord{MountPath: md.MountPath, MappedDirectory: md})
+	h.updateMountRecord(ctx, prot.MreqtRemove, &mountRecord{MountPath: md.MountPath})
+
+	h2 := h.restart()
+	if len(h2.mounts) != 1 {
+		t.Fatalf("expected 1 recovered mount got: %+v", h2.mounts)
+	}
+	r, ok := h2.mounts[vpd.MountPath]
+	if !ok || r.VPMemDevice == nil || r.VPMemDevice.DeviceNumber != 7 || len(r.VPMemDevice.Mappings) != 1 {
+		t.Fatalf("unexpected recovered mount: %+v", r)
+	}
+}
+
+// workloadSettings returns the settings of container `id` in the pod of
+// sandbox `sid`.
+func (h *testHost) workloadSettings(sid, id string, args ...string) *prot.VMHostedContainerSettingsV2 {
+	settings := h.settings(id, args...)
+	settings.OCISpecification.Hostname = ""
+	settings.OCISpecification.Windows = nil
+	settings.OCISpecification.Annotations = map[string]string{
+		"io.kubernetes.cri.container-type": "container",
+		"io.kubernetes.cri.sandbox-id":     sid,
+	}
+	return settings
+}
+
+func Test_Host_CreateContainer_JoinsSandbox(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	sb := h.createContainer("sb", "/pause")
+	sb.isSandbox = true
+
+	c, err := h.CreateContainer(context.Background(), "c1", h.workloadSettings("sb", "c1", "/bin/sh"))
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	expected := fmt.Sprintf("/proc/%d/ns/ipc", sb.container.Pid())
+	for _, ns := range c.spec.Linux.Namespaces {
+		if ns.Type == oci.IPCNamespace && ns.Path == expected {
+			return
+		}
+	}
+	t.Fatalf("expected the IPC namespace %s got: %+v", expected, c.spec.Linux.Namespaces)
+}
+
+func Test_Host_CreateContainer_SandboxExited(t *testing.T) {
+	h := newTestHost(t)
+	defer h.close()
+	h.scripts["/pause"] = mockruntime.ProcessScript{}
+	sb := h.createContainer("sb", "/pause")
+	sb.isSandbox = true
+	if _, err := sb.Start(context.Background(), stdio.ConnectionSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	waitProcess(t, sb.initProcess)
+
+	if _, err := h.CreateContainer(context.Background(), "c1", h.workloadSettings("sb", "c1", "/bin/sh")); err == nil {
+		t.Fatal("expected an error creating a container in an exited sandbox")
+	}
+	if h.rt.Container("c1") != nil {
+		t.Fatal("expected the container not to be created")
+	}
+}
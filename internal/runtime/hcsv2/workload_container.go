@@ -2,6 +2,7 @@ package hcsv2
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,8 +16,13 @@ import (
 	"go.opencensus.io/trace"
 )
 
+// annotationSharePIDNamespace is set to "true" by CRI when the workload
+// containers of a pod share the PID namespace of the sandbox
+// (`shareProcessNamespace`).
+const annotationSharePIDNamespace = "io.kubernetes.cri.share-process-namespace"
+
 func getWorkloadRootDir(id string) string {
-	return filepath.Join("/run/gcs/c", id)
+	return filepath.Join(containersRootDir, id)
 }
 
 func updateSandboxMounts(sbid string, spec *oci.Spec) error {
@@ -53,7 +59,9 @@ func specHasGPUDevice(spec *oci.Spec) bool {
 	return false
 }
 
-func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, spec *oci.Spec) (err error) {
+// setupWorkloadContainerSpec sets up `spec` of container `id` to run in the pod
+// of sandbox `sbid`, whose init process is `sbPid`.
+func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, sbPid int, spec *oci.Spec) (err error) {
 	ctx, span := trace.StartSpan(ctx, "hcsv2::setupWorkloadContainerSpec")
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
@@ -113,13 +121,20 @@ func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, spec *oci.
 		spec.Mounts = append(spec.Mounts, mt)
 	}
 
-	// TODO: JTERRY75 /dev/shm is not properly setup for LCOW I believe. CRI
-	// also has a concept of a sandbox/shm file when the IPC NamespaceMode !=
-	// NODE.
+	// Add the sandbox /dev/shm if the spec did not override it.
+	setShmMount(spec, getSandboxShmPath(sbid))
+
+	// Join the IPC and UTS namespaces of the sandbox, and its PID namespace if
+	// the pod shares it.
+	setNamespacePath(spec, oci.IPCNamespace, fmt.Sprintf("/proc/%d/ns/ipc", sbPid))
+	setNamespacePath(spec, oci.UTSNamespace, fmt.Sprintf("/proc/%d/ns/uts", sbPid))
+	if spec.Annotations[annotationSharePIDNamespace] == "true" {
+		setNamespacePath(spec, oci.PIDNamespace, fmt.Sprintf("/proc/%d/ns/pid", sbPid))
+	}
 
 	// Check if we need to do any capability/device mappings
-	if spec.Annotations["io.microsoft.virtualmachine.lcow.privileged"] == "true" {
-		log.G(ctx).Debug("'io.microsoft.virtualmachine.lcow.privileged' set for privileged container")
+	if spec.Annotations[annotationPrivileged] == "true" {
+		log.G(ctx).Debugf("'%s' set for privileged container", annotationPrivileged)
 
 		// Add all host devices
 		hostDevices, err := devices.HostDevices()
@@ -155,8 +170,8 @@ func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, spec *oci.
 		}
 	}
 
-	// Force the parent cgroup into our /containers root
-	spec.Linux.CgroupsPath = "/containers/" + id
+	// Force the parent cgroup into the pod cgroup under our /containers root
+	spec.Linux.CgroupsPath = getPodContainerCgroupPath(sbid, id)
 
 	if spec.Windows != nil && specHasGPUDevice(spec) {
 		// we only support Nvidia gpus right now
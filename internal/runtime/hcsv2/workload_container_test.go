@@ -0,0 +1,96 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"testing"
+
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func newWorkloadTestSpec() *oci.Spec {
+	return &oci.Spec{
+		Annotations: make(map[string]string),
+		Mounts: []oci.Mount{
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm"},
+		},
+		Linux: &oci.Linux{
+			Namespaces: []oci.LinuxNamespace{
+				{Type: oci.PIDNamespace},
+				{Type: oci.IPCNamespace},
+				{Type: oci.MountNamespace},
+			},
+		},
+	}
+}
+
+func namespacePath(spec *oci.Spec, nsType oci.LinuxNamespaceType) (string, bool) {
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == nsType {
+			return ns.Path, true
+		}
+	}
+	return "", false
+}
+
+func Test_setupWorkloadContainerSpec_PodNamespaces(t *testing.T) {
+	spec := newWorkloadTestSpec()
+	if err := setupWorkloadContainerSpec(context.Background(), "sb", "c1", 10, spec); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if p, _ := namespacePath(spec, oci.IPCNamespace); p != "/proc/10/ns/ipc" {
+		t.Fatalf("expected ipc namespace /proc/10/ns/ipc got: %q", p)
+	}
+	if p, _ := namespacePath(spec, oci.UTSNamespace); p != "/proc/10/ns/uts" {
+		t.Fatalf("expected uts namespace /proc/10/ns/uts got: %q", p)
+	}
+	if p, ok := namespacePath(spec, oci.PIDNamespace); !ok || p != "" {
+		t.Fatalf("expected a new pid namespace got: %q", p)
+	}
+	if p, _ := namespacePath(spec, oci.MountNamespace); p != "" {
+		t.Fatalf("expected a new mount namespace got: %q", p)
+	}
+}
+
+func Test_setupWorkloadContainerSpec_SharePIDNamespace(t *testing.T) {
+	spec := newWorkloadTestSpec()
+	spec.Annotations[annotationSharePIDNamespace] = "true"
+	if err := setupWorkloadContainerSpec(context.Background(), "sb", "c1", 10, spec); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if p, _ := namespacePath(spec, oci.PIDNamespace); p != "/proc/10/ns/pid" {
+		t.Fatalf("expected pid namespace /proc/10/ns/pid got: %q", p)
+	}
+}
+
+func Test_setupWorkloadContainerSpec_Shm(t *testing.T) {
+	spec := newWorkloadTestSpec()
+	if err := setupWorkloadContainerSpec(context.Background(), "sb", "c1", 10, spec); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	var shm []oci.Mount
+	for _, m := range spec.Mounts {
+		if m.Destination == "/dev/shm" {
+			shm = append(shm, m)
+		}
+	}
+	if len(shm) != 1 {
+		t.Fatalf("expected 1 /dev/shm mount got: %d", len(shm))
+	}
+	if shm[0].Type != "bind" || shm[0].Source != getSandboxShmPath("sb") {
+		t.Fatalf("expected bind mount of %s got: %+v", getSandboxShmPath("sb"), shm[0])
+	}
+}
+
+func Test_setShmMount_Override(t *testing.T) {
+	spec := &oci.Spec{
+		Mounts: []oci.Mount{
+			{Destination: "/dev/shm", Type: "bind", Source: "/custom"},
+		},
+	}
+	setShmMount(spec, "/sandbox/shm")
+	if len(spec.Mounts) != 1 || spec.Mounts[0].Source != "/custom" {
+		t.Fatalf("expected /dev/shm override to be kept got: %+v", spec.Mounts)
+	}
+}
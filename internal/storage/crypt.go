@@ -0,0 +1,127 @@
+// +build linux
+
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage/devicemapper"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// cryptCipher is the cipher of dm-crypt devices. XTS splits the 512 bit
+	// key into two AES-256 keys.
+	cryptCipher  = "aes-xts-plain64"
+	cryptKeySize = 64
+)
+
+// Test dependencies
+var (
+	randRead      = rand.Read
+	deviceSize    = getDeviceSize
+	addKey        = unix.AddKey
+	invalidateKey = keyctlInvalidate
+)
+
+// getDeviceSize returns the size in bytes of the block device at `path`.
+func getDeviceSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
+
+// keyctlInvalidate invalidates the key `id` in the kernel keyring.
+func keyctlInvalidate(id int) error {
+	_, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	return err
+}
+
+// cryptKeyDescription returns the description of the logon key of the
+// dm-crypt device `name` in the kernel keyring. Logon keys must be described
+// as "<service>:<name>".
+func cryptKeyDescription(name string) string {
+	return "opengcs:" + name
+}
+
+// CreateCryptDevice creates the device-mapper device `name` that encrypts the
+// whole block device `source` with a random key generated in the guest. It
+// returns the path of the new device.
+//
+// The key is handed to the kernel as a logon key, which cannot be read back
+// from user space, and is invalidated once the device holds it. It is never
+// stored, so the content of `source` cannot be read once the device is removed.
+// A new device over the same `source` therefore holds nothing readable and must
+// be formatted with `FormatExt4` before it is mounted.
+func CreateCryptDevice(ctx context.Context, name, source string) (_ string, err error) {
+	_, span := trace.StartSpan(ctx, "storage::CreateCryptDevice")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.StringAttribute("name", name),
+		trace.StringAttribute("source", source))
+
+	size, err := deviceSize(source)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get the size of %s", source)
+	}
+	if size < 512 || size%512 != 0 {
+		return "", errors.Errorf("invalid size %d of %s", size, source)
+	}
+	key := make([]byte, cryptKeySize)
+	defer func() {
+		for i := range key {
+			key[i] = 0
+		}
+	}()
+	if _, err := randRead(key); err != nil {
+		return "", errors.Wrap(err, "failed to generate dm-crypt key")
+	}
+	desc := cryptKeyDescription(name)
+	id, err := addKey("logon", desc, key, unix.KEY_SPEC_PROCESS_KEYRING)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to add dm-crypt key %s to the keyring", desc)
+	}
+	defer func() {
+		// The device has its own copy of the key once it is created.
+		if err := invalidateKey(id); err != nil {
+			log.G(ctx).WithField("key", desc).WithError(err).Warn("failed to invalidate dm-crypt key")
+		}
+	}()
+	target := devicemapper.CryptTarget(0, size/512, cryptCipher, cryptKeySize, desc, source, 0)
+	p, err := createDevice(name, 0, []devicemapper.Target{target})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create dm-crypt device %s over %s", name, source)
+	}
+	return p, nil
+}
+
+// FormatExt4 formats the block device at `path` with a new ext4 filesystem,
+// erasing whatever it held.
+func FormatExt4(ctx context.Context, path string) (err error) {
+	ctx, span := trace.StartSpan(ctx, "storage::FormatExt4")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(trace.StringAttribute("path", path))
+
+	// The inode tables and journal are initialized lazily and the device is
+	// not discarded, there is nothing to read from it before it is written.
+	out, err := exec.CommandContext(ctx, "mkfs.ext4", "-q", "-F", "-E", "lazy_itable_init=1,lazy_journal_init=1,nodiscard", path).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to format %s: %s", path, out)
+	}
+	return nil
+}
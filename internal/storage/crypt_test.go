@@ -0,0 +1,118 @@
+// +build linux
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/opengcs/internal/storage/devicemapper"
+	"github.com/pkg/errors"
+)
+
+func Test_CreateCryptDevice_Target(t *testing.T) {
+	deviceSize = func(path string) (int64, error) {
+		return 1 << 20, nil
+	}
+	randRead = func(b []byte) (int, error) {
+		for i := range b {
+			b[i] = 0xab
+		}
+		return len(b), nil
+	}
+	added := false
+	addKey = func(keyType, description string, payload []byte, ringid int) (int, error) {
+		if keyType != "logon" || description != "opengcs:dm-crypt-test" {
+			t.Errorf("expected logon key opengcs:dm-crypt-test got: %s key %s", keyType, description)
+		}
+		if !bytes.Equal(payload, bytes.Repeat([]byte{0xab}, cryptKeySize)) {
+			t.Errorf("unexpected key payload: %x", payload)
+		}
+		added = true
+		return 42, nil
+	}
+	invalidated := 0
+	invalidateKey = func(id int) error {
+		invalidated = id
+		return nil
+	}
+	createDevice = func(name string, flags devicemapper.CreateFlags, targets []devicemapper.Target) (string, error) {
+		if name != "dm-crypt-test" {
+			t.Errorf("expected name: dm-crypt-test, got: %s", name)
+		}
+		if flags&devicemapper.CreateReadOnly != 0 {
+			t.Error("expected a writable device")
+		}
+		if len(targets) != 1 {
+			t.Fatalf("expected 1 target got: %d", len(targets))
+		}
+		if !added {
+			t.Error("expected the key to be in the keyring before the device is created")
+		}
+		// The key is referenced in the keyring rather than part of the table.
+		expected := "aes-xts-plain64 :64:logon:opengcs:dm-crypt-test 0 /dev/sdb 0"
+		if strings.Contains(targets[0].Params, "abab") {
+			t.Errorf("expected no key in the table got: %q", targets[0].Params)
+		}
+		if targets[0].Type != "crypt" || targets[0].Params != expected || targets[0].Length != 2048 {
+			t.Errorf("expected crypt target %q of 2048 sectors got: %+v", expected, targets[0])
+		}
+		return "/dev/mapper/" + name, nil
+	}
+	p, err := CreateCryptDevice(context.Background(), "dm-crypt-test", "/dev/sdb")
+	if err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if p != "/dev/mapper/dm-crypt-test" {
+		t.Fatalf("expected path: /dev/mapper/dm-crypt-test, got: %s", p)
+	}
+	if invalidated != 42 {
+		t.Fatalf("expected key 42 to be invalidated got: %d", invalidated)
+	}
+}
+
+func Test_CreateCryptDevice_RandFails(t *testing.T) {
+	deviceSize = func(path string) (int64, error) {
+		return 1 << 20, nil
+	}
+	randRead = func(b []byte) (int, error) {
+		return 0, errors.New("no entropy")
+	}
+	addKey = func(keyType, description string, payload []byte, ringid int) (int, error) {
+		return 0, errors.New("unexpected add key")
+	}
+	createDevice = func(name string, flags devicemapper.CreateFlags, targets []devicemapper.Target) (string, error) {
+		return "", errors.New("unexpected create")
+	}
+	if _, err := CreateCryptDevice(context.Background(), "dm-crypt-test", "/dev/sdb"); err == nil {
+		t.Fatal("expected error when the key cannot be generated")
+	}
+}
+
+func Test_CreateCryptDevice_CreateFails_InvalidatesKey(t *testing.T) {
+	deviceSize = func(path string) (int64, error) {
+		return 1 << 20, nil
+	}
+	randRead = func(b []byte) (int, error) {
+		return len(b), nil
+	}
+	addKey = func(keyType, description string, payload []byte, ringid int) (int, error) {
+		return 42, nil
+	}
+	invalidated := 0
+	invalidateKey = func(id int) error {
+		invalidated = id
+		return nil
+	}
+	createDevice = func(name string, flags devicemapper.CreateFlags, targets []devicemapper.Target) (string, error) {
+		return "", errors.New("create failed")
+	}
+	if _, err := CreateCryptDevice(context.Background(), "dm-crypt-test", "/dev/sdb"); err == nil {
+		t.Fatal("expected error when the device cannot be created")
+	}
+	if invalidated != 42 {
+		t.Fatalf("expected key 42 to be invalidated got: %d", invalidated)
+	}
+}
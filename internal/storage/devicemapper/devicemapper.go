@@ -177,6 +177,65 @@ func LinearTarget(sectorStart, length int64, path string, deviceStart int64) Tar
 	}
 }
 
+// VerityParams are the parameters of a dm-verity hash tree. Block numbers and
+// counts are in units of the respective block size.
+type VerityParams struct {
+	// Version is the hash tree format version, 1 for the format of
+	// `veritysetup`.
+	Version int
+	// DataBlockSize and HashBlockSize are the block sizes in bytes.
+	DataBlockSize, HashBlockSize int
+	// DataBlocks is the number of data blocks that are verified.
+	DataBlocks int64
+	// HashStartBlock is the first block of the hash tree on the hash device.
+	HashStartBlock int64
+	// Algorithm is the hash algorithm, such as "sha256".
+	Algorithm string
+	// RootDigest is the hex encoded root hash of the hash tree.
+	RootDigest string
+	// Salt is the hex encoded salt, empty if there is none.
+	Salt string
+}
+
+// VerityTarget constructs a device-mapper target that verifies the data blocks
+// of `dataDevice` against the hash tree on `hashDevice` as they are read. A
+// read of a block that does not match the tree fails with EIO.
+func VerityTarget(dataDevice, hashDevice string, p VerityParams) Target {
+	salt := p.Salt
+	if salt == "" {
+		salt = "-"
+	}
+	return Target{
+		Type:        "verity",
+		SectorStart: 0,
+		Length:      p.DataBlocks * int64(p.DataBlockSize) / 512,
+		Params: fmt.Sprintf("%d %s %s %d %d %d %d %s %s %s",
+			p.Version,
+			dataDevice,
+			hashDevice,
+			p.DataBlockSize,
+			p.HashBlockSize,
+			p.DataBlocks,
+			p.HashStartBlock,
+			p.Algorithm,
+			p.RootDigest,
+			salt),
+	}
+}
+
+// CryptTarget constructs a device-mapper target that encrypts a portion of a
+// block device at the specified offset with `cipher`, such as
+// "aes-xts-plain64", and the `keySize` byte logon key `keyDescription` in the
+// kernel keyring, so that the key itself is not part of the table.
+func CryptTarget(sectorStart, length int64, cipher string, keySize int, keyDescription string, path string, deviceStart int64) Target {
+	return Target{
+		Type:        "crypt",
+		SectorStart: sectorStart,
+		Length:      length,
+		Params:      fmt.Sprintf("%s :%d:logon:%s 0 %s %d", cipher, keySize, keyDescription, path, deviceStart),
+	}
+}
+
 // makeTableIoctl builds an ioctl input structure with a table of the speicifed
 // targets.
 func makeTableIoctl(name string, targets []Target) *dmIoctl {
@@ -245,7 +304,7 @@ func CreateDevice(name string, flags CreateFlags, targets []Target) (_ string, e
 	os.Remove(p)
 	err = unix.Mknod(p, unix.S_IFBLK|0600, int(dev))
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	return p, nil
@@ -140,3 +140,11 @@ func TestLinearError(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCryptTargetParams(t *testing.T) {
+	target := CryptTarget(0, 100, "aes-xts-plain64", 64, "opengcs:dm-crypt-test", "/dev/sdb", 8)
+	expected := "aes-xts-plain64 :64:logon:opengcs:dm-crypt-test 0 /dev/sdb 8"
+	if target.Type != "crypt" || target.Params != expected || target.Length != 100 {
+		t.Fatalf("expected crypt target %q of 100 sectors got: %+v", expected, target)
+	}
+}
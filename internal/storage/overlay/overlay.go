@@ -6,8 +6,10 @@ import (
 	"context"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 	"golang.org/x/sys/unix"
@@ -35,6 +37,13 @@ func Mount(ctx context.Context, layerPaths []string, upperdirPath, workdirPath,
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
 
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			storage.RecordMountLatency(ctx, "overlay", start)
+		}
+	}()
+
 	lowerdir := strings.Join(layerPaths, ":")
 	span.AddAttributes(
 		trace.StringAttribute("layerPaths", lowerdir),
@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage"
 	"github.com/Microsoft/opengcs/service/gcs/transport"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
@@ -33,6 +35,13 @@ func Mount(ctx context.Context, vsock transport.Transport, target, share string,
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
 
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			storage.RecordMountLatency(ctx, "plan9", start)
+		}
+	}()
+
 	span.AddAttributes(
 		trace.StringAttribute("target", target),
 		trace.StringAttribute("share", share),
@@ -4,10 +4,16 @@ package pmem
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage"
+	"github.com/Microsoft/opengcs/internal/storage/devicemapper"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 	"golang.org/x/sys/unix"
@@ -15,27 +21,143 @@ import (
 
 // Test dependencies
 var (
-	osMkdirAll  = os.MkdirAll
-	osRemoveAll = os.RemoveAll
-	unixMount   = unix.Mount
+	osMkdirAll         = os.MkdirAll
+	osRemoveAll        = os.RemoveAll
+	unixMount          = unix.Mount
+	createDevice       = devicemapper.CreateDevice
+	createVerityDevice = storage.CreateVerityDevice
+	removeDevice       = devicemapper.RemoveDevice
+	unmountPath        = storage.UnmountPath
 )
 
-// Mount mounts the pmem device at `/dev/pmem<device>` to `target`.
+// pmemDevice is a pmem device with mounted filesystems.
+type pmemDevice struct {
+	// refs is the number of filesystems mounted from the device.
+	refs int
+	// packed is whether the filesystems are in regions of the device rather
+	// than the whole device.
+	packed bool
+}
+
+var (
+	devicesMutex sync.Mutex
+	// devices are the pmem devices with mounted filesystems by number.
+	devices = make(map[uint32]*pmemDevice)
+)
+
+// acquireDevice takes a reference on pmem device `device` for a filesystem in
+// regions of it if `packed` or in the whole device otherwise. A device cannot
+// hold both.
+func acquireDevice(device uint32, packed bool) error {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	d, ok := devices[device]
+	if !ok {
+		d = &pmemDevice{packed: packed}
+		devices[device] = d
+	} else if d.packed != packed {
+		if packed {
+			return errors.Errorf("pmem device %d is already mounted as a whole", device)
+		}
+		return errors.Errorf("pmem device %d is already mounted by regions", device)
+	}
+	d.refs++
+	return nil
+}
+
+// releaseDevice drops a reference taken by `acquireDevice` on pmem device
+// `device`.
+func releaseDevice(device uint32) {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	if d, ok := devices[device]; ok {
+		d.refs--
+		if d.refs <= 0 {
+			delete(devices, device)
+		}
+	}
+}
+
+// Adopt takes the reference on pmem device `device` held by the filesystem in
+// `mappings` of it mounted by a previous instance of the GCS, so that the
+// device is tracked as if that filesystem had been mounted by `Mount`. The
+// device-mapper devices of the filesystem are named after its target, so they
+// are found again by `Unmount` without further state.
+func Adopt(device uint32, mappings []prot.VPMemMapping) error {
+	return acquireDevice(device, len(mappings) != 0)
+}
+
+// deviceName returns the base name of the device-mapper devices of the
+// filesystem of pmem device `device` mounted to `target`. The name is derived
+// from `target` rather than from the regions of the device so that the same
+// filesystem can be mounted to several targets.
+func deviceName(device uint32, target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return fmt.Sprintf("pmem%d-%x", device, sum[:8])
+}
+
+func linearDeviceName(device uint32, target string) string {
+	return "dm-linear-" + deviceName(device, target)
+}
+
+func verityDeviceName(device uint32, target string) string {
+	return "dm-verity-" + deviceName(device, target)
+}
+
+// linearTargets returns the targets of a device-mapper device that maps
+// `mappings` of `source` one after the other.
+func linearTargets(source string, mappings []prot.VPMemMapping) ([]devicemapper.Target, error) {
+	targets := make([]devicemapper.Target, len(mappings))
+	var sector int64
+	for i, m := range mappings {
+		if m.DeviceOffsetInBytes < 0 || m.DeviceSizeInBytes <= 0 || m.DeviceOffsetInBytes%512 != 0 || m.DeviceSizeInBytes%512 != 0 {
+			return nil, errors.Errorf("invalid mapping of %d bytes at offset %d", m.DeviceSizeInBytes, m.DeviceOffsetInBytes)
+		}
+		length := m.DeviceSizeInBytes / 512
+		targets[i] = devicemapper.LinearTarget(sector, length, source, m.DeviceOffsetInBytes/512)
+		sector += length
+	}
+	return targets, nil
+}
+
+// Mount mounts the pmem device at `/dev/pmem<device>` to `target`. If
+// `mappings` is not empty only the filesystem in those regions of the device
+// is mounted through a device-mapper linear device. If `verityInfo` is not nil
+// the filesystem is mounted through a dm-verity device that verifies its
+// content.
 //
 // `target` will be created. On mount failure the created `target` will be
 // automatically cleaned up.
 //
 // Note: For now the platform only supports readonly pmem that is assumed to be
 // `ext4`.
-func Mount(ctx context.Context, device uint32, target string) (err error) {
-	_, span := trace.StartSpan(ctx, "pmem::Mount")
+func Mount(ctx context.Context, device uint32, target string, mappings []prot.VPMemMapping, verityInfo *prot.DeviceVerityInfo) (err error) {
+	ctx, span := trace.StartSpan(ctx, "pmem::Mount")
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
 
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			storage.RecordMountLatency(ctx, "pmem", start)
+		}
+	}()
+
 	span.AddAttributes(
 		trace.Int64Attribute("device", int64(device)),
-		trace.StringAttribute("target", target))
+		trace.StringAttribute("target", target),
+		trace.Int64Attribute("mappings", int64(len(mappings))))
 
+	if err := acquireDevice(device, len(mappings) != 0); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			releaseDevice(device)
+		}
+	}()
 	if err := osMkdirAll(target, 0700); err != nil {
 		return err
 	}
@@ -45,9 +167,66 @@ func Mount(ctx context.Context, device uint32, target string) (err error) {
 		}
 	}()
 	source := fmt.Sprintf("/dev/pmem%d", device)
+	if len(mappings) != 0 {
+		targets, err := linearTargets(source, mappings)
+		if err != nil {
+			return err
+		}
+		name := linearDeviceName(device, target)
+		source, err = createDevice(name, devicemapper.CreateReadOnly, targets)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create linear device %s over pmem device %d", name, device)
+		}
+		defer func() {
+			if err != nil {
+				removeDevice(name)
+			}
+		}()
+	}
+	if verityInfo != nil {
+		name := verityDeviceName(device, target)
+		source, err = createVerityDevice(ctx, name, source, verityInfo)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				removeDevice(name)
+			}
+		}()
+	}
 	flags := uintptr(unix.MS_RDONLY)
 	if err := unixMount(source, target, "ext4", flags, "noload"); err != nil {
 		return errors.Wrapf(err, "failed to mount pmem device %s onto %s", source, target)
 	}
 	return nil
 }
+
+// Unmount unmounts `target` mounted from `mappings` of pmem device `device` by
+// `Mount` and removes the device-mapper devices it created for `target`.
+func Unmount(ctx context.Context, device uint32, target string, mappings []prot.VPMemMapping, verityInfo *prot.DeviceVerityInfo) (err error) {
+	ctx, span := trace.StartSpan(ctx, "pmem::Unmount")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.Int64Attribute("device", int64(device)),
+		trace.StringAttribute("target", target),
+		trace.Int64Attribute("mappings", int64(len(mappings))))
+
+	if err := unmountPath(ctx, target, true); err != nil {
+		return err
+	}
+	if verityInfo != nil {
+		if err := removeDevice(verityDeviceName(device, target)); err != nil {
+			return errors.Wrapf(err, "failed to remove dm-verity device of pmem device %d", device)
+		}
+	}
+	if len(mappings) != 0 {
+		if err := removeDevice(linearDeviceName(device, target)); err != nil {
+			return errors.Wrapf(err, "failed to remove linear device of pmem device %d", device)
+		}
+	}
+	releaseDevice(device)
+	return nil
+}
@@ -6,8 +6,12 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/Microsoft/opengcs/internal/storage/devicemapper"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
@@ -16,6 +20,11 @@ func clearTestDependencies() {
 	osMkdirAll = nil
 	osRemoveAll = nil
 	unixMount = nil
+	createVerityDevice = nil
+	removeDevice = nil
+	unmountPath = nil
+	createDevice = nil
+	devices = make(map[uint32]*pmemDevice)
 }
 
 func Test_Mount_Mkdir_Fails_Error(t *testing.T) {
@@ -25,7 +34,7 @@ func Test_Mount_Mkdir_Fails_Error(t *testing.T) {
 	osMkdirAll = func(path string, perm os.FileMode) error {
 		return expectedErr
 	}
-	err := Mount(context.Background(), 0, "")
+	err := Mount(context.Background(), 0, "", nil, nil)
 	if err != expectedErr {
 		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
 	}
@@ -49,7 +58,7 @@ func Test_Mount_Mkdir_ExpectedPath(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), 0, target)
+	err := Mount(context.Background(), 0, target, nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -73,7 +82,7 @@ func Test_Mount_Mkdir_ExpectedPerm(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), 0, target)
+	err := Mount(context.Background(), 0, target, nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -100,7 +109,7 @@ func Test_Mount_Calls_RemoveAll_OnMountFailure(t *testing.T) {
 		// Fake the mount failure to test remove is called
 		return expectedErr
 	}
-	err := Mount(context.Background(), 0, target)
+	err := Mount(context.Background(), 0, target, nil, nil)
 	if errors.Cause(err) != expectedErr {
 		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
 	}
@@ -127,7 +136,7 @@ func Test_Mount_Valid_Source(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), device, "/fake/path")
+	err := Mount(context.Background(), device, "/fake/path", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -150,7 +159,7 @@ func Test_Mount_Valid_Target(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, expectedTarget)
+	err := Mount(context.Background(), 0, expectedTarget, nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -173,7 +182,7 @@ func Test_Mount_Valid_FSType(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, "/fake/path")
+	err := Mount(context.Background(), 0, "/fake/path", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -196,7 +205,7 @@ func Test_Mount_Valid_Flags(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, "/fake/path")
+	err := Mount(context.Background(), 0, "/fake/path", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -219,8 +228,299 @@ func Test_Mount_Valid_Data(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, "/fake/path")
+	err := Mount(context.Background(), 0, "/fake/path", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
 }
+
+func Test_Mount_Verity_Source(t *testing.T) {
+	clearTestDependencies()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	info := &prot.DeviceVerityInfo{RootDigest: "abcd"}
+	name := verityDeviceName(1, "/fake/path")
+	createVerityDevice = func(ctx context.Context, n, source string, vi *prot.DeviceVerityInfo) (string, error) {
+		if n != name || source != "/dev/pmem1" || vi != info {
+			t.Errorf("unexpected verity device %s over %s", n, source)
+		}
+		return "/dev/mapper/" + n, nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		if source != "/dev/mapper/"+name {
+			t.Errorf("expected source: /dev/mapper/%s, got: %s", name, source)
+			return errors.New("unexpected source")
+		}
+		return nil
+	}
+	err := Mount(context.Background(), 1, "/fake/path", nil, info)
+	if err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+}
+
+func Test_Mount_Verity_RemovesDevice_OnMountFailure(t *testing.T) {
+	clearTestDependencies()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	osRemoveAll = func(path string) error {
+		return nil
+	}
+	createVerityDevice = func(ctx context.Context, name, source string, vi *prot.DeviceVerityInfo) (string, error) {
+		return "/dev/mapper/" + name, nil
+	}
+	removed := ""
+	removeDevice = func(name string) error {
+		removed = name
+		return nil
+	}
+	// A device that does not match its root digest fails to mount.
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		return unix.EIO
+	}
+	err := Mount(context.Background(), 1, "/fake/path", nil, &prot.DeviceVerityInfo{RootDigest: "abcd"})
+	if errors.Cause(err) != unix.EIO {
+		t.Fatalf("expected err: %v, got: %v", unix.EIO, err)
+	}
+	if expected := verityDeviceName(1, "/fake/path"); removed != expected {
+		t.Fatalf("expected %s to be removed got: %q", expected, removed)
+	}
+}
+
+func Test_Unmount_Verity(t *testing.T) {
+	clearTestDependencies()
+
+	unmountPath = func(ctx context.Context, target string, removeTarget bool) error {
+		return nil
+	}
+	removed := ""
+	removeDevice = func(name string) error {
+		removed = name
+		return nil
+	}
+	if err := Unmount(context.Background(), 1, "/fake/path", nil, &prot.DeviceVerityInfo{}); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	if expected := verityDeviceName(1, "/fake/path"); removed != expected {
+		t.Fatalf("expected %s to be removed got: %q", expected, removed)
+	}
+}
+
+func Test_Mount_Mappings(t *testing.T) {
+	clearTestDependencies()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	mappings := []prot.VPMemMapping{
+		{DeviceOffsetInBytes: 4096, DeviceSizeInBytes: 1024},
+		{DeviceOffsetInBytes: 16384, DeviceSizeInBytes: 512},
+	}
+	linear := linearDeviceName(2, "/fake/path")
+	createDevice = func(name string, flags devicemapper.CreateFlags, targets []devicemapper.Target) (string, error) {
+		if name != linear {
+			t.Errorf("expected name: %s, got: %s", linear, name)
+		}
+		expected := []devicemapper.Target{
+			devicemapper.LinearTarget(0, 2, "/dev/pmem2", 8),
+			devicemapper.LinearTarget(2, 1, "/dev/pmem2", 32),
+		}
+		if !reflect.DeepEqual(targets, expected) {
+			t.Errorf("expected targets: %+v, got: %+v", expected, targets)
+		}
+		return "/dev/mapper/" + name, nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		if source != "/dev/mapper/"+linear {
+			t.Errorf("expected source: /dev/mapper/%s, got: %s", linear, source)
+			return errors.New("unexpected source")
+		}
+		return nil
+	}
+	if err := Mount(context.Background(), 2, "/fake/path", mappings, nil); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	if d := devices[2]; d == nil || d.refs != 1 || !d.packed {
+		t.Fatalf("expected 1 packed reference on pmem device 2 got: %+v", d)
+	}
+}
+
+func Test_Mount_Mappings_InvalidMapping(t *testing.T) {
+	clearTestDependencies()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	osRemoveAll = func(path string) error {
+		return nil
+	}
+	mappings := []prot.VPMemMapping{{DeviceOffsetInBytes: 100, DeviceSizeInBytes: 512}}
+	if err := Mount(context.Background(), 2, "/fake/path", mappings, nil); err == nil {
+		t.Fatal("expected unaligned mapping to fail")
+	}
+	if _, ok := devices[2]; ok {
+		t.Fatal("expected no reference on pmem device 2 after failure")
+	}
+}
+
+func Test_Mount_Mappings_RefCount(t *testing.T) {
+	clearTestDependencies()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	createDevice = func(name string, flags devicemapper.CreateFlags, targets []devicemapper.Target) (string, error) {
+		return "/dev/mapper/" + name, nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		return nil
+	}
+	var removed []string
+	removeDevice = func(name string) error {
+		removed = append(removed, name)
+		return nil
+	}
+	unmountPath = func(ctx context.Context, target string, removeTarget bool) error {
+		return nil
+	}
+	layer1 := []prot.VPMemMapping{{DeviceOffsetInBytes: 0, DeviceSizeInBytes: 512}}
+	layer2 := []prot.VPMemMapping{{DeviceOffsetInBytes: 512, DeviceSizeInBytes: 512}}
+	if err := Mount(context.Background(), 3, "/layer1", layer1, nil); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	if err := Mount(context.Background(), 3, "/layer2", layer2, nil); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	// The whole device cannot be mounted while layers are packed in it.
+	if err := Mount(context.Background(), 3, "/whole", nil, nil); err == nil {
+		t.Fatal("expected mounting the whole device to fail")
+	}
+	if err := Unmount(context.Background(), 3, "/layer1", layer1, nil); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	if d := devices[3]; d == nil || d.refs != 1 {
+		t.Fatalf("expected 1 reference on pmem device 3 got: %+v", d)
+	}
+	if err := Unmount(context.Background(), 3, "/layer2", layer2, nil); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	if _, ok := devices[3]; ok {
+		t.Fatal("expected no reference on pmem device 3")
+	}
+	expected := []string{linearDeviceName(3, "/layer1"), linearDeviceName(3, "/layer2")}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Fatalf("expected removed devices: %v, got: %v", expected, removed)
+	}
+}
+
+func Test_deviceName(t *testing.T) {
+	name := deviceName(4, "/run/layers/p0")
+	if name != deviceName(4, "/run/layers/p0") {
+		t.Fatal("expected the name to be stable")
+	}
+	if !strings.HasPrefix(name, "pmem4-") {
+		t.Fatalf("expected name of pmem device 4 got: %s", name)
+	}
+	if name == deviceName(4, "/run/layers/p1") || name == deviceName(5, "/run/layers/p0") {
+		t.Fatal("expected different targets and devices to have different names")
+	}
+}
+
+func Test_Mount_Mappings_SameMappingTwice(t *testing.T) {
+	clearTestDependencies()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	created := make(map[string]bool)
+	createDevice = func(name string, flags devicemapper.CreateFlags, targets []devicemapper.Target) (string, error) {
+		if created[name] {
+			return "", unix.EBUSY
+		}
+		created[name] = true
+		return "/dev/mapper/" + name, nil
+	}
+	createVerityDevice = func(ctx context.Context, name, source string, vi *prot.DeviceVerityInfo) (string, error) {
+		if created[name] {
+			return "", unix.EBUSY
+		}
+		created[name] = true
+		return "/dev/mapper/" + name, nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		return nil
+	}
+	removeDevice = func(name string) error {
+		if !created[name] {
+			return unix.ENXIO
+		}
+		delete(created, name)
+		return nil
+	}
+	unmountPath = func(ctx context.Context, target string, removeTarget bool) error {
+		return nil
+	}
+	// The same layer is mounted for two containers.
+	layer := []prot.VPMemMapping{{DeviceOffsetInBytes: 0, DeviceSizeInBytes: 512}}
+	info := &prot.DeviceVerityInfo{RootDigest: "abcd"}
+	if err := Mount(context.Background(), 3, "/c1/layer", layer, info); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	if err := Mount(context.Background(), 3, "/c2/layer", layer, info); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	if len(created) != 4 {
+		t.Fatalf("expected 4 device-mapper devices got: %v", created)
+	}
+	if err := Unmount(context.Background(), 3, "/c1/layer", layer, info); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	if !created[linearDeviceName(3, "/c2/layer")] || !created[verityDeviceName(3, "/c2/layer")] {
+		t.Fatalf("expected the devices of the other mount to be kept got: %v", created)
+	}
+	if err := Unmount(context.Background(), 3, "/c2/layer", layer, info); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	if len(created) != 0 {
+		t.Fatalf("expected all devices to be removed got: %v", created)
+	}
+	if _, ok := devices[3]; ok {
+		t.Fatal("expected no reference on pmem device 3")
+	}
+}
+
+func Test_Adopt_Unmount(t *testing.T) {
+	clearTestDependencies()
+
+	unmountPath = func(ctx context.Context, target string, removeTarget bool) error {
+		return nil
+	}
+	var removed []string
+	removeDevice = func(name string) error {
+		removed = append(removed, name)
+		return nil
+	}
+	// A layer mounted by a previous GCS is unmounted through the names of its
+	// devices derived from the target.
+	layer := []prot.VPMemMapping{{DeviceOffsetInBytes: 0, DeviceSizeInBytes: 512}}
+	if err := Adopt(3, layer); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	if err := Mount(context.Background(), 3, "/whole", nil, nil); err == nil {
+		t.Fatal("expected mounting the whole device to fail")
+	}
+	if err := Unmount(context.Background(), 3, "/layer", layer, &prot.DeviceVerityInfo{}); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+	expected := []string{verityDeviceName(3, "/layer"), linearDeviceName(3, "/layer")}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Fatalf("expected removed devices: %v, got: %v", expected, removed)
+	}
+	if _, ok := devices[3]; ok {
+		t.Fatal("expected no reference on pmem device 3")
+	}
+}
@@ -12,6 +12,9 @@ import (
 
 	"github.com/Microsoft/opengcs/internal/log"
 	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage"
+	"github.com/Microsoft/opengcs/internal/storage/devicemapper"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 	"golang.org/x/sys/unix"
@@ -25,22 +28,68 @@ var (
 
 	// controllerLunToName is stubbed to make testing `Mount` easier.
 	controllerLunToName = ControllerLunToName
+
+	osStat             = os.Stat
+	createVerityDevice = storage.CreateVerityDevice
+	removeDevice       = devicemapper.RemoveDevice
+	unmountPath        = storage.UnmountPath
+	createCryptDevice  = storage.CreateCryptDevice
+	formatExt4         = storage.FormatExt4
 )
 
+// verityDeviceName returns the name of the dm-verity device of the SCSI device
+// on `controller` index `lun`.
+func verityDeviceName(controller, lun uint8) string {
+	return fmt.Sprintf("dm-verity-scsi%d-%d", controller, lun)
+}
+
+// cryptDeviceName returns the name of the dm-crypt device of the SCSI device on
+// `controller` index `lun`.
+func cryptDeviceName(controller, lun uint8) string {
+	return fmt.Sprintf("dm-crypt-scsi%d-%d", controller, lun)
+}
+
+// withoutDeadline is a context with the values of the context it wraps but
+// that is never canceled and has no deadline.
+type withoutDeadline struct {
+	context.Context
+}
+
+func (withoutDeadline) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (withoutDeadline) Done() <-chan struct{}       { return nil }
+func (withoutDeadline) Err() error                  { return nil }
+
 // Mount creates a mount from the SCSI device on `controller` index `lun` to
-// `target`
+// `target`. If `verityInfo` is not nil the read-only device is mounted through
+// a dm-verity device that verifies its content. If `encrypted` is `true` the
+// writable device is formatted and mounted through a dm-crypt device with an
+// ephemeral key. Formatting is not bound by the deadline of `ctx`.
 //
 // `target` will be created. On mount failure the created `target` will be
 // automatically cleaned up.
-func Mount(ctx context.Context, controller, lun uint8, target string, readonly bool) (err error) {
+func Mount(ctx context.Context, controller, lun uint8, target string, readonly bool, verityInfo *prot.DeviceVerityInfo, encrypted bool) (err error) {
 	ctx, span := trace.StartSpan(ctx, "scsi::Mount")
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
 
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			storage.RecordMountLatency(ctx, "scsi", start)
+		}
+	}()
+
 	span.AddAttributes(
 		trace.Int64Attribute("controller", int64(controller)),
-		trace.Int64Attribute("lun", int64(lun)))
+		trace.Int64Attribute("lun", int64(lun)),
+		trace.BoolAttribute("encrypted", encrypted))
 
+	if verityInfo != nil && !readonly {
+		return errors.Errorf("SCSI device %d:%d with verity info must be read-only", controller, lun)
+	}
+	if encrypted && readonly {
+		return errors.Errorf("encrypted SCSI device %d:%d must be writable", controller, lun)
+	}
 	if err := osMkdirAll(target, 0700); err != nil {
 		return err
 	}
@@ -53,6 +102,42 @@ func Mount(ctx context.Context, controller, lun uint8, target string, readonly b
 	if err != nil {
 		return err
 	}
+	if verityInfo != nil {
+		if err := waitForDevice(ctx, source); err != nil {
+			return err
+		}
+		source, err = createVerityDevice(ctx, verityDeviceName(controller, lun), source, verityInfo)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				removeDevice(verityDeviceName(controller, lun))
+			}
+		}()
+	}
+	if encrypted {
+		if err := waitForDevice(ctx, source); err != nil {
+			return err
+		}
+		source, err = createCryptDevice(ctx, cryptDeviceName(controller, lun), source)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				removeDevice(cryptDeviceName(controller, lun))
+			}
+		}()
+		// The key was just generated so nothing on the device can be read
+		// back. Always format it rather than probing what it decrypts to.
+		// Formatting a large disk takes far longer than the deadline of
+		// `ctx`, which is sized for waiting on the device, and killing mkfs
+		// partway through would fail the mount anyway.
+		if err := formatExt4(withoutDeadline{ctx}, source); err != nil {
+			return err
+		}
+	}
 	var flags uintptr
 	data := ""
 	if readonly {
@@ -81,6 +166,55 @@ func Mount(ctx context.Context, controller, lun uint8, target string, readonly b
 	return nil
 }
 
+// waitForDevice waits for the device node `source` found by
+// `controllerLunToName` to show up under `/dev`.
+func waitForDevice(ctx context.Context, source string) error {
+	for {
+		_, err := osStat(source)
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// Unmount unmounts `target` mounted from the SCSI device on `controller` index
+// `lun` by `Mount` and removes its dm-verity device if `verityInfo` is not nil
+// or its dm-crypt device if `encrypted` is `true`.
+func Unmount(ctx context.Context, controller, lun uint8, target string, verityInfo *prot.DeviceVerityInfo, encrypted bool) (err error) {
+	ctx, span := trace.StartSpan(ctx, "scsi::Unmount")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.Int64Attribute("controller", int64(controller)),
+		trace.Int64Attribute("lun", int64(lun)),
+		trace.StringAttribute("target", target))
+
+	if err := unmountPath(ctx, target, true); err != nil {
+		return err
+	}
+	if verityInfo != nil {
+		if err := removeDevice(verityDeviceName(controller, lun)); err != nil {
+			return errors.Wrapf(err, "failed to remove dm-verity device of SCSI device %d:%d", controller, lun)
+		}
+	}
+	if encrypted {
+		if err := removeDevice(cryptDeviceName(controller, lun)); err != nil {
+			return errors.Wrapf(err, "failed to remove dm-crypt device of SCSI device %d:%d", controller, lun)
+		}
+	}
+	return nil
+}
+
 // ControllerLunToName finds the `/dev/sd*` path to the SCSI device on
 // `controller` index `lun`.
 func ControllerLunToName(ctx context.Context, controller, lun uint8) (_ string, err error) {
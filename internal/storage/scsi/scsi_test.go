@@ -7,7 +7,9 @@ import (
 	"errors"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"golang.org/x/sys/unix"
 )
 
@@ -16,6 +18,12 @@ func clearTestDependencies() {
 	osRemoveAll = nil
 	unixMount = nil
 	controllerLunToName = nil
+	osStat = nil
+	createVerityDevice = nil
+	removeDevice = nil
+	unmountPath = nil
+	createCryptDevice = nil
+	formatExt4 = nil
 }
 
 func Test_Mount_Mkdir_Fails_Error(t *testing.T) {
@@ -25,7 +33,7 @@ func Test_Mount_Mkdir_Fails_Error(t *testing.T) {
 	osMkdirAll = func(path string, perm os.FileMode) error {
 		return expectedErr
 	}
-	err := Mount(context.Background(), 0, 0, "", false)
+	err := Mount(context.Background(), 0, 0, "", false, nil, false)
 	if err != expectedErr {
 		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
 	}
@@ -52,7 +60,7 @@ func Test_Mount_Mkdir_ExpectedPath(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, target, false)
+	err := Mount(context.Background(), 0, 0, target, false, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -79,7 +87,7 @@ func Test_Mount_Mkdir_ExpectedPerm(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, target, false)
+	err := Mount(context.Background(), 0, 0, target, false, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -106,7 +114,7 @@ func Test_Mount_ControllerLunToName_Valid_Controller(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), expectedController, 0, "/fake/path", false)
+	err := Mount(context.Background(), expectedController, 0, "/fake/path", false, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -133,7 +141,7 @@ func Test_Mount_ControllerLunToName_Valid_Lun(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), 0, expectedLun, "/fake/path", false)
+	err := Mount(context.Background(), 0, expectedLun, "/fake/path", false, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -163,7 +171,7 @@ func Test_Mount_Calls_RemoveAll_OnControllerToLunFailure(t *testing.T) {
 	// NOTE: Do NOT set unixMount because the controller to lun fails. Expect it
 	// not to be called.
 
-	err := Mount(context.Background(), 0, 0, target, false)
+	err := Mount(context.Background(), 0, 0, target, false, nil, false)
 	if err != expectedErr {
 		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
 	}
@@ -196,7 +204,7 @@ func Test_Mount_Calls_RemoveAll_OnMountFailure(t *testing.T) {
 		// Fake the mount failure to test remove is called
 		return expectedErr
 	}
-	err := Mount(context.Background(), 0, 0, target, false)
+	err := Mount(context.Background(), 0, 0, target, false, nil, false)
 	if err != expectedErr {
 		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
 	}
@@ -225,7 +233,7 @@ func Test_Mount_Valid_Source(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", false)
+	err := Mount(context.Background(), 0, 0, "/fake/path", false, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -251,7 +259,7 @@ func Test_Mount_Valid_Target(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, expectedTarget, false)
+	err := Mount(context.Background(), 0, 0, expectedTarget, false, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -277,7 +285,7 @@ func Test_Mount_Valid_FSType(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", false)
+	err := Mount(context.Background(), 0, 0, "/fake/path", false, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -303,7 +311,7 @@ func Test_Mount_Valid_Flags(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", false)
+	err := Mount(context.Background(), 0, 0, "/fake/path", false, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -329,7 +337,7 @@ func Test_Mount_Readonly_Valid_Flags(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", true)
+	err := Mount(context.Background(), 0, 0, "/fake/path", true, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -354,7 +362,7 @@ func Test_Mount_Valid_Data(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", false)
+	err := Mount(context.Background(), 0, 0, "/fake/path", false, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -380,8 +388,172 @@ func Test_Mount_Readonly_Valid_Data(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", true)
+	err := Mount(context.Background(), 0, 0, "/fake/path", true, nil, false)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
 }
+
+func Test_Mount_Verity_Requires_Readonly(t *testing.T) {
+	clearTestDependencies()
+
+	err := Mount(context.Background(), 0, 1, "/fake/path", false, &prot.DeviceVerityInfo{RootDigest: "abcd"}, false)
+	if err == nil {
+		t.Fatal("expected writable mount with verity info to fail")
+	}
+}
+
+func Test_Mount_Verity_Source(t *testing.T) {
+	clearTestDependencies()
+
+	// NOTE: Do NOT set osRemoveAll because the mount succeeds. Expect it not to
+	// be called.
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		return "/dev/sdb", nil
+	}
+	osStat = func(name string) (os.FileInfo, error) {
+		return nil, nil
+	}
+	createVerityDevice = func(ctx context.Context, name, source string, vi *prot.DeviceVerityInfo) (string, error) {
+		if name != "dm-verity-scsi0-1" || source != "/dev/sdb" {
+			t.Errorf("unexpected verity device %s over %s", name, source)
+		}
+		return "/dev/mapper/" + name, nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		if source != "/dev/mapper/dm-verity-scsi0-1" {
+			t.Errorf("expected source: /dev/mapper/dm-verity-scsi0-1, got: %s", source)
+			return errors.New("unexpected source")
+		}
+		return nil
+	}
+	err := Mount(context.Background(), 0, 1, "/fake/path", true, &prot.DeviceVerityInfo{RootDigest: "abcd"}, false)
+	if err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+}
+
+func Test_Mount_Encrypted_Requires_Writable(t *testing.T) {
+	clearTestDependencies()
+
+	err := Mount(context.Background(), 0, 1, "/fake/path", true, nil, true)
+	if err == nil {
+		t.Fatal("expected read-only encrypted mount to fail")
+	}
+}
+
+func Test_Mount_Encrypted_Source(t *testing.T) {
+	clearTestDependencies()
+
+	// NOTE: Do NOT set osRemoveAll because the mount succeeds. Expect it not to
+	// be called.
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		return "/dev/sdb", nil
+	}
+	osStat = func(name string) (os.FileInfo, error) {
+		return nil, nil
+	}
+	createCryptDevice = func(ctx context.Context, name, source string) (string, error) {
+		if name != "dm-crypt-scsi0-1" || source != "/dev/sdb" {
+			t.Errorf("unexpected crypt device %s over %s", name, source)
+		}
+		return "/dev/mapper/" + name, nil
+	}
+	formatted := false
+	formatExt4 = func(ctx context.Context, path string) error {
+		formatted = path == "/dev/mapper/dm-crypt-scsi0-1"
+		return nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		if !formatted {
+			t.Error("expected the crypt device to be formatted before mount")
+		}
+		if source != "/dev/mapper/dm-crypt-scsi0-1" {
+			t.Errorf("expected source: /dev/mapper/dm-crypt-scsi0-1, got: %s", source)
+			return errors.New("unexpected source")
+		}
+		return nil
+	}
+	err := Mount(context.Background(), 0, 1, "/fake/path", false, nil, true)
+	if err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+}
+
+func Test_Mount_Encrypted_Format_Fails_RemovesDevice(t *testing.T) {
+	clearTestDependencies()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	osRemoveAll = func(path string) error {
+		return nil
+	}
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		return "/dev/sdb", nil
+	}
+	osStat = func(name string) (os.FileInfo, error) {
+		return nil, nil
+	}
+	createCryptDevice = func(ctx context.Context, name, source string) (string, error) {
+		return "/dev/mapper/" + name, nil
+	}
+	expectedErr := errors.New("mkfs failed")
+	formatExt4 = func(ctx context.Context, path string) error {
+		return expectedErr
+	}
+	removed := ""
+	removeDevice = func(name string) error {
+		removed = name
+		return nil
+	}
+	err := Mount(context.Background(), 0, 1, "/fake/path", false, nil, true)
+	if err != expectedErr {
+		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
+	}
+	if removed != "dm-crypt-scsi0-1" {
+		t.Fatalf("expected dm-crypt-scsi0-1 to be removed, got: %q", removed)
+	}
+}
+
+func Test_Mount_Encrypted_Format_IgnoresDeadline(t *testing.T) {
+	clearTestDependencies()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		return "/dev/sdb", nil
+	}
+	osStat = func(name string) (os.FileInfo, error) {
+		return nil, nil
+	}
+	createCryptDevice = func(ctx context.Context, name, source string) (string, error) {
+		return "/dev/mapper/" + name, nil
+	}
+	formatExt4 = func(ctx context.Context, path string) error {
+		if _, ok := ctx.Deadline(); ok {
+			t.Error("expected the format to have no deadline")
+		}
+		if ctx.Done() != nil || ctx.Err() != nil {
+			t.Error("expected the format to not be canceled")
+		}
+		return nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if err := Mount(ctx, 0, 1, "/fake/path", false, nil, true); err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+}
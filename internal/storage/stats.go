@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/oc"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	// MountLatency is the time in milliseconds taken to mount a device or
+	// filesystem.
+	MountLatency = stats.Float64("opengcs/storage/mount_latency", "The time taken to mount a device or filesystem", stats.UnitMilliseconds)
+
+	// KeyMountType is the kind of mount, for example "scsi" or "overlay".
+	KeyMountType, _ = tag.NewKey("mount_type")
+
+	// Views are the views of the storage measures to register with
+	// `view.Register`.
+	Views = []*view.View{
+		{
+			Name:        "opengcs/storage/mount_latency",
+			Measure:     MountLatency,
+			Description: "The distribution of the time taken by successful mounts",
+			TagKeys:     []tag.Key{KeyMountType},
+			Aggregation: oc.LatencyDistribution,
+		},
+	}
+)
+
+// RecordMountLatency records the time elapsed since `start` to `MountLatency`
+// for a successful mount of `mountType`.
+func RecordMountLatency(ctx context.Context, mountType string, start time.Time) {
+	oc.RecordLatency(ctx, MountLatency, start, tag.Upsert(KeyMountType, mountType))
+}
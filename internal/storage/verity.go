@@ -0,0 +1,64 @@
+// +build linux
+
+package storage
+
+import (
+	"context"
+
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage/devicemapper"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Test dependencies
+var (
+	createDevice = devicemapper.CreateDevice
+)
+
+// CreateVerityDevice creates the read-only device-mapper device `name` that
+// verifies the ext4 filesystem of the block device `source` against the hash
+// tree described by `info`. It returns the path of the new device.
+//
+// Blocks that do not match the root digest of the hash tree cannot be read,
+// so a device that was tampered with fails to mount.
+func CreateVerityDevice(ctx context.Context, name, source string, info *prot.DeviceVerityInfo) (_ string, err error) {
+	_, span := trace.StartSpan(ctx, "storage::CreateVerityDevice")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.StringAttribute("name", name),
+		trace.StringAttribute("source", source),
+		trace.StringAttribute("rootDigest", info.RootDigest))
+
+	if info.RootDigest == "" {
+		return "", errors.New("verity info has no root digest")
+	}
+	if info.BlockSize <= 0 || info.Ext4SizeInBytes <= 0 || info.Ext4SizeInBytes%int64(info.BlockSize) != 0 {
+		return "", errors.Errorf("invalid verity block size %d for ext4 size %d", info.BlockSize, info.Ext4SizeInBytes)
+	}
+	// The hash tree is appended to the filesystem, after the superblock if
+	// there is one.
+	dataBlocks := info.Ext4SizeInBytes / int64(info.BlockSize)
+	hashStart := dataBlocks
+	if info.SuperBlock {
+		hashStart++
+	}
+	target := devicemapper.VerityTarget(source, source, devicemapper.VerityParams{
+		Version:        info.Version,
+		DataBlockSize:  info.BlockSize,
+		HashBlockSize:  info.BlockSize,
+		DataBlocks:     dataBlocks,
+		HashStartBlock: hashStart,
+		Algorithm:      info.HashAlgorithm(),
+		RootDigest:     info.RootDigest,
+		Salt:           info.Salt,
+	})
+	p, err := createDevice(name, devicemapper.CreateReadOnly, []devicemapper.Target{target})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create dm-verity device %s over %s", name, source)
+	}
+	return p, nil
+}
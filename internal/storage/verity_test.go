@@ -0,0 +1,61 @@
+// +build linux
+
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Microsoft/opengcs/internal/storage/devicemapper"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+)
+
+func Test_CreateVerityDevice_Target(t *testing.T) {
+	info := &prot.DeviceVerityInfo{
+		Ext4SizeInBytes: 8192,
+		Version:         1,
+		SuperBlock:      true,
+		RootDigest:      "abcd",
+		BlockSize:       4096,
+	}
+	createDevice = func(name string, flags devicemapper.CreateFlags, targets []devicemapper.Target) (string, error) {
+		if name != "dm-verity-test" {
+			t.Errorf("expected name: dm-verity-test, got: %s", name)
+		}
+		if flags&devicemapper.CreateReadOnly == 0 {
+			t.Error("expected a read-only device")
+		}
+		if len(targets) != 1 {
+			t.Fatalf("expected 1 target got: %d", len(targets))
+		}
+		// The 2 data blocks are followed by the superblock.
+		expected := "1 /dev/pmem0 /dev/pmem0 4096 4096 2 3 sha256 abcd -"
+		if targets[0].Type != "verity" || targets[0].Params != expected || targets[0].Length != 16 {
+			t.Errorf("expected verity target %q of 16 sectors got: %+v", expected, targets[0])
+		}
+		return "/dev/mapper/" + name, nil
+	}
+	p, err := CreateVerityDevice(context.Background(), "dm-verity-test", "/dev/pmem0", info)
+	if err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if p != "/dev/mapper/dm-verity-test" {
+		t.Fatalf("expected path: /dev/mapper/dm-verity-test, got: %s", p)
+	}
+}
+
+func Test_CreateVerityDevice_Invalid(t *testing.T) {
+	createDevice = func(name string, flags devicemapper.CreateFlags, targets []devicemapper.Target) (string, error) {
+		return "", errors.New("unexpected create")
+	}
+	for _, info := range []*prot.DeviceVerityInfo{
+		{Ext4SizeInBytes: 8192, BlockSize: 4096},
+		{Ext4SizeInBytes: 8000, BlockSize: 4096, RootDigest: "abcd"},
+		{Ext4SizeInBytes: 8192, RootDigest: "abcd"},
+	} {
+		if _, err := CreateVerityDevice(context.Background(), "dm-verity-test", "/dev/pmem0", info); err == nil {
+			t.Fatalf("expected error for verity info %+v", info)
+		}
+	}
+}
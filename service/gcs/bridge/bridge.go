@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"sync"
@@ -55,13 +56,52 @@ func (f HandlerFunc) ServeMsg(r *Request) (RequestResponse, error) {
 // Mux is a protocol multiplexer for request response pairs
 // following the bridge protocol.
 type Mux struct {
-	mu sync.Mutex
-	m  map[prot.MessageIdentifier]map[prot.ProtocolVersion]Handler
+	mu          sync.Mutex
+	m           map[prot.MessageIdentifier]map[prot.ProtocolVersion]Handler
+	timeouts    map[prot.MessageIdentifier]time.Duration
+	middlewares []Middleware
 }
 
 // NewBridgeMux creates a default bridge multiplexer.
 func NewBridgeMux() *Mux {
-	return &Mux{m: make(map[prot.MessageIdentifier]map[prot.ProtocolVersion]Handler)}
+	return &Mux{
+		m:        make(map[prot.MessageIdentifier]map[prot.ProtocolVersion]Handler),
+		timeouts: make(map[prot.MessageIdentifier]time.Duration),
+	}
+}
+
+// SetTimeout sets the deadline applied to every request of type `id` before
+// its handler is called. If the deadline is hit the request fails with
+// `gcserr.HvVmcomputeTimeout`. A `timeout` <= 0 removes the deadline.
+//
+// A handler that does not honor the cancellation of its context may still
+// complete the request after the deadline. The bridge does not run another
+// request for the same container until it returns.
+func (mux *Mux) SetTimeout(id prot.MessageIdentifier, timeout time.Duration) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if timeout <= 0 {
+		delete(mux.timeouts, id)
+		return
+	}
+	mux.timeouts[id] = timeout
+}
+
+// Use appends `mw` to the middlewares that wrap every handler served by
+// `mux`. The first middleware registered is the outermost, so it sees the
+// request first and the response last. Middlewares also see requests that
+// have no registered handler and requests that time out.
+func (mux *Mux) Use(mw ...Middleware) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	for _, m := range mw {
+		if m == nil {
+			panic("bridge: nil middleware")
+		}
+	}
+	mux.middlewares = append(mux.middlewares, mw...)
 }
 
 // Handle registers the handler for the given message id and protocol version.
@@ -119,13 +159,94 @@ func (mux *Mux) Handler(r *Request) Handler {
 	return h
 }
 
-// ServeMsg dispatches the request to the handler whose
-// type matches the request type.
+// ServeMsg dispatches the request through the middlewares to the handler
+// whose type matches the request type.
+//
+// If a timeout is set for the request type, or the request context can be
+// cancelled, ServeMsg returns as soon as the context is done even if the
+// handler has not yet returned.
 func (mux *Mux) ServeMsg(r *Request) (RequestResponse, error) {
-	h := mux.Handler(r)
+	mux.mu.Lock()
+	var h Handler = HandlerFunc(mux.serveWithDeadline)
+	for i := len(mux.middlewares) - 1; i >= 0; i-- {
+		h = mux.middlewares[i](h)
+	}
+	mux.mu.Unlock()
+
 	return h.ServeMsg(r)
 }
 
+// serveWithDeadline calls the handler registered for `r` and enforces the
+// timeout for its type and the cancellation of its context.
+func (mux *Mux) serveWithDeadline(r *Request) (RequestResponse, error) {
+	h := mux.Handler(r)
+
+	mux.mu.Lock()
+	timeout := mux.timeouts[r.Header.Type]
+	mux.mu.Unlock()
+
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		rc := *r
+		rc.Context = ctx
+		r = &rc
+	}
+	if ctx.Done() == nil {
+		// The context can never be done so there is nothing to wait on.
+		return h.ServeMsg(r)
+	}
+
+	type result struct {
+		resp     RequestResponse
+		err      error
+		panicked interface{}
+	}
+	resultChan := make(chan result, 1)
+	if r.handlers != nil {
+		r.handlers.Add(1)
+	}
+	go func() {
+		if r.handlers != nil {
+			defer r.handlers.Done()
+		}
+		// A panic in the handler is handed back to the calling goroutine so
+		// that it can be recovered by the middlewares.
+		defer func() {
+			if p := recover(); p != nil {
+				resultChan <- result{panicked: p}
+			}
+		}()
+		resp, err := h.ServeMsg(r)
+		resultChan <- result{resp: resp, err: err}
+	}()
+
+	select {
+	case res := <-resultChan:
+		if res.panicked != nil {
+			panic(res.panicked)
+		}
+		return res.resp, res.err
+	case <-ctx.Done():
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			return nil, gcserr.WrapHresult(
+				errors.Errorf("bridge: %v request timed out after %v", r.Header.Type, timeout),
+				gcserr.HvVmcomputeTimeout)
+		default:
+			return nil, gcserr.WrapHresult(
+				errors.Errorf("bridge: %v request was cancelled", r.Header.Type),
+				gcserr.HrErrCancelled)
+		}
+	}
+}
+
 // Request is the bridge request that has been sent.
 type Request struct {
 	// Context is the request context received from the bridge.
@@ -143,6 +264,12 @@ type Request struct {
 	// Version is the version of the protocol that `Header` and `Message` were
 	// sent in.
 	Version prot.ProtocolVersion
+
+	// conn is the connection the request was read from.
+	conn *connection
+	// handlers tracks the handler goroutines of the request, which can still
+	// be running after `ServeMsg` returned on a timeout or cancellation.
+	handlers *sync.WaitGroup
 }
 
 // RequestResponse is the base response for any bridge message request.
@@ -150,6 +277,10 @@ type RequestResponse interface {
 	Base() *prot.MessageResponseBase
 }
 
+// DefaultMaxMessageSize is the maximum size of a message read from the bridge
+// when `Bridge.MaxMessageSize` is not set.
+const DefaultMaxMessageSize = 4 * 1024 * 1024
+
 type bridgeResponse struct {
 	// ctx is the context created on request read
 	ctx      context.Context
@@ -175,10 +306,31 @@ type Bridge struct {
 	Handler Handler
 	// EnableV4 enables the v4+ bridge and the schema v2+ interfaces.
 	EnableV4 bool
-
-	// responseChan is the response channel used for both request/response
-	// and publish notification workflows.
-	responseChan chan bridgeResponse
+	// MaxMessageSize is the maximum size in bytes, including the header, of a
+	// message read from the bridge. Larger messages are answered with an
+	// error without reading them into memory. If 0 `DefaultMaxMessageSize` is
+	// used.
+	MaxMessageSize uint32
+	// MaxConcurrentRequests is the maximum number of requests that are
+	// handled at once. Once reached no more requests are read from the host
+	// until one completes. Process waits and cancels are not counted. If <= 0
+	// `DefaultMaxConcurrentRequests` is used.
+	MaxConcurrentRequests int
+	// ResponseQueueSize is the number of responses that can wait to be written
+	// to the host before handlers block. If <= 0 `DefaultResponseQueueSize`
+	// is used.
+	ResponseQueueSize int
+	// NotificationQueueSize is the number of notifications that can wait to be
+	// written to the host, including while it is disconnected, before the
+	// oldest ones are dropped. Exit notifications are never dropped. If <= 0
+	// `DefaultNotificationQueueSize` is used.
+	NotificationQueueSize int
+
+	// notifications holds the published notifications until they are written
+	// to the host. It outlives any one connection so that notifications
+	// published while the bridge is disconnected are not lost.
+	notifications     *notificationQueue
+	notificationsOnce sync.Once
 
 	hostState *hcsv2.Host
 
@@ -186,15 +338,68 @@ type Bridge struct {
 	// hasQuitPending when != 0 will cause no more requests to be Read.
 	hasQuitPending uint32
 
+	// protVer is the protocol version each connection starts with before the
+	// host negotiates one.
 	protVer prot.ProtocolVersion
 }
 
+// connection is the state of the bridge that lasts for a single connection to
+// the host.
+type connection struct {
+	// protVer is the protocol version negotiated on the connection. It must be
+	// accessed atomically.
+	protVer uint32
+	// negotiated is closed once the response to the protocol negotiation is
+	// written. No notifications are written to the connection before then.
+	negotiated     chan struct{}
+	negotiatedOnce sync.Once
+
+	// pendingMutex guards pending.
+	pendingMutex sync.Mutex
+	// pending holds the cancel func of each in-flight request by its
+	// `SequenceID` so that it can be cancelled by a
+	// `ComputeSystemCancelRequestV1`.
+	pending map[prot.SequenceID]context.CancelFunc
+}
+
+func newConnection(ver prot.ProtocolVersion) *connection {
+	conn := &connection{
+		negotiated: make(chan struct{}),
+		pending:    make(map[prot.SequenceID]context.CancelFunc),
+	}
+	if ver != prot.PvInvalid {
+		conn.setProtocolVersion(ver)
+		conn.markNegotiated()
+	}
+	return conn
+}
+
+// protocolVersion returns the protocol version negotiated on the connection.
+func (conn *connection) protocolVersion() prot.ProtocolVersion {
+	return prot.ProtocolVersion(atomic.LoadUint32(&conn.protVer))
+}
+
+// setProtocolVersion sets the protocol version negotiated on the connection.
+func (conn *connection) setProtocolVersion(ver prot.ProtocolVersion) {
+	atomic.StoreUint32(&conn.protVer, uint32(ver))
+}
+
+// markNegotiated releases the notifications waiting to be written to the
+// connection.
+func (conn *connection) markNegotiated() {
+	conn.negotiatedOnce.Do(func() { close(conn.negotiated) })
+}
+
 // AssignHandlers creates and assigns the appropriate bridge
 // events to be listen for and intercepted on `mux` before forwarding
 // to `gcs` for handling.
 func (b *Bridge) AssignHandlers(mux *Mux, host *hcsv2.Host) {
 	b.hostState = host
 
+	// Tracing is outermost so that the span records the error returned for a
+	// recovered panic.
+	mux.Use(TracingMiddleware, MetricsMiddleware(statsRecorder{}), LoggingMiddleware, RecoveryMiddleware)
+
 	// These are PvInvalid because they will be called previous to any protocol
 	// negotiation so they respond only when the protocols are not known.
 	if b.EnableV4 {
@@ -215,6 +420,15 @@ func (b *Bridge) AssignHandlers(mux *Mux, host *hcsv2.Host) {
 		mux.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV4, b.modifySettingsV2)
 		mux.HandleFunc(prot.ComputeSystemDumpStacksV1, prot.PvV4, b.dumpStacksV2)
 		mux.HandleFunc(prot.ComputeSystemDeleteContainerStateV1, prot.PvV4, b.deleteContainerStateV2)
+		mux.HandleFunc(prot.ComputeSystemCancelRequestV1, prot.PvV4, b.cancelRequestV2)
+		mux.HandleFunc(prot.ComputeSystemPauseV1, prot.PvV4, b.pauseContainerV2)
+		mux.HandleFunc(prot.ComputeSystemResumeV1, prot.PvV4, b.resumeContainerV2)
+		mux.HandleFunc(prot.ComputeSystemCheckpointV1, prot.PvV4, b.checkpointContainerV2)
+		mux.HandleFunc(prot.ComputeSystemRestoreV1, prot.PvV4, b.restoreContainerV2)
+
+		for id, timeout := range defaultTimeouts {
+			mux.SetTimeout(id, timeout)
+		}
 	}
 }
 
@@ -223,21 +437,71 @@ func (b *Bridge) AssignHandlers(mux *Mux, host *hcsv2.Host) {
 // event in an asynchronous manner.
 func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser) error {
 	requestChan := make(chan *Request)
-	requestErrChan := make(chan error)
-	b.responseChan = make(chan bridgeResponse)
-	responseErrChan := make(chan error)
+	requestErrChan := make(chan error, 1)
+	conn := newConnection(b.protVer)
+	notifications := b.notificationQueue()
+	responses := newResponseQueue(b.responseQueueSize(), notifications)
+	if b.hostState != nil {
+		// The containers recovered after a GCS restart were created by the
+		// previous instance, so their events were never published.
+		for _, c := range b.hostState.TakeRecoveredContainers() {
+			b.publishContainerEvents(context.Background(), prot.MessageBase{ContainerID: c.ID()}, c)
+		}
+	}
+	responseErrChan := make(chan error, 1)
 	b.quitChan = make(chan bool)
-
+	// done is closed on return so that any handler still in flight does not
+	// block or panic trying to write its response.
+	done := make(chan struct{})
+	// written is closed once the response writer exits. The writer of the
+	// next connection must not take notifications before one that failed to
+	// be written here is queued again, so wait for it on return.
+	written := make(chan struct{})
+
+	defer func() { <-written }()
 	defer close(b.quitChan)
 	defer bridgeOut.Close()
-	defer close(responseErrChan)
-	defer close(b.responseChan)
-	defer close(requestChan)
-	defer close(requestErrChan)
+	defer close(done)
 	defer bridgeIn.Close()
+	// The host cannot receive the responses to the requests still in flight,
+	// so release any that are waiting.
+	defer conn.cancelPendingRequests()
+
+	// Process each bridge request async, limited and ordered by the
+	// scheduler, and queue its response.
+	serve := func(r *Request) {
+		br := bridgeResponse{
+			ctx: r.Context,
+			header: &prot.MessageHeader{
+				Type: prot.GetResponseIdentifier(r.Header.Type),
+				ID:   r.Header.ID,
+			},
+		}
+		resp, err := b.Handler.ServeMsg(r)
+		conn.removePendingRequest(r.Header.ID)
+		if resp == nil {
+			resp = &prot.MessageResponseBase{}
+		}
+		resp.Base().ActivityID = r.ActivityID
+		if err != nil {
+			span := trace.FromContext(r.Context)
+			if span != nil {
+				oc.SetSpanStatus(span, err)
+			}
+			setErrorForResponseBase(resp.Base(), err)
+		}
+		br.response = resp
+		responses.pushResponse(br, done)
+		// A handler that timed out or was cancelled may still be changing
+		// the state of the container. Do not release the request, and with it
+		// the next request for the container, until it returns.
+		r.handlers.Wait()
+	}
+	scheduler := newRequestScheduler(b.maxConcurrentRequests(), serve)
 
 	// Receive bridge requests and schedule them to be processed.
 	go func() {
+		defer close(requestChan)
 		var recverr error
 		for {
 			if atomic.LoadUint32(&b.hasQuitPending) == 0 {
@@ -249,21 +513,54 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 					recverr = errors.Wrap(err, "bridge: failed reading message header")
 					break
 				}
-				message := make([]byte, header.Size-prot.MessageHeaderSize)
-				if _, err := io.ReadFull(bridgeIn, message); err != nil {
-					if err == io.ErrUnexpectedEOF || err == os.ErrClosed {
+				// frameErr is set for a frame that can be read but not
+				// dispatched. It is answered with an error response rather than
+				// tearing down the connection.
+				var frameErr error
+				var message []byte
+				if header.Size < prot.MessageHeaderSize {
+					// The size cannot be trusted so treat the frame as header
+					// only.
+					frameErr = gcserr.WrapHresult(
+						errors.Errorf("bridge: invalid message size %d", header.Size),
+						gcserr.HrVmcomputeInvalidJSON)
+				} else if header.Size > b.maxMessageSize() {
+					// Skip the payload without allocating it so the stream
+					// stays in sync.
+					if _, err := io.CopyN(ioutil.Discard, bridgeIn, int64(header.Size-prot.MessageHeaderSize)); err != nil {
+						if err == io.EOF || err == os.ErrClosed {
+							break
+						}
+						recverr = errors.Wrap(err, "bridge: failed discarding message payload")
+						break
+					}
+					frameErr = gcserr.WrapHresult(
+						errors.Errorf("bridge: message size %d exceeds the maximum of %d", header.Size, b.maxMessageSize()),
+						gcserr.HrVmcomputeInvalidJSON)
+				} else {
+					message = make([]byte, header.Size-prot.MessageHeaderSize)
+					if _, err := io.ReadFull(bridgeIn, message); err != nil {
+						if err == io.ErrUnexpectedEOF || err == os.ErrClosed {
+							break
+						}
+						recverr = errors.Wrap(err, "bridge: failed reading message payload")
 						break
 					}
-					recverr = errors.Wrap(err, "bridge: failed reading message payload")
-					break
+				}
+
+				if frameErr == nil {
+					if err := header.ValidateRequest(); err != nil {
+						frameErr = gcserr.WrapHresult(errors.Wrap(err, "bridge"), gcserr.HrVmcomputeUnknownMessage)
+					}
 				}
 
 				base := prot.MessageBase{}
-				if err := json.Unmarshal(message, &base); err != nil {
-					// TODO: JTERRY75 - This should fail the request but right
-					// now we still forward to the method and let them return
-					// this error. Unify the JSON part previous to invoking a
-					// request.
+				if frameErr == nil {
+					if err := json.Unmarshal(message, &base); err != nil {
+						frameErr = gcserr.WrapHresult(
+							errors.Wrapf(err, "bridge: failed to unmarshal MessageBase in message \"%s\"", message),
+							gcserr.HrVmcomputeInvalidJSON)
+					}
 				}
 
 				var ctx context.Context
@@ -298,52 +595,51 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 					trace.StringAttribute("activityID", base.ActivityID),
 					trace.StringAttribute("cid", base.ContainerID))
 
+				if frameErr != nil {
+					log.G(ctx).WithError(frameErr).Error("request rejected")
+					responses.pushResponse(newErrorResponse(ctx, header, "", frameErr), done)
+					continue
+				}
+
+				ctx = conn.addPendingRequest(ctx, header.ID)
+
 				log.G(ctx).WithField("message", string(message)).Debug("request read message")
 
-				requestChan <- &Request{
+				req := &Request{
 					Context:     ctx,
 					Header:      header,
 					ContainerID: base.ContainerID,
 					ActivityID:  base.ActivityID,
 					Message:     message,
-					Version:     b.protVer,
+					Version:     conn.protocolVersion(),
+					conn:        conn,
+					handlers:    &sync.WaitGroup{},
+				}
+				// Process waits and cancels do not wait for the scheduler,
+				// which may be blocked on the requests they are for.
+				if unscheduledRequests[header.Type] {
+					go serve(req)
+					continue
 				}
+				requestChan <- req
 			}
 		}
 		requestErrChan <- recverr
 	}()
-	// Process each bridge request async and create the response writer.
 	go func() {
 		for req := range requestChan {
-			go func(r *Request) {
-				br := bridgeResponse{
-					ctx: r.Context,
-					header: &prot.MessageHeader{
-						Type: prot.GetResponseIdentifier(r.Header.Type),
-						ID:   r.Header.ID,
-					},
-				}
-				resp, err := b.Handler.ServeMsg(r)
-				if resp == nil {
-					resp = &prot.MessageResponseBase{}
-				}
-				resp.Base().ActivityID = r.ActivityID
-				if err != nil {
-					span := trace.FromContext(r.Context)
-					if span != nil {
-						oc.SetSpanStatus(span, err)
-					}
-					setErrorForResponseBase(resp.Base(), err)
-				}
-				br.response = resp
-				b.responseChan <- br
-			}(req)
+			scheduler.schedule(req)
 		}
 	}()
 	// Process each bridge response sync. This channel is for request/response and publish workflows.
 	go func() {
+		defer close(written)
 		var resperr error
-		for resp := range b.responseChan {
+		for {
+			resp, ok := responses.pop(conn.negotiated, done)
+			if !ok {
+				return
+			}
 			responseBytes, err := json.Marshal(resp.response)
 			if err != nil {
 				resperr = errors.Wrapf(err, "bridge: failed to marshal JSON for response \"%v\"", resp.response)
@@ -352,13 +648,20 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 			resp.header.Size = uint32(len(responseBytes) + prot.MessageHeaderSize)
 			if err := binary.Write(bridgeOut, binary.LittleEndian, resp.header); err != nil {
 				resperr = errors.Wrap(err, "bridge: failed writing message header")
+				requeueNotification(notifications, resp)
 				break
 			}
 
 			if _, err := bridgeOut.Write(responseBytes); err != nil {
 				resperr = errors.Wrap(err, "bridge: failed writing message payload")
+				requeueNotification(notifications, resp)
 				break
 			}
+			// The host expects the negotiation response before any
+			// notification.
+			if resp.header.Type == prot.ComputeSystemResponseNegotiateProtocolV1 && conn.protocolVersion() != prot.PvInvalid {
+				conn.markNegotiated()
+			}
 
 			s := trace.FromContext(resp.ctx)
 			if s != nil {
@@ -396,7 +699,170 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 	}
 }
 
-// PublishNotification writes a specific notification to the bridge.
+var (
+	// reconnectMinDelay is the delay before the first attempt to dial the host
+	// again. It doubles after each failed attempt up to reconnectMaxDelay.
+	reconnectMinDelay = 100 * time.Millisecond
+	reconnectMaxDelay = 5 * time.Second
+)
+
+// ServeWithReconnect serves the bridge on the connection returned by `dial`.
+// When the connection is lost, such as when the host agent restarts, the host
+// is dialed again until it succeeds and the protocol must be negotiated again.
+// The notifications published while disconnected are written once it is. The
+// containers and processes in the guest are left running throughout.
+//
+// Notifications are buffered only up to `NotificationQueueSize`. If more are
+// published during a long disconnect the oldest are dropped and a warning is
+// logged, so the host can miss OOM and other events. Exit notifications are
+// always kept.
+//
+// It keeps serving until a request shuts down the UVM.
+func (b *Bridge) ServeWithReconnect(dial func() (io.ReadWriteCloser, error)) error {
+	delay := reconnectMinDelay
+	for {
+		conn, err := dial()
+		if err != nil {
+			logrus.WithError(err).WithField("delay", delay).Warn("failed to dial host connection, retrying")
+			time.Sleep(delay)
+			if delay *= 2; delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+			continue
+		}
+		delay = reconnectMinDelay
+
+		err = b.ListenAndServe(conn, conn)
+		if atomic.LoadUint32(&b.hasQuitPending) != 0 {
+			return err
+		}
+		logrus.WithError(err).Warn("lost host connection, reconnecting")
+		// Only the first connection can skip the protocol negotiation.
+		b.protVer = prot.PvInvalid
+	}
+}
+
+// maxMessageSize returns the maximum size of a message that will be read from
+// the bridge.
+func (b *Bridge) maxMessageSize() uint32 {
+	if b.MaxMessageSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return b.MaxMessageSize
+}
+
+// maxConcurrentRequests returns the maximum number of requests handled at
+// once.
+func (b *Bridge) maxConcurrentRequests() int {
+	if b.MaxConcurrentRequests <= 0 {
+		return DefaultMaxConcurrentRequests
+	}
+	return b.MaxConcurrentRequests
+}
+
+// responseQueueSize returns the number of responses that can wait to be
+// written.
+func (b *Bridge) responseQueueSize() int {
+	if b.ResponseQueueSize <= 0 {
+		return DefaultResponseQueueSize
+	}
+	return b.ResponseQueueSize
+}
+
+// notificationQueueSize returns the number of notifications that can wait to
+// be written.
+func (b *Bridge) notificationQueueSize() int {
+	if b.NotificationQueueSize <= 0 {
+		return DefaultNotificationQueueSize
+	}
+	return b.NotificationQueueSize
+}
+
+// newErrorResponse creates the response to the request described by `header`
+// for a failure that happened before it could be dispatched.
+func newErrorResponse(ctx context.Context, header *prot.MessageHeader, activityID string, err error) bridgeResponse {
+	if span := trace.FromContext(ctx); span != nil {
+		oc.SetSpanStatus(span, err)
+	}
+	resp := &prot.MessageResponseBase{ActivityID: activityID}
+	setErrorForResponseBase(resp, err)
+	return bridgeResponse{
+		ctx: ctx,
+		header: &prot.MessageHeader{
+			Type: prot.GetResponseIdentifier(header.Type),
+			ID:   header.ID,
+		},
+		response: resp,
+	}
+}
+
+// addPendingRequest returns a copy of `ctx` that is cancelled when either the
+// request `id` completes or a `ComputeSystemCancelRequestV1` for it is
+// received.
+func (conn *connection) addPendingRequest(ctx context.Context, id prot.SequenceID) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+
+	conn.pendingMutex.Lock()
+	defer conn.pendingMutex.Unlock()
+	conn.pending[id] = cancel
+	return ctx
+}
+
+// removePendingRequest releases the context of the request `id`.
+func (conn *connection) removePendingRequest(id prot.SequenceID) {
+	conn.pendingMutex.Lock()
+	defer conn.pendingMutex.Unlock()
+	if cancel, ok := conn.pending[id]; ok {
+		cancel()
+		delete(conn.pending, id)
+	}
+}
+
+// cancelPendingRequest cancels the context of the in-flight request `id`. It
+// returns false if there is no such request.
+func (conn *connection) cancelPendingRequest(id prot.SequenceID) bool {
+	conn.pendingMutex.Lock()
+	defer conn.pendingMutex.Unlock()
+	cancel, ok := conn.pending[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// cancelPendingRequests cancels the context of every in-flight request.
+func (conn *connection) cancelPendingRequests() {
+	conn.pendingMutex.Lock()
+	defer conn.pendingMutex.Unlock()
+	for _, cancel := range conn.pending {
+		cancel()
+	}
+}
+
+// notificationQueue returns the queue of notifications waiting to be written
+// to the host.
+func (b *Bridge) notificationQueue() *notificationQueue {
+	b.notificationsOnce.Do(func() {
+		b.notifications = newNotificationQueue(b.notificationQueueSize())
+	})
+	return b.notifications
+}
+
+// requeueNotification queues `resp` to be written to the next connection,
+// before any other notification, if it is a notification that failed to be
+// written to the current one.
+func requeueNotification(notifications *notificationQueue, resp bridgeResponse) {
+	if resp.header.Type != prot.ComputeSystemNotificationV1 {
+		return
+	}
+	notifications.pushFront(resp)
+}
+
+// PublishNotification writes a specific notification to the bridge. If the
+// bridge is not connected, or the protocol is not yet negotiated, the
+// notification is written once it is. It never blocks: if more than
+// `NotificationQueueSize` notifications are waiting to be written, older ones
+// other than exits are dropped.
 func (b *Bridge) PublishNotification(n *prot.ContainerNotification) {
 	ctx, span := trace.StartSpan(context.Background(), "opengcs::bridge::PublishNotification")
 	span.AddAttributes(trace.StringAttribute("notification", fmt.Sprintf("%+v", n)))
@@ -411,7 +877,7 @@ func (b *Bridge) PublishNotification(n *prot.ContainerNotification) {
 		},
 		response: n,
 	}
-	b.responseChan <- resp
+	b.notificationQueue().push(resp)
 }
 
 // setErrorForResponseBase modifies the passed-in MessageResponseBase to
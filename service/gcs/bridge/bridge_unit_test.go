@@ -1,14 +1,17 @@
 package bridge
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/Microsoft/opengcs/service/gcs/gcserr"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
@@ -594,18 +597,18 @@ func Test_Bridge_ListenAndServe_HandlersAreAsync_Success(t *testing.T) {
 
 	mux := NewBridgeMux()
 
-	orderWg := sync.WaitGroup{}
-	orderWg.Add(1)
+	// release is closed once the response to the second request has been
+	// read.
+	release := make(chan struct{})
 
 	firstFn := func(r *Request) (RequestResponse, error) {
-		// Wait for the second request to come in.
-		orderWg.Wait()
+		// Wait for the second request to be responded to.
+		<-release
 		return &prot.MessageResponseBase{
 			Result: 1,
 		}, nil
 	}
 	secondFn := func(r *Request) (RequestResponse, error) {
-		defer orderWg.Done()
 		return &prot.MessageResponseBase{
 			Result: 10,
 		}, nil
@@ -627,16 +630,17 @@ func Test_Bridge_ListenAndServe_HandlersAreAsync_Success(t *testing.T) {
 		b.quitChan <- true
 	}()
 
-	if err := serverSend(lc.CWrite(), prot.ComputeSystemResizeConsoleV1, prot.SequenceID(0), nil); err != nil {
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemResizeConsoleV1, prot.SequenceID(0), &prot.MessageBase{}); err != nil {
 		t.Error("Failed to send first message to server")
 		return
 	}
-	if err := serverSend(lc.CWrite(), prot.ComputeSystemModifySettingsV1, prot.SequenceID(1), nil); err != nil {
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemModifySettingsV1, prot.SequenceID(1), &prot.MessageBase{}); err != nil {
 		t.Error("Failed to send second message to server")
 		return
 	}
 
 	headerFirst, _, errFirst := serverRead(lc.CRead())
+	close(release)
 	if errFirst != nil {
 		t.Error("Failed to read first response from server")
 		return
@@ -661,3 +665,397 @@ func Test_Bridge_ListenAndServe_HandlersAreAsync_Success(t *testing.T) {
 		t.Error("Incorrect response order for 1st request")
 	}
 }
+
+func Test_Bridge_Mux_ServeMsg_Timeout(t *testing.T) {
+	m := NewBridgeMux()
+	m.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV4, func(r *Request) (RequestResponse, error) {
+		<-r.Context.Done()
+		return nil, r.Context.Err()
+	})
+	m.SetTimeout(prot.ComputeSystemModifySettingsV1, 10*time.Millisecond)
+
+	req := &Request{
+		Context: context.Background(),
+		Header: &prot.MessageHeader{
+			Type: prot.ComputeSystemModifySettingsV1,
+			ID:   prot.SequenceID(1),
+		},
+		Version: prot.PvV4,
+	}
+
+	_, err := m.ServeMsg(req)
+	if err == nil {
+		t.Fatal("expected timeout error got: nil")
+	}
+	if hr, _ := gcserr.GetHresult(err); hr != gcserr.HvVmcomputeTimeout {
+		t.Fatalf("expected HRESULT %v got: %v", gcserr.HvVmcomputeTimeout, hr)
+	}
+}
+
+func Test_Bridge_Mux_ServeMsg_Timeout_TracksHandler(t *testing.T) {
+	m := NewBridgeMux()
+	release := make(chan struct{})
+	m.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV4, func(r *Request) (RequestResponse, error) {
+		// Ignore the cancellation of the context.
+		<-release
+		return &prot.MessageResponseBase{}, nil
+	})
+	m.SetTimeout(prot.ComputeSystemModifySettingsV1, 10*time.Millisecond)
+
+	req := &Request{
+		Context: context.Background(),
+		Header: &prot.MessageHeader{
+			Type: prot.ComputeSystemModifySettingsV1,
+			ID:   prot.SequenceID(1),
+		},
+		Version:  prot.PvV4,
+		handlers: &sync.WaitGroup{},
+	}
+	if _, err := m.ServeMsg(req); err == nil {
+		t.Fatal("expected timeout error got: nil")
+	}
+
+	returned := make(chan struct{})
+	go func() {
+		req.handlers.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+		t.Fatal("expected the handler to still be tracked after the timeout")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the handler to return")
+	}
+}
+
+func Test_Bridge_Mux_ServeMsg_TimeoutRemoved(t *testing.T) {
+	m := NewBridgeMux()
+	m.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV4, func(r *Request) (RequestResponse, error) {
+		time.Sleep(20 * time.Millisecond)
+		return &prot.MessageResponseBase{}, nil
+	})
+	m.SetTimeout(prot.ComputeSystemModifySettingsV1, 10*time.Millisecond)
+	m.SetTimeout(prot.ComputeSystemModifySettingsV1, 0)
+
+	req := &Request{
+		Context: context.Background(),
+		Header: &prot.MessageHeader{
+			Type: prot.ComputeSystemModifySettingsV1,
+			ID:   prot.SequenceID(1),
+		},
+		Version: prot.PvV4,
+	}
+
+	if _, err := m.ServeMsg(req); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+}
+
+func Test_Bridge_ListenAndServe_CancelRequest_Success(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	lc := newLoopbackConnection()
+	defer lc.close()
+
+	mux := NewBridgeMux()
+	b := &Bridge{
+		Handler: mux,
+		protVer: prot.PvV4,
+	}
+	mux.HandleFunc(prot.ComputeSystemCancelRequestV1, prot.PvV4, b.cancelRequestV2)
+	mux.HandleFunc(prot.ComputeSystemExecuteProcessV1, prot.PvV4, func(r *Request) (RequestResponse, error) {
+		<-r.Context.Done()
+		return nil, r.Context.Err()
+	})
+
+	go func() {
+		if err := b.ListenAndServe(lc.SRead(), lc.SWrite()); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		b.quitChan <- true
+	}()
+
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemExecuteProcessV1, prot.SequenceID(1), &prot.MessageBase{}); err != nil {
+		t.Fatal("Failed to send exec message to server")
+	}
+	// Wait for the exec request to be in flight.
+	time.Sleep(50 * time.Millisecond)
+	cancel := &prot.CancelRequest{SequenceID: prot.SequenceID(1)}
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemCancelRequestV1, prot.SequenceID(2), cancel); err != nil {
+		t.Fatal("Failed to send cancel message to server")
+	}
+
+	for i := 0; i < 2; i++ {
+		header, body, err := serverRead(lc.CRead())
+		if err != nil {
+			t.Fatal("Failed to read response from server")
+		}
+		response := &prot.MessageResponseBase{}
+		if err := json.Unmarshal(body, response); err != nil {
+			t.Fatal("Failed to unmarshal response body from server")
+		}
+		switch header.ID {
+		case prot.SequenceID(1):
+			if response.Result != int32(gcserr.HrErrCancelled) {
+				t.Errorf("expected cancelled exec result got: %d", response.Result)
+			}
+		case prot.SequenceID(2):
+			if response.Result != 0 {
+				t.Errorf("expected successful cancel result got: %d", response.Result)
+			}
+		default:
+			t.Errorf("unexpected response id %d", header.ID)
+		}
+	}
+}
+
+func Test_Bridge_ListenAndServe_CancelRequest_NotFound(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	lc := newLoopbackConnection()
+	defer lc.close()
+
+	mux := NewBridgeMux()
+	b := &Bridge{
+		Handler: mux,
+		protVer: prot.PvV4,
+	}
+	mux.HandleFunc(prot.ComputeSystemCancelRequestV1, prot.PvV4, b.cancelRequestV2)
+
+	go func() {
+		if err := b.ListenAndServe(lc.SRead(), lc.SWrite()); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		b.quitChan <- true
+	}()
+
+	cancel := &prot.CancelRequest{SequenceID: prot.SequenceID(10)}
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemCancelRequestV1, prot.SequenceID(1), cancel); err != nil {
+		t.Fatal("Failed to send cancel message to server")
+	}
+	_, body, err := serverRead(lc.CRead())
+	if err != nil {
+		t.Fatal("Failed to read response from server")
+	}
+	response := &prot.MessageResponseBase{}
+	if err := json.Unmarshal(body, response); err != nil {
+		t.Fatal("Failed to unmarshal response body from server")
+	}
+	if response.Result != int32(gcserr.HrErrNotFound) {
+		t.Fatalf("expected not found result got: %d", response.Result)
+	}
+}
+
+func serverSendRaw(conn io.Writer, header prot.MessageHeader, body []byte) error {
+	if err := binary.Write(conn, binary.LittleEndian, header); err != nil {
+		return errors.Wrap(err, "bridge_test: failed to write message header")
+	}
+	if _, err := conn.Write(body); err != nil {
+		return errors.Wrap(err, "bridge_test: failed to write the message body")
+	}
+	return nil
+}
+
+// verifyRejected reads the next response and verifies it is a failure with
+// `hr` for the request `id`.
+func verifyRejected(t *testing.T, conn io.Reader, id prot.SequenceID, hr gcserr.Hresult) {
+	header, body, err := serverRead(conn)
+	if err != nil {
+		t.Fatal("Failed to read response from server")
+	}
+	response := &prot.MessageResponseBase{}
+	if err := json.Unmarshal(body, response); err != nil {
+		t.Fatal("Failed to unmarshal response body from server")
+	}
+	if header.ID != id {
+		t.Fatalf("expected response for id %d got: %d", id, header.ID)
+	}
+	if response.Result != int32(hr) {
+		t.Fatalf("expected result %v got: %d", hr, response.Result)
+	}
+	if len(response.ErrorRecords) != 1 {
+		t.Fatalf("expected 1 error record got: %d", len(response.ErrorRecords))
+	}
+}
+
+func Test_Bridge_ListenAndServe_MalformedFrames_Rejected(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	lc := newLoopbackConnection()
+	defer lc.close()
+
+	var called bool
+	mux := NewBridgeMux()
+	mux.HandleFunc(prot.ComputeSystemResizeConsoleV1, prot.PvV4, func(r *Request) (RequestResponse, error) {
+		called = true
+		return &prot.MessageResponseBase{}, nil
+	})
+	b := &Bridge{
+		Handler:        mux,
+		MaxMessageSize: 1024,
+		protVer:        prot.PvV4,
+	}
+
+	go func() {
+		if err := b.ListenAndServe(lc.SRead(), lc.SWrite()); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		b.quitChan <- true
+	}()
+
+	// Size smaller than the header.
+	if err := serverSendRaw(lc.CWrite(), prot.MessageHeader{Type: prot.ComputeSystemResizeConsoleV1, ID: 1, Size: 4}, nil); err != nil {
+		t.Fatal(err)
+	}
+	verifyRejected(t, lc.CRead(), 1, gcserr.HrVmcomputeInvalidJSON)
+
+	// Size larger than MaxMessageSize.
+	big := make([]byte, 2048)
+	if err := serverSendRaw(lc.CWrite(), prot.MessageHeader{Type: prot.ComputeSystemResizeConsoleV1, ID: 2, Size: uint32(len(big) + prot.MessageHeaderSize)}, big); err != nil {
+		t.Fatal(err)
+	}
+	verifyRejected(t, lc.CRead(), 2, gcserr.HrVmcomputeInvalidJSON)
+
+	// Not a request.
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemResponseResizeConsoleV1, 3, &prot.MessageBase{}); err != nil {
+		t.Fatal(err)
+	}
+	verifyRejected(t, lc.CRead(), 3, gcserr.HrVmcomputeUnknownMessage)
+
+	// Wrong category.
+	if err := serverSend(lc.CWrite(), prot.MessageIdentifier(prot.MtRequest|0x00200801), 4, &prot.MessageBase{}); err != nil {
+		t.Fatal(err)
+	}
+	verifyRejected(t, lc.CRead(), 4, gcserr.HrVmcomputeUnknownMessage)
+
+	// Wrong version.
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemResizeConsoleV1+1, 5, &prot.MessageBase{}); err != nil {
+		t.Fatal(err)
+	}
+	verifyRejected(t, lc.CRead(), 5, gcserr.HrVmcomputeUnknownMessage)
+
+	// MessageBase fails to unmarshal.
+	body := []byte("{not json")
+	if err := serverSendRaw(lc.CWrite(), prot.MessageHeader{Type: prot.ComputeSystemResizeConsoleV1, ID: 6, Size: uint32(len(body) + prot.MessageHeaderSize)}, body); err != nil {
+		t.Fatal(err)
+	}
+	verifyRejected(t, lc.CRead(), 6, gcserr.HrVmcomputeInvalidJSON)
+
+	if called {
+		t.Fatal("handler was called for a malformed frame")
+	}
+
+	// The connection is still usable.
+	if err := serverSend(lc.CWrite(), prot.ComputeSystemResizeConsoleV1, 7, &prot.MessageBase{}); err != nil {
+		t.Fatal(err)
+	}
+	header, body, err := serverRead(lc.CRead())
+	if err != nil {
+		t.Fatal("Failed to read response from server")
+	}
+	response := &prot.MessageResponseBase{}
+	if err := json.Unmarshal(body, response); err != nil {
+		t.Fatal("Failed to unmarshal response body from server")
+	}
+	if header.ID != 7 || response.Result != 0 {
+		t.Fatalf("expected success for id 7 got: id %d result %d", header.ID, response.Result)
+	}
+}
+
+// negotiate negotiates protocol version 4 on `conn` and returns the next
+// message written after the negotiation response.
+func negotiate(t *testing.T, conn net.Conn, id prot.SequenceID) (*prot.MessageHeader, []byte) {
+	message := prot.NegotiateProtocol{MinimumVersion: uint32(prot.PvV4), MaximumVersion: uint32(prot.PvV4)}
+	if err := serverSend(conn, prot.ComputeSystemNegotiateProtocolV1, id, message); err != nil {
+		t.Fatalf("failed to send negotiate protocol: %v", err)
+	}
+	header, _, err := serverRead(conn)
+	if err != nil {
+		t.Fatalf("failed to read negotiate protocol response: %v", err)
+	}
+	if header.Type != prot.ComputeSystemResponseNegotiateProtocolV1 || header.ID != id {
+		t.Fatalf("expected negotiate protocol response %d got: %v %d", id, header.Type, header.ID)
+	}
+	header, body, err := serverRead(conn)
+	if err != nil {
+		t.Fatalf("failed to read message after negotiation: %v", err)
+	}
+	return header, body
+}
+
+func verifyNotification(t *testing.T, header *prot.MessageHeader, body []byte, cid string) {
+	if header.Type != prot.ComputeSystemNotificationV1 {
+		t.Fatalf("expected notification got: %v", header.Type)
+	}
+	var n prot.ContainerNotification
+	if err := json.Unmarshal(body, &n); err != nil {
+		t.Fatalf("failed to unmarshal notification: %v", err)
+	}
+	if n.ContainerID != cid {
+		t.Fatalf("expected notification for %s got: %s", cid, n.ContainerID)
+	}
+}
+
+func Test_Bridge_ServeWithReconnect_ReplaysNotifications(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	oldMin, oldMax := reconnectMinDelay, reconnectMaxDelay
+	reconnectMinDelay, reconnectMaxDelay = time.Millisecond, 2*time.Millisecond
+	defer func() {
+		reconnectMinDelay, reconnectMaxDelay = oldMin, oldMax
+	}()
+
+	mux := NewBridgeMux()
+	b := &Bridge{Handler: mux}
+	mux.HandleFunc(prot.ComputeSystemNegotiateProtocolV1, prot.PvInvalid, b.negotiateProtocolV2)
+
+	// The first dial fails as if the host were not yet listening.
+	conns := make(chan net.Conn)
+	dialed := false
+	dial := func() (io.ReadWriteCloser, error) {
+		if !dialed {
+			dialed = true
+			return nil, errors.New("host not listening")
+		}
+		return <-conns, nil
+	}
+
+	b.PublishNotification(&prot.ContainerNotification{MessageBase: prot.MessageBase{ContainerID: "c1"}})
+	go b.ServeWithReconnect(dial)
+
+	client, server := net.Pipe()
+	conns <- server
+	// Nothing is written before the protocol is negotiated.
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if header, _, err := serverRead(client); err == nil {
+		t.Fatalf("expected no message before negotiation got: %v", header.Type)
+	}
+	client.SetReadDeadline(time.Time{})
+	header, body := negotiate(t, client, 1)
+	verifyNotification(t, header, body, "c1")
+
+	// Notifications published while disconnected are written after the
+	// protocol is negotiated on the next connection.
+	client.Close()
+	b.PublishNotification(&prot.ContainerNotification{MessageBase: prot.MessageBase{ContainerID: "c2"}})
+	client, server = net.Pipe()
+	defer client.Close()
+	conns <- server
+	header, body = negotiate(t, client, 1)
+	verifyNotification(t, header, body, "c2")
+}
@@ -6,12 +6,13 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Microsoft/opengcs/internal/cgroupv2"
 	"github.com/Microsoft/opengcs/internal/debug"
 	"github.com/Microsoft/opengcs/internal/log"
-	"github.com/Microsoft/opengcs/internal/oc"
 	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
 	"github.com/Microsoft/opengcs/service/gcs/gcserr"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
 	"github.com/Microsoft/opengcs/service/libs/commonutils"
 	"github.com/pkg/errors"
@@ -36,17 +37,37 @@ var capabilities = prot.GcsCapabilities{
 		SignalProcessSupported:        true,
 		DumpStacksSupported:           true,
 		DeleteContainerStateSupported: true,
+		CancelRequestSupported:        true,
+		PauseResumeSupported:          true,
+		CheckpointRestoreSupported:    true,
 	},
 }
 
+// defaultTimeouts are the deadlines `AssignHandlers` applies to requests that
+// are expected to complete in a bounded amount of time. Requests that are not
+// listed, such as `ComputeSystemWaitForProcessV1`, run until they complete or
+// are cancelled by the HCS.
+var defaultTimeouts = map[prot.MessageIdentifier]time.Duration{
+	prot.ComputeSystemCreateV1:               5 * time.Minute,
+	prot.ComputeSystemStartV1:                time.Minute,
+	prot.ComputeSystemExecuteProcessV1:       5 * time.Minute,
+	prot.ComputeSystemShutdownForcedV1:       time.Minute,
+	prot.ComputeSystemShutdownGracefulV1:     time.Minute,
+	prot.ComputeSystemSignalProcessV1:        time.Minute,
+	prot.ComputeSystemGetPropertiesV1:        time.Minute,
+	prot.ComputeSystemResizeConsoleV1:        time.Minute,
+	prot.ComputeSystemModifySettingsV1:       5 * time.Minute,
+	prot.ComputeSystemDumpStacksV1:           time.Minute,
+	prot.ComputeSystemDeleteContainerStateV1: 5 * time.Minute,
+	prot.ComputeSystemPauseV1:                time.Minute,
+	prot.ComputeSystemResumeV1:               time.Minute,
+	prot.ComputeSystemCheckpointV1:           5 * time.Minute,
+	prot.ComputeSystemRestoreV1:              5 * time.Minute,
+}
+
 // negotiateProtocolV2 was introduced in v4 so will not be called with a minimum
 // lower than that.
-func (b *Bridge) negotiateProtocolV2(r *Request) (_ RequestResponse, err error) {
-	_, span := trace.StartSpan(r.Context, "opengcs::bridge::negotiateProtocolV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
+func (b *Bridge) negotiateProtocolV2(r *Request) (RequestResponse, error) {
 	var request prot.NegotiateProtocol
 	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
 		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
@@ -66,7 +87,11 @@ func (b *Bridge) negotiateProtocolV2(r *Request) (_ RequestResponse, err error)
 	major := min(uint32(prot.PvMax), request.MaximumVersion)
 
 	// Set our protocol selected version before return.
-	b.protVer = prot.ProtocolVersion(major)
+	if r.conn != nil {
+		r.conn.setProtocolVersion(prot.ProtocolVersion(major))
+	} else {
+		b.protVer = prot.ProtocolVersion(major)
+	}
 
 	return &prot.NegotiateProtocolResponse{
 		Version:      major,
@@ -77,11 +102,8 @@ func (b *Bridge) negotiateProtocolV2(r *Request) (_ RequestResponse, err error)
 // createContainerV2 creates a container based on the settings passed in `r`.
 //
 // This is allowed only for protocol version 4+, schema version 2.1+
-func (b *Bridge) createContainerV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::createContainerV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+func (b *Bridge) createContainerV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
 
 	var request prot.ContainerCreate
 	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
@@ -99,30 +121,76 @@ func (b *Bridge) createContainerV2(r *Request) (_ RequestResponse, err error) {
 			gcserr.HrVmcomputeInvalidJSON)
 	}
 
+	if settingsV2.OCISpecification == nil {
+		return nil, gcserr.WrapHresult(errors.New("missing OCISpecification"), gcserr.HrVmcomputeInvalidJSON)
+	}
+
 	c, err := b.hostState.CreateContainer(ctx, request.ContainerID, &settingsV2)
 	if err != nil {
 		return nil, err
 	}
-	waitFn := func() prot.NotificationType {
-		return c.Wait()
-	}
+	b.publishContainerEvents(ctx, request.MessageBase, c)
+	return &prot.ContainerCreateResponse{}, nil
+}
+
+// publishContainerEvents publishes the OOM kill notifications of the container
+// `c` created by `request` and its exit notification once it exits.
+func (b *Bridge) publishContainerEvents(ctx context.Context, request prot.MessageBase, c *hcsv2.Container) {
+	go func() {
+		for mem := range c.OOMEvents() {
+			info, err := json.Marshal(prot.ContainerOomKilledInfo{Memory: mem})
+			if err != nil {
+				log.G(ctx).WithError(err).Error("failed to marshal oom kill info")
+			}
+			b.PublishNotification(&prot.ContainerNotification{
+				MessageBase: prot.MessageBase{
+					ContainerID: request.ContainerID,
+					ActivityID:  request.ActivityID,
+				},
+				Type:       prot.NtOomKilled,
+				Operation:  prot.AoNone,
+				Result:     0,
+				ResultInfo: string(info),
+			})
+		}
+	}()
 
 	go func() {
-		nt := waitFn()
+		status := c.Wait()
+		info, err := json.Marshal(exitInfo(status))
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to marshal container exit info")
+		}
 		notification := &prot.ContainerNotification{
 			MessageBase: prot.MessageBase{
 				ContainerID: request.ContainerID,
 				ActivityID:  request.ActivityID,
 			},
-			Type:       nt,
+			Type:       status.Type,
 			Operation:  prot.AoNone,
-			Result:     0,
-			ResultInfo: "",
+			Result:     int32(status.ExitCode),
+			ResultInfo: string(info),
 		}
 		b.PublishNotification(notification)
 	}()
+}
 
-	return &prot.ContainerCreateResponse{}, nil
+// exitInfo returns the `ResultInfo` of the exit notification of a container
+// that exited with `status`.
+func exitInfo(status hcsv2.ExitStatus) *prot.ContainerExitInfo {
+	info := &prot.ContainerExitInfo{
+		Reason:    prot.ErExited,
+		ExitCode:  int32(status.ExitCode),
+		Signal:    int32(status.Signal),
+		OomKilled: status.OOMKilled,
+		ExitTime:  status.ExitTime,
+	}
+	if status.OOMKilled {
+		info.Reason = prot.ErOomKilled
+	} else if status.Signal != 0 {
+		info.Reason = prot.ErSignaled
+	}
+	return info
 }
 
 // startContainerV2 doesn't have a great correlation to LCOW. On Windows this is
@@ -130,12 +198,7 @@ func (b *Bridge) createContainerV2(r *Request) (_ RequestResponse, err error) {
 // wait until the exec process of the init process to actually issue the start.
 //
 // This is allowed only for protocol version 4+, schema version 2.1+
-func (b *Bridge) startContainerV2(r *Request) (_ RequestResponse, err error) {
-	_, span := trace.StartSpan(r.Context, "opengcs::bridge::startContainerV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
+func (b *Bridge) startContainerV2(r *Request) (RequestResponse, error) {
 	// This is just a noop, but needs to be handled so that an error isn't
 	// returned to the HCS.
 	var request prot.MessageBase
@@ -162,10 +225,7 @@ func (b *Bridge) startContainerV2(r *Request) (_ RequestResponse, err error) {
 //
 // This is allowed only for protocol version 4+, schema version 2.1+
 func (b *Bridge) execProcessV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::execProcessV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+	ctx := r.Context
 
 	var request prot.ContainerExecuteProcess
 	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
@@ -198,7 +258,7 @@ func (b *Bridge) execProcessV2(r *Request) (_ RequestResponse, err error) {
 		// We found a V2 container. Treat this as a V2 process.
 		if params.OCIProcess == nil {
 			pid, err = c.Start(ctx, conSettings)
-		} else {
+		} else if err = b.hostState.SecurityPolicy().EnforceExecProcess(ctx, request.ContainerID, params.OCIProcess); err == nil {
 			pid, err = c.ExecProcess(ctx, params.OCIProcess, conSettings)
 		}
 	}
@@ -218,11 +278,7 @@ func (b *Bridge) execProcessV2(r *Request) (_ RequestResponse, err error) {
 //
 // This is allowed only for protocol version 4+, schema version 2.1+
 func (b *Bridge) killContainerV2(r *Request) (RequestResponse, error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::killContainerV2")
-	defer span.End()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
-	return b.signalContainerV2(ctx, span, r, unix.SIGKILL)
+	return b.signalContainerV2(r.Context, r, unix.SIGKILL)
 }
 
 // shutdownContainerV2 is a user requested shutdown of the container and all
@@ -231,21 +287,14 @@ func (b *Bridge) killContainerV2(r *Request) (RequestResponse, error) {
 //
 // This is allowed only for protocol version 4+, schema version 2.1+
 func (b *Bridge) shutdownContainerV2(r *Request) (RequestResponse, error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::shutdownContainerV2")
-	defer span.End()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
-	return b.signalContainerV2(ctx, span, r, unix.SIGTERM)
+	return b.signalContainerV2(r.Context, r, unix.SIGTERM)
 }
 
 // signalContainerV2 is not a handler func. This is because the actual signal is
 // implied based on the message type of either `killContainerV2` or
 // `shutdownContainerV2`.
-func (b *Bridge) signalContainerV2(ctx context.Context, span *trace.Span, r *Request, signal syscall.Signal) (_ RequestResponse, err error) {
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(
-		trace.StringAttribute("cid", r.ContainerID),
-		trace.Int64Attribute("signal", int64(signal)))
+func (b *Bridge) signalContainerV2(ctx context.Context, r *Request, signal syscall.Signal) (RequestResponse, error) {
+	trace.FromContext(ctx).AddAttributes(trace.Int64Attribute("signal", int64(signal)))
 
 	var request prot.MessageBase
 	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
@@ -276,18 +325,15 @@ func (b *Bridge) signalContainerV2(ctx context.Context, span *trace.Span, r *Req
 	return &prot.MessageResponseBase{}, nil
 }
 
-func (b *Bridge) signalProcessV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::signalProcessV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+func (b *Bridge) signalProcessV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
 
 	var request prot.ContainerSignalProcess
 	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
 		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
 	}
 
-	span.AddAttributes(
+	trace.FromContext(r.Context).AddAttributes(
 		trace.Int64Attribute("pid", int64(request.ProcessID)),
 		trace.Int64Attribute("signal", int64(request.Options.Signal)))
 
@@ -314,11 +360,8 @@ func (b *Bridge) signalProcessV2(r *Request) (_ RequestResponse, err error) {
 	return &prot.MessageResponseBase{}, nil
 }
 
-func (b *Bridge) getPropertiesV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::getPropertiesV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+func (b *Bridge) getPropertiesV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
 
 	var request prot.ContainerGetProperties
 	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
@@ -355,11 +398,35 @@ func (b *Bridge) getPropertiesV2(r *Request) (_ RequestResponse, err error) {
 				properties.ProcessList[i].ProcessID = uint32(pid)
 			}
 		} else if requestedProperty == prot.PtStatistics {
-			cgroupMetrics, err := c.GetStats(ctx)
-			if err != nil {
-				return nil, err
+			if cgroupv2.IsUnified() {
+				cgroupMetrics, err := c.GetStatsV2(ctx)
+				if err != nil {
+					return nil, err
+				}
+				properties.MetricsV2 = cgroupMetrics
+			} else {
+				cgroupMetrics, err := c.GetStats(ctx)
+				if err != nil {
+					return nil, err
+				}
+				properties.Metrics = cgroupMetrics
+			}
+		} else if requestedProperty == prot.PtPodStatistics {
+			// Only a sandbox has pod statistics, which include every container
+			// in its pod.
+			if cgroupv2.IsUnified() {
+				podMetrics, err := c.GetPodStatsV2(ctx)
+				if err != nil {
+					return nil, err
+				}
+				properties.PodMetricsV2 = podMetrics
+			} else {
+				podMetrics, err := c.GetPodStats(ctx)
+				if err != nil {
+					return nil, err
+				}
+				properties.PodMetrics = podMetrics
 			}
-			properties.Metrics = cgroupMetrics
 		}
 	}
 
@@ -377,18 +444,13 @@ func (b *Bridge) getPropertiesV2(r *Request) (_ RequestResponse, err error) {
 	}, nil
 }
 
-func (b *Bridge) waitOnProcessV2(r *Request) (_ RequestResponse, err error) {
-	_, span := trace.StartSpan(r.Context, "opengcs::bridge::waitOnProcessV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
-
+func (b *Bridge) waitOnProcessV2(r *Request) (RequestResponse, error) {
 	var request prot.ContainerWaitForProcess
 	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
 		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
 	}
 
-	span.AddAttributes(
+	trace.FromContext(r.Context).AddAttributes(
 		trace.Int64Attribute("pid", int64(request.ProcessID)),
 		trace.Int64Attribute("timeout-ms", int64(request.TimeoutInMs)))
 
@@ -429,21 +491,20 @@ func (b *Bridge) waitOnProcessV2(r *Request) (_ RequestResponse, err error) {
 		}, nil
 	case <-tc:
 		return nil, gcserr.NewHresultError(gcserr.HvVmcomputeTimeout)
+	case <-r.Context.Done():
+		return nil, gcserr.WrapHresult(r.Context.Err(), gcserr.HrErrCancelled)
 	}
 }
 
-func (b *Bridge) resizeConsoleV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::resizeConsoleV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+func (b *Bridge) resizeConsoleV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
 
 	var request prot.ContainerResizeConsole
 	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
 		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
 	}
 
-	span.AddAttributes(
+	trace.FromContext(r.Context).AddAttributes(
 		trace.Int64Attribute("pid", int64(request.ProcessID)),
 		trace.Int64Attribute("height", int64(request.Height)),
 		trace.Int64Attribute("width", int64(request.Width)))
@@ -466,11 +527,8 @@ func (b *Bridge) resizeConsoleV2(r *Request) (_ RequestResponse, err error) {
 	return &prot.MessageResponseBase{}, nil
 }
 
-func (b *Bridge) modifySettingsV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::modifySettingsV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+func (b *Bridge) modifySettingsV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
 
 	request, err := prot.UnmarshalContainerModifySettings(r.Message)
 	if err != nil {
@@ -485,11 +543,26 @@ func (b *Bridge) modifySettingsV2(r *Request) (_ RequestResponse, err error) {
 	return &prot.MessageResponseBase{}, nil
 }
 
-func (b *Bridge) dumpStacksV2(r *Request) (_ RequestResponse, err error) {
-	_, span := trace.StartSpan(r.Context, "opengcs::bridge::dumpStacksV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
+// cancelRequestV2 cancels the context of the in-flight request identified by
+// `SequenceID`. The cancelled request is still responded to, typically with
+// `gcserr.HrErrCancelled`.
+func (b *Bridge) cancelRequestV2(r *Request) (RequestResponse, error) {
+	var request prot.CancelRequest
+	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+	}
+
+	trace.FromContext(r.Context).AddAttributes(trace.Int64Attribute("cancel-message-id", int64(request.SequenceID)))
+
+	if r.conn == nil || !r.conn.cancelPendingRequest(request.SequenceID) {
+		return nil, gcserr.WrapHresult(
+			errors.Errorf("no in-flight request with id %d", request.SequenceID),
+			gcserr.HrErrNotFound)
+	}
+	return &prot.MessageResponseBase{}, nil
+}
 
+func (b *Bridge) dumpStacksV2(r *Request) (RequestResponse, error) {
 	stacks := debug.DumpStacks()
 
 	return &prot.DumpStacksResponse{
@@ -497,12 +570,8 @@ func (b *Bridge) dumpStacksV2(r *Request) (_ RequestResponse, err error) {
 	}, nil
 }
 
-func (b *Bridge) deleteContainerStateV2(r *Request) (_ RequestResponse, err error) {
-	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::deleteContainerStateV2")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-
-	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+func (b *Bridge) deleteContainerStateV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
 
 	var request prot.MessageBase
 	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
@@ -521,3 +590,133 @@ func (b *Bridge) deleteContainerStateV2(r *Request) (_ RequestResponse, err erro
 	b.hostState.RemoveContainer(request.ContainerID)
 	return &prot.MessageResponseBase{}, nil
 }
+
+// pauseContainerV2 suspends all processes in the container and publishes an
+// `NtPaused` notification once they are suspended.
+//
+// This is allowed only for protocol version 4+, schema version 2.1+
+func (b *Bridge) pauseContainerV2(r *Request) (RequestResponse, error) {
+	var request prot.MessageBase
+	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+	}
+
+	c, err := b.hostState.GetContainer(request.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Pause(r.Context); err != nil {
+		return nil, err
+	}
+
+	b.PublishNotification(&prot.ContainerNotification{
+		MessageBase: prot.MessageBase{
+			ContainerID: request.ContainerID,
+			ActivityID:  request.ActivityID,
+		},
+		Type:      prot.NtPaused,
+		Operation: prot.AoPause,
+	})
+	return &prot.MessageResponseBase{}, nil
+}
+
+// resumeContainerV2 resumes all processes in a container suspended by
+// `pauseContainerV2` and publishes an `NtResumed` notification once they are
+// running.
+//
+// This is allowed only for protocol version 4+, schema version 2.1+
+func (b *Bridge) resumeContainerV2(r *Request) (RequestResponse, error) {
+	var request prot.MessageBase
+	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+	}
+
+	c, err := b.hostState.GetContainer(request.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Resume(r.Context); err != nil {
+		return nil, err
+	}
+
+	b.PublishNotification(&prot.ContainerNotification{
+		MessageBase: prot.MessageBase{
+			ContainerID: request.ContainerID,
+			ActivityID:  request.ActivityID,
+		},
+		Type:      prot.NtResumed,
+		Operation: prot.AoResume,
+	})
+	return &prot.MessageResponseBase{}, nil
+}
+
+// checkpointContainerV2 writes the state of the container to the image
+// directory in the request using CRIU.
+//
+// This is allowed only for protocol version 4+, schema version 2.1+
+func (b *Bridge) checkpointContainerV2(r *Request) (RequestResponse, error) {
+	var request prot.ContainerCheckpoint
+	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+	}
+	if request.ImagePath == "" {
+		return nil, gcserr.WrapHresult(errors.New("checkpoint image path must not be empty"), gcserr.HrInvalidArg)
+	}
+
+	c, err := b.hostState.GetContainer(request.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+
+	trace.FromContext(r.Context).AddAttributes(trace.StringAttribute("imagePath", request.ImagePath))
+	opts := runtime.CheckpointOptions{
+		LeaveRunning:   request.LeaveRunning,
+		TCPEstablished: request.TCPEstablished,
+	}
+	if err := c.Checkpoint(r.Context, request.ImagePath, opts); err != nil {
+		return nil, err
+	}
+	return &prot.MessageResponseBase{}, nil
+}
+
+// restoreContainerV2 restores a container from the image directory in the
+// request written by `checkpointContainerV2`. Like `createContainerV2` the
+// container's stdio is connected by the exec of its init process.
+//
+// This is allowed only for protocol version 4+, schema version 2.1+
+func (b *Bridge) restoreContainerV2(r *Request) (RequestResponse, error) {
+	ctx := r.Context
+
+	var request prot.ContainerRestore
+	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+	}
+	if request.ImagePath == "" {
+		return nil, gcserr.WrapHresult(errors.New("checkpoint image path must not be empty"), gcserr.HrInvalidArg)
+	}
+
+	var settingsV2 prot.VMHostedContainerSettingsV2
+	if err := commonutils.UnmarshalJSONWithHresult([]byte(request.ContainerConfig), &settingsV2); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal JSON for ContainerConfig \"%s\"", request.ContainerConfig)
+	}
+
+	if settingsV2.SchemaVersion.Cmp(prot.SchemaVersion{Major: 2, Minor: 1}) < 0 {
+		return nil, gcserr.WrapHresult(
+			errors.Errorf("invalid schema version: %v", settingsV2.SchemaVersion),
+			gcserr.HrVmcomputeInvalidJSON)
+	}
+
+	if settingsV2.OCISpecification == nil {
+		return nil, gcserr.WrapHresult(errors.New("missing OCISpecification"), gcserr.HrVmcomputeInvalidJSON)
+	}
+
+	trace.FromContext(ctx).AddAttributes(trace.StringAttribute("imagePath", request.ImagePath))
+	c, err := b.hostState.RestoreContainer(ctx, request.ContainerID, &settingsV2, request.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	b.publishContainerEvents(ctx, request.MessageBase, c)
+	return &prot.MessageResponseBase{}, nil
+}
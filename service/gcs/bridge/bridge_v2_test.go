@@ -0,0 +1,604 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/policy"
+	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	"github.com/Microsoft/opengcs/service/gcs/transport"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// testBridge is a Bridge whose handlers are served by a Host backed by a mock
+// runtime.
+type testBridge struct {
+	*Bridge
+	t   *testing.T
+	dir string
+	rt  *mockruntime.Runtime
+}
+
+func newTestBridge(t *testing.T) *testBridge {
+	dir, err := ioutil.TempDir("", "bridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hcsv2.SetRunDir(dir)
+	tb := &testBridge{
+		Bridge: &Bridge{},
+		t:      t,
+		dir:    dir,
+		rt:     mockruntime.NewRuntime(),
+	}
+	tb.hostState = hcsv2.NewHost(tb.rt, &transport.MockTransport{})
+	return tb
+}
+
+func (tb *testBridge) close() {
+	hcsv2.SetRunDir("/run/gcs")
+	os.RemoveAll(tb.dir)
+}
+
+// request returns a request whose message is the JSON encoding of `msg`.
+func (tb *testBridge) request(msg interface{}) *Request {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+	return &Request{Context: context.Background(), Message: b}
+}
+
+// containerConfig returns the JSON encoded settings of a standalone container
+// `id` running `args`. Every container gets its own network namespace, unique
+// to the test bridge.
+func (tb *testBridge) containerConfig(id string, args ...string) string {
+	settings := prot.VMHostedContainerSettingsV2{
+		SchemaVersion: prot.SchemaVersion{Major: 2, Minor: 1},
+		OCIBundlePath: filepath.Join(tb.dir, "bundles", id),
+		OCISpecification: &oci.Spec{
+			Version:  oci.Version,
+			Hostname: "test",
+			Process:  &oci.Process{Args: args, Cwd: "/"},
+			Linux:    &oci.Linux{},
+			Windows: &oci.Windows{
+				Network: &oci.WindowsNetwork{NetworkNamespace: filepath.Base(tb.dir) + "-" + id},
+			},
+		},
+	}
+	b, err := json.Marshal(settings)
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+	return string(b)
+}
+
+// startContainer creates container `id` and starts its init process through
+// the bridge handlers.
+func (tb *testBridge) startContainer(id string) {
+	create := prot.ContainerCreate{
+		MessageBase:     prot.MessageBase{ContainerID: id},
+		ContainerConfig: tb.containerConfig(id, "/bin/sh"),
+	}
+	if _, err := tb.createContainerV2(tb.request(create)); err != nil {
+		tb.t.Fatalf("failed to create container %s: %v", id, err)
+	}
+	exec := prot.ContainerExecuteProcess{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		Settings:    prot.ExecuteProcessSettings{ProcessParameters: "{}"},
+	}
+	if _, err := tb.execProcessV2(tb.request(exec)); err != nil {
+		tb.t.Fatalf("failed to start container %s: %v", id, err)
+	}
+}
+
+// notification returns the next notification of type `nt` published by the
+// bridge, skipping any other.
+func (tb *testBridge) notification(nt prot.NotificationType) *prot.ContainerNotification {
+	timeout := time.After(5 * time.Second)
+	q := tb.notificationQueue()
+	for {
+		if br, ok := q.tryPop(); ok {
+			if n := br.response.(*prot.ContainerNotification); n.Type == nt {
+				return n
+			}
+			continue
+		}
+		select {
+		case <-q.available:
+		case <-timeout:
+			tb.t.Fatalf("timed out waiting for a %s notification", nt)
+		}
+	}
+}
+
+// assertNoNotification fails if a notification of type `nt` is queued.
+func (tb *testBridge) assertNoNotification(nt prot.NotificationType) {
+	for {
+		br, ok := tb.notificationQueue().tryPop()
+		if !ok {
+			return
+		}
+		if n := br.response.(*prot.ContainerNotification); n.Type == nt {
+			tb.t.Fatalf("expected no %s notification got: %+v", nt, n)
+		}
+	}
+}
+
+// assertHresult fails unless `err` carries the HRESULT `expected`.
+func assertHresult(t *testing.T, err error, expected gcserr.Hresult) {
+	t.Helper()
+	if hr, _ := gcserr.GetHresult(err); hr != expected {
+		t.Fatalf("expected HRESULT %v got: %v", expected, err)
+	}
+}
+
+func Test_exitInfo(t *testing.T) {
+	exitTime := time.Now()
+	tests := []struct {
+		name     string
+		status   hcsv2.ExitStatus
+		expected prot.ContainerExitInfo
+	}{
+		{
+			name:     "Exited",
+			status:   hcsv2.ExitStatus{Type: prot.NtUnexpectedExit, ExitCode: 1, ExitTime: exitTime},
+			expected: prot.ContainerExitInfo{Reason: prot.ErExited, ExitCode: 1, ExitTime: exitTime},
+		},
+		{
+			name:     "Signaled",
+			status:   hcsv2.ExitStatus{Type: prot.NtForcedExit, ExitCode: 137, Signal: syscall.SIGKILL, ExitTime: exitTime},
+			expected: prot.ContainerExitInfo{Reason: prot.ErSignaled, ExitCode: 137, Signal: 9, ExitTime: exitTime},
+		},
+		{
+			name:     "OomKilled",
+			status:   hcsv2.ExitStatus{Type: prot.NtUnexpectedExit, ExitCode: 137, Signal: syscall.SIGKILL, OOMKilled: true, ExitTime: exitTime},
+			expected: prot.ContainerExitInfo{Reason: prot.ErOomKilled, ExitCode: 137, Signal: 9, OomKilled: true, ExitTime: exitTime},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := exitInfo(test.status)
+			if *info != test.expected {
+				t.Fatalf("expected: %+v got: %+v", test.expected, *info)
+			}
+		})
+	}
+}
+
+func Test_Bridge_CheckpointRestore_EmptyImagePath(t *testing.T) {
+	b := &Bridge{}
+	for name, handler := range map[string]HandlerFunc{
+		"Checkpoint": b.checkpointContainerV2,
+		"Restore":    b.restoreContainerV2,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := handler(&Request{
+				Context: context.Background(),
+				Message: []byte(`{"ContainerId":"c1"}`),
+			})
+			if err == nil {
+				t.Fatal("expected error for empty image path")
+			}
+			if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrInvalidArg {
+				t.Fatalf("expected HRESULT %v got: %v", gcserr.HrInvalidArg, hr)
+			}
+		})
+	}
+}
+
+func Test_Bridge_PauseResume(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	msg := prot.MessageBase{ContainerID: "c1", ActivityID: "a1"}
+	if _, err := tb.pauseContainerV2(tb.request(msg)); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if status := tb.rt.Container("c1").Status(); status != "paused" {
+		t.Fatalf("expected paused container got: %s", status)
+	}
+	if n := tb.notification(prot.NtPaused); n.ContainerID != "c1" || n.ActivityID != "a1" || n.Operation != prot.AoPause {
+		t.Fatalf("unexpected pause notification: %+v", n)
+	}
+
+	if _, err := tb.resumeContainerV2(tb.request(msg)); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if status := tb.rt.Container("c1").Status(); status != "running" {
+		t.Fatalf("expected running container got: %s", status)
+	}
+	if n := tb.notification(prot.NtResumed); n.ContainerID != "c1" || n.Operation != prot.AoResume {
+		t.Fatalf("unexpected resume notification: %+v", n)
+	}
+}
+
+func Test_Bridge_Resume_NotPaused(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	if _, err := tb.resumeContainerV2(tb.request(prot.MessageBase{ContainerID: "c1"})); err == nil {
+		t.Fatal("expected error resuming a running container")
+	}
+	tb.assertNoNotification(prot.NtResumed)
+}
+
+func Test_Bridge_PauseResume_UnknownContainer(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+
+	for name, handler := range map[string]HandlerFunc{
+		"Pause":  tb.pauseContainerV2,
+		"Resume": tb.resumeContainerV2,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := handler(tb.request(prot.MessageBase{ContainerID: "missing"}))
+			assertHresult(t, err, gcserr.HrVmcomputeSystemNotFound)
+		})
+	}
+	tb.assertNoNotification(prot.NtPaused)
+	tb.assertNoNotification(prot.NtResumed)
+}
+
+func Test_Bridge_CheckpointRestore(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	checkpoint := prot.ContainerCheckpoint{
+		MessageBase: prot.MessageBase{ContainerID: "c1"},
+		ImagePath:   "/images/c1",
+	}
+	if _, err := tb.checkpointContainerV2(tb.request(checkpoint)); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if status := tb.rt.Container("c1").Status(); status != "stopped" {
+		t.Fatalf("expected checkpointed container to be stopped got: %s", status)
+	}
+
+	restore := prot.ContainerRestore{
+		MessageBase:     prot.MessageBase{ContainerID: "c2"},
+		ContainerConfig: tb.containerConfig("c2", "/bin/sh"),
+		ImagePath:       "/images/c1",
+	}
+	if _, err := tb.restoreContainerV2(tb.request(restore)); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if _, err := tb.hostState.GetContainer("c2"); err != nil {
+		t.Fatalf("expected restored container to be tracked got: %v", err)
+	}
+	if status := tb.rt.Container("c2").Status(); status != "running" {
+		t.Fatalf("expected restored container to be running got: %s", status)
+	}
+}
+
+func Test_Bridge_CheckpointRestore_RuntimeFailure(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	expectedErr := gcserr.NewHresultError(gcserr.HrFail)
+	tb.rt.Fail(mockruntime.OpCheckpoint, expectedErr)
+	checkpoint := prot.ContainerCheckpoint{
+		MessageBase: prot.MessageBase{ContainerID: "c1"},
+		ImagePath:   "/images/c1",
+	}
+	if _, err := tb.checkpointContainerV2(tb.request(checkpoint)); err != expectedErr {
+		t.Fatalf("expected error %v got: %v", expectedErr, err)
+	}
+	if status := tb.rt.Container("c1").Status(); status != "running" {
+		t.Fatalf("expected container to keep running after a failed checkpoint got: %s", status)
+	}
+
+	tb.rt.Fail(mockruntime.OpRestore, expectedErr)
+	restore := prot.ContainerRestore{
+		MessageBase:     prot.MessageBase{ContainerID: "c2"},
+		ContainerConfig: tb.containerConfig("c2", "/bin/sh"),
+		ImagePath:       "/images/c1",
+	}
+	if _, err := tb.restoreContainerV2(tb.request(restore)); errors.Cause(err) != expectedErr {
+		t.Fatalf("expected error %v got: %v", expectedErr, err)
+	}
+	if _, err := tb.hostState.GetContainer("c2"); err == nil {
+		t.Fatal("expected a failed restore to not track the container")
+	}
+}
+
+func Test_Bridge_Restore_DeniedByPolicy(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	checkpoint := prot.ContainerCheckpoint{
+		MessageBase: prot.MessageBase{ContainerID: "c1"},
+		ImagePath:   "/images/c1",
+	}
+	if _, err := tb.checkpointContainerV2(tb.request(checkpoint)); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	tb.hostState.SetSecurityPolicy(policy.NewEnforcer(&policy.Policy{}))
+	restore := prot.ContainerRestore{
+		MessageBase:     prot.MessageBase{ContainerID: "c2"},
+		ContainerConfig: tb.containerConfig("c2", "/bin/sh"),
+		ImagePath:       "/images/c1",
+	}
+	_, err := tb.restoreContainerV2(tb.request(restore))
+	assertHresult(t, err, gcserr.HrErrAccessDisabledByPolicy)
+	if tb.rt.Container("c2") != nil {
+		t.Fatal("expected the container not to be restored")
+	}
+}
+
+func Test_Bridge_Checkpoint_UnknownContainer(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+
+	checkpoint := prot.ContainerCheckpoint{
+		MessageBase: prot.MessageBase{ContainerID: "missing"},
+		ImagePath:   "/images/missing",
+	}
+	_, err := tb.checkpointContainerV2(tb.request(checkpoint))
+	assertHresult(t, err, gcserr.HrVmcomputeSystemNotFound)
+}
+
+// execProcess runs `args` in the started container `id` through the bridge
+// handlers and returns the mock process.
+func (tb *testBridge) execProcess(id string, args ...string) *mockruntime.Process {
+	params, err := json.Marshal(prot.ProcessParameters{
+		OCIProcess: &oci.Process{Args: args, Cwd: "/"},
+	})
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+	exec := prot.ContainerExecuteProcess{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		Settings:    prot.ExecuteProcessSettings{ProcessParameters: string(params)},
+	}
+	resp, err := tb.execProcessV2(tb.request(exec))
+	if err != nil {
+		tb.t.Fatalf("failed to exec process in container %s: %v", id, err)
+	}
+	pid := int(resp.(*prot.ContainerExecuteProcessResponse).ProcessID)
+	p, ok := tb.rt.Container(id).ExecProcesses()[pid]
+	if !ok {
+		tb.t.Fatalf("expected exec process %d in container %s", pid, id)
+	}
+	return p
+}
+
+// waitProcess waits through the bridge handler for process `pid` of container
+// `id` to exit, for at most `timeout` milliseconds.
+func (tb *testBridge) waitProcess(id string, pid int, timeout uint32) (uint32, error) {
+	wait := prot.ContainerWaitForProcess{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		ProcessID:   uint32(pid),
+		TimeoutInMs: timeout,
+	}
+	resp, err := tb.waitOnProcessV2(tb.request(wait))
+	if err != nil {
+		return 0, err
+	}
+	return resp.(*prot.ContainerWaitForProcessResponse).ExitCode, nil
+}
+
+func Test_Bridge_CreateContainer_InvalidSchema(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+
+	config, err := json.Marshal(prot.VMHostedContainerSettingsV2{
+		SchemaVersion:    prot.SchemaVersion{Major: 2, Minor: 0},
+		OCISpecification: &oci.Spec{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := prot.ContainerCreate{
+		MessageBase:     prot.MessageBase{ContainerID: "c1"},
+		ContainerConfig: string(config),
+	}
+	_, err = tb.createContainerV2(tb.request(create))
+	assertHresult(t, err, gcserr.HrVmcomputeInvalidJSON)
+	if tb.rt.Container("c1") != nil {
+		t.Fatal("expected no container to be created")
+	}
+}
+
+func Test_Bridge_CreateContainer_RuntimeFailure(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+
+	expectedErr := gcserr.NewHresultError(gcserr.HrFail)
+	tb.rt.Fail(mockruntime.OpCreate, expectedErr)
+	create := prot.ContainerCreate{
+		MessageBase:     prot.MessageBase{ContainerID: "c1"},
+		ContainerConfig: tb.containerConfig("c1", "/bin/sh"),
+	}
+	if _, err := tb.createContainerV2(tb.request(create)); errors.Cause(err) != expectedErr {
+		t.Fatalf("expected error %v got: %v", expectedErr, err)
+	}
+	if _, err := tb.hostState.GetContainer("c1"); err == nil {
+		t.Fatal("expected a failed create to not track the container")
+	}
+}
+
+func Test_Bridge_ExecProcess_Wait(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	p := tb.execProcess("c1", "/bin/true")
+	p.Exit(3)
+	exitCode, err := tb.waitProcess("c1", p.Pid(), prot.InfiniteWaitTimeout)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if exitCode != 3 {
+		t.Fatalf("expected exit code 3 got: %d", exitCode)
+	}
+}
+
+func Test_Bridge_ExecProcess_RuntimeFailure(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	expectedErr := gcserr.NewHresultError(gcserr.HrFail)
+	tb.rt.Fail(mockruntime.OpExec, expectedErr)
+	params, err := json.Marshal(prot.ProcessParameters{
+		OCIProcess: &oci.Process{Args: []string{"/bin/true"}, Cwd: "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec := prot.ContainerExecuteProcess{
+		MessageBase: prot.MessageBase{ContainerID: "c1"},
+		Settings:    prot.ExecuteProcessSettings{ProcessParameters: string(params)},
+	}
+	if _, err := tb.execProcessV2(tb.request(exec)); errors.Cause(err) != expectedErr {
+		t.Fatalf("expected error %v got: %v", expectedErr, err)
+	}
+	if n := len(tb.rt.Container("c1").ExecProcesses()); n != 0 {
+		t.Fatalf("expected no exec process got: %d", n)
+	}
+}
+
+func Test_Bridge_WaitOnProcess_Timeout(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	_, err := tb.waitProcess("c1", tb.rt.Container("c1").Pid(), 10)
+	assertHresult(t, err, gcserr.HvVmcomputeTimeout)
+}
+
+func Test_Bridge_WaitOnProcess_UnknownProcess(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	_, err := tb.waitProcess("c1", 1, prot.InfiniteWaitTimeout)
+	assertHresult(t, err, gcserr.HrErrNotFound)
+}
+
+// Test_Bridge_SignalProcess_UnknownProcess only covers the failure path, as
+// processes are signaled with kill(2) which cannot reach a mock pid.
+func Test_Bridge_SignalProcess_UnknownProcess(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	signal := prot.ContainerSignalProcess{
+		MessageBase: prot.MessageBase{ContainerID: "c1"},
+		ProcessID:   1,
+		Options:     prot.SignalProcessOptions{Signal: int32(syscall.SIGTERM)},
+	}
+	_, err := tb.signalProcessV2(tb.request(signal))
+	assertHresult(t, err, gcserr.HrErrNotFound)
+}
+
+func Test_Bridge_KillContainer_ExitNotification(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	if _, err := tb.killContainerV2(tb.request(prot.MessageBase{ContainerID: "c1"})); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	// The exit is notified once the host waited on the init process.
+	exitCode, err := tb.waitProcess("c1", tb.rt.Container("c1").Pid(), prot.InfiniteWaitTimeout)
+	if err != nil || exitCode != 128+uint32(syscall.SIGKILL) {
+		t.Fatalf("expected exit code %d got: %d (%v)", 128+syscall.SIGKILL, exitCode, err)
+	}
+	n := tb.notification(prot.NtForcedExit)
+	if n.ContainerID != "c1" || n.Result != 128+int32(syscall.SIGKILL) {
+		t.Fatalf("unexpected exit notification: %+v", n)
+	}
+	var info prot.ContainerExitInfo
+	if err := json.Unmarshal([]byte(n.ResultInfo), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Reason != prot.ErSignaled || info.Signal != int32(syscall.SIGKILL) {
+		t.Fatalf("unexpected exit info: %+v", info)
+	}
+}
+
+func Test_Bridge_DeleteContainerState(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	tb.rt.Container("c1").Exit(0)
+	if _, err := tb.waitProcess("c1", tb.rt.Container("c1").Pid(), prot.InfiniteWaitTimeout); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	tb.notification(prot.NtUnexpectedExit)
+	if _, err := tb.deleteContainerStateV2(tb.request(prot.MessageBase{ContainerID: "c1"})); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if tb.rt.Container("c1") != nil {
+		t.Fatal("expected the runtime container to be deleted")
+	}
+	_, err := tb.hostState.GetContainer("c1")
+	assertHresult(t, err, gcserr.HrVmcomputeSystemNotFound)
+}
+
+func Test_Bridge_GetProperties_ProcessList(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+	p := tb.execProcess("c1", "/bin/sh")
+
+	query, err := json.Marshal(prot.PropertyQuery{PropertyTypes: []prot.PropertyType{prot.PtProcessList}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := prot.ContainerGetProperties{
+		MessageBase: prot.MessageBase{ContainerID: "c1"},
+		Query:       string(query),
+	}
+	resp, err := tb.getPropertiesV2(tb.request(get))
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	var properties prot.PropertiesV2
+	if err := json.Unmarshal([]byte(resp.(*prot.ContainerGetPropertiesResponse).Properties), &properties); err != nil {
+		t.Fatal(err)
+	}
+	pids := make(map[uint32]bool)
+	for _, d := range properties.ProcessList {
+		pids[d.ProcessID] = true
+	}
+	if len(pids) != 2 || !pids[uint32(tb.rt.Container("c1").Pid())] || !pids[uint32(p.Pid())] {
+		t.Fatalf("expected the init and exec process pids got: %+v", properties.ProcessList)
+	}
+}
+
+func Test_Bridge_GetProperties_PodStatistics_NotSandbox(t *testing.T) {
+	tb := newTestBridge(t)
+	defer tb.close()
+	tb.startContainer("c1")
+
+	query, err := json.Marshal(prot.PropertyQuery{PropertyTypes: []prot.PropertyType{prot.PtPodStatistics}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := prot.ContainerGetProperties{
+		MessageBase: prot.MessageBase{ContainerID: "c1"},
+		Query:       string(query),
+	}
+	_, err = tb.getPropertiesV2(tb.request(get))
+	assertHresult(t, err, gcserr.HrInvalidArg)
+}
@@ -0,0 +1,107 @@
+package bridge
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+// Middleware wraps a `Handler` to add behavior before and/or after it handles
+// a request. Middlewares are installed with `Mux.Use`.
+type Middleware func(Handler) Handler
+
+// TracingMiddleware starts a span named after the request type around the
+// handler and sets its status from the returned error. The handler receives
+// the span in `Request.Context` so it can add its own attributes with
+// `trace.FromContext`.
+func TracingMiddleware(next Handler) Handler {
+	return HandlerFunc(func(r *Request) (_ RequestResponse, err error) {
+		ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::"+r.Header.Type.String())
+		defer span.End()
+		defer func() { oc.SetSpanStatus(span, err) }()
+		span.AddAttributes(
+			trace.StringAttribute("cid", r.ContainerID),
+			trace.StringAttribute("activityID", r.ActivityID))
+
+		rc := *r
+		rc.Context = ctx
+		return next.ServeMsg(&rc)
+	})
+}
+
+// RecoveryMiddleware converts a panic in the handler into an error, and
+// therefore an `ErrorRecord` in the response, rather than crashing the GCS.
+func RecoveryMiddleware(next Handler) Handler {
+	return HandlerFunc(func(r *Request) (resp RequestResponse, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				log.G(r.Context).WithFields(logrus.Fields{
+					"message-type": r.Header.Type.String(),
+					"panic":        fmt.Sprint(p),
+					"stack":        string(debug.Stack()),
+				}).Error("opengcs::bridge - recovered from handler panic")
+				resp = nil
+				err = gcserr.WrapHresult(
+					errors.Errorf("bridge: panic handling %v: %v", r.Header.Type, p),
+					gcserr.HrFail)
+			}
+		}()
+		return next.ServeMsg(r)
+	})
+}
+
+// LoggingMiddleware logs the type, container, duration and outcome of every
+// request.
+func LoggingMiddleware(next Handler) Handler {
+	return HandlerFunc(func(r *Request) (RequestResponse, error) {
+		start := time.Now()
+		resp, err := next.ServeMsg(r)
+		entry := log.G(r.Context).WithFields(logrus.Fields{
+			"message-type": r.Header.Type.String(),
+			"message-id":   r.Header.ID,
+			"cid":          r.ContainerID,
+			"activityID":   r.ActivityID,
+			"duration":     time.Since(start).String(),
+		})
+		if err != nil {
+			entry.WithError(err).Error("request failed")
+		} else {
+			entry.Debug("request succeeded")
+		}
+		return resp, err
+	})
+}
+
+// LatencyRecorder receives the latency and outcome of every request handled
+// through `MetricsMiddleware`.
+type LatencyRecorder interface {
+	RecordLatency(r *Request, latency time.Duration, err error)
+}
+
+// LatencyRecorderFunc is an adapter to use functions as a `LatencyRecorder`.
+type LatencyRecorderFunc func(r *Request, latency time.Duration, err error)
+
+// RecordLatency calls f(r, latency, err).
+func (f LatencyRecorderFunc) RecordLatency(r *Request, latency time.Duration, err error) {
+	f(r, latency, err)
+}
+
+// MetricsMiddleware returns a middleware that measures the latency of every
+// request and reports it to `recorder`.
+func MetricsMiddleware(recorder LatencyRecorder) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) (RequestResponse, error) {
+			start := time.Now()
+			resp, err := next.ServeMsg(r)
+			recorder.RecordLatency(r, time.Since(start), err)
+			return resp, err
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package bridge
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+func newMiddlewareTestRequest(ctx context.Context) *Request {
+	return &Request{
+		Context: ctx,
+		Header: &prot.MessageHeader{
+			Type: prot.ComputeSystemModifySettingsV1,
+			ID:   prot.SequenceID(1),
+		},
+		ContainerID: "c1",
+		Version:     prot.PvV4,
+	}
+}
+
+func Test_Bridge_Mux_Use_Order(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(r *Request) (RequestResponse, error) {
+				calls = append(calls, name+"-before")
+				resp, err := next.ServeMsg(r)
+				calls = append(calls, name+"-after")
+				return resp, err
+			})
+		}
+	}
+
+	m := NewBridgeMux()
+	m.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV4, func(r *Request) (RequestResponse, error) {
+		calls = append(calls, "handler")
+		return &prot.MessageResponseBase{}, nil
+	})
+	m.Use(record("first"))
+	m.Use(record("second"))
+
+	if _, err := m.ServeMsg(newMiddlewareTestRequest(context.Background())); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	expected := []string{"first-before", "second-before", "handler", "second-after", "first-after"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected calls %v got: %v", expected, calls)
+	}
+}
+
+func Test_Bridge_Mux_Use_NilMiddleware_Panic(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("The code did not panic on nil middleware")
+		}
+	}()
+
+	m := NewBridgeMux()
+	m.Use(nil)
+}
+
+func Test_Bridge_RecoveryMiddleware_Panic(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	m := NewBridgeMux()
+	m.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV4, func(r *Request) (RequestResponse, error) {
+		panic("test panic")
+	})
+	m.Use(RecoveryMiddleware)
+
+	// A cancellable context runs the handler on another goroutine so this
+	// also verifies the panic is handed back to the middleware.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, c := range []context.Context{context.Background(), ctx} {
+		resp, err := m.ServeMsg(newMiddlewareTestRequest(c))
+		if resp != nil {
+			t.Errorf("expected nil response got: %+v", resp)
+		}
+		if hr, _ := gcserr.GetHresult(err); hr != gcserr.HrFail {
+			t.Errorf("expected HRESULT %v got: %v", gcserr.HrFail, hr)
+		}
+
+		base := &prot.MessageResponseBase{}
+		setErrorForResponseBase(base, err)
+		if len(base.ErrorRecords) != 1 || base.ErrorRecords[0].Result != int32(gcserr.HrFail) {
+			t.Errorf("expected a single HrFail error record got: %+v", base.ErrorRecords)
+		}
+	}
+}
+
+func Test_Bridge_TracingMiddleware_SpanInContext(t *testing.T) {
+	var span *trace.Span
+	m := NewBridgeMux()
+	m.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV4, func(r *Request) (RequestResponse, error) {
+		span = trace.FromContext(r.Context)
+		return &prot.MessageResponseBase{}, nil
+	})
+	m.Use(TracingMiddleware)
+
+	if _, err := m.ServeMsg(newMiddlewareTestRequest(context.Background())); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if span == nil {
+		t.Fatal("expected handler context to contain a span")
+	}
+}
+
+func Test_Bridge_MetricsMiddleware_RecordsLatency(t *testing.T) {
+	handlerErr := errors.New("test failure")
+
+	var (
+		recorded   bool
+		gotType    prot.MessageIdentifier
+		gotErr     error
+		gotLatency time.Duration
+	)
+	recorder := LatencyRecorderFunc(func(r *Request, latency time.Duration, err error) {
+		recorded = true
+		gotType = r.Header.Type
+		gotLatency = latency
+		gotErr = err
+	})
+
+	m := NewBridgeMux()
+	m.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV4, func(r *Request) (RequestResponse, error) {
+		time.Sleep(10 * time.Millisecond)
+		return nil, handlerErr
+	})
+	m.Use(MetricsMiddleware(recorder))
+
+	if _, err := m.ServeMsg(newMiddlewareTestRequest(context.Background())); err != handlerErr {
+		t.Fatalf("expected handler error got: %v", err)
+	}
+	if !recorded {
+		t.Fatal("expected latency to be recorded")
+	}
+	if gotType != prot.ComputeSystemModifySettingsV1 {
+		t.Errorf("expected message type %v got: %v", prot.ComputeSystemModifySettingsV1, gotType)
+	}
+	if gotErr != handlerErr {
+		t.Errorf("expected recorded error %v got: %v", handlerErr, gotErr)
+	}
+	if gotLatency < 10*time.Millisecond {
+		t.Errorf("expected latency >= 10ms got: %v", gotLatency)
+	}
+}
@@ -0,0 +1,293 @@
+package bridge
+
+import (
+	"sync"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// DefaultMaxConcurrentRequests is the number of requests the bridge
+	// handles at once when `Bridge.MaxConcurrentRequests` is not set.
+	DefaultMaxConcurrentRequests = 64
+	// DefaultResponseQueueSize is the number of responses that can wait to be
+	// written to the bridge when `Bridge.ResponseQueueSize` is not set.
+	DefaultResponseQueueSize = 64
+	// DefaultNotificationQueueSize is the number of notifications that can
+	// wait to be written to the bridge before older ones are dropped when
+	// `Bridge.NotificationQueueSize` is not set.
+	DefaultNotificationQueueSize = 256
+)
+
+// unscheduledRequests are the request types that are neither limited by
+// `Bridge.MaxConcurrentRequests` nor serialized with the other requests for
+// their container. A process wait can be outstanding for the lifetime of the
+// process and a cancel must be able to reach the request it cancels.
+var unscheduledRequests = map[prot.MessageIdentifier]bool{
+	prot.ComputeSystemWaitForProcessV1: true,
+	prot.ComputeSystemCancelRequestV1:  true,
+}
+
+// requestScheduler runs the requests read from the bridge on a bounded number
+// of goroutines. Requests for the same container ID are run one at a time in
+// the order they were read. Requests without a container ID are run as soon
+// as a slot is available.
+type requestScheduler struct {
+	serve func(*Request)
+	// slots has one entry for each request that is running. Requests waiting
+	// behind another request for their container do not hold a slot.
+	slots chan struct{}
+
+	// mu guards queues.
+	mu sync.Mutex
+	// queues holds the requests waiting to run for each container that has a
+	// request running.
+	queues map[string][]*Request
+}
+
+func newRequestScheduler(maxConcurrent int, serve func(*Request)) *requestScheduler {
+	return &requestScheduler{
+		serve:  serve,
+		slots:  make(chan struct{}, maxConcurrent),
+		queues: make(map[string][]*Request),
+	}
+}
+
+// schedule admits `r` to be run. If `r` can run now it blocks while the
+// maximum number of requests are already running, which in turn stops the
+// bridge reading more requests from the host. A request queued behind another
+// request for its container never blocks.
+func (s *requestScheduler) schedule(r *Request) {
+	if unscheduledRequests[r.Header.Type] {
+		go s.serve(r)
+		return
+	}
+
+	if r.ContainerID == "" {
+		s.slots <- struct{}{}
+		go func() {
+			defer func() { <-s.slots }()
+			s.serve(r)
+		}()
+		return
+	}
+
+	s.mu.Lock()
+	if q, running := s.queues[r.ContainerID]; running {
+		s.queues[r.ContainerID] = append(q, r)
+		s.mu.Unlock()
+		return
+	}
+	// An empty queue marks the container as running so that the requests
+	// read meanwhile are queued behind `r`.
+	s.queues[r.ContainerID] = []*Request{}
+	s.mu.Unlock()
+
+	s.slots <- struct{}{}
+	go s.run(r)
+}
+
+// run serves `r`, which holds a slot, and then the requests queued for its
+// container in order until there are none left.
+func (s *requestScheduler) run(r *Request) {
+	id := r.ContainerID
+	for {
+		s.serve(r)
+		<-s.slots
+
+		s.mu.Lock()
+		q := s.queues[id]
+		if len(q) == 0 {
+			delete(s.queues, id)
+			s.mu.Unlock()
+			return
+		}
+		r = q[0]
+		q[0] = nil
+		s.queues[id] = q[1:]
+		s.mu.Unlock()
+
+		s.slots <- struct{}{}
+	}
+}
+
+// notificationQueue holds the notifications waiting to be written to the
+// bridge, in the order they were published. It is shared by every connection
+// so that the notifications not written to one connection are written to the
+// next.
+//
+// Publishing never blocks. Once the queue is full the oldest notification is
+// dropped to make room. Exit notifications are never dropped as the host waits
+// for them, so the queue grows beyond its size if only exits are queued. There
+// is at most one for each container.
+type notificationQueue struct {
+	mu    sync.Mutex
+	items []bridgeResponse
+	size  int
+	// available has a value while the queue is not empty.
+	available chan struct{}
+}
+
+func newNotificationQueue(size int) *notificationQueue {
+	return &notificationQueue{
+		size:      size,
+		available: make(chan struct{}, 1),
+	}
+}
+
+// push queues `br` after the queued notifications.
+func (q *notificationQueue) push(br bridgeResponse) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, br)
+	q.trimLocked()
+	q.signalLocked()
+}
+
+// pushFront queues `br` before the queued notifications. It is used to
+// re-deliver a notification that could not be written, which is older than any
+// queued one.
+func (q *notificationQueue) pushFront(br bridgeResponse) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append([]bridgeResponse{br}, q.items...)
+	q.trimLocked()
+	q.signalLocked()
+}
+
+// tryPop returns the oldest queued notification, or false if there is none.
+func (q *notificationQueue) tryPop() (bridgeResponse, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return bridgeResponse{}, false
+	}
+	br := q.items[0]
+	q.items[0] = bridgeResponse{}
+	q.items = q.items[1:]
+	q.signalLocked()
+	return br, true
+}
+
+// trimLocked drops the oldest notifications other than exits until the queue
+// fits its size or only exits are left.
+func (q *notificationQueue) trimLocked() {
+	for len(q.items) > q.size {
+		victim := -1
+		for i, br := range q.items {
+			if !isExitNotification(br) {
+				victim = i
+				break
+			}
+		}
+		if victim < 0 {
+			return
+		}
+		dropped := q.items[victim]
+		q.items = append(q.items[:victim], q.items[victim+1:]...)
+
+		entry := logrus.WithField("size", q.size)
+		if n, ok := dropped.response.(*prot.ContainerNotification); ok {
+			entry = entry.WithFields(logrus.Fields{
+				"cid":  n.ContainerID,
+				"type": n.Type,
+			})
+		}
+		entry.Warning("dropped bridge notification, too many notifications are waiting to be written")
+		// The span of a notification ends once it is written.
+		if dropped.ctx != nil {
+			if s := trace.FromContext(dropped.ctx); s != nil {
+				s.End()
+			}
+		}
+	}
+}
+
+// signalLocked makes `available` ready if the queue is not empty.
+func (q *notificationQueue) signalLocked() {
+	if len(q.items) == 0 {
+		return
+	}
+	select {
+	case q.available <- struct{}{}:
+	default:
+	}
+}
+
+// isExitNotification returns true if `br` notifies the host that a container
+// exited.
+func isExitNotification(br bridgeResponse) bool {
+	n, ok := br.response.(*prot.ContainerNotification)
+	if !ok {
+		return false
+	}
+	switch n.Type {
+	case prot.NtGracefulExit, prot.NtForcedExit, prot.NtUnexpectedExit:
+		return true
+	}
+	return false
+}
+
+// responseQueue holds the messages waiting to be written to the bridge.
+// Notifications are always written before any queued responses so that a
+// large number of responses cannot delay them.
+type responseQueue struct {
+	notifications *notificationQueue
+	responses     chan bridgeResponse
+}
+
+func newResponseQueue(size int, notifications *notificationQueue) *responseQueue {
+	return &responseQueue{
+		notifications: notifications,
+		responses:     make(chan bridgeResponse, size),
+	}
+}
+
+// pushResponse queues `br` at normal priority. It blocks while the queue is
+// full unless `done` is closed first.
+func (q *responseQueue) pushResponse(br bridgeResponse, done <-chan struct{}) {
+	select {
+	case q.responses <- br:
+	case <-done:
+	}
+}
+
+// pop returns the next message to write. Notifications are only returned once
+// `ready` is closed. It returns false if `done` is closed before a message is
+// available.
+func (q *responseQueue) pop(ready, done <-chan struct{}) (bridgeResponse, bool) {
+	released := false
+	for {
+		if !released {
+			select {
+			case <-ready:
+				released = true
+			default:
+			}
+		}
+		// A nil channel is never ready, so notifications stay queued until
+		// `ready` is closed.
+		var available chan struct{}
+		waitReady := ready
+		if released {
+			if br, ok := q.notifications.tryPop(); ok {
+				return br, true
+			}
+			available = q.notifications.available
+			waitReady = nil
+		}
+
+		select {
+		case <-available:
+			// Check again now that a notification was queued.
+		case br := <-q.responses:
+			return br, true
+		case <-waitReady:
+			// Check again now that notifications can be returned.
+		case <-done:
+			return bridgeResponse{}, false
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package bridge
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+)
+
+func newSchedulerTestRequest(typ prot.MessageIdentifier, id prot.SequenceID, cid string) *Request {
+	return &Request{
+		Header: &prot.MessageHeader{
+			Type: typ,
+			ID:   id,
+		},
+		ContainerID: cid,
+	}
+}
+
+func Test_RequestScheduler_SameContainer_RunsInOrder(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		running int
+		order   []prot.SequenceID
+		wg      sync.WaitGroup
+	)
+	s := newRequestScheduler(10, func(r *Request) {
+		defer wg.Done()
+		mu.Lock()
+		running++
+		if running > 1 {
+			t.Errorf("request %d ran concurrently with another for the same container", r.Header.ID)
+		}
+		order = append(order, r.Header.ID)
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	const count = 5
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		s.schedule(newSchedulerTestRequest(prot.ComputeSystemModifySettingsV1, prot.SequenceID(i), "c1"))
+	}
+	wg.Wait()
+
+	for i, id := range order {
+		if id != prot.SequenceID(i) {
+			t.Fatalf("expected requests in order got: %v", order)
+		}
+	}
+}
+
+func Test_RequestScheduler_DifferentContainers_RunConcurrently(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 2)
+	s := newRequestScheduler(10, func(r *Request) {
+		started <- r.ContainerID
+		<-release
+	})
+	defer close(release)
+
+	s.schedule(newSchedulerTestRequest(prot.ComputeSystemModifySettingsV1, 0, "c1"))
+	s.schedule(newSchedulerTestRequest(prot.ComputeSystemModifySettingsV1, 1, "c2"))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for both containers' requests to start")
+		}
+	}
+}
+
+func Test_RequestScheduler_MaxConcurrent_Blocks(t *testing.T) {
+	release := make(chan struct{})
+	s := newRequestScheduler(1, func(r *Request) {
+		if r.Header.ID == 0 {
+			<-release
+		}
+	})
+
+	s.schedule(newSchedulerTestRequest(prot.ComputeSystemModifySettingsV1, 0, ""))
+
+	scheduled := make(chan struct{})
+	go func() {
+		s.schedule(newSchedulerTestRequest(prot.ComputeSystemModifySettingsV1, 1, ""))
+		close(scheduled)
+	}()
+
+	select {
+	case <-scheduled:
+		t.Fatal("expected schedule to block while the maximum requests are running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-scheduled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for schedule to unblock")
+	}
+}
+
+func Test_RequestScheduler_Queued_DoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan prot.SequenceID, 4)
+	s := newRequestScheduler(2, func(r *Request) {
+		started <- r.Header.ID
+		if r.ContainerID == "c1" {
+			<-release
+		}
+	})
+
+	// The requests queued behind the stuck request for c1 hold no slot, so
+	// neither block the scheduler nor the request for c2.
+	scheduled := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			s.schedule(newSchedulerTestRequest(prot.ComputeSystemModifySettingsV1, prot.SequenceID(i), "c1"))
+		}
+		s.schedule(newSchedulerTestRequest(prot.ComputeSystemModifySettingsV1, 3, "c2"))
+		close(scheduled)
+	}()
+	select {
+	case <-scheduled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the queued requests to be scheduled")
+	}
+	ids := make(map[prot.SequenceID]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-started:
+			ids[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the requests to start")
+		}
+	}
+	if !ids[0] || !ids[3] {
+		t.Fatalf("expected requests 0 and 3 to start got: %v", ids)
+	}
+}
+
+func Test_RequestScheduler_Unscheduled_Bypass(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	waited := make(chan struct{})
+	s := newRequestScheduler(1, func(r *Request) {
+		if r.Header.Type == prot.ComputeSystemWaitForProcessV1 {
+			close(waited)
+			return
+		}
+		<-release
+	})
+
+	// Fill the only slot and the queue for the container.
+	s.schedule(newSchedulerTestRequest(prot.ComputeSystemModifySettingsV1, 0, "c1"))
+	s.schedule(newSchedulerTestRequest(prot.ComputeSystemWaitForProcessV1, 1, "c1"))
+
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the process wait to bypass the scheduler")
+	}
+}
+
+func Test_ResponseQueue_NotificationsFirst(t *testing.T) {
+	ready := make(chan struct{})
+	close(ready)
+	done := make(chan struct{})
+	b := &Bridge{}
+	q := newResponseQueue(4, b.notificationQueue())
+	for i := 0; i < 3; i++ {
+		q.pushResponse(bridgeResponse{header: &prot.MessageHeader{Type: prot.ComputeSystemResponseGetPropertiesV1}}, done)
+	}
+	b.PublishNotification(&prot.ContainerNotification{Type: prot.NtOomKilled})
+
+	br, ok := q.pop(ready, done)
+	if !ok {
+		t.Fatal("expected a queued message")
+	}
+	if br.header.Type != prot.ComputeSystemNotificationV1 {
+		t.Fatalf("expected notification first got: %v", br.header.Type)
+	}
+
+	close(done)
+	for i := 0; i < 3; i++ {
+		if _, ok := q.pop(ready, make(chan struct{})); !ok {
+			t.Fatal("expected a queued response")
+		}
+	}
+	if _, ok := q.pop(ready, done); ok {
+		t.Fatal("expected pop to fail once done is closed")
+	}
+}
+
+func Test_ResponseQueue_NotificationsHeldUntilReady(t *testing.T) {
+	ready := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	b := &Bridge{}
+	q := newResponseQueue(4, b.notificationQueue())
+	b.PublishNotification(&prot.ContainerNotification{Type: prot.NtOomKilled})
+	q.pushResponse(bridgeResponse{header: &prot.MessageHeader{Type: prot.ComputeSystemResponseNegotiateProtocolV1}}, done)
+
+	br, ok := q.pop(ready, done)
+	if !ok {
+		t.Fatal("expected a queued message")
+	}
+	if br.header.Type != prot.ComputeSystemResponseNegotiateProtocolV1 {
+		t.Fatalf("expected the response before ready got: %v", br.header.Type)
+	}
+
+	popped := make(chan bridgeResponse)
+	go func() {
+		br, _ := q.pop(ready, done)
+		popped <- br
+	}()
+	select {
+	case br := <-popped:
+		t.Fatalf("expected no message before ready got: %v", br.header.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(ready)
+	select {
+	case br := <-popped:
+		if br.header.Type != prot.ComputeSystemNotificationV1 {
+			t.Fatalf("expected notification once ready got: %v", br.header.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the notification once ready")
+	}
+}
+
+func newNotificationTestResponse(id string, nt prot.NotificationType) bridgeResponse {
+	return bridgeResponse{
+		header:   &prot.MessageHeader{Type: prot.ComputeSystemNotificationV1},
+		response: &prot.ContainerNotification{MessageBase: prot.MessageBase{ContainerID: id}, Type: nt},
+	}
+}
+
+// popNotificationIDs returns the container IDs of the queued notifications in
+// the order they are popped.
+func popNotificationIDs(q *notificationQueue) []string {
+	var ids []string
+	for {
+		br, ok := q.tryPop()
+		if !ok {
+			return ids
+		}
+		ids = append(ids, br.response.(*prot.ContainerNotification).ContainerID)
+	}
+}
+
+func Test_NotificationQueue_DropsOldestNonExit(t *testing.T) {
+	q := newNotificationQueue(2)
+	q.push(newNotificationTestResponse("c1", prot.NtOomKilled))
+	q.push(newNotificationTestResponse("c2", prot.NtUnexpectedExit))
+	q.push(newNotificationTestResponse("c3", prot.NtOomKilled))
+	q.push(newNotificationTestResponse("c4", prot.NtForcedExit))
+
+	if ids := popNotificationIDs(q); !reflect.DeepEqual(ids, []string{"c2", "c4"}) {
+		t.Fatalf("expected the exit notifications to be kept got: %v", ids)
+	}
+}
+
+func Test_NotificationQueue_KeepsExits(t *testing.T) {
+	q := newNotificationQueue(2)
+	for _, id := range []string{"c1", "c2", "c3"} {
+		q.push(newNotificationTestResponse(id, prot.NtUnexpectedExit))
+	}
+	q.push(newNotificationTestResponse("c4", prot.NtOomKilled))
+
+	if ids := popNotificationIDs(q); !reflect.DeepEqual(ids, []string{"c1", "c2", "c3"}) {
+		t.Fatalf("expected every exit notification to be kept got: %v", ids)
+	}
+}
+
+func Test_NotificationQueue_PushFront(t *testing.T) {
+	q := newNotificationQueue(DefaultNotificationQueueSize)
+	q.push(newNotificationTestResponse("c2", prot.NtOomKilled))
+	q.push(newNotificationTestResponse("c3", prot.NtOomKilled))
+	q.pushFront(newNotificationTestResponse("c1", prot.NtOomKilled))
+
+	if ids := popNotificationIDs(q); !reflect.DeepEqual(ids, []string{"c1", "c2", "c3"}) {
+		t.Fatalf("expected the requeued notification first got: %v", ids)
+	}
+}
+
+func Test_Bridge_PublishNotification_DoesNotBlock(t *testing.T) {
+	b := &Bridge{}
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < DefaultNotificationQueueSize*2; i++ {
+			b.PublishNotification(&prot.ContainerNotification{Type: prot.NtOomKilled})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out publishing to a full notification queue")
+	}
+	if n := len(popNotificationIDs(b.notificationQueue())); n != DefaultNotificationQueueSize {
+		t.Fatalf("expected %d queued notifications got: %d", DefaultNotificationQueueSize, n)
+	}
+}
+
+func Test_Bridge_NotificationQueueSize(t *testing.T) {
+	b := &Bridge{NotificationQueueSize: 3}
+	for i := 0; i < 5; i++ {
+		b.PublishNotification(&prot.ContainerNotification{MessageBase: prot.MessageBase{ContainerID: fmt.Sprintf("c%d", i)}, Type: prot.NtOomKilled})
+	}
+	if ids := popNotificationIDs(b.notificationQueue()); !reflect.DeepEqual(ids, []string{"c2", "c3", "c4"}) {
+		t.Fatalf("expected the 3 newest notifications got: %v", ids)
+	}
+}
@@ -0,0 +1,66 @@
+package bridge
+
+import (
+	"context"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/oc"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	// RequestLatency is the time in milliseconds taken to handle a request.
+	RequestLatency = stats.Float64("opengcs/bridge/request_latency", "The time taken to handle a bridge request", stats.UnitMilliseconds)
+	// RequestErrors counts the requests that failed.
+	RequestErrors = stats.Int64("opengcs/bridge/request_errors", "The number of bridge requests that failed", stats.UnitDimensionless)
+
+	// KeyMessageType is the `prot.MessageIdentifier` of the request.
+	KeyMessageType, _ = tag.NewKey("message_type")
+
+	// Views are the views of the bridge measures to register with
+	// `view.Register`.
+	Views = []*view.View{
+		{
+			Name:        "opengcs/bridge/request_count",
+			Measure:     RequestLatency,
+			Description: "The number of bridge requests handled",
+			TagKeys:     []tag.Key{KeyMessageType},
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "opengcs/bridge/request_latency",
+			Measure:     RequestLatency,
+			Description: "The distribution of the time taken to handle bridge requests",
+			TagKeys:     []tag.Key{KeyMessageType},
+			Aggregation: oc.LatencyDistribution,
+		},
+		{
+			Name:        "opengcs/bridge/request_errors",
+			Measure:     RequestErrors,
+			Description: "The number of bridge requests that failed",
+			TagKeys:     []tag.Key{KeyMessageType},
+			Aggregation: view.Count(),
+		},
+	}
+)
+
+// statsRecorder is a `LatencyRecorder` that records to the OpenCensus bridge
+// measures.
+type statsRecorder struct{}
+
+// RecordLatency records `latency` to `RequestLatency` and, if `err` is not
+// nil, counts `RequestErrors` for the type of `r`.
+func (statsRecorder) RecordLatency(r *Request, latency time.Duration, err error) {
+	mutators := []tag.Mutator{tag.Upsert(KeyMessageType, r.Header.Type.String())}
+	ms := []stats.Measurement{RequestLatency.M(float64(latency.Nanoseconds()) / float64(time.Millisecond))}
+	if err != nil {
+		ms = append(ms, RequestErrors.M(1))
+	}
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_ = stats.RecordWithTags(ctx, mutators, ms...)
+}
@@ -0,0 +1,54 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"go.opencensus.io/stats/view"
+)
+
+func Test_Bridge_StatsRecorder_RecordsRequests(t *testing.T) {
+	if err := view.Register(Views...); err != nil {
+		t.Fatalf("failed to register views: %v", err)
+	}
+	defer view.Unregister(Views...)
+
+	r := &Request{
+		Context: context.Background(),
+		Header:  &prot.MessageHeader{Type: prot.ComputeSystemGetPropertiesV1},
+	}
+	var rec statsRecorder
+	rec.RecordLatency(r, 10*time.Millisecond, nil)
+	rec.RecordLatency(r, 20*time.Millisecond, errors.New("test failure"))
+
+	expected := map[string]int64{
+		"opengcs/bridge/request_count":  2,
+		"opengcs/bridge/request_errors": 1,
+	}
+	for name, count := range expected {
+		rows, err := view.RetrieveData(name)
+		if err != nil {
+			t.Fatalf("failed to retrieve %s: %v", name, err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("expected 1 row for %s got: %d", name, len(rows))
+		}
+		if tag := rows[0].Tags[0]; tag.Key != KeyMessageType || tag.Value != r.Header.Type.String() {
+			t.Errorf("expected %s tag %s got: %s=%s", name, r.Header.Type, tag.Key.Name(), tag.Value)
+		}
+		if got := rows[0].Data.(*view.CountData).Value; got != count {
+			t.Errorf("expected %s count %d got: %d", name, count, got)
+		}
+	}
+
+	rows, err := view.RetrieveData("opengcs/bridge/request_latency")
+	if err != nil {
+		t.Fatalf("failed to retrieve latency: %v", err)
+	}
+	if d := rows[0].Data.(*view.DistributionData); d.Count != 2 || d.Min != 10 || d.Max != 20 {
+		t.Errorf("expected 2 latencies between 10ms and 20ms got: %+v", d)
+	}
+}
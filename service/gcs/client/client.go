@@ -0,0 +1,473 @@
+// Package client implements the host side of the HCS<->GCS bridge protocol. It
+// is the counterpart of the `bridge` package and allows tooling to drive a GCS
+// directly over any `io.ReadWriteCloser` without hand-rolling the message
+// framing.
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrClosed is returned for any call made on, or pending when, the `Client`
+// connection is closed.
+var ErrClosed = errors.New("client: connection closed")
+
+// notificationBufferSize is the number of notifications that can be queued
+// before the read loop blocks waiting for the caller to drain
+// `Notifications`.
+const notificationBufferSize = 64
+
+// cancelTimeout is how long to wait for the GCS to acknowledge the
+// cancellation of a request whose context is done.
+const cancelTimeout = 30 * time.Second
+
+// responseBase is implemented by every response message.
+type responseBase interface {
+	Base() *prot.MessageResponseBase
+}
+
+// response is the result of a single request as seen by the read loop.
+type response struct {
+	header  prot.MessageHeader
+	message []byte
+	err     error
+}
+
+// Client is a host side connection to a GCS bridge. All methods are safe to
+// call concurrently. Responses are correlated to their requests by the
+// `SequenceID` in the message header.
+type Client struct {
+	rwc io.ReadWriteCloser
+
+	// writeMu serializes writing a header and payload pair to `rwc`.
+	writeMu sync.Mutex
+	// lastID is the last `SequenceID` handed out. Accessed atomically.
+	lastID uint64
+
+	mu      sync.Mutex
+	pending map[prot.SequenceID]chan response
+	readErr error
+
+	notifications chan *prot.ContainerNotification
+	closeOnce     sync.Once
+	closed        chan struct{}
+	readDone      chan struct{}
+}
+
+// New creates a `Client` speaking the bridge protocol over `rwc` and starts
+// reading responses. The caller must call `Close` to release `rwc`.
+func New(rwc io.ReadWriteCloser) *Client {
+	c := &Client{
+		rwc:           rwc,
+		pending:       make(map[prot.SequenceID]chan response),
+		notifications: make(chan *prot.ContainerNotification, notificationBufferSize),
+		closed:        make(chan struct{}),
+		readDone:      make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Notifications returns the channel that every `ComputeSystemNotificationV1`
+// received from the GCS is delivered on. The channel is closed once the
+// connection is closed. Callers should drain it; if it fills up responses
+// will not be delivered until there is room again.
+func (c *Client) Notifications() <-chan *prot.ContainerNotification {
+	return c.notifications
+}
+
+// Close closes the underlying connection and fails all pending calls with
+// `ErrClosed`.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.rwc.Close()
+	})
+	<-c.readDone
+	return err
+}
+
+// readLoop reads every message from the GCS and dispatches it to either the
+// pending request with the matching `SequenceID` or the notification channel.
+func (c *Client) readLoop() {
+	defer close(c.readDone)
+	defer close(c.notifications)
+
+	var err error
+	for {
+		var header prot.MessageHeader
+		if err = binary.Read(c.rwc, binary.LittleEndian, &header); err != nil {
+			err = errors.Wrap(err, "client: failed reading message header")
+			break
+		}
+		if header.Size < prot.MessageHeaderSize {
+			err = errors.Errorf("client: invalid message size %d", header.Size)
+			break
+		}
+		message := make([]byte, header.Size-prot.MessageHeaderSize)
+		if _, err = io.ReadFull(c.rwc, message); err != nil {
+			err = errors.Wrap(err, "client: failed reading message payload")
+			break
+		}
+
+		if header.Type == prot.ComputeSystemNotificationV1 {
+			var n prot.ContainerNotification
+			if err := json.Unmarshal(message, &n); err != nil {
+				logrus.WithError(err).Error("opengcs::client - failed to unmarshal notification")
+				continue
+			}
+			select {
+			case c.notifications <- &n:
+			case <-c.closed:
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[header.ID]
+		delete(c.pending, header.ID)
+		c.mu.Unlock()
+		if !ok {
+			// This is expected for requests whose context was done before
+			// the response arrived.
+			logrus.WithFields(logrus.Fields{
+				"message-type": header.Type.String(),
+				"message-id":   header.ID,
+			}).Debug("opengcs::client - response for unknown request")
+			continue
+		}
+		ch <- response{header: header, message: message}
+	}
+
+	select {
+	case <-c.closed:
+		err = ErrClosed
+	default:
+	}
+
+	c.mu.Lock()
+	c.readErr = err
+	for id, ch := range c.pending {
+		ch <- response{err: err}
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+}
+
+// call sends `request` as a message of type `typ` and waits for the response
+// to be unmarshaled into `resp`. If the GCS responds with a failure the
+// returned error carries the HRESULT from the response. If `ctx` is done first
+// the request is cancelled in the GCS as well.
+func (c *Client) call(ctx context.Context, typ prot.MessageIdentifier, request interface{}, resp responseBase) error {
+	message, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrapf(err, "client: failed to marshal JSON for request \"%v\"", request)
+	}
+
+	id := prot.SequenceID(atomic.AddUint64(&c.lastID, 1))
+	ch := make(chan response, 1)
+
+	c.mu.Lock()
+	if c.readErr != nil {
+		err := c.readErr
+		c.mu.Unlock()
+		return err
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	header := prot.MessageHeader{
+		Type: typ,
+		Size: uint32(len(message) + prot.MessageHeaderSize),
+		ID:   id,
+	}
+	if err := c.write(&header, message); err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return err
+	}
+
+	var r response
+	select {
+	case r = <-ch:
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if typ != prot.ComputeSystemCancelRequestV1 {
+			go c.cancel(id)
+		}
+		return ctx.Err()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if r.header.Type != prot.GetResponseIdentifier(typ) {
+		return errors.Errorf("client: unexpected response type %v for request %v", r.header.Type, typ)
+	}
+	if err := json.Unmarshal(r.message, resp); err != nil {
+		return errors.Wrapf(err, "client: failed to unmarshal JSON in response \"%s\"", r.message)
+	}
+	return responseError(resp.Base())
+}
+
+// cancel asks the GCS to cancel the in-flight request `id`. It is best effort
+// as the request may have completed already.
+func (c *Client) cancel(id prot.SequenceID) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+
+	request := prot.CancelRequest{SequenceID: id}
+	var resp prot.MessageResponseBase
+	if err := c.call(ctx, prot.ComputeSystemCancelRequestV1, &request, &resp); err != nil {
+		logrus.WithError(err).WithField("message-id", id).Debug("opengcs::client - failed to cancel request")
+	}
+}
+
+// write writes a single framed message to the connection.
+func (c *Client) write(header *prot.MessageHeader, message []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := binary.Write(c.rwc, binary.LittleEndian, header); err != nil {
+		return errors.Wrap(err, "client: failed writing message header")
+	}
+	if _, err := c.rwc.Write(message); err != nil {
+		return errors.Wrap(err, "client: failed writing message payload")
+	}
+	return nil
+}
+
+// responseError converts a failed `MessageResponseBase` into an error that
+// carries the HRESULT of the response. It returns nil on success.
+func responseError(base *prot.MessageResponseBase) error {
+	if base.Result >= 0 {
+		return nil
+	}
+	message := base.ErrorMessage
+	if message == "" && len(base.ErrorRecords) > 0 {
+		message = base.ErrorRecords[0].Message
+	}
+	return gcserr.WrapHresult(errors.New(message), gcserr.Hresult(base.Result))
+}
+
+// NegotiateProtocol negotiates the protocol version to use with the GCS. It
+// must be the first call made on a new connection.
+func (c *Client) NegotiateProtocol(ctx context.Context, min, max prot.ProtocolVersion) (*prot.NegotiateProtocolResponse, error) {
+	request := prot.NegotiateProtocol{
+		MinimumVersion: uint32(min),
+		MaximumVersion: uint32(max),
+	}
+	var resp prot.NegotiateProtocolResponse
+	if err := c.call(ctx, prot.ComputeSystemNegotiateProtocolV1, &request, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateContainer creates the container `id` with the given settings.
+func (c *Client) CreateContainer(ctx context.Context, id string, settings *prot.VMHostedContainerSettingsV2) error {
+	config, err := json.Marshal(settings)
+	if err != nil {
+		return errors.Wrap(err, "client: failed to marshal container settings")
+	}
+	request := prot.ContainerCreate{
+		MessageBase:     prot.MessageBase{ContainerID: id},
+		ContainerConfig: string(config),
+	}
+	var resp prot.ContainerCreateResponse
+	return c.call(ctx, prot.ComputeSystemCreateV1, &request, &resp)
+}
+
+// StartContainer sends the start message for container `id`. For LCOW the
+// container is not actually started until its init process is executed.
+func (c *Client) StartContainer(ctx context.Context, id string) error {
+	request := prot.MessageBase{ContainerID: id}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemStartV1, &request, &resp)
+}
+
+// ExecProcess executes a process in container `id` and returns its pid. Use
+// `hcsv2.UVMContainerID` or `params.IsExternal` to run a process in the UVM
+// itself. Only the ports whose matching `CreateStd*Pipe` is set in `params`
+// are connected.
+func (c *Client) ExecProcess(ctx context.Context, id string, params *prot.ProcessParameters, stdio prot.ExecuteProcessVsockStdioRelaySettings) (uint32, error) {
+	p, err := json.Marshal(params)
+	if err != nil {
+		return 0, errors.Wrap(err, "client: failed to marshal process parameters")
+	}
+	request := prot.ContainerExecuteProcess{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		Settings: prot.ExecuteProcessSettings{
+			ProcessParameters:       string(p),
+			VsockStdioRelaySettings: stdio,
+		},
+	}
+	var resp prot.ContainerExecuteProcessResponse
+	if err := c.call(ctx, prot.ComputeSystemExecuteProcessV1, &request, &resp); err != nil {
+		return 0, err
+	}
+	return resp.ProcessID, nil
+}
+
+// WaitForProcess waits for process `pid` in container `id` to exit and returns
+// its exit code. If `timeoutInMs` elapses first the returned error carries
+// `gcserr.HvVmcomputeTimeout`. Use `prot.InfiniteWaitTimeout` to wait forever.
+func (c *Client) WaitForProcess(ctx context.Context, id string, pid, timeoutInMs uint32) (uint32, error) {
+	request := prot.ContainerWaitForProcess{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		ProcessID:   pid,
+		TimeoutInMs: timeoutInMs,
+	}
+	var resp prot.ContainerWaitForProcessResponse
+	if err := c.call(ctx, prot.ComputeSystemWaitForProcessV1, &request, &resp); err != nil {
+		return 0, err
+	}
+	return resp.ExitCode, nil
+}
+
+// SignalProcess sends `signal` to process `pid` in container `id`. A signal
+// of 0 is treated by the GCS as SIGKILL.
+func (c *Client) SignalProcess(ctx context.Context, id string, pid uint32, signal int32) error {
+	request := prot.ContainerSignalProcess{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		ProcessID:   pid,
+		Options:     prot.SignalProcessOptions{Signal: signal},
+	}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemSignalProcessV1, &request, &resp)
+}
+
+// ShutdownContainer sends SIGTERM to all processes in container `id`. If `id`
+// is `hcsv2.UVMContainerID` the UVM itself is shutdown and no response is
+// expected.
+func (c *Client) ShutdownContainer(ctx context.Context, id string) error {
+	request := prot.MessageBase{ContainerID: id}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemShutdownGracefulV1, &request, &resp)
+}
+
+// KillContainer sends SIGKILL to all processes in container `id`.
+func (c *Client) KillContainer(ctx context.Context, id string) error {
+	request := prot.MessageBase{ContainerID: id}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemShutdownForcedV1, &request, &resp)
+}
+
+// ResizeConsole resizes the tty of process `pid` in container `id`.
+func (c *Client) ResizeConsole(ctx context.Context, id string, pid uint32, height, width uint16) error {
+	request := prot.ContainerResizeConsole{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		ProcessID:   pid,
+		Height:      height,
+		Width:       width,
+	}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemResizeConsoleV1, &request, &resp)
+}
+
+// ModifySettings issues `request` against container `id`. Use
+// `hcsv2.UVMContainerID` to modify the UVM itself.
+func (c *Client) ModifySettings(ctx context.Context, id string, request *prot.ModifySettingRequest) error {
+	msg := prot.ContainerModifySettings{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		Request:     request,
+	}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemModifySettingsV1, &msg, &resp)
+}
+
+// GetProperties queries the properties of container `id`.
+func (c *Client) GetProperties(ctx context.Context, id string, query prot.PropertyQuery) (*prot.PropertiesV2, error) {
+	q, err := json.Marshal(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to marshal property query")
+	}
+	request := prot.ContainerGetProperties{
+		MessageBase: prot.MessageBase{ContainerID: id},
+		Query:       string(q),
+	}
+	var resp prot.ContainerGetPropertiesResponse
+	if err := c.call(ctx, prot.ComputeSystemGetPropertiesV1, &request, &resp); err != nil {
+		return nil, err
+	}
+	properties := &prot.PropertiesV2{}
+	if err := json.Unmarshal([]byte(resp.Properties), properties); err != nil {
+		return nil, errors.Wrapf(err, "client: failed to unmarshal JSON in properties \"%s\"", resp.Properties)
+	}
+	return properties, nil
+}
+
+// DumpStacks returns the goroutine stacks of the GCS.
+func (c *Client) DumpStacks(ctx context.Context) (string, error) {
+	request := prot.MessageBase{}
+	var resp prot.DumpStacksResponse
+	if err := c.call(ctx, prot.ComputeSystemDumpStacksV1, &request, &resp); err != nil {
+		return "", err
+	}
+	return resp.GuestStacks, nil
+}
+
+// DeleteContainerState deletes the state of the exited container `id`.
+func (c *Client) DeleteContainerState(ctx context.Context, id string) error {
+	request := prot.MessageBase{ContainerID: id}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemDeleteContainerStateV1, &request, &resp)
+}
+
+// PauseContainer suspends all processes in container `id`.
+func (c *Client) PauseContainer(ctx context.Context, id string) error {
+	request := prot.MessageBase{ContainerID: id}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemPauseV1, &request, &resp)
+}
+
+// ResumeContainer resumes all processes in container `id` suspended by
+// `PauseContainer`.
+func (c *Client) ResumeContainer(ctx context.Context, id string) error {
+	request := prot.MessageBase{ContainerID: id}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemResumeV1, &request, &resp)
+}
+
+// CheckpointContainer writes the state of container `id` to the guest
+// directory `imagePath`.
+func (c *Client) CheckpointContainer(ctx context.Context, id, imagePath string, leaveRunning bool) error {
+	request := prot.ContainerCheckpoint{
+		MessageBase:  prot.MessageBase{ContainerID: id},
+		ImagePath:    imagePath,
+		LeaveRunning: leaveRunning,
+	}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemCheckpointV1, &request, &resp)
+}
+
+// RestoreContainer restores container `id` from the checkpoint in the guest
+// directory `imagePath`. Its stdio is connected by executing its initial
+// process as for a created container.
+func (c *Client) RestoreContainer(ctx context.Context, id string, settings *prot.VMHostedContainerSettingsV2, imagePath string) error {
+	config, err := json.Marshal(settings)
+	if err != nil {
+		return errors.Wrap(err, "client: failed to marshal container settings")
+	}
+	request := prot.ContainerRestore{
+		MessageBase:     prot.MessageBase{ContainerID: id},
+		ContainerConfig: string(config),
+		ImagePath:       imagePath,
+	}
+	var resp prot.MessageResponseBase
+	return c.call(ctx, prot.ComputeSystemRestoreV1, &request, &resp)
+}
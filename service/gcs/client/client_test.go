@@ -0,0 +1,246 @@
+package client
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/bridge"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+)
+
+// pipeConn joins the read end of one pipe and the write end of another into
+// an `io.ReadWriteCloser`.
+type pipeConn struct {
+	r *os.File
+	w *os.File
+}
+
+func (p *pipeConn) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *pipeConn) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p *pipeConn) Close() error {
+	p.w.Close()
+	return p.r.Close()
+}
+
+// newTestClient starts a `bridge.Bridge` dispatching to `mux` and returns a
+// `Client` connected to it.
+func newTestClient(t *testing.T, mux *bridge.Mux) (*Client, *bridge.Bridge) {
+	cr, sw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, cw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &bridge.Bridge{
+		Handler:  mux,
+		EnableV4: true,
+	}
+	b.AssignHandlers(mux, nil)
+	go b.ListenAndServe(sr, sw)
+
+	return New(&pipeConn{r: cr, w: cw}), b
+}
+
+func Test_Client_NegotiateProtocol_Success(t *testing.T) {
+	c, _ := newTestClient(t, bridge.NewBridgeMux())
+	defer c.Close()
+
+	resp, err := c.NegotiateProtocol(context.Background(), prot.PvV4, prot.PvMax)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Version != uint32(prot.PvV4) {
+		t.Fatalf("expected version %d, got %d", prot.PvV4, resp.Version)
+	}
+	if resp.Capabilities.RuntimeOsType != prot.OsTypeLinux {
+		t.Fatalf("expected os type %s, got %s", prot.OsTypeLinux, resp.Capabilities.RuntimeOsType)
+	}
+}
+
+func Test_Client_NegotiateProtocol_PauseResumeSupported(t *testing.T) {
+	c, _ := newTestClient(t, bridge.NewBridgeMux())
+	defer c.Close()
+
+	resp, err := c.NegotiateProtocol(context.Background(), prot.PvV4, prot.PvMax)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Capabilities.GuestDefinedCapabilities.PauseResumeSupported {
+		t.Fatal("expected pause and resume to be supported")
+	}
+}
+
+func Test_Client_NegotiateProtocol_Unsupported(t *testing.T) {
+	c, _ := newTestClient(t, bridge.NewBridgeMux())
+	defer c.Close()
+
+	_, err := c.NegotiateProtocol(context.Background(), prot.PvMax+1, prot.PvMax+1)
+	if err == nil {
+		t.Fatal("expected error for unsupported version")
+	}
+	hr, herr := gcserr.GetHresult(err)
+	if herr != nil || hr != gcserr.HrVmcomputeUnsupportedProtocolVersion {
+		t.Fatalf("expected HRESULT %v, got %v", gcserr.HrVmcomputeUnsupportedProtocolVersion, hr)
+	}
+}
+
+func Test_Client_ResponsesCorrelatedBySequenceID(t *testing.T) {
+	mux := bridge.NewBridgeMux()
+	c, _ := newTestClient(t, mux)
+	defer c.Close()
+
+	if _, err := c.NegotiateProtocol(context.Background(), prot.PvV4, prot.PvMax); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The first process wait blocks until the second is answered so the
+	// responses are written out of order.
+	release := make(chan struct{})
+	mux.HandleFunc(prot.ComputeSystemWaitForProcessV1, prot.PvV4, func(r *bridge.Request) (bridge.RequestResponse, error) {
+		if r.ContainerID == "slow" {
+			<-release
+			return &prot.ContainerWaitForProcessResponse{ExitCode: 1}, nil
+		}
+		close(release)
+		return &prot.ContainerWaitForProcessResponse{ExitCode: 2}, nil
+	})
+
+	slow := make(chan uint32)
+	go func() {
+		code, err := c.WaitForProcess(context.Background(), "slow", 1, prot.InfiniteWaitTimeout)
+		if err != nil {
+			t.Error(err)
+		}
+		slow <- code
+	}()
+
+	// Make sure the slow request is in flight first.
+	time.Sleep(100 * time.Millisecond)
+	code, err := c.WaitForProcess(context.Background(), "fast", 1, prot.InfiniteWaitTimeout)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code != 2 {
+		t.Fatalf("expected exit code 2 for fast request, got %d", code)
+	}
+	if code := <-slow; code != 1 {
+		t.Fatalf("expected exit code 1 for slow request, got %d", code)
+	}
+}
+
+func Test_Client_ErrorResponse_HasHresult(t *testing.T) {
+	mux := bridge.NewBridgeMux()
+	c, _ := newTestClient(t, mux)
+	defer c.Close()
+
+	if _, err := c.NegotiateProtocol(context.Background(), prot.PvV4, prot.PvMax); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mux.HandleFunc(prot.ComputeSystemSignalProcessV1, prot.PvV4, func(r *bridge.Request) (bridge.RequestResponse, error) {
+		return nil, gcserr.WrapHresult(errors.New("no such process"), gcserr.HrErrNotFound)
+	})
+
+	err := c.SignalProcess(context.Background(), "c1", 10, 9)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	hr, herr := gcserr.GetHresult(err)
+	if herr != nil || hr != gcserr.HrErrNotFound {
+		t.Fatalf("expected HRESULT %v, got %v", gcserr.HrErrNotFound, hr)
+	}
+}
+
+func Test_Client_Notifications(t *testing.T) {
+	c, b := newTestClient(t, bridge.NewBridgeMux())
+	defer c.Close()
+
+	// Make sure the bridge is serving before publishing.
+	if _, err := c.NegotiateProtocol(context.Background(), prot.PvV4, prot.PvMax); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.PublishNotification(&prot.ContainerNotification{
+		MessageBase: prot.MessageBase{ContainerID: "c1"},
+		Type:        prot.NtUnexpectedExit,
+		Operation:   prot.AoNone,
+	})
+
+	select {
+	case n := <-c.Notifications():
+		if n.ContainerID != "c1" || n.Type != prot.NtUnexpectedExit {
+			t.Fatalf("unexpected notification: %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for notification")
+	}
+}
+
+func Test_Client_Close_FailsPendingCalls(t *testing.T) {
+	mux := bridge.NewBridgeMux()
+	c, _ := newTestClient(t, mux)
+
+	if _, err := c.NegotiateProtocol(context.Background(), prot.PvV4, prot.PvMax); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	block := make(chan struct{})
+	defer close(block)
+	mux.HandleFunc(prot.ComputeSystemWaitForProcessV1, prot.PvV4, func(r *bridge.Request) (bridge.RequestResponse, error) {
+		<-block
+		return &prot.ContainerWaitForProcessResponse{}, nil
+	})
+
+	errs := make(chan error)
+	go func() {
+		_, err := c.WaitForProcess(context.Background(), "c1", 1, prot.InfiniteWaitTimeout)
+		errs <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-errs:
+		if err != ErrClosed {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for pending call to fail")
+	}
+
+	if err := c.StartContainer(context.Background(), "c1"); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after close, got %v", err)
+	}
+}
+
+func Test_Client_ContextDone_CancelsRequest(t *testing.T) {
+	mux := bridge.NewBridgeMux()
+	c, _ := newTestClient(t, mux)
+	defer c.Close()
+
+	if _, err := c.NegotiateProtocol(context.Background(), prot.PvV4, prot.PvMax); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cancelled := make(chan struct{})
+	mux.HandleFunc(prot.ComputeSystemWaitForProcessV1, prot.PvV4, func(r *bridge.Request) (bridge.RequestResponse, error) {
+		<-r.Context.Done()
+		close(cancelled)
+		return nil, r.Context.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.WaitForProcess(ctx, "c1", 1, prot.InfiniteWaitTimeout); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the request to be cancelled in the GCS")
+	}
+}
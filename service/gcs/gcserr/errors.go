@@ -15,8 +15,18 @@ const (
 	HrNotImpl = Hresult(-2147467263) // 0x80004001
 	// HrFail is the HRESULT for an invocation failure.
 	HrFail = Hresult(-2147467259) // 0x80004005
+	// HrInvalidArg is the HRESULT for an invalid argument.
+	HrInvalidArg = Hresult(-2147024809) // 0x80070057
+	// HrAccessDenied is the HRESULT for a request the GCS refuses to carry
+	// out.
+	HrAccessDenied = Hresult(-2147024891) // 0x80070005
 	// HrErrNotFound is the HRESULT for an invalid process id.
 	HrErrNotFound = Hresult(-2147023728) // 0x80070490
+	// HrErrCancelled is the HRESULT for operations that were cancelled.
+	HrErrCancelled = Hresult(-2147023673) // 0x800704C7
+	// HrErrAccessDisabledByPolicy is the HRESULT for a request denied by the
+	// security policy.
+	HrErrAccessDisabledByPolicy = Hresult(-2147023636) // 0x800704EC
 	// HvVmcomputeTimeout is the HRESULT for operations that timed out.
 	HvVmcomputeTimeout = Hresult(-1070137079) // 0xC0370109
 	// HrVmcomputeInvalidJSON is the HRESULT for failing to unmarshal a json
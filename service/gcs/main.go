@@ -1,24 +1,34 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/Microsoft/opengcs/internal/cgroupv2"
 	"github.com/Microsoft/opengcs/internal/kmsg"
+	"github.com/Microsoft/opengcs/internal/metrics"
 	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/policy"
 	"github.com/Microsoft/opengcs/internal/runtime/hcsv2"
+	"github.com/Microsoft/opengcs/internal/storage"
 	"github.com/Microsoft/opengcs/service/gcs/bridge"
 	"github.com/Microsoft/opengcs/service/gcs/runtime/runc"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
 	"github.com/Microsoft/opengcs/service/gcs/transport"
 	"github.com/containerd/cgroups"
 	cgroupstats "github.com/containerd/cgroups/stats/v1"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
 )
 
@@ -36,6 +46,99 @@ func memoryLogFormat(metrics *cgroupstats.Metrics) logrus.Fields {
 	}
 }
 
+func memoryLogFormatV2(metrics *cgroupv2.Metrics) logrus.Fields {
+	return logrus.Fields{
+		"memoryUsage":      metrics.Memory.Usage,
+		"memoryUsageLimit": metrics.Memory.UsageLimit,
+		"swapUsage":        metrics.Memory.SwapUsage,
+		"swapUsageLimit":   metrics.Memory.SwapLimit,
+		"anon":             metrics.Memory.Anon,
+		"file":             metrics.Memory.File,
+		"kernelStack":      metrics.Memory.KernelStack,
+		"slab":             metrics.Memory.Slab,
+	}
+}
+
+// gcsMemoryPollInterval is how often the memory usage of the gcs is compared
+// to -gcs-mem-limit-bytes on v2.
+const gcsMemoryPollInterval = time.Second
+
+// readMemoryEventsV2 is `readMemoryEvents` for a unified hierarchy. `msg` is
+// logged each time the memory.events counter returned by `counter` increases,
+// along with the memory limit `limit` of the cgroup if it is not 0.
+func readMemoryEventsV2(startTime time.Time, w *cgroupv2.MemoryEventWatcher, msg string, limit int64, cg *cgroupv2.Cgroup, counter func(*cgroupv2.MemoryEvents) uint64) {
+	count := 0
+	var last uint64
+	for {
+		events, err := w.Wait()
+		if err != nil {
+			if err != cgroupv2.ErrDeleted {
+				logrus.WithError(err).WithField("cgroup", cg.Path()).Error("failed to read memory events")
+			}
+			return
+		}
+		if counter(events) == last {
+			continue
+		}
+		last = counter(events)
+
+		count++
+		entry := logrus.WithFields(logrus.Fields{
+			"gcsStartTime": startTime,
+			"time":         time.Now(),
+			"cgroup":       cg.Path(),
+			"count":        count,
+		})
+		if limit != 0 {
+			entry = entry.WithField("limitBytes", limit)
+		}
+		// Sleep for one second in case there is a series of allocations slightly after
+		// reaching threshold.
+		time.Sleep(time.Second)
+		metrics, err := cg.Stat()
+		if err != nil || metrics.Memory == nil {
+			entry.WithError(err).Error(msg)
+		} else {
+			entry.WithFields(memoryLogFormatV2(metrics)).Warn(msg)
+		}
+	}
+}
+
+// readMemoryThresholdV2 logs every time the memory usage of `cg` rises above
+// the threshold of `w`.
+func readMemoryThresholdV2(startTime time.Time, w *cgroupv2.MemoryThresholdWatcher, threshold uint64, cg *cgroupv2.Cgroup) {
+	count := 0
+	for {
+		usage, err := w.Wait()
+		if err != nil {
+			if err != cgroupv2.ErrDeleted {
+				logrus.WithError(err).WithField("cgroup", cg.Path()).Error("failed to poll memory usage")
+			}
+			return
+		}
+
+		count++
+		msg := "memory usage for cgroup exceeded threshold"
+		entry := logrus.WithFields(logrus.Fields{
+			"gcsStartTime":   startTime,
+			"time":           time.Now(),
+			"cgroup":         cg.Path(),
+			"thresholdBytes": threshold,
+			"usageBytes":     usage,
+			"count":          count,
+		})
+		// Sleep for one second in case there is a series of allocations slightly after
+		// reaching threshold.
+		time.Sleep(time.Second)
+		metrics, err := cg.Stat()
+		if err != nil || metrics.Memory == nil {
+			entry.WithError(err).Error(msg)
+		} else {
+			entry.WithFields(memoryLogFormatV2(metrics)).Warn(msg)
+		}
+	}
+}
+
 func readMemoryEvents(startTime time.Time, efdFile *os.File, cgName string, threshold int64, cg cgroups.Cgroup) {
 	// Buffer must be >= 8 bytes for eventfd reads
 	// http://man7.org/linux/man-pages/man2/eventfd.2.html
@@ -79,6 +182,22 @@ func readMemoryEvents(startTime time.Time, efdFile *os.File, cgName string, thre
 	}
 }
 
+// loadSecurityPolicy returns the security policy given either base64 encoded
+// in `encoded` or in the file `path`.
+func loadSecurityPolicy(encoded, path string) (*policy.Policy, error) {
+	if encoded != "" && path != "" {
+		return nil, errors.New("only one of -security-policy and -security-policy-file may be set")
+	}
+	if path != "" {
+		return policy.Load(path)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode security policy")
+	}
+	return policy.Parse(data)
+}
+
 func main() {
 	startTime := time.Now()
 	logLevel := flag.String("loglevel", "debug", "Logging Level: debug, info, warning, error, fatal, panic.")
@@ -88,7 +207,20 @@ func main() {
 	useInOutErr := flag.Bool("use-inouterr", false, "If true use stdin/stdout for bridge communication and stderr for logging")
 	v4 := flag.Bool("v4", false, "enable the v4 protocol support and v2 schema")
 	rootMemReserveBytes := flag.Uint64("root-mem-reserve-bytes", 75*1024*1024, "the amount of memory reserved for the orchestration, the rest will be assigned to containers")
-	gcsMemLimitBytes := flag.Uint64("gcs-mem-limit-bytes", 50*1024*1024, "the maximum amount of memory the gcs can use")
+	gcsMemLimitBytes := flag.Uint64("gcs-mem-limit-bytes", 50*1024*1024, "the memory usage of the gcs above which an event is logged")
+	maxMessageSize := flag.Uint("max-message-size", bridge.DefaultMaxMessageSize, "the maximum size in bytes of a message read from the bridge")
+	maxConcurrentRequests := flag.Int("max-concurrent-requests", bridge.DefaultMaxConcurrentRequests, "the maximum number of bridge requests handled at once")
+	responseQueueSize := flag.Int("response-queue-size", bridge.DefaultResponseQueueSize, "the number of bridge responses that can wait to be written to the host")
+	notificationQueueSize := flag.Int("notification-queue-size", bridge.DefaultNotificationQueueSize, "the number of notifications that can wait to be written to the host, including while it is disconnected, before older ones other than exits are dropped")
+	transportType := flag.String("transport", "vsock", "Transport used to dial the host: vsock, unix or tcp")
+	unixTransportDir := flag.String("unix-transport-dir", "/run/gcs/transport", "the directory containing the <port>.sock sockets when -transport=unix")
+	tcpTransportAddr := flag.String("tcp-transport-addr", "127.0.0.1:6500", "the loopback host:port of the host when -transport=tcp")
+	metricsPort := flag.Uint("metrics-port", 0, "the transport port on which Prometheus metrics are served at /metrics, 0 to disable")
+	statsInterval := flag.Duration("stats-interval", time.Minute, "the interval at which OpenCensus stats are logged when -v4 is set, 0 to disable")
+	ociRuntimes := flag.String("oci-runtimes", "runc", "comma separated list of the runc compatible binaries containers may select with the "+runc.RuntimeAnnotation+" annotation, the first one is the default")
+	securityPolicy := flag.String("security-policy", "", "the base64 encoded JSON security policy enforced on the requests of the host")
+	securityPolicyFile := flag.String("security-policy-file", "", "the file containing the JSON security policy enforced on the requests of the host")
+	allowPrivileged := flag.Bool("allow-privileged", false, "allow containers with the privileged or unconfined annotation, which run without the default seccomp profile and capabilities")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "\nUsage of %s:\n", os.Args[0])
@@ -96,6 +228,9 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Examples:\n")
 		fmt.Fprintf(os.Stderr, "    %s -loglevel=debug -logfile=/run/gcs/gcs.log\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "    %s -loglevel=info -logfile=stdout\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "    %s -v4 -transport=unix -unix-transport-dir=/tmp/gcs\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "    %s -v4 -metrics-port=9100\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "    %s -v4 -oci-runtimes=runc,crun,runsc\n", os.Args[0])
 	}
 
 	flag.Parse()
@@ -104,6 +239,20 @@ func main() {
 	if *v4 {
 		trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 		trace.RegisterExporter(&oc.LogrusExporter{})
+
+		if *statsInterval > 0 {
+			var views []*view.View
+			views = append(views, bridge.Views...)
+			views = append(views, hcsv2.Views...)
+			views = append(views, runc.Views...)
+			views = append(views, stdio.Views...)
+			views = append(views, storage.Views...)
+			if err := view.Register(views...); err != nil {
+				logrus.WithError(err).Fatal("failed to register OpenCensus views")
+			}
+			view.SetReportingPeriod(*statsInterval)
+			view.RegisterExporter(&oc.LogrusExporter{})
+		}
 	}
 
 	// Use a file instead of stdout
@@ -145,96 +294,183 @@ func main() {
 	// Continuously log /dev/kmsg
 	go kmsg.ReadForever(kmsg.LogLevel(*kmsgLogLevel))
 
-	tport := &transport.VsockTransport{}
-	rtime, err := runc.NewRuntime(baseLogPath)
+	var tport transport.Transport
+	switch *transportType {
+	case "vsock":
+		tport = &transport.VsockTransport{}
+	case "unix":
+		tport = &transport.UnixTransport{Dir: *unixTransportDir}
+	case "tcp":
+		tport = &transport.TCPTransport{Address: *tcpTransportAddr}
+	default:
+		logrus.WithFields(logrus.Fields{
+			"transport": *transportType,
+		}).Fatal("unknown transport")
+	}
+	var binaries []string
+	for _, binary := range strings.Split(*ociRuntimes, ",") {
+		if binary = strings.TrimSpace(binary); binary != "" {
+			binaries = append(binaries, binary)
+		}
+	}
+	rtime, err := runc.NewRuntime(baseLogPath, binaries...)
 	if err != nil {
 		logrus.WithError(err).Fatal("failed to initialize new runc runtime")
 	}
 	mux := bridge.NewBridgeMux()
 	b := bridge.Bridge{
-		Handler:  mux,
-		EnableV4: *v4,
+		Handler:               mux,
+		EnableV4:              *v4,
+		MaxMessageSize:        uint32(*maxMessageSize),
+		MaxConcurrentRequests: *maxConcurrentRequests,
+		ResponseQueueSize:     *responseQueueSize,
+		NotificationQueueSize: *notificationQueueSize,
 	}
 	h := hcsv2.NewHost(rtime, tport)
+	h.SetAllowPrivileged(*allowPrivileged)
+	if *securityPolicy != "" || *securityPolicyFile != "" {
+		p, err := loadSecurityPolicy(*securityPolicy, *securityPolicyFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to load security policy")
+		}
+		h.SetSecurityPolicy(policy.NewEnforcer(p))
+	}
+	// Rebuild the host state if the GCS was restarted while containers were
+	// running.
+	if err := h.Recover(context.Background()); err != nil {
+		logrus.WithError(err).Error("failed to recover host state")
+	}
 	b.AssignHandlers(mux, h)
 
-	var bridgeIn io.ReadCloser
-	var bridgeOut io.WriteCloser
-	if *useInOutErr {
-		bridgeIn = os.Stdin
-		bridgeOut = os.Stdout
-	} else {
-		const commandPort uint32 = 0x40000000
-		bridgeCon, err := tport.Dial(commandPort)
-		if err != nil {
+	if *metricsPort != 0 {
+		lt, ok := tport.(transport.Listener)
+		if !ok {
 			logrus.WithFields(logrus.Fields{
-				"port":          commandPort,
-				logrus.ErrorKey: err,
-			}).Fatal("failed to dial host vsock connection")
+				"transport": *transportType,
+			}).Fatal("transport does not support serving metrics")
 		}
-		bridgeIn = bridgeCon
-		bridgeOut = bridgeCon
+		l, err := lt.Listen(uint32(*metricsPort))
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to listen for metrics")
+		}
+		go func() {
+			if err := metrics.Serve(l, h); err != nil {
+				logrus.WithError(err).Error("metrics server exited")
+			}
+		}()
 	}
 
 	// Setup the UVM cgroups to protect against a workload taking all available
 	// memory and causing the GCS to malfunction we create two cgroups: gcs,
 	// containers.
 	//
-
-	// Write 1 to memory.use_hierarchy on the root cgroup to enable hierarchy
-	// support. This needs to be set before we create any cgroups as the write
-	// will fail otherwise.
-	if err := ioutil.WriteFile("/sys/fs/cgroup/memory/memory.use_hierarchy", []byte("1"), 0644); err != nil {
-		logrus.WithError(err).Fatal("failed to enable hierarchy support for root cgroup")
-	}
-
 	// The containers cgroup is limited only by {Totalram - 75 MB
 	// (reservation)}.
 	//
 	// The gcs cgroup is not limited but an event will get logged if memory
-	// usage exceeds 50 MB.
+	// usage exceeds 50 MB, and on v2 also if its processes are OOM killed.
 	sinfo := syscall.Sysinfo_t{}
 	if err := syscall.Sysinfo(&sinfo); err != nil {
 		logrus.WithError(err).Fatal("failed to get sys info")
 	}
 	containersLimit := int64(sinfo.Totalram - *rootMemReserveBytes)
-	containersControl, err := cgroups.New(cgroups.V1, cgroups.StaticPath("/containers"), &oci.LinuxResources{
-		Memory: &oci.LinuxMemory{
-			Limit: &containersLimit,
-		},
-	})
-	if err != nil {
-		logrus.WithError(err).Fatal("failed to create containers cgroup")
-	}
-	defer containersControl.Delete()
+	if cgroupv2.IsUnified() {
+		logrus.Info("using the unified cgroup v2 hierarchy")
+		containersControl, err := cgroupv2.New("/containers", &oci.LinuxResources{
+			Memory: &oci.LinuxMemory{
+				Limit: &containersLimit,
+			},
+		})
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to create containers cgroup")
+		}
+		defer containersControl.Delete()
 
-	gcsControl, err := cgroups.New(cgroups.V1, cgroups.StaticPath("/gcs"), &oci.LinuxResources{})
-	if err != nil {
-		logrus.WithError(err).Fatal("failed to create gcs cgroup")
-	}
-	defer gcsControl.Delete()
-	if err := gcsControl.Add(cgroups.Process{Pid: os.Getpid()}); err != nil {
-		logrus.WithError(err).Fatal("failed add gcs pid to gcs cgroup")
-	}
+		gcsControl, err := cgroupv2.New("/gcs", &oci.LinuxResources{})
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to create gcs cgroup")
+		}
+		defer gcsControl.Delete()
+		if err := gcsControl.AddProc(os.Getpid()); err != nil {
+			logrus.WithError(err).Fatal("failed add gcs pid to gcs cgroup")
+		}
 
-	event := cgroups.MemoryThresholdEvent(*gcsMemLimitBytes, false)
-	gefd, err := gcsControl.RegisterMemoryEvent(event)
-	if err != nil {
-		logrus.WithError(err).Fatal("failed to register memory threshold for gcs cgroup")
-	}
-	gefdFile := os.NewFile(gefd, "gefd")
-	defer gefdFile.Close()
+		// There are no usage threshold events on v2, and setting the threshold
+		// as memory.high would throttle the gcs. As on v1 the gcs is not
+		// limited, so its usage is polled against the threshold instead.
+		gcsThreshold := gcsControl.WatchMemoryThreshold(*gcsMemLimitBytes, gcsMemoryPollInterval)
+		defer gcsThreshold.Close()
 
-	oom, err := containersControl.OOMEventFD()
-	if err != nil {
-		logrus.WithError(err).Fatal("failed to retrieve the container cgroups oom eventfd")
-	}
-	oomFile := os.NewFile(oom, "cefd")
-	defer oomFile.Close()
+		gcsWatcher, err := gcsControl.WatchMemoryEvents()
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to watch memory events of gcs cgroup")
+		}
+		defer gcsWatcher.Close()
+
+		containersWatcher, err := containersControl.WatchMemoryEvents()
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to watch memory events of containers cgroup")
+		}
+		defer containersWatcher.Close()
 
-	go readMemoryEvents(startTime, gefdFile, "/gcs", int64(*gcsMemLimitBytes), gcsControl)
-	go readMemoryEvents(startTime, oomFile, "/containers", containersLimit, containersControl)
-	err = b.ListenAndServe(bridgeIn, bridgeOut)
+		go readMemoryThresholdV2(startTime, gcsThreshold, *gcsMemLimitBytes, gcsControl)
+		go readMemoryEventsV2(startTime, gcsWatcher, "processes of cgroup were oom killed", 0, gcsControl, func(e *cgroupv2.MemoryEvents) uint64 { return e.OomKill })
+		go readMemoryEventsV2(startTime, containersWatcher, "memory usage for cgroup reached its limit", containersLimit, containersControl, func(e *cgroupv2.MemoryEvents) uint64 { return e.Oom })
+	} else {
+		// Write 1 to memory.use_hierarchy on the root cgroup to enable
+		// hierarchy support. This needs to be set before we create any
+		// cgroups as the write will fail otherwise.
+		if err := ioutil.WriteFile("/sys/fs/cgroup/memory/memory.use_hierarchy", []byte("1"), 0644); err != nil {
+			logrus.WithError(err).Fatal("failed to enable hierarchy support for root cgroup")
+		}
+
+		containersControl, err := cgroups.New(cgroups.V1, cgroups.StaticPath("/containers"), &oci.LinuxResources{
+			Memory: &oci.LinuxMemory{
+				Limit: &containersLimit,
+			},
+		})
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to create containers cgroup")
+		}
+		defer containersControl.Delete()
+
+		gcsControl, err := cgroups.New(cgroups.V1, cgroups.StaticPath("/gcs"), &oci.LinuxResources{})
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to create gcs cgroup")
+		}
+		defer gcsControl.Delete()
+		if err := gcsControl.Add(cgroups.Process{Pid: os.Getpid()}); err != nil {
+			logrus.WithError(err).Fatal("failed add gcs pid to gcs cgroup")
+		}
+
+		event := cgroups.MemoryThresholdEvent(*gcsMemLimitBytes, false)
+		gefd, err := gcsControl.RegisterMemoryEvent(event)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to register memory threshold for gcs cgroup")
+		}
+		gefdFile := os.NewFile(gefd, "gefd")
+		defer gefdFile.Close()
+
+		oom, err := containersControl.OOMEventFD()
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to retrieve the container cgroups oom eventfd")
+		}
+		oomFile := os.NewFile(oom, "cefd")
+		defer oomFile.Close()
+
+		go readMemoryEvents(startTime, gefdFile, "/gcs", int64(*gcsMemLimitBytes), gcsControl)
+		go readMemoryEvents(startTime, oomFile, "/containers", containersLimit, containersControl)
+	}
+	if *useInOutErr {
+		err = b.ListenAndServe(os.Stdin, os.Stdout)
+	} else {
+		// The host agent can restart while the UVM keeps running, so the
+		// command connection is dialed again whenever it is lost.
+		const commandPort uint32 = 0x40000000
+		err = b.ServeWithReconnect(func() (io.ReadWriteCloser, error) {
+			return tport.Dial(commandPort)
+		})
+	}
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			logrus.ErrorKey: err,
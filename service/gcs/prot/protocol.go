@@ -6,6 +6,7 @@ package prot
 import (
 	"encoding/json"
 	"strconv"
+	"time"
 
 	"github.com/Microsoft/opengcs/service/libs/commonutils"
 	v1 "github.com/containerd/cgroups/stats/v1"
@@ -104,6 +105,17 @@ const (
 	ComputeSystemDumpStacksV1 = 0x10100c01
 	// ComputeSystemDeleteContainerStateV1 is the delete container request.
 	ComputeSystemDeleteContainerStateV1 = 0x10100d01
+	// ComputeSystemCancelRequestV1 is the request to cancel an in-flight
+	// request.
+	ComputeSystemCancelRequestV1 = 0x10100e01
+	// ComputeSystemPauseV1 is the pause container request.
+	ComputeSystemPauseV1 = 0x10100f01
+	// ComputeSystemResumeV1 is the resume container request.
+	ComputeSystemResumeV1 = 0x10101001
+	// ComputeSystemCheckpointV1 is the checkpoint container request.
+	ComputeSystemCheckpointV1 = 0x10101101
+	// ComputeSystemRestoreV1 is the restore container request.
+	ComputeSystemRestoreV1 = 0x10101201
 
 	// ComputeSystemResponseCreateV1 is the create container response.
 	ComputeSystemResponseCreateV1 = 0x20100101
@@ -134,6 +146,16 @@ const (
 	ComputeSystemResponseNegotiateProtocolV1 = 0x20100b01
 	// ComputeSystemResponseDumpStacksV1 is the dump stack response
 	ComputeSystemResponseDumpStacksV1 = 0x20100c01
+	// ComputeSystemResponseCancelRequestV1 is the cancel request response.
+	ComputeSystemResponseCancelRequestV1 = 0x20100e01
+	// ComputeSystemResponsePauseV1 is the pause container response.
+	ComputeSystemResponsePauseV1 = 0x20100f01
+	// ComputeSystemResponseResumeV1 is the resume container response.
+	ComputeSystemResponseResumeV1 = 0x20101001
+	// ComputeSystemResponseCheckpointV1 is the checkpoint container response.
+	ComputeSystemResponseCheckpointV1 = 0x20101101
+	// ComputeSystemResponseRestoreV1 is the restore container response.
+	ComputeSystemResponseRestoreV1 = 0x20101201
 
 	// ComputeSystemNotificationV1 is the notification identifier.
 	ComputeSystemNotificationV1 = 0x30100101
@@ -170,6 +192,16 @@ func (mi MessageIdentifier) String() string {
 		return "ComputeSystemDumpStacksV1"
 	case ComputeSystemDeleteContainerStateV1:
 		return "ComputeSystemDeleteContainerStateV1"
+	case ComputeSystemCancelRequestV1:
+		return "ComputeSystemCancelRequestV1"
+	case ComputeSystemPauseV1:
+		return "ComputeSystemPauseV1"
+	case ComputeSystemResumeV1:
+		return "ComputeSystemResumeV1"
+	case ComputeSystemCheckpointV1:
+		return "ComputeSystemCheckpointV1"
+	case ComputeSystemRestoreV1:
+		return "ComputeSystemRestoreV1"
 	case ComputeSystemResponseCreateV1:
 		return "ComputeSystemResponseCreateV1"
 	case ComputeSystemResponseStartV1:
@@ -194,6 +226,16 @@ func (mi MessageIdentifier) String() string {
 		return "ComputeSystemResponseNegotiateProtocolV1"
 	case ComputeSystemResponseDumpStacksV1:
 		return "ComputeSystemResponseDumpStacksV1"
+	case ComputeSystemResponseCancelRequestV1:
+		return "ComputeSystemResponseCancelRequestV1"
+	case ComputeSystemResponsePauseV1:
+		return "ComputeSystemResponsePauseV1"
+	case ComputeSystemResponseResumeV1:
+		return "ComputeSystemResponseResumeV1"
+	case ComputeSystemResponseCheckpointV1:
+		return "ComputeSystemResponseCheckpointV1"
+	case ComputeSystemResponseRestoreV1:
+		return "ComputeSystemResponseRestoreV1"
 	case ComputeSystemNotificationV1:
 		return "ComputeSystemNotificationV1"
 	default:
@@ -201,6 +243,21 @@ func (mi MessageIdentifier) String() string {
 	}
 }
 
+// Type returns the MessageType portion of the identifier.
+func (mi MessageIdentifier) Type() MessageType {
+	return MessageType(uint32(mi) & messageTypeMask)
+}
+
+// Category returns the MessageCategory portion of the identifier.
+func (mi MessageIdentifier) Category() MessageCategory {
+	return MessageCategory(uint32(mi) & messageCategoryMask)
+}
+
+// Version returns the version portion of the identifier.
+func (mi MessageIdentifier) Version() uint32 {
+	return (uint32(mi) & messageVersionMask) >> messageVersionShift
+}
+
 // SequenceID is used to correlate requests and responses.
 type SequenceID uint64
 
@@ -214,6 +271,21 @@ type MessageHeader struct {
 // MessageHeaderSize is the size in bytes of the MessageHeader struct.
 const MessageHeaderSize = 16
 
+// ValidateRequest returns an error if the header does not describe a version 1
+// compute system request. It does not validate that the message id is known.
+func (h *MessageHeader) ValidateRequest() error {
+	if h.Type.Type() != MtRequest {
+		return errors.Errorf("invalid message type 0x%x for request %v", uint32(h.Type.Type()), h.Type)
+	}
+	if h.Type.Category() != McComputeSystem {
+		return errors.Errorf("invalid message category 0x%x for request %v", uint32(h.Type.Category()), h.Type)
+	}
+	if h.Type.Version() != 1 {
+		return errors.Errorf("invalid message version %d for request %v", h.Type.Version(), h.Type)
+	}
+	return nil
+}
+
 /////////////////////////////////////////////////////
 
 // ProtocolVersion is a type for the seclected HCS<->GCS protocol version of
@@ -271,6 +343,9 @@ type GcsGuestCapabilities struct {
 	SignalProcessSupported        bool `json:",omitempty"`
 	DumpStacksSupported           bool `json:",omitempty"`
 	DeleteContainerStateSupported bool `json:",omitempty"`
+	CancelRequestSupported        bool `json:",omitempty"`
+	PauseResumeSupported          bool `json:",omitempty"`
+	CheckpointRestoreSupported    bool `json:",omitempty"`
 }
 
 // ocspancontext is the internal JSON representation of the OpenCensus
@@ -328,6 +403,38 @@ type ContainerCreate struct {
 	SupportedVersions ProtocolSupport `json:",omitempty"`
 }
 
+// ContainerCheckpoint is the message from the HCS specifying to checkpoint a
+// container into an image directory in the utility VM.
+type ContainerCheckpoint struct {
+	MessageBase
+	// ImagePath is the guest path of the directory the checkpoint image is
+	// written to, such as a mounted SCSI disk.
+	ImagePath string
+	// LeaveRunning leaves the container running after the checkpoint.
+	LeaveRunning bool `json:",omitempty"`
+	// TCPEstablished allows checkpointing established TCP connections.
+	TCPEstablished bool `json:"TcpEstablished,omitempty"`
+}
+
+// ContainerRestore is the message from the HCS specifying to restore a
+// container from a checkpoint image directory in the utility VM. Like
+// `ContainerCreate` the container's stdio is connected by executing its
+// initial process.
+type ContainerRestore struct {
+	MessageBase
+	ContainerConfig string
+	// ImagePath is the guest path of the directory the checkpoint image is
+	// read from.
+	ImagePath string
+}
+
+// CancelRequest is the message from the HCS specifying to cancel the context
+// of the in-flight request with the given `SequenceID`.
+type CancelRequest struct {
+	MessageBase
+	SequenceID SequenceID `json:"SequenceId"`
+}
+
 // NotificationType defines a type of notification to be sent back to the HCS.
 type NotificationType string
 
@@ -352,6 +459,11 @@ const (
 	NtStarted = NotificationType("Started")
 	// NtPaused indicates a paused notification to be sent back to the HCS
 	NtPaused = NotificationType("Paused")
+	// NtResumed indicates a resumed notification to be sent back to the HCS
+	NtResumed = NotificationType("Resumed")
+	// NtOomKilled indicates that a process in the container was killed by the
+	// kernel OOM killer. It does not by itself mean that the container exited.
+	NtOomKilled = NotificationType("OomKilled")
 	// NtUnknown indicates an unknown notification to be sent back to the HCS
 	NtUnknown = NotificationType("Unknown")
 )
@@ -378,8 +490,7 @@ const (
 )
 
 // ContainerNotification is a message sent from the GCS to the HCS to indicate
-// some kind of event. At the moment, it is only used for container exit
-// notifications.
+// some kind of event, such as a container exit or an OOM kill.
 type ContainerNotification struct {
 	MessageBase
 	Type       NotificationType
@@ -388,6 +499,44 @@ type ContainerNotification struct {
 	ResultInfo string `json:",omitempty"`
 }
 
+// ContainerOomKilledInfo is the JSON `ResultInfo` of an `NtOomKilled`
+// notification.
+type ContainerOomKilledInfo struct {
+	// Memory is the memory cgroup stats of the container right after the OOM
+	// kill, if they could be read.
+	Memory *v1.MemoryStat `json:",omitempty"`
+}
+
+// ExitReason is the reason a container exited.
+type ExitReason string
+
+const (
+	// ErExited indicates that the container's init process exited on its own.
+	ErExited = ExitReason("Exited")
+	// ErSignaled indicates that the container's init process was terminated
+	// by a signal.
+	ErSignaled = ExitReason("Signaled")
+	// ErOomKilled indicates that a process in the container was killed by the
+	// kernel OOM killer before the container exited.
+	ErOomKilled = ExitReason("OomKilled")
+)
+
+// ContainerExitInfo is the JSON `ResultInfo` of a container exit
+// notification. The notification's `Result` is the exit code.
+type ContainerExitInfo struct {
+	Reason ExitReason
+	// ExitCode is the exit code of the init process. It is 128+N if the
+	// process was terminated by signal N.
+	ExitCode int32
+	// Signal is the signal that terminated the init process, if any.
+	Signal int32 `json:",omitempty"`
+	// OomKilled is true if any process in the container was killed by the
+	// kernel OOM killer before the container exited.
+	OomKilled bool `json:",omitempty"`
+	// ExitTime is the time the init process exited.
+	ExitTime time.Time
+}
+
 // ExecuteProcessVsockStdioRelaySettings defines the port numbers for each
 // stdio socket for a process.
 type ExecuteProcessVsockStdioRelaySettings struct {
@@ -458,6 +607,9 @@ const (
 	PtCPUGroup = PropertyType("CpuGroup")
 	// PtStatistics is the property type for statistics
 	PtStatistics = PropertyType("Statistics")
+	// PtPodStatistics is the property type for the statistics of the pod of a
+	// sandbox container
+	PtPodStatistics = PropertyType("PodStatistics")
 	// PtProcessList is the property type for a process list
 	PtProcessList = PropertyType("ProcessList")
 	// PtPendingUpdates is the property type for determining if there are
@@ -519,6 +671,9 @@ const (
 	MrtVPCIDevice = ModifyResourceType("VPCIDevice")
 	// MrtContainerConstraints is the modify resource type for updating container constraints
 	MrtContainerConstraints = ModifyResourceType("ContainerConstraints")
+	// MrtPodConstraints is the modify resource type for updating the
+	// constraints of the pod of a sandbox container
+	MrtPodConstraints = ModifyResourceType("PodConstraints")
 )
 
 // ModifyRequestType is the type of operation to perform on a given modify
@@ -618,6 +773,12 @@ func UnmarshalContainerModifySettings(b []byte) (*ContainerModifySettings, error
 			return &request, errors.Wrap(err, "failed to unmarshal settings as ContainerConstraintsV2")
 		}
 		msr.Settings = cc
+	case MrtPodConstraints:
+		pc := &PodConstraintsV2{}
+		if err := commonutils.UnmarshalJSONWithHresult(msrRawSettings, pc); err != nil {
+			return &request, errors.Wrap(err, "failed to unmarshal settings as PodConstraintsV2")
+		}
+		msr.Settings = pc
 	default:
 		return &request, errors.Errorf("invalid ResourceType '%s'", msr.ResourceType)
 	}
@@ -756,13 +917,49 @@ type MappedVirtualDisk struct {
 	AttachOnly        bool  `json:",omitempty"`
 }
 
+// DeviceVerityInfo describes the dm-verity hash tree appended to the ext4
+// filesystem of a read-only layer device. A device with verity information is
+// mounted only if its content matches `RootDigest`.
+type DeviceVerityInfo struct {
+	// Ext4SizeInBytes is the size of the ext4 filesystem. The hash tree
+	// starts right after it.
+	Ext4SizeInBytes int64
+	// Version is the hash tree format version.
+	Version int
+	// Algorithm is the hash algorithm, such as "sha256".
+	Algorithm string
+	// SuperBlock is whether a `veritysetup` superblock precedes the hash
+	// tree.
+	SuperBlock bool `json:",omitempty"`
+	// RootDigest is the hex encoded root hash of the hash tree.
+	RootDigest string
+	// Salt is the hex encoded salt of the hash tree.
+	Salt string `json:",omitempty"`
+	// BlockSize is the size in bytes of both the data and hash blocks.
+	BlockSize int
+}
+
+// HashAlgorithm returns the hash algorithm of the hash tree, which is sha256
+// if `Algorithm` is not set.
+func (i *DeviceVerityInfo) HashAlgorithm() string {
+	if i.Algorithm == "" {
+		return "sha256"
+	}
+	return i.Algorithm
+}
+
 // MappedVirtualDiskV2 represents a disk on the host which is mapped into a
 // directory in the guest in the V2 schema.
 type MappedVirtualDiskV2 struct {
-	MountPath  string `json:",omitempty"`
-	Lun        uint8  `json:",omitempty"`
-	Controller uint8  `json:",omitempty"`
-	ReadOnly   bool   `json:",omitempty"`
+	MountPath  string            `json:",omitempty"`
+	Lun        uint8             `json:",omitempty"`
+	Controller uint8             `json:",omitempty"`
+	ReadOnly   bool              `json:",omitempty"`
+	VerityInfo *DeviceVerityInfo `json:",omitempty"`
+	// Encrypted mounts the writable disk through a dm-crypt device keyed with
+	// an ephemeral key generated in the guest. The disk is formatted on mount,
+	// and its content cannot be read once the UVM is torn down.
+	Encrypted bool `json:",omitempty"`
 }
 
 // MappedDirectory represents a directory on the host which is mapped to a
@@ -788,6 +985,17 @@ type MappedDirectoryV2 struct {
 type MappedVPMemDeviceV2 struct {
 	DeviceNumber uint32 `json:",omitempty"`
 	MountPath    string `json:",omitempty"`
+	// Mappings are the regions of the device that make up the mounted
+	// filesystem, in order. The whole device is mounted if there are none.
+	Mappings   []VPMemMapping    `json:",omitempty"`
+	VerityInfo *DeviceVerityInfo `json:",omitempty"`
+}
+
+// VPMemMapping is a region of a VPMem device. Several layers can be packed in
+// one device, each in its own regions.
+type VPMemMapping struct {
+	DeviceOffsetInBytes int64
+	DeviceSizeInBytes   int64
 }
 
 type MappedVPCIDeviceV2 struct {
@@ -799,6 +1007,14 @@ type ContainerConstraintsV2 struct {
 	Linux   oci.LinuxResources   `json:",omitempty"`
 }
 
+// PodConstraintsV2 is a modify type that corresponds to MrtPodConstraints.
+// The pod cgroup is limited to `Linux` plus `Overhead`, the resources used to
+// run the pod itself such as its sandbox.
+type PodConstraintsV2 struct {
+	Linux    oci.LinuxResources `json:",omitempty"`
+	Overhead oci.LinuxResources `json:",omitempty"`
+}
+
 // VMHostedContainerSettings is the set of settings used to specify the initial
 // configuration of a container.
 type VMHostedContainerSettings struct {
@@ -906,5 +1122,84 @@ type Properties struct {
 
 type PropertiesV2 struct {
 	ProcessList []ProcessDetails `json:"ProcessList,omitempty"`
-	Metrics     *v1.Metrics      `json:"LCOWMetrics,omitempty"`
+	// Metrics is set on a cgroup v1 hierarchy and MetricsV2 on a unified
+	// hierarchy.
+	Metrics   *v1.Metrics `json:"LCOWMetrics,omitempty"`
+	MetricsV2 *MetricsV2  `json:"LCOWMetricsV2,omitempty"`
+	// PodMetrics and PodMetricsV2 are the metrics of the pod of a sandbox,
+	// which include every container in the pod.
+	PodMetrics   *v1.Metrics `json:"LCOWPodMetrics,omitempty"`
+	PodMetricsV2 *MetricsV2  `json:"LCOWPodMetricsV2,omitempty"`
+}
+
+// MetricsV2 are the statistics of a cgroup on a unified cgroup v2 hierarchy. A
+// controller that is not enabled for the cgroup leaves its field nil.
+type MetricsV2 struct {
+	Pids         *PidsStatV2     `json:",omitempty"`
+	CPU          *CPUStatV2      `json:",omitempty"`
+	Memory       *MemoryStatV2   `json:",omitempty"`
+	MemoryEvents *MemoryEventsV2 `json:",omitempty"`
+	IO           *IOStatV2       `json:",omitempty"`
+}
+
+// PidsStatV2 is read from pids.current and pids.max. A `Limit` of 0 means
+// there is no limit.
+type PidsStatV2 struct {
+	Current uint64
+	Limit   uint64
+}
+
+// CPUStatV2 is read from cpu.stat.
+type CPUStatV2 struct {
+	UsageUsec     uint64
+	UserUsec      uint64
+	SystemUsec    uint64
+	NrPeriods     uint64
+	NrThrottled   uint64
+	ThrottledUsec uint64
+}
+
+// MemoryStatV2 is read from memory.current, memory.max, memory.swap.current,
+// memory.swap.max and memory.stat. A limit of 0 means there is no limit.
+type MemoryStatV2 struct {
+	Usage      uint64
+	UsageLimit uint64
+	SwapUsage  uint64
+	SwapLimit  uint64
+
+	Anon          uint64
+	File          uint64
+	KernelStack   uint64
+	Slab          uint64
+	Sock          uint64
+	Shmem         uint64
+	FileMapped    uint64
+	FileDirty     uint64
+	FileWriteback uint64
+	Pgfault       uint64
+	Pgmajfault    uint64
+}
+
+// MemoryEventsV2 are the counters read from memory.events.
+type MemoryEventsV2 struct {
+	Low     uint64
+	High    uint64
+	Max     uint64
+	Oom     uint64
+	OomKill uint64
+}
+
+// IOStatV2 is read from io.stat.
+type IOStatV2 struct {
+	Usage []IOEntryV2 `json:",omitempty"`
+}
+
+// IOEntryV2 is the I/O of a cgroup to the block device `Major`:`Minor`.
+type IOEntryV2 struct {
+	Major  uint64
+	Minor  uint64
+	Rbytes uint64
+	Wbytes uint64
+	Rios   uint64
+	Wios   uint64
 }
@@ -0,0 +1,58 @@
+package runtime
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UnknownExitCode is the exit code reported for a process whose exit status
+// cannot be collected, such as a process adopted after the GCS restarted, which
+// was reparented to init rather than to the new GCS.
+const UnknownExitCode = 255
+
+// adoptedProcessPollInterval is how often WaitAdoptedProcess checks whether the
+// process exited.
+const adoptedProcessPollInterval = 250 * time.Millisecond
+
+// WaitAdoptedProcess waits for the process `pid`, which does not need to be a
+// child of the GCS, to exit. As its exit status cannot be collected the
+// process is polled for in /proc, and a process reusing the pid is told apart
+// by its start time.
+func WaitAdoptedProcess(pid int) {
+	startTime, err := processStartTime(pid)
+	for err == nil {
+		time.Sleep(adoptedProcessPollInterval)
+		var t string
+		t, err = processStartTime(pid)
+		if err == nil && t != startTime {
+			return
+		}
+	}
+}
+
+// processStartTime returns the start time of the process `pid` from
+// /proc/<pid>/stat. It returns an error if the process does not exist or is a
+// zombie.
+func processStartTime(pid int) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", err
+	}
+	// The command name may contain spaces and parentheses, so the fields are
+	// counted from its closing parenthesis. They start at field 3, the state,
+	// and the start time is field 22.
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	if len(fields) < 20 {
+		return "", errors.Errorf("unexpected format of stat for process %d: %q", pid, data)
+	}
+	if fields[0] == "Z" {
+		return "", errors.Errorf("process %d is a zombie", pid)
+	}
+	return fields[19], nil
+}
@@ -0,0 +1,46 @@
+package runtime
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func Test_WaitAdoptedProcess(t *testing.T) {
+	cmd := exec.Command("sleep", "0.5")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		WaitAdoptedProcess(cmd.Process.Pid)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected wait to block while the process runs")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The process is not reaped so it exits as a zombie.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the process to exit")
+	}
+}
+
+func Test_processStartTime(t *testing.T) {
+	startTime, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if startTime == "" || startTime == "0" {
+		t.Fatalf("expected a start time got: %q", startTime)
+	}
+	if _, err := processStartTime(1 << 22); err == nil {
+		t.Fatal("expected error for a process that does not exist")
+	}
+}
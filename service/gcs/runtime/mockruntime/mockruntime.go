@@ -0,0 +1,500 @@
+// Package mockruntime defines an in-memory implementation of the Runtime
+// interface for tests.
+//
+// Mock processes do not run anything. Their lifetime is described by a
+// ProcessScript: they write the scripted output to their stdio, then exit with
+// the scripted exit code after the scripted delay or when killed by a signal
+// they do not ignore. Their stdio is relayed with real `stdio.PipeRelay` and
+// `stdio.TtyRelay` relays backed by in-memory pipes and sockets, and any
+// operation can be made to fail with `Runtime.Fail`.
+package mockruntime
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// Operations that can be made to fail with `Runtime.Fail`.
+const (
+	OpCreate     = "create"
+	OpRestore    = "restore"
+	OpLoad       = "load"
+	OpList       = "list"
+	OpStart      = "start"
+	OpExec       = "exec"
+	OpKill       = "kill"
+	OpDelete     = "delete"
+	OpPause      = "pause"
+	OpResume     = "resume"
+	OpCheckpoint = "checkpoint"
+	OpState      = "state"
+	OpUpdate     = "update"
+)
+
+// pidBase is the first pid given to a mock process. It is PID_MAX_LIMIT, so
+// code signaling a mock pid with kill(2) gets ESRCH instead of signaling a
+// real process.
+const pidBase = 1 << 22
+
+// ProcessScript describes the lifetime of a mock process.
+type ProcessScript struct {
+	// Stdout and Stderr are written to the stdio of the process once it
+	// starts. Stderr is not written for processes with a terminal.
+	Stdout []byte
+	Stderr []byte
+	// Delay is how long the process runs before exiting with ExitCode. A
+	// process with a negative Delay runs until it is killed.
+	Delay    time.Duration
+	ExitCode int
+	// IgnoredSignals are the signals that do not terminate the process. A
+	// process killed by signal N exits with code 128+N.
+	IgnoredSignals []syscall.Signal
+}
+
+// RunUntilKilled is the script of a process that runs until it is killed.
+var RunUntilKilled = ProcessScript{Delay: -1}
+
+// Runtime is an in-memory implementation of runtime.Runtime.
+type Runtime struct {
+	// Script returns the script of a process started from `spec` in container
+	// `id`. If nil every process runs until it is killed.
+	Script func(id string, spec *oci.Process) ProcessScript
+
+	m           sync.Mutex
+	nextPid     int
+	containers  map[string]*Container
+	failures    map[string]error
+	checkpoints map[string]bool
+}
+
+var _ runtime.Runtime = &Runtime{}
+
+// NewRuntime returns a new mock runtime without any container.
+func NewRuntime() *Runtime {
+	return &Runtime{
+		nextPid:     pidBase,
+		containers:  make(map[string]*Container),
+		failures:    make(map[string]error),
+		checkpoints: make(map[string]bool),
+	}
+}
+
+// Fail makes every subsequent call to operation `op` fail with `err`, or
+// succeed again if `err` is nil.
+func (r *Runtime) Fail(op string, err error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err == nil {
+		delete(r.failures, op)
+	} else {
+		r.failures[op] = err
+	}
+}
+
+func (r *Runtime) failure(op string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.failures[op]
+}
+
+// Container returns the container `id` or nil if it does not exist.
+func (r *Runtime) Container(id string) *Container {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.containers[id]
+}
+
+// CreateContainer creates a container whose init process is started by
+// `Container.Start`, from the config.json of the bundle at `bundlePath`.
+func (r *Runtime) CreateContainer(id string, bundlePath string, stdioSet *stdio.ConnectionSet) (runtime.Container, error) {
+	if err := r.failure(OpCreate); err != nil {
+		return nil, err
+	}
+	return r.newContainer(id, bundlePath, stdioSet, false)
+}
+
+// RestoreContainer restores a running container from the image directory
+// `imagePath` written by `Container.Checkpoint`.
+func (r *Runtime) RestoreContainer(id string, bundlePath string, imagePath string, stdioSet *stdio.ConnectionSet) (runtime.Container, error) {
+	if err := r.failure(OpRestore); err != nil {
+		return nil, err
+	}
+	r.m.Lock()
+	ok := r.checkpoints[imagePath]
+	r.m.Unlock()
+	if !ok {
+		return nil, errors.Errorf("no checkpoint image at %s", imagePath)
+	}
+	return r.newContainer(id, bundlePath, stdioSet, true)
+}
+
+// LoadContainer returns the existing container `id`. Unlike a real runtime,
+// the stdio relays of its processes are kept.
+func (r *Runtime) LoadContainer(id string) (runtime.Container, error) {
+	if err := r.failure(OpLoad); err != nil {
+		return nil, err
+	}
+	c := r.Container(id)
+	if c == nil {
+		return nil, gcserr.WrapHresult(errors.Errorf("container %s does not exist", id), gcserr.HrVmcomputeSystemNotFound)
+	}
+	return c, nil
+}
+
+func (r *Runtime) newContainer(id string, bundlePath string, stdioSet *stdio.ConnectionSet, start bool) (*Container, error) {
+	spec, err := ociSpecFromBundle(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if _, ok := r.containers[id]; ok {
+		return nil, errors.Errorf("container %s already exists", id)
+	}
+	c := &Container{
+		r:          r,
+		id:         id,
+		bundlePath: bundlePath,
+		created:    time.Now(),
+		status:     "created",
+		processes:  make(map[int]*Process),
+	}
+	c.Process, err = r.newProcessLocked(c, spec.Process, stdioSet)
+	if err != nil {
+		return nil, err
+	}
+	if start {
+		c.status = "running"
+		c.Process.start()
+	}
+	r.containers[id] = c
+	return c, nil
+}
+
+func (r *Runtime) newProcessLocked(c *Container, spec *oci.Process, stdioSet *stdio.ConnectionSet) (*Process, error) {
+	script := RunUntilKilled
+	if r.Script != nil {
+		script = r.Script(c.id, spec)
+	}
+	r.nextPid++
+	return newProcess(c, r.nextPid, spec, script, stdioSet)
+}
+
+// ListContainerStates returns the state of every container that was not
+// deleted.
+func (r *Runtime) ListContainerStates() ([]runtime.ContainerState, error) {
+	if err := r.failure(OpList); err != nil {
+		return nil, err
+	}
+	r.m.Lock()
+	containers := make([]*Container, 0, len(r.containers))
+	for _, c := range r.containers {
+		containers = append(containers, c)
+	}
+	r.m.Unlock()
+
+	states := make([]runtime.ContainerState, 0, len(containers))
+	for _, c := range containers {
+		states = append(states, c.state())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states, nil
+}
+
+func ociSpecFromBundle(bundlePath string) (*oci.Spec, error) {
+	configPath := filepath.Join(bundlePath, "config.json")
+	configFile, err := os.Open(configPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open bundle config at %s", configPath)
+	}
+	defer configFile.Close()
+	var spec oci.Spec
+	if err := json.NewDecoder(configFile).Decode(&spec); err != nil {
+		return nil, errors.Wrap(err, "failed to parse OCI spec")
+	}
+	if spec.Process == nil {
+		return nil, errors.New("OCI spec has no process")
+	}
+	return &spec, nil
+}
+
+// Container is a mock container. Its embedded Process is its init process.
+type Container struct {
+	*Process
+	r          *Runtime
+	id         string
+	bundlePath string
+	created    time.Time
+
+	m         sync.Mutex
+	status    string
+	resources []interface{}
+	processes map[int]*Process
+}
+
+var _ runtime.Container = &Container{}
+
+// ID returns the id of the container.
+func (c *Container) ID() string {
+	return c.id
+}
+
+// Status returns the OCI status of the container: created, running, paused
+// or stopped.
+func (c *Container) Status() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.Process.exited() {
+		return "stopped"
+	}
+	return c.status
+}
+
+// Resources returns the resources passed to every call to Update.
+func (c *Container) Resources() []interface{} {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return append([]interface{}(nil), c.resources...)
+}
+
+// ExecProcesses returns the exec processes of the container that were not
+// deleted by pid.
+func (c *Container) ExecProcesses() map[int]*Process {
+	c.m.Lock()
+	defer c.m.Unlock()
+	processes := make(map[int]*Process, len(c.processes))
+	for pid, p := range c.processes {
+		processes[pid] = p
+	}
+	return processes
+}
+
+// LoadProcesses returns the exec processes of the container that have not
+// exited.
+func (c *Container) LoadProcesses() ([]runtime.Process, error) {
+	if err := c.r.failure(OpLoad); err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	var processes []runtime.Process
+	for _, p := range c.processes {
+		if !p.exited() {
+			processes = append(processes, p)
+		}
+	}
+	return processes, nil
+}
+
+// Exists returns true until the container is deleted.
+func (c *Container) Exists() (bool, error) {
+	return c.r.Container(c.id) == c, nil
+}
+
+// Start starts the init process.
+func (c *Container) Start() error {
+	if err := c.r.failure(OpStart); err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.status != "created" {
+		return errors.Errorf("container %s is not in the created state", c.id)
+	}
+	c.status = "running"
+	c.Process.start()
+	return nil
+}
+
+// ExecProcess starts a process from `spec` in the running container.
+func (c *Container) ExecProcess(spec *oci.Process, stdioSet *stdio.ConnectionSet) (runtime.Process, error) {
+	if err := c.r.failure(OpExec); err != nil {
+		return nil, err
+	}
+	if c.Status() != "running" {
+		return nil, errors.Errorf("cannot exec in container %s that is not running", c.id)
+	}
+	c.r.m.Lock()
+	p, err := c.r.newProcessLocked(c, spec, stdioSet)
+	c.r.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	c.processes[p.pid] = p
+	c.m.Unlock()
+	p.start()
+	return p, nil
+}
+
+// Kill sends `signal` to the init process. SIGTERM and SIGKILL are sent to
+// every process in the container.
+func (c *Container) Kill(signal syscall.Signal) error {
+	if err := c.r.failure(OpKill); err != nil {
+		return err
+	}
+	if c.Process.exited() {
+		return gcserr.NewHresultError(gcserr.HrVmcomputeSystemNotFound)
+	}
+	if signal == syscall.SIGTERM || signal == syscall.SIGKILL {
+		c.m.Lock()
+		for _, p := range c.processes {
+			p.signal(signal)
+		}
+		c.m.Unlock()
+	}
+	c.Process.signal(signal)
+	return nil
+}
+
+// Delete deletes the container, killing its init process if it was never
+// started.
+func (c *Container) Delete() error {
+	if err := c.r.failure(OpDelete); err != nil {
+		return err
+	}
+	if c.Status() == "created" {
+		c.Process.signal(syscall.SIGKILL)
+	}
+	c.r.m.Lock()
+	defer c.r.m.Unlock()
+	if c.r.containers[c.id] == c {
+		delete(c.r.containers, c.id)
+	}
+	return nil
+}
+
+// Pause pauses the running container.
+func (c *Container) Pause() error {
+	if err := c.r.failure(OpPause); err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.status != "running" || c.Process.exited() {
+		return errors.Errorf("container %s is not running", c.id)
+	}
+	c.status = "paused"
+	return nil
+}
+
+// Resume resumes the paused container.
+func (c *Container) Resume() error {
+	if err := c.r.failure(OpResume); err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.status != "paused" {
+		return errors.Errorf("container %s is not paused", c.id)
+	}
+	c.status = "running"
+	return nil
+}
+
+// Checkpoint records `imagePath` as a checkpoint image that containers can be
+// restored from, stopping the container unless `opts.LeaveRunning` is set.
+func (c *Container) Checkpoint(imagePath string, opts runtime.CheckpointOptions) error {
+	if err := c.r.failure(OpCheckpoint); err != nil {
+		return err
+	}
+	if c.Status() != "running" {
+		return errors.Errorf("container %s is not running", c.id)
+	}
+	c.r.m.Lock()
+	c.r.checkpoints[imagePath] = true
+	c.r.m.Unlock()
+	if !opts.LeaveRunning {
+		c.m.Lock()
+		for _, p := range c.processes {
+			p.signal(syscall.SIGKILL)
+		}
+		c.m.Unlock()
+		c.Process.signal(syscall.SIGKILL)
+	}
+	return nil
+}
+
+// GetState returns the state of the container.
+func (c *Container) GetState() (*runtime.ContainerState, error) {
+	if err := c.r.failure(OpState); err != nil {
+		return nil, err
+	}
+	state := c.state()
+	return &state, nil
+}
+
+func (c *Container) state() runtime.ContainerState {
+	return runtime.ContainerState{
+		OCIVersion: oci.Version,
+		ID:         c.id,
+		Pid:        c.Process.pid,
+		BundlePath: c.bundlePath,
+		RootfsPath: filepath.Join(c.bundlePath, "rootfs"),
+		Status:     c.Status(),
+		Created:    c.created.Format(time.RFC3339Nano),
+	}
+}
+
+// GetRunningProcesses returns the processes of the container that have not
+// exited.
+func (c *Container) GetRunningProcesses() ([]runtime.ContainerProcessState, error) {
+	return c.processStates(false)
+}
+
+// GetAllProcesses returns the processes of the container that were not
+// deleted, marking those that exited as zombies.
+func (c *Container) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
+	return c.processStates(true)
+}
+
+func (c *Container) processStates(zombies bool) ([]runtime.ContainerProcessState, error) {
+	if err := c.r.failure(OpState); err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	processes := []*Process{c.Process}
+	for _, p := range c.processes {
+		processes = append(processes, p)
+	}
+	c.m.Unlock()
+
+	var states []runtime.ContainerProcessState
+	for _, p := range processes {
+		exited := p.exited()
+		if exited && !zombies {
+			continue
+		}
+		states = append(states, runtime.ContainerProcessState{
+			Pid:              p.pid,
+			Command:          p.spec.Args,
+			CreatedByRuntime: true,
+			IsZombie:         exited,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Pid < states[j].Pid })
+	return states, nil
+}
+
+// Update records `resources`, see `Container.Resources`.
+func (c *Container) Update(resources interface{}) error {
+	if err := c.r.failure(OpUpdate); err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.resources = append(c.resources, resources)
+	return nil
+}
@@ -0,0 +1,241 @@
+package mockruntime
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// Process is a mock process running a ProcessScript.
+type Process struct {
+	c      *Container
+	pid    int
+	spec   *oci.Process
+	script ProcessScript
+
+	ttyRelay  *stdio.TtyRelay
+	pipeRelay *stdio.PipeRelay
+	// stdin, stdout and stderr are the process side of its stdio. They are
+	// nil if the process does not have that stream, and stdout is the
+	// terminal for a process with a terminal.
+	stdin  *os.File
+	stdout *os.File
+	stderr *os.File
+
+	startOnce sync.Once
+	waitOnce  sync.Once
+	exitCh    chan struct{}
+
+	m          sync.Mutex
+	exitCode   int
+	exitSignal syscall.Signal
+	signals    []syscall.Signal
+}
+
+// newProcess returns the mock process `pid` of container `c`. For V2 container
+// creation stdioSet will be nil, in this case it is expected that the caller
+// starts the relay previous to calling Start on the container, as with runc.
+func newProcess(c *Container, pid int, spec *oci.Process, script ProcessScript, stdioSet *stdio.ConnectionSet) (_ *Process, err error) {
+	p := &Process{
+		c:      c,
+		pid:    pid,
+		spec:   spec,
+		script: script,
+		exitCh: make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			p.closeStdio()
+		}
+	}()
+
+	if spec.Terminal {
+		// A socket pair stands in for the pty. Resizing it fails.
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create mock terminal")
+		}
+		master := os.NewFile(uintptr(fds[0]), "master")
+		p.stdout = os.NewFile(uintptr(fds[1]), "terminal")
+		p.stdin = p.stdout
+		p.ttyRelay = stdio.NewTtyRelay(stdioSet, master)
+		if stdioSet != nil {
+			p.ttyRelay.Start()
+		}
+		return p, nil
+	}
+
+	p.pipeRelay, err = stdio.NewPipeRelay(stdioSet)
+	if err != nil {
+		return nil, err
+	}
+	fileSet, err := p.pipeRelay.Files()
+	if err != nil {
+		return nil, err
+	}
+	p.stdin, p.stdout, p.stderr = fileSet.In, fileSet.Out, fileSet.Err
+	if stdioSet != nil {
+		p.pipeRelay.Start()
+	}
+	return p, nil
+}
+
+// start runs the script of the process.
+func (p *Process) start() {
+	p.startOnce.Do(func() {
+		go func() {
+			if p.stdout != nil && len(p.script.Stdout) > 0 {
+				p.stdout.Write(p.script.Stdout)
+			}
+			if p.stderr != nil && len(p.script.Stderr) > 0 {
+				p.stderr.Write(p.script.Stderr)
+			}
+			if p.script.Delay >= 0 {
+				select {
+				case <-time.After(p.script.Delay):
+					p.Exit(p.script.ExitCode)
+				case <-p.exitCh:
+				}
+			}
+		}()
+	})
+}
+
+// Pid returns the pid of the process. Mock pids are not valid pids on the
+// system.
+func (p *Process) Pid() int {
+	return p.pid
+}
+
+// Tty returns the terminal relay of the process, or nil if it does not have
+// a terminal.
+func (p *Process) Tty() *stdio.TtyRelay {
+	return p.ttyRelay
+}
+
+// PipeRelay returns the pipe relay of the process, or nil if it has a
+// terminal.
+func (p *Process) PipeRelay() *stdio.PipeRelay {
+	return p.pipeRelay
+}
+
+// Stdin returns the stdin of the process, which is the terminal for a process
+// with a terminal, or nil if the process does not have stdin.
+func (p *Process) Stdin() io.Reader {
+	if p.stdin == nil {
+		return nil
+	}
+	return p.stdin
+}
+
+// Signals returns the signals that were sent to the process.
+func (p *Process) Signals() []syscall.Signal {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return append([]syscall.Signal(nil), p.signals...)
+}
+
+// Exit makes the process exit with `exitCode` if it has not exited yet. If
+// it is the init process of its container every other process in the
+// container is killed.
+func (p *Process) Exit(exitCode int) {
+	p.exit(exitCode, 0)
+}
+
+// exit makes the process exit with `exitCode`, terminated by `signal` if it is
+// not 0.
+func (p *Process) exit(exitCode int, signal syscall.Signal) {
+	p.m.Lock()
+	select {
+	case <-p.exitCh:
+		p.m.Unlock()
+		return
+	default:
+	}
+	p.exitCode = exitCode
+	p.exitSignal = signal
+	p.closeStdio()
+	close(p.exitCh)
+	p.m.Unlock()
+
+	if p == p.c.Process {
+		for _, e := range p.c.ExecProcesses() {
+			e.signal(syscall.SIGKILL)
+		}
+	}
+}
+
+// exited returns true if the process has exited.
+func (p *Process) exited() bool {
+	select {
+	case <-p.exitCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// signal records `signal` and makes the process exit with 128+`signal` unless
+// its script ignores it.
+func (p *Process) signal(signal syscall.Signal) {
+	p.m.Lock()
+	p.signals = append(p.signals, signal)
+	p.m.Unlock()
+	for _, s := range p.script.IgnoredSignals {
+		if s == signal {
+			return
+		}
+	}
+	p.exit(128+int(signal), signal)
+}
+
+// Wait waits for the process to exit and for its relay to finish.
+func (p *Process) Wait() (int, error) {
+	<-p.exitCh
+	p.waitOnce.Do(func() {
+		if p.ttyRelay != nil {
+			p.ttyRelay.Wait()
+		}
+		if p.pipeRelay != nil {
+			p.pipeRelay.Wait()
+		}
+	})
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.exitCode, nil
+}
+
+// ExitSignal returns the signal that terminated the process.
+func (p *Process) ExitSignal() syscall.Signal {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.exitSignal
+}
+
+// Delete removes the process from the exec processes of its container. The
+// init process is deleted with the container.
+func (p *Process) Delete() error {
+	if err := p.c.r.failure(OpDelete); err != nil {
+		return err
+	}
+	p.c.m.Lock()
+	delete(p.c.processes, p.pid)
+	p.c.m.Unlock()
+	return nil
+}
+
+// closeStdio closes the process side of its stdio so that its relay sees the
+// end of its output.
+func (p *Process) closeStdio() {
+	for _, f := range []*os.File{p.stdin, p.stdout, p.stderr} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
@@ -1,5 +1,6 @@
 // Package runc defines an implementation of the Runtime interface which uses
-// runC as the container runtime.
+// runC, or any other binary implementing the runC command line such as crun or
+// runsc, as the container runtime.
 package runc
 
 import (
@@ -7,6 +8,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
@@ -26,20 +28,34 @@ import (
 const (
 	containerFilesDir = "/var/run/gcsrunc"
 	initPidFilename   = "initpid"
+
+	// stateRootDir contains the state root directory of each runtime binary.
+	stateRootDir = "/var/run/gcsruntimes"
 )
 
+// RuntimeAnnotation is the OCI spec annotation selecting the binary that runs a
+// container. Its value must be one of the binaries the runtime was created
+// with.
+const RuntimeAnnotation = "io.microsoft.lcow.runtime"
+
 // runcRuntime is an implementation of the Runtime interface which uses runC as
 // the container runtime.
 type runcRuntime struct {
 	runcLogBasePath string
+	// binaries are the runC compatible binaries containers may be run with.
+	// The first one is used for containers that do not select one with
+	// RuntimeAnnotation.
+	binaries []string
 }
 
 var _ runtime.Runtime = &runcRuntime{}
 
 type container struct {
-	r    *runcRuntime
-	id   string
-	init *process
+	r  *runcRuntime
+	id string
+	// binary is the runC compatible binary managing the container.
+	binary string
+	init   *process
 	// ownsPidNamespace indicates whether the container's init process is also
 	// the init process for its pid namespace.
 	ownsPidNamespace bool
@@ -53,6 +69,10 @@ func (c *container) Pid() int {
 	return c.init.Pid()
 }
 
+func (c *container) ExitSignal() syscall.Signal {
+	return c.init.ExitSignal()
+}
+
 func (c *container) Tty() *stdio.TtyRelay {
 	return c.init.ttyRelay
 }
@@ -68,12 +88,22 @@ type process struct {
 	pid       int
 	ttyRelay  *stdio.TtyRelay
 	pipeRelay *stdio.PipeRelay
+	// adopted is true for a process created before the GCS restarted, which
+	// is not a child of the GCS and cannot be waited on.
+	adopted bool
+	// exitSignal is the signal that terminated the process, set once it is
+	// waited on.
+	exitSignal syscall.Signal
 }
 
 func (p *process) Pid() int {
 	return p.pid
 }
 
+func (p *process) ExitSignal() syscall.Signal {
+	return p.exitSignal
+}
+
 func (p *process) Tty() *stdio.TtyRelay {
 	return p.ttyRelay
 }
@@ -82,10 +112,26 @@ func (p *process) PipeRelay() *stdio.PipeRelay {
 	return p.pipeRelay
 }
 
-// NewRuntime instantiates a new runcRuntime struct.
-func NewRuntime(logBasePath string) (runtime.Runtime, error) {
+// NewRuntime instantiates a new runcRuntime struct. `binaries` are the names
+// or paths of the runC compatible binaries containers may select with
+// RuntimeAnnotation, the first one being the default.
+func NewRuntime(logBasePath string, binaries ...string) (runtime.Runtime, error) {
+	if len(binaries) == 0 {
+		return nil, errors.New("at least one runtime binary is required")
+	}
+	roots := make(map[string]string)
+	for _, binary := range binaries {
+		if _, err := exec.LookPath(binary); err != nil {
+			return nil, errors.Wrapf(err, "failed to find runtime binary %s", binary)
+		}
+		root := getStateRoot(binary)
+		if other, ok := roots[root]; ok {
+			return nil, errors.Errorf("runtime binaries %s and %s would share the state root %s", other, binary, root)
+		}
+		roots[root] = binary
+	}
 
-	rtime := &runcRuntime{runcLogBasePath: logBasePath}
+	rtime := &runcRuntime{runcLogBasePath: logBasePath, binaries: binaries}
 	if err := rtime.initialize(); err != nil {
 		return nil, err
 	}
@@ -94,7 +140,10 @@ func NewRuntime(logBasePath string) (runtime.Runtime, error) {
 
 // initialize sets up any state necessary for the runcRuntime to function.
 func (r *runcRuntime) initialize() error {
-	paths := [2]string{containerFilesDir, r.runcLogBasePath}
+	paths := []string{containerFilesDir, r.runcLogBasePath}
+	for _, binary := range r.binaries {
+		paths = append(paths, getStateRoot(binary))
+	}
 	for _, p := range paths {
 		_, err := os.Stat(p)
 		if err != nil {
@@ -123,13 +172,104 @@ func (r *runcRuntime) CreateContainer(id string, bundlePath string, stdioSet *st
 	return c, nil
 }
 
+// RestoreContainer restores a container with the given ID and the given
+// bundlePath from the checkpoint image directory imagePath.
+func (r *runcRuntime) RestoreContainer(id string, bundlePath string, imagePath string, stdioSet *stdio.ConnectionSet) (c runtime.Container, err error) {
+	c, err = r.runRestoreCommand(id, bundlePath, imagePath, stdioSet)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadContainer returns the existing container with the given ID, such as a
+// container created before the GCS restarted. The processes of the container
+// are adopted: their stdio is lost and they are polled for exit.
+//
+// It fails with `gcserr.HrVmcomputeSystemNotFound` only if every runtime binary
+// listed its containers and none of them has the container.
+func (r *runcRuntime) LoadContainer(id string) (runtime.Container, error) {
+	c := &container{r: r, id: id}
+	var state *runtime.ContainerState
+	var listErr error
+	for _, binary := range r.binaries {
+		states, err := r.listBinaryContainerStates(binary)
+		if err != nil {
+			listErr = err
+			continue
+		}
+		for i := range states {
+			if states[i].ID == id {
+				c.binary = binary
+				state = &states[i]
+				break
+			}
+		}
+		if state != nil {
+			break
+		}
+	}
+	if state == nil {
+		if listErr != nil {
+			return nil, errors.Wrapf(listErr, "failed to find container %s", id)
+		}
+		return nil, gcserr.WrapHresult(errors.Errorf("container %s does not exist", id), gcserr.HrVmcomputeSystemNotFound)
+	}
+
+	spec, err := ociSpecFromBundle(state.BundlePath)
+	if err != nil {
+		return nil, err
+	}
+	c.ownsPidNamespace = ownsPidNamespace(spec)
+
+	// runc reports no pid once the init process exited, so use the one
+	// recorded when the container was created.
+	pid, err := r.readPidFile(filepath.Join(r.getContainerDir(id), initPidFilename))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the init pid of container %s", id)
+	}
+	c.init = &process{c: c, pid: pid, adopted: true}
+	return c, nil
+}
+
+// LoadProcesses returns the exec processes of a container returned by
+// LoadContainer that are still running, and cleans up the state of the ones
+// that exited.
+func (c *container) LoadProcesses() ([]runtime.Process, error) {
+	processDirs, err := ioutil.ReadDir(c.r.getContainerDir(c.id))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the contents of container directory %s", c.r.getContainerDir(c.id))
+	}
+	var processes []runtime.Process
+	for _, processDir := range processDirs {
+		if processDir.Name() == initPidFilename {
+			continue
+		}
+		pid, err := strconv.Atoi(processDir.Name())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse string \"%s\" as pid", processDir.Name())
+		}
+		if pid == c.init.pid {
+			continue
+		}
+		if !c.r.processExists(pid) {
+			if err := c.r.cleanupProcess(c.id, pid); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		processes = append(processes, &process{c: c, pid: pid, adopted: true})
+	}
+	return processes, nil
+}
+
 // Start unblocks the container's init process created by the call to
 // CreateContainer.
 func (c *container) Start() error {
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"start", c.id}
-	cmd := createRuncCommand(logPath, args...)
-	out, err := cmd.CombinedOutput()
+	cmd := createRuncCommand(c.binary, logPath, args...)
+	out, err := combinedOutput(cmd)
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
 		c.r.cleanupContainer(c.id)
@@ -156,8 +296,8 @@ func (c *container) Kill(signal syscall.Signal) error {
 		args = append(args, "--all")
 	}
 	args = append(args, c.id, strconv.Itoa(int(signal)))
-	cmd := createRuncCommand(logPath, args...)
-	out, err := cmd.CombinedOutput()
+	cmd := createRuncCommand(c.binary, logPath, args...)
+	out, err := combinedOutput(cmd)
 	if err != nil {
 		if strings.Contains(err.Error(), "os: process already finished") ||
 			strings.Contains(err.Error(), "container not running") ||
@@ -176,8 +316,8 @@ func (c *container) Kill(signal syscall.Signal) error {
 func (c *container) Delete() error {
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"delete", c.id}
-	cmd := createRuncCommand(logPath, args...)
-	out, err := cmd.CombinedOutput()
+	cmd := createRuncCommand(c.binary, logPath, args...)
+	out, err := combinedOutput(cmd)
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
 		return errors.Wrapf(err, "runc delete failed with %v: %s", runcErr, string(out))
@@ -201,8 +341,8 @@ func (p *process) Delete() error {
 func (c *container) Pause() error {
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"pause", c.id}
-	cmd := createRuncCommand(logPath, args...)
-	out, err := cmd.CombinedOutput()
+	cmd := createRuncCommand(c.binary, logPath, args...)
+	out, err := combinedOutput(cmd)
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
 		return errors.Wrapf(err, "runc pause failed with %v: %s", runcErr, string(out))
@@ -214,8 +354,8 @@ func (c *container) Pause() error {
 func (c *container) Resume() error {
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"resume", c.id}
-	cmd := createRuncCommand(logPath, args...)
-	out, err := cmd.CombinedOutput()
+	cmd := createRuncCommand(c.binary, logPath, args...)
+	out, err := combinedOutput(cmd)
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
 		return errors.Wrapf(err, "runc resume failed with %v: %s", runcErr, string(out))
@@ -223,12 +363,35 @@ func (c *container) Resume() error {
 	return nil
 }
 
+// Checkpoint dumps the state of the container into imagePath using CRIU.
+func (c *container) Checkpoint(imagePath string, opts runtime.CheckpointOptions) error {
+	if err := os.MkdirAll(imagePath, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create checkpoint image directory %s", imagePath)
+	}
+	logPath := c.r.getLogPath(c.id)
+	args := []string{"checkpoint", "--image-path", imagePath}
+	if opts.LeaveRunning {
+		args = append(args, "--leave-running")
+	}
+	if opts.TCPEstablished {
+		args = append(args, "--tcp-established")
+	}
+	args = append(args, c.id)
+	cmd := createRuncCommand(c.binary, logPath, args...)
+	out, err := combinedOutput(cmd)
+	if err != nil {
+		runcErr := getRuncLogError(logPath)
+		return errors.Wrapf(err, "runc checkpoint failed with %v: %s", runcErr, string(out))
+	}
+	return nil
+}
+
 // GetState returns information about the given container.
 func (c *container) GetState() (*runtime.ContainerState, error) {
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"state", c.id}
-	cmd := createRuncCommand(logPath, args...)
-	out, err := cmd.CombinedOutput()
+	cmd := createRuncCommand(c.binary, logPath, args...)
+	out, err := combinedOutput(cmd)
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
 		return nil, errors.Wrapf(err, "runc state failed with %v: %s", runcErr, string(out))
@@ -260,19 +423,38 @@ func (c *container) Exists() (bool, error) {
 }
 
 // ListContainerStates returns ContainerState structs for all existing
-// containers, whether they're running or not.
+// containers, whether they're running or not, across all runtime binaries. A
+// binary that fails to list its containers is logged and skipped so that it
+// does not hide the containers of the others.
 func (r *runcRuntime) ListContainerStates() ([]runtime.ContainerState, error) {
+	var states []runtime.ContainerState
+	for _, binary := range r.binaries {
+		binaryStates, err := r.listBinaryContainerStates(binary)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"binary":        binary,
+				logrus.ErrorKey: err,
+			}).Warning("failed to list the containers of runtime binary")
+			continue
+		}
+		states = append(states, binaryStates...)
+	}
+	return states, nil
+}
+
+// listBinaryContainerStates returns the states of the containers managed by the
+// runC compatible `binary`.
+func (r *runcRuntime) listBinaryContainerStates(binary string) ([]runtime.ContainerState, error) {
 	logPath := filepath.Join(r.runcLogBasePath, "global-runc.log")
-	args := []string{"list", "-f", "json"}
-	cmd := createRuncCommand(logPath, args...)
-	out, err := cmd.CombinedOutput()
+	cmd := createRuncCommand(binary, logPath, "list", "-f", "json")
+	out, err := combinedOutput(cmd)
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
-		return nil, errors.Wrapf(err, "runc list failed with %v: %s", runcErr, string(out))
+		return nil, errors.Wrapf(err, "%s list failed with %v: %s", binary, runcErr, string(out))
 	}
 	var states []runtime.ContainerState
 	if err := json.Unmarshal(out, &states); err != nil {
-		return nil, errors.Wrap(err, "failed to unmarshal the states for the container list")
+		return nil, errors.Wrapf(err, "failed to unmarshal the states for the %s container list", binary)
 	}
 	return states, nil
 }
@@ -280,7 +462,7 @@ func (r *runcRuntime) ListContainerStates() ([]runtime.ContainerState, error) {
 // GetRunningProcesses gets only the running processes associated with the given
 // container. This excludes zombie processes.
 func (c *container) GetRunningProcesses() ([]runtime.ContainerProcessState, error) {
-	pids, err := c.r.getRunningPids(c.id)
+	pids, err := c.getRunningPids()
 	if err != nil {
 		return nil, err
 	}
@@ -320,7 +502,7 @@ func (c *container) GetRunningProcesses() ([]runtime.ContainerProcessState, erro
 // GetAllProcesses gets all processes associated with the given container,
 // including both running and zombie processes.
 func (c *container) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
-	runningPids, err := c.r.getRunningPids(c.id)
+	runningPids, err := c.getRunningPids()
 	if err != nil {
 		return nil, err
 	}
@@ -371,18 +553,18 @@ func (c *container) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
 
 // getRunningPids gets the pids of all processes which runC recognizes as
 // running.
-func (r *runcRuntime) getRunningPids(id string) ([]int, error) {
-	logPath := r.getLogPath(id)
-	args := []string{"ps", "-f", "json", id}
-	cmd := createRuncCommand(logPath, args...)
-	out, err := cmd.CombinedOutput()
+func (c *container) getRunningPids() ([]int, error) {
+	logPath := c.r.getLogPath(c.id)
+	args := []string{"ps", "-f", "json", c.id}
+	cmd := createRuncCommand(c.binary, logPath, args...)
+	out, err := combinedOutput(cmd)
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
 		return nil, errors.Wrapf(err, "runc ps failed with %v: %s", runcErr, string(out))
 	}
 	var pids []int
 	if err := json.Unmarshal(out, &pids); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal pids for container %s", id)
+		return nil, errors.Wrapf(err, "failed to unmarshal pids for container %s", c.id)
 	}
 	return pids, nil
 }
@@ -413,26 +595,36 @@ func (r *runcRuntime) pidMapToProcessStates(pidMap map[int]*runtime.ContainerPro
 	return processStates
 }
 
-// waitOnProcess waits for the process to exit, and returns its exit code.
-func (r *runcRuntime) waitOnProcess(pid int) (int, error) {
+// waitOnProcess waits for the process to exit, and returns its exit code and
+// the signal that terminated it, if any.
+func (r *runcRuntime) waitOnProcess(pid int) (int, syscall.Signal, error) {
 	process, err := os.FindProcess(pid)
 	if err != nil {
-		return -1, errors.Wrapf(err, "failed to find process %d", pid)
+		return -1, 0, errors.Wrapf(err, "failed to find process %d", pid)
 	}
 	state, err := process.Wait()
 	if err != nil {
-		return -1, errors.Wrapf(err, "failed waiting on process %d", pid)
+		return -1, 0, errors.Wrapf(err, "failed waiting on process %d", pid)
 	}
 
 	status := state.Sys().(syscall.WaitStatus)
 	if status.Signaled() {
-		return 128 + int(status.Signal()), nil
+		return 128 + int(status.Signal()), status.Signal(), nil
 	}
-	return status.ExitStatus(), nil
+	return status.ExitStatus(), 0, nil
 }
 
 func (p *process) Wait() (int, error) {
-	exitCode, err := p.c.r.waitOnProcess(p.pid)
+	var (
+		exitCode int
+		err      error
+	)
+	if p.adopted {
+		runtime.WaitAdoptedProcess(p.pid)
+		exitCode = runtime.UnknownExitCode
+	} else {
+		exitCode, p.exitSignal, err = p.c.r.waitOnProcess(p.pid)
+	}
 
 	l := logrus.WithField("cid", p.c.id)
 	l.WithField("pid", p.pid).Debug("process wait completed")
@@ -508,36 +700,42 @@ func (c *container) Wait() (int, error) {
 
 // runCreateCommand sets up the arguments for calling runc create.
 func (r *runcRuntime) runCreateCommand(id string, bundlePath string, stdioSet *stdio.ConnectionSet) (runtime.Container, error) {
-	c := &container{r: r, id: id}
-	if err := r.makeContainerDir(id); err != nil {
+	return r.runInitCommand(id, bundlePath, stdioSet, "create", "-b", bundlePath)
+}
+
+// runRestoreCommand sets up the arguments for calling runc restore.
+func (r *runcRuntime) runRestoreCommand(id string, bundlePath string, imagePath string, stdioSet *stdio.ConnectionSet) (runtime.Container, error) {
+	return r.runInitCommand(id, bundlePath, stdioSet, "restore", "-b", bundlePath, "--image-path", imagePath, "--detach")
+}
+
+// runInitCommand runs the runc command `args` that creates the init process of
+// container `id`, either runc create or runc restore.
+func (r *runcRuntime) runInitCommand(id string, bundlePath string, stdioSet *stdio.ConnectionSet, args ...string) (runtime.Container, error) {
+	spec, err := ociSpecFromBundle(bundlePath)
+	if err != nil {
 		return nil, err
 	}
-	// Create a temporary random directory to store the process's files.
-	tempProcessDir, err := ioutil.TempDir(containerFilesDir, id)
+	binary, err := r.selectBinary(spec)
 	if err != nil {
 		return nil, err
 	}
+	// The UVM root filesystem is an initramfs which cannot be pivoted from.
+	// runsc does not pivot the root of its sandbox and has no such flag.
+	if filepath.Base(binary) != "runsc" {
+		args = append(args, "--no-pivot")
+	}
 
-	spec, err := ociSpecFromBundle(bundlePath)
+	c := &container{r: r, id: id, binary: binary}
+	if err := r.makeContainerDir(id); err != nil {
+		return nil, err
+	}
+	// Create a temporary random directory to store the process's files.
+	tempProcessDir, err := ioutil.TempDir(containerFilesDir, id)
 	if err != nil {
 		return nil, err
 	}
 
-	// Determine if the container owns its own pid namespace or not. Per the OCI
-	// spec:
-	// - If the spec has no entry for the pid namespace, the container inherits
-	//   the runtime namespace (container does not own).
-	// - If the spec has a pid namespace entry, but the path is empty, a new
-	//   namespace will be created and used for the container (container owns).
-	// - If there is a pid namespace entry with a path, the container uses the
-	//   namespace at that path (container does not own).
-	if spec.Linux != nil {
-		for _, ns := range spec.Linux.Namespaces {
-			if ns.Type == oci.PIDNamespace {
-				c.ownsPidNamespace = ns.Path == ""
-			}
-		}
-	}
+	c.ownsPidNamespace = ownsPidNamespace(spec)
 
 	if spec.Process.Cwd != "/" {
 		cwd := path.Join(bundlePath, "rootfs", spec.Process.Cwd)
@@ -545,7 +743,6 @@ func (r *runcRuntime) runCreateCommand(id string, bundlePath string, stdioSet *s
 		_ = os.MkdirAll(cwd, 0755)
 	}
 
-	args := []string{"create", "-b", bundlePath, "--no-pivot"}
 	p, err := c.startProcess(tempProcessDir, spec.Process.Terminal, stdioSet, args...)
 	if err != nil {
 		return nil, err
@@ -561,6 +758,41 @@ func (r *runcRuntime) runCreateCommand(id string, bundlePath string, stdioSet *s
 	return c, nil
 }
 
+// ownsPidNamespace returns true if the container created from `spec` owns its
+// own pid namespace. Per the OCI spec:
+// - If the spec has no entry for the pid namespace, the container inherits
+//   the runtime namespace (container does not own).
+// - If the spec has a pid namespace entry, but the path is empty, a new
+//   namespace will be created and used for the container (container owns).
+// - If there is a pid namespace entry with a path, the container uses the
+//   namespace at that path (container does not own).
+func ownsPidNamespace(spec *oci.Spec) bool {
+	owns := false
+	if spec.Linux != nil {
+		for _, ns := range spec.Linux.Namespaces {
+			if ns.Type == oci.PIDNamespace {
+				owns = ns.Path == ""
+			}
+		}
+	}
+	return owns
+}
+
+// selectBinary returns the runtime binary selected by the RuntimeAnnotation of
+// `spec`, or the default binary if it has none.
+func (r *runcRuntime) selectBinary(spec *oci.Spec) (string, error) {
+	binary, ok := spec.Annotations[RuntimeAnnotation]
+	if !ok {
+		return r.binaries[0], nil
+	}
+	for _, b := range r.binaries {
+		if b == binary {
+			return b, nil
+		}
+	}
+	return "", gcserr.WrapHresult(errors.Errorf("runtime %q is not allowed, allowed runtimes are %v", binary, r.binaries), gcserr.HrInvalidArg)
+}
+
 func ociSpecFromBundle(bundlePath string) (*oci.Spec, error) {
 	configPath := filepath.Join(bundlePath, "config.json")
 	configFile, err := os.Open(configPath)
@@ -598,10 +830,10 @@ func (c *container) runExecCommand(processDef *oci.Process, stdioSet *stdio.Conn
 }
 
 // startProcess performs the operations necessary to start a container process
-// and properly handle its stdio. This function is used by both CreateContainer
-// and ExecProcess. For V2 container creation stdioSet will be nil, in this case
-// it is expected that the caller starts the relay previous to calling Start on
-// the container.
+// and properly handle its stdio. This function is used by CreateContainer,
+// RestoreContainer and ExecProcess. For V2 container creation and restore
+// stdioSet will be nil, in this case it is expected that the caller starts the
+// relay previous to calling Start on the container.
 func (c *container) startProcess(tempProcessDir string, hasTerminal bool, stdioSet *stdio.ConnectionSet, initialArgs ...string) (p *process, err error) {
 	args := initialArgs
 
@@ -627,7 +859,7 @@ func (c *container) startProcess(tempProcessDir string, hasTerminal bool, stdioS
 	}
 	args = append(args, c.id)
 
-	cmd := createRuncCommand(logPath, args...)
+	cmd := createRuncCommand(c.binary, logPath, args...)
 
 	var pipeRelay *stdio.PipeRelay
 	if !hasTerminal {
@@ -653,9 +885,9 @@ func (c *container) startProcess(tempProcessDir string, hasTerminal bool, stdioS
 		}
 	}
 
-	if err := cmd.Run(); err != nil {
+	if err := runCommand(cmd); err != nil {
 		runcErr := getRuncLogError(logPath)
-		return nil, errors.Wrapf(err, "failed to run runc create/exec call for container %s with %v", c.id, runcErr)
+		return nil, errors.Wrapf(err, "failed to run runc create/exec/restore call for container %s with %v", c.id, runcErr)
 	}
 
 	var ttyRelay *stdio.TtyRelay
@@ -700,9 +932,9 @@ func (c *container) Update(resources interface{}) error {
 	}
 	logPath := c.r.getLogPath(c.id)
 	args := []string{"update", "--resources", "-", c.id}
-	cmd := createRuncCommand(logPath, args...)
+	cmd := createRuncCommand(c.binary, logPath, args...)
 	cmd.Stdin = strings.NewReader(string(jsonResources))
-	out, err := cmd.CombinedOutput()
+	out, err := combinedOutput(cmd)
 	if err != nil {
 		runcErr := getRuncLogError(logPath)
 		return errors.Wrapf(err, "runc update request %s failed with %v: %s", string(jsonResources), runcErr, string(out))
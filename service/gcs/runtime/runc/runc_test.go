@@ -0,0 +1,131 @@
+package runc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_selectBinary(t *testing.T) {
+	r := &runcRuntime{binaries: []string{"runc", "crun", "/usr/local/bin/runsc"}}
+
+	tests := []struct {
+		annotations map[string]string
+		expected    string
+	}{
+		{nil, "runc"},
+		{map[string]string{RuntimeAnnotation: "crun"}, "crun"},
+		{map[string]string{RuntimeAnnotation: "/usr/local/bin/runsc"}, "/usr/local/bin/runsc"},
+	}
+	for _, test := range tests {
+		binary, err := r.selectBinary(&oci.Spec{Annotations: test.annotations})
+		if err != nil {
+			t.Fatalf("expected nil error for annotations %v got: %v", test.annotations, err)
+		}
+		if binary != test.expected {
+			t.Fatalf("expected binary %s for annotations %v got: %s", test.expected, test.annotations, binary)
+		}
+	}
+}
+
+func Test_selectBinary_NotAllowed(t *testing.T) {
+	r := &runcRuntime{binaries: []string{"runc", "crun"}}
+
+	_, err := r.selectBinary(&oci.Spec{Annotations: map[string]string{RuntimeAnnotation: "runsc"}})
+	if err == nil {
+		t.Fatal("expected error for runtime not in the allowed list")
+	}
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrInvalidArg {
+		t.Fatalf("expected hresult %v got: %v (%v)", gcserr.HrInvalidArg, hr, herr)
+	}
+}
+
+func Test_ownsPidNamespace(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []oci.LinuxNamespace
+		expected   bool
+	}{
+		{"NoPidNamespace", []oci.LinuxNamespace{{Type: oci.NetworkNamespace}}, false},
+		{"NewPidNamespace", []oci.LinuxNamespace{{Type: oci.PIDNamespace}}, true},
+		{"SharedPidNamespace", []oci.LinuxNamespace{{Type: oci.PIDNamespace, Path: "/proc/1/ns/pid"}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := &oci.Spec{Linux: &oci.Linux{Namespaces: test.namespaces}}
+			if owns := ownsPidNamespace(spec); owns != test.expected {
+				t.Fatalf("expected %v got: %v", test.expected, owns)
+			}
+		})
+	}
+}
+
+func Test_createRuncCommand_StateRoot(t *testing.T) {
+	tests := []struct {
+		binary   string
+		expected string
+	}{
+		{"runc", "/var/run/gcsruntimes/runc"},
+		{"/usr/local/bin/runsc", "/var/run/gcsruntimes/runsc"},
+	}
+	for _, test := range tests {
+		cmd := createRuncCommand(test.binary, "/tmp/runc.log", "list")
+		if len(cmd.Args) < 3 || cmd.Args[1] != "--root" || cmd.Args[2] != test.expected {
+			t.Fatalf("expected state root %s for binary %s got args: %v", test.expected, test.binary, cmd.Args)
+		}
+	}
+}
+
+// writeRuntimeBinary writes a runtime binary to `dir` that runs `script` for
+// every command.
+func writeRuntimeBinary(t *testing.T, dir, name, script string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_LoadContainer_NotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &runcRuntime{
+		runcLogBasePath: dir,
+		binaries:        []string{writeRuntimeBinary(t, dir, "empty", "echo '[]'")},
+	}
+	_, err = r.LoadContainer("c1")
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrVmcomputeSystemNotFound {
+		t.Fatalf("expected hresult %v got: %v", gcserr.HrVmcomputeSystemNotFound, err)
+	}
+}
+
+func Test_LoadContainer_ListFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &runcRuntime{
+		runcLogBasePath: dir,
+		binaries: []string{
+			writeRuntimeBinary(t, dir, "empty", "echo '[]'"),
+			writeRuntimeBinary(t, dir, "broken", "exit 1"),
+		},
+	}
+	_, err = r.LoadContainer("c1")
+	if err == nil {
+		t.Fatal("expected error when a runtime binary cannot list its containers")
+	}
+	if hr, _ := gcserr.GetHresult(err); hr == gcserr.HrVmcomputeSystemNotFound {
+		t.Fatalf("expected a list failure to not be reported as not found got: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package runc
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/oc"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	// CommandLatency is the time in milliseconds taken by a runc command.
+	CommandLatency = stats.Float64("opengcs/runc/command_latency", "The time taken by a runc command", stats.UnitMilliseconds)
+
+	// KeySubcommand is the runc subcommand, for example "create" or "kill".
+	KeySubcommand, _ = tag.NewKey("subcommand")
+
+	// KeyRuntime is the runtime binary that ran the command, for example
+	// "runc" or "crun".
+	KeyRuntime, _ = tag.NewKey("runtime")
+
+	// Views are the views of the runc measures to register with
+	// `view.Register`.
+	Views = []*view.View{
+		{
+			Name:        "opengcs/runc/command_latency",
+			Measure:     CommandLatency,
+			Description: "The distribution of the time taken by runc commands",
+			TagKeys:     []tag.Key{KeySubcommand, KeyRuntime},
+			Aggregation: oc.LatencyDistribution,
+		},
+	}
+)
+
+// runcSubcommandIndex is the index in `exec.Cmd.Args` of the subcommand of a
+// command created by `createRuncCommand`.
+const runcSubcommandIndex = 5
+
+// recordCommandLatency records the time elapsed since `start` to
+// `CommandLatency` for the subcommand of `cmd`.
+func recordCommandLatency(cmd *exec.Cmd, start time.Time) {
+	subcommand := "unknown"
+	if len(cmd.Args) > runcSubcommandIndex {
+		subcommand = cmd.Args[runcSubcommandIndex]
+	}
+	oc.RecordLatency(context.Background(), CommandLatency, start,
+		tag.Upsert(KeySubcommand, subcommand),
+		tag.Upsert(KeyRuntime, filepath.Base(cmd.Args[0])))
+}
+
+// runCommand calls `cmd.Run` and records its duration.
+func runCommand(cmd *exec.Cmd) error {
+	defer recordCommandLatency(cmd, time.Now())
+	return cmd.Run()
+}
+
+// combinedOutput calls `cmd.CombinedOutput` and records its duration.
+func combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	defer recordCommandLatency(cmd, time.Now())
+	return cmd.CombinedOutput()
+}
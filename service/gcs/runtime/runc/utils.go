@@ -123,7 +123,16 @@ func getRuncLogError(logPath string) error {
 	return lastErr
 }
 
-func createRuncCommand(logPath string, args ...string) *exec.Cmd {
-	args = append([]string{"--log", logPath, "--log-format", "json"}, args...)
-	return exec.Command("runc", args...)
+// getStateRoot returns the directory in which the runC compatible `binary`
+// keeps the state of its containers. Each binary gets its own directory as
+// their state formats are not compatible.
+func getStateRoot(binary string) string {
+	return filepath.Join(stateRootDir, filepath.Base(binary))
+}
+
+// createRuncCommand returns the command running the runC compatible `binary`
+// with `args`, logging to `logPath`.
+func createRuncCommand(binary string, logPath string, args ...string) *exec.Cmd {
+	args = append([]string{"--root", getStateRoot(binary), "--log", logPath, "--log-format", "json"}, args...)
+	return exec.Command(binary, args...)
 }
@@ -30,6 +30,15 @@ type ContainerProcessState struct {
 	IsZombie         bool
 }
 
+// CheckpointOptions are the options used to checkpoint a container.
+type CheckpointOptions struct {
+	// LeaveRunning leaves the container running after the checkpoint instead
+	// of stopping it.
+	LeaveRunning bool
+	// TCPEstablished allows checkpointing established TCP connections.
+	TCPEstablished bool
+}
+
 // StdioPipes contain the interfaces for reading from and writing to a
 // process's stdio.
 type StdioPipes struct {
@@ -41,6 +50,10 @@ type StdioPipes struct {
 // Process is an interface to manipulate process state.
 type Process interface {
 	Wait() (int, error)
+	// ExitSignal returns the signal that terminated the process as reported
+	// by its wait status, or 0 if it exited on its own or its wait status is
+	// unknown. It is only valid once `Wait` has returned.
+	ExitSignal() syscall.Signal
 	Pid() int
 	Delete() error
 	Tty() *stdio.TtyRelay
@@ -61,11 +74,26 @@ type Container interface {
 	GetRunningProcesses() ([]ContainerProcessState, error)
 	GetAllProcesses() ([]ContainerProcessState, error)
 	Update(resources interface{}) error
+	// Checkpoint writes the state of the container to the image directory
+	// `imagePath` so that it can be restored with `Runtime.RestoreContainer`.
+	Checkpoint(imagePath string, opts CheckpointOptions) error
+	// LoadProcesses returns the running exec processes of a container returned
+	// by `Runtime.LoadContainer`.
+	LoadProcesses() ([]Process, error)
 }
 
 // Runtime is the interface defining commands over an OCI container runtime,
 // such as runC.
 type Runtime interface {
 	CreateContainer(id string, bundlePath string, stdioSet *stdio.ConnectionSet) (c Container, err error)
+	// RestoreContainer restores a container with the given ID from the
+	// checkpoint image directory `imagePath`. The restored container is
+	// already running and must not be started.
+	RestoreContainer(id string, bundlePath string, imagePath string, stdioSet *stdio.ConnectionSet) (c Container, err error)
+	// LoadContainer returns the existing container with the given ID, such as
+	// a container created before the GCS restarted. The stdio of its processes
+	// is not recovered, and the exit code of a process that is not a child of
+	// the GCS is reported as UnknownExitCode.
+	LoadContainer(id string) (c Container, err error)
 	ListContainerStates() ([]ContainerState, error)
 }
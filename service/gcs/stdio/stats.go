@@ -0,0 +1,35 @@
+package stdio
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	// BytesCopied is the number of bytes relayed between a process and its
+	// stdio connections.
+	BytesCopied = stats.Int64("opengcs/stdio/bytes_copied", "The number of bytes relayed for process stdio", stats.UnitBytes)
+
+	// KeyStream is the stdio stream, one of "stdin", "stdout" or "stderr".
+	KeyStream, _ = tag.NewKey("stream")
+
+	// Views are the views of the stdio measures to register with
+	// `view.Register`.
+	Views = []*view.View{
+		{
+			Name:        "opengcs/stdio/bytes_copied",
+			Measure:     BytesCopied,
+			Description: "The total number of bytes relayed for process stdio",
+			TagKeys:     []tag.Key{KeyStream},
+			Aggregation: view.Sum(),
+		},
+	}
+)
+
+// recordBytesCopied records `n` bytes relayed on `stream` to `BytesCopied`.
+func recordBytesCopied(stream string, n int64) {
+	_ = stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(KeyStream, stream)}, BytesCopied.M(n))
+}
@@ -164,7 +164,9 @@ func (pr *PipeRelay) Files() (*FileSet, error) {
 }
 
 func copyAndCleanClose(c transport.Connection, r io.Reader, name string) {
-	if n, err := io.Copy(c, r); err != nil {
+	n, err := io.Copy(c, r)
+	recordBytesCopied(name, n)
+	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			logrus.ErrorKey: err,
 			"bytes":         n,
@@ -206,7 +208,9 @@ func (pr *PipeRelay) Start() {
 	if pr.s.In != nil {
 		pr.wg.Add(1)
 		go func() {
-			if n, err := io.Copy(pr.pipes[1], pr.s.In); err != nil {
+			n, err := io.Copy(pr.pipes[1], pr.s.In)
+			recordBytesCopied("stdin", n)
+			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					logrus.ErrorKey: err,
 					"bytes":         n,
@@ -330,7 +334,9 @@ func (r *TtyRelay) Start() {
 	if r.s.In != nil {
 		r.wg.Add(1)
 		go func() {
-			if _, err := io.Copy(r.pty, r.s.In); err != nil {
+			n, err := io.Copy(r.pty, r.s.In)
+			recordBytesCopied("stdin", n)
+			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					logrus.ErrorKey: err,
 				}).Error("opengcs::TtyRelay::Start - error copying stdin to pty")
@@ -341,7 +347,9 @@ func (r *TtyRelay) Start() {
 	if r.s.Out != nil {
 		r.wg.Add(1)
 		go func() {
-			if _, err := io.Copy(r.s.Out, r.pty); err != nil {
+			n, err := io.Copy(r.s.Out, r.pty)
+			recordBytesCopied("stdout", n)
+			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					logrus.ErrorKey: err,
 				}).Error("opengcs::TtyRelay::Start - error copying pty to stdout")
@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// MockTransport is an in-memory implementation of Transport for tests. Every
+// Dial creates a connected pair of Unix sockets, returns one end and hands
+// the other end, the host side of the connection, to `Accept`.
+type MockTransport struct {
+	m sync.Mutex
+	// pending are the host sides of the connections dialed on each port that
+	// have not been accepted yet.
+	pending map[uint32]chan Connection
+	// dialErrors are the errors returned by Dial by port.
+	dialErrors map[uint32]error
+}
+
+var _ Transport = &MockTransport{}
+
+// Dial returns the guest side of a new in-memory connection on `port`.
+func (t *MockTransport) Dial(port uint32) (Connection, error) {
+	t.m.Lock()
+	err := t.dialErrors[port]
+	t.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "mock Dial port (%d) failed", port)
+	}
+	guest, err := fileConn(fds[0], "guest")
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, err
+	}
+	host, err := fileConn(fds[1], "host")
+	if err != nil {
+		guest.Close()
+		return nil, err
+	}
+	t.connections(port) <- host
+	return guest, nil
+}
+
+// Accept returns the host side of the next connection dialed on `port`,
+// blocking until it is dialed.
+func (t *MockTransport) Accept(port uint32) Connection {
+	return <-t.connections(port)
+}
+
+// FailDial makes every subsequent Dial on `port` return `err`, or succeed
+// again if `err` is nil.
+func (t *MockTransport) FailDial(port uint32, err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.dialErrors == nil {
+		t.dialErrors = make(map[uint32]error)
+	}
+	t.dialErrors[port] = err
+}
+
+func (t *MockTransport) connections(port uint32) chan Connection {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[uint32]chan Connection)
+	}
+	c, ok := t.pending[port]
+	if !ok {
+		// Dial must not block waiting for the test to accept.
+		c = make(chan Connection, 16)
+		t.pending[port] = c
+	}
+	return c
+}
+
+// fileConn returns the Unix socket connection for the socket `fd`, which it
+// takes ownership of.
+func fileConn(fd int, name string) (*net.UnixConn, error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create mock connection")
+	}
+	return c.(*net.UnixConn), nil
+}
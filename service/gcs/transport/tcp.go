@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TCPTransport is an implementation of Transport which uses TCP connections to
+// a single loopback address. It allows running the GCS outside of a utility VM
+// against a local stand-in for the host.
+//
+// Ports are 32 bits wide, as for vsock, so they cannot be mapped onto TCP
+// ports. Instead every connection is made to `Address` and the port being
+// dialed is written as the first 4 bytes (little-endian) of the stream so the
+// host side can route it.
+type TCPTransport struct {
+	// Address is the `host:port` the host side is listening on. The host must
+	// resolve to a loopback address.
+	Address string
+}
+
+var _ Transport = &TCPTransport{}
+
+// Dial connects to `Address` and sends `port` as the connection preamble.
+func (t *TCPTransport) Dial(port uint32) (Connection, error) {
+	logrus.WithFields(logrus.Fields{
+		"port":    port,
+		"address": t.Address,
+	}).Info("opengcs::TCPTransport::Dial - tcp dial port")
+
+	addr, err := net.ResolveTCPAddr("tcp", t.Address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve address %q", t.Address)
+	}
+	if !addr.IP.IsLoopback() {
+		return nil, errors.Errorf("address %q is not a loopback address", t.Address)
+	}
+
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "tcp Dial port (%d) failed", port)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, port); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to write preamble for port (%d)", port)
+	}
+	return conn, nil
+}
@@ -4,6 +4,7 @@ package transport
 
 import (
 	"io"
+	"net"
 	"os"
 )
 
@@ -18,6 +19,13 @@ type Transport interface {
 	Dial(port uint32) (Connection, error)
 }
 
+// Listener is implemented by a `Transport` that can also accept connections
+// initiated by the host.
+type Listener interface {
+	// Listen returns a listener accepting connections on `port`.
+	Listen(port uint32) (net.Listener, error)
+}
+
 // Connection is the interface defining a data connection, such as a socket or
 // a mocked implementation.
 type Connection interface {
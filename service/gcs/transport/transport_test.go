@@ -0,0 +1,181 @@
+package transport
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func Test_UnixTransport_Dial_Success(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixtransport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tport := &UnixTransport{Dir: dir}
+	l, err := net.Listen("unix", tport.SocketPath(1234))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan []byte)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			close(accepted)
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		accepted <- b
+	}()
+
+	conn, err := tport.Dial(1234)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-accepted; string(b) != "hello" {
+		t.Fatalf("expected \"hello\", got %q", b)
+	}
+}
+
+func Test_UnixTransport_Dial_NoListener_Failure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixtransport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tport := &UnixTransport{Dir: dir}
+	if _, err := tport.Dial(1234); err == nil {
+		t.Fatal("expected error dialing port with no listener")
+	}
+}
+
+func Test_UnixTransport_Listen_ReplacesStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixtransport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tport := &UnixTransport{Dir: dir}
+	if err := ioutil.WriteFile(tport.SocketPath(1234), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tport.Listen(1234)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	conn, err := tport.Dial(1234)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	if b, _ := ioutil.ReadAll(conn); string(b) != "hello" {
+		t.Fatalf("expected \"hello\", got %q", b)
+	}
+}
+
+func Test_TCPTransport_Dial_WritesPreamble(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan uint32)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			close(accepted)
+			return
+		}
+		defer conn.Close()
+		var port uint32
+		if err := binary.Read(conn, binary.LittleEndian, &port); err != nil {
+			t.Error(err)
+		}
+		accepted <- port
+	}()
+
+	tport := &TCPTransport{Address: l.Addr().String()}
+	conn, err := tport.Dial(0x40000000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	if port := <-accepted; port != 0x40000000 {
+		t.Fatalf("expected port 0x40000000, got 0x%x", port)
+	}
+}
+
+func Test_TCPTransport_Dial_NotLoopback_Failure(t *testing.T) {
+	tport := &TCPTransport{Address: "192.0.2.1:80"}
+	if _, err := tport.Dial(1); err == nil {
+		t.Fatal("expected error dialing non-loopback address")
+	}
+}
+
+func Test_MockTransport_Dial_Success(t *testing.T) {
+	tport := &MockTransport{}
+	conn, err := tport.Dial(1234)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	host := tport.Accept(1234)
+	defer host.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(host)
+	if string(b) != "hello" {
+		t.Fatalf("expected \"hello\" got: %q", b)
+	}
+	conn.Close()
+}
+
+func Test_MockTransport_Dial_Failure(t *testing.T) {
+	tport := &MockTransport{}
+	tport.FailDial(1234, os.ErrPermission)
+	if _, err := tport.Dial(1234); err != os.ErrPermission {
+		t.Fatalf("expected %v got: %v", os.ErrPermission, err)
+	}
+	tport.FailDial(1234, nil)
+	conn, err := tport.Dial(1234)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.Close()
+	tport.Accept(1234).Close()
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// UnixTransport is an implementation of Transport which uses Unix domain
+// sockets. It allows running the GCS outside of a utility VM against a local
+// stand-in for the host.
+//
+// Port N is mapped to the socket `<Dir>/<N>.sock` which the host side is
+// expected to be listening on.
+type UnixTransport struct {
+	// Dir is the directory containing the per-port sockets.
+	Dir string
+}
+
+var _ Transport = &UnixTransport{}
+var _ Listener = &UnixTransport{}
+
+// SocketPath returns the path of the socket that `port` maps to.
+func (t *UnixTransport) SocketPath(port uint32) string {
+	return filepath.Join(t.Dir, strconv.FormatUint(uint64(port), 10)+".sock")
+}
+
+// Dial connects to the Unix socket that `port` maps to.
+func (t *UnixTransport) Dial(port uint32) (Connection, error) {
+	path := t.SocketPath(port)
+	logrus.WithFields(logrus.Fields{
+		"port": port,
+		"path": path,
+	}).Info("opengcs::UnixTransport::Dial - unix dial port")
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unix Dial port (%d) failed", port)
+	}
+	return conn, nil
+}
+
+// Listen accepts connections on the Unix socket that `port` maps to. A stale
+// socket left at that path is removed first.
+func (t *UnixTransport) Listen(port uint32) (net.Listener, error) {
+	path := t.SocketPath(port)
+	logrus.WithFields(logrus.Fields{
+		"port": port,
+		"path": path,
+	}).Info("opengcs::UnixTransport::Listen - unix listen port")
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to remove stale socket %s", path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unix Listen port (%d) failed", port)
+	}
+	return l, nil
+}
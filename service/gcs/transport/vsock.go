@@ -2,6 +2,7 @@ package transport
 
 import (
 	"fmt"
+	"net"
 	"syscall"
 	"time"
 
@@ -20,6 +21,7 @@ const (
 type VsockTransport struct{}
 
 var _ Transport = &VsockTransport{}
+var _ Listener = &VsockTransport{}
 
 // Dial accepts a vsock socket port number as configuration, and
 // returns an unconnected VsockConnection struct.
@@ -47,3 +49,16 @@ func (t *VsockTransport) Dial(port uint32) (Connection, error) {
 	}
 	return nil, fmt.Errorf("failed connecting the VsockConnection: can't connect after 10 attempts")
 }
+
+// Listen accepts connections from any cid on the vsock `port`.
+func (t *VsockTransport) Listen(port uint32) (net.Listener, error) {
+	logrus.WithFields(logrus.Fields{
+		"port": port,
+	}).Info("opengcs::VsockTransport::Listen - vsock listen port")
+
+	l, err := vsock.Listen(vmaddrCidAny, port)
+	if err != nil {
+		return nil, errors.Wrapf(err, "vsock Listen port (%d) failed", port)
+	}
+	return l, nil
+}